@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// netRange is the first and last address of a network, as 16 byte
+// addresses (IPv4 addresses mapped to IPv6).
+type netRange struct {
+	first, last [net.IPv6len]byte
+}
+
+// netRanges are sorted and don't overlap, so an address can be looked
+// up with a binary search.
+type netRanges []netRange
+
+// newNetRanges returns the address ranges of the networks, merging the
+// networks that overlap.
+func newNetRanges(networks []*net.IPNet) netRanges {
+	var ranges netRanges
+	for _, n := range networks {
+		ip := n.IP.To16()
+		if ip == nil {
+			continue
+		}
+		ones, bits := n.Mask.Size()
+		if bits == net.IPv4len*8 {
+			ones += (net.IPv6len - net.IPv4len) * 8
+		}
+		mask := net.CIDRMask(ones, net.IPv6len*8)
+		var r netRange
+		for i := range r.first {
+			r.first[i] = ip[i] & mask[i]
+			r.last[i] = r.first[i] | ^mask[i]
+		}
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first[:], ranges[j].first[:]) < 0
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if l := len(merged); l > 0 && bytes.Compare(r.first[:], merged[l-1].last[:]) <= 0 {
+			if bytes.Compare(r.last[:], merged[l-1].last[:]) > 0 {
+				merged[l-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// contains returns true if the IP is in one of the ranges.
+func (ranges netRanges) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	i := sort.Search(len(ranges), func(i int) bool {
+		return bytes.Compare(ranges[i].last[:], ip) >= 0
+	})
+	return i < len(ranges) && bytes.Compare(ranges[i].first[:], ip) <= 0
+}
+
+// zoneACL is the "acl" zone option, the networks that are allowed to
+// query the zone and the response for the other clients.
+type zoneACL struct {
+	allow netRanges // everyone if empty
+	deny  netRanges
+	rcode int
+	drop  bool
+}
+
+// parseACL parses the "acl" zone option:
+//
+//	{ "allow": [ "10.0.0.0/8", "fd00::/8" ], "deny": [ "10.1.0.0/16" ], "response": "nxdomain" }
+func parseACL(m map[string]interface{}) (*zoneACL, error) {
+	acl := &zoneACL{rcode: dns.RcodeRefused}
+	for k, v := range m {
+		switch k {
+		case "allow", "deny":
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("acl %s must be a list of networks", k)
+			}
+			var networks []*net.IPNet
+			for _, s := range list {
+				n, err := parsePeer(valueToString(s))
+				if err != nil {
+					return nil, fmt.Errorf("Bad acl %s: %s", k, err)
+				}
+				networks = append(networks, n)
+			}
+			if k == "allow" {
+				acl.allow = newNetRanges(networks)
+			} else {
+				acl.deny = newNetRanges(networks)
+			}
+		case "response":
+			switch valueToString(v) {
+			case "refused":
+				acl.rcode = dns.RcodeRefused
+			case "servfail":
+				acl.rcode = dns.RcodeServerFailure
+			case "nxdomain":
+				acl.rcode = dns.RcodeNameError
+			case "drop":
+				acl.drop = true
+			default:
+				return nil, fmt.Errorf("Bad acl response '%s'", v)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown acl option '%s'", k)
+		}
+	}
+	return acl, nil
+}
+
+// allowed returns true if the IP can query the zone; it's in the allowed
+// networks (if there are any) and not in the denied networks.
+func (acl *zoneACL) allowed(ip net.IP) bool {
+	if acl.deny.contains(ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || acl.allow.contains(ip)
+}
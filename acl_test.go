@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestACL(c *C) {
+	acl, err := parseACL(map[string]interface{}{
+		"allow": []interface{}{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.7", "fd00::/8"},
+		"deny":  []interface{}{"10.66.0.0/16", "10.66.1.0/24"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(acl.rcode, Equals, dns.RcodeRefused)
+	// the overlapping networks are merged
+	c.Check(acl.allow, HasLen, 3)
+	c.Check(acl.deny, HasLen, 1)
+
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":        true,
+		"10.255.255.255":  true,
+		"10.1.2.3":        true,
+		"10.66.0.1":       false,
+		"10.66.1.1":       false,
+		"10.67.0.1":       true,
+		"11.0.0.0":        false,
+		"9.255.255.255":   false,
+		"192.0.2.7":       true,
+		"192.0.2.8":       false,
+		"::ffff:10.0.0.1": true,
+		"fd12::1":         true,
+		"2001:db8::1":     false,
+	} {
+		c.Check(acl.allowed(net.ParseIP(ip)), Equals, allowed, Commentf("ip %s", ip))
+	}
+
+	// without an allow list everyone not denied is allowed
+	acl, err = parseACL(map[string]interface{}{
+		"deny":     []interface{}{"2001:db8::/32"},
+		"response": "drop",
+	})
+	c.Assert(err, IsNil)
+	c.Check(acl.drop, Equals, true)
+	c.Check(acl.allowed(net.ParseIP("192.0.2.1")), Equals, true)
+	c.Check(acl.allowed(net.ParseIP("2001:db8::1")), Equals, false)
+	c.Check(acl.allowed(net.ParseIP("2001:db9::1")), Equals, true)
+
+	for _, m := range []map[string]interface{}{
+		{"allow": []interface{}{"10.0.0.0/33"}},
+		{"deny": "10.0.0.0/8"},
+		{"response": "ignore"},
+		{"allows": []interface{}{"10.0.0.0/8"}},
+	} {
+		_, err = parseACL(m)
+		c.Check(err, NotNil, Commentf("acl %v", m))
+	}
+}
+
+func (s *ServeSuite) TestServingACL(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	writeZone := func(acl string) *Zone {
+		data := fmt.Sprintf(`{"acl": %s,
+			"data": {"": {"ns": ["ns1.example.net"]}, "www": {"a": [["192.0.2.1"]]}}}`, acl)
+		fileName := dir + "/acl.example.net.json"
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		delete(lastRead, "acl.example.net")
+		c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+		return zones["acl.example.net"]
+	}
+	defer func() {
+		os.Remove(dir + "/acl.example.net.json")
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	z := writeZone(`{"allow": ["127.0.0.0/8", "::1"]}`)
+	r := exchange(c, "www.acl.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Answer, HasLen, 1)
+	c.Check(z.Metrics.Denied.Count(), Equals, int64(0))
+
+	// deny takes precedence
+	z = writeZone(`{"allow": ["127.0.0.0/8"], "deny": ["127.0.0.1"]}`)
+	r = exchange(c, "www.acl.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeRefused)
+	c.Check(r.Answer, HasLen, 0)
+	c.Check(z.Metrics.Denied.Count(), Equals, int64(1))
+
+	z = writeZone(`{"allow": ["10.0.0.0/8"], "response": "nxdomain"}`)
+	r = exchange(c, "www.acl.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	c.Check(r.Ns, HasLen, 0)
+
+	z = writeZone(`{"deny": ["127.0.0.1"], "response": "drop"}`)
+	cli := &dns.Client{ReadTimeout: 200 * time.Millisecond}
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.acl.example.net.", dns.TypeA)
+	_, _, err = cli.Exchange(msg, "127.0.0.1"+PORT)
+	c.Check(err, NotNil)
+	c.Check(z.Metrics.Denied.Count(), Equals, int64(3))
+}
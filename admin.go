@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abh/geodns/health"
+	"github.com/miekg/dns"
+)
+
+// maxHealthBody is the largest SetHealth request read.
+const maxHealthBody = 1024 * 1024
+
+// maxHealthImport is the largest ImportHealth request read.
+const maxHealthImport = 16 * maxHealthBody
+
+// The admin API is an interface to the zones in memory, for inspecting
+// a running server. The calls are GET requests returning JSON:
+//
+//	/v1/ListZones
+//	/v1/GetZone?origin=example.com
+//	/v1/ListLabels?origin=example.com
+//	/v1/GetHealth?origin=example.com&label=www
+//
+// The maintenance mode of a zone is switched with a POST request:
+//
+//	/v1/SetMaintenance?origin=example.com&active=true
+//
+// The health of the IPs for the "external" health checks is set with a
+// POST request with a JSON object of IPs and booleans:
+//
+//	/v1/SetHealth?source=monitoring
+//
+// A zone file is read again, without checking the other zones, with a
+// POST request:
+//
+//	/v1/ReloadZone?origin=example.com
+//
+// The state of the health checks (of all the zones, or of one) is
+// exported with a GET request and imported on another server with a
+// POST request of the exported JSON; imported states that aren't
+// confirmed by a check within the window expire:
+//
+//	/v1/ExportHealth?origin=example.com
+//	/v1/ImportHealth?window=5m
+//
+// The read-only calls are also served as a gRPC service (see
+// admingrpc.go and admin.proto) on the same listener.
+type adminHandler struct {
+	zones Zones
+	// held when reading zones, as the zones are added and removed
+	// while the server is running
+	mu sync.Locker
+	// reloads the zone with the origin, nil if it's not supported
+	reload func(origin string) error
+}
+
+type adminZone struct {
+	Origin      string           `json:"origin"`
+	Serial      int              `json:"serial"`
+	Ttl         int              `json:"ttl"`
+	MaxHosts    int              `json:"max_hosts"`
+	Targeting   string           `json:"targeting"`
+	Labels      int              `json:"labels"`
+	DNSSEC      bool             `json:"dnssec"`
+	Maintenance *bool            `json:"maintenance,omitempty"`
+	Metrics     map[string]int64 `json:"metrics"`
+}
+
+type adminLabel struct {
+	Name     string                   `json:"name"`
+	Ttl      int                      `json:"ttl"`
+	MaxHosts int                      `json:"max_hosts"`
+	Order    string                   `json:"order"`
+	Closest  bool                     `json:"closest,omitempty"`
+	Alias    string                   `json:"alias,omitempty"`
+	Records  map[string][]adminRecord `json:"records"`
+	Backup   map[string][]adminRecord `json:"backup,omitempty"`
+}
+
+type adminRecord struct {
+	Data    string            `json:"data"`
+	Ttl     uint32            `json:"ttl"`
+	Weight  int               `json:"weight"`
+	Share   float64           `json:"share"`
+	Healthy bool              `json:"healthy"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+func newAdminHandler(zones Zones, mu sync.Locker, reload func(origin string) error) http.Handler {
+	h := &adminHandler{zones: zones, mu: mu, reload: reload}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/ListZones", h.listZones)
+	mux.HandleFunc("/v1/GetZone", h.getZone)
+	mux.HandleFunc("/v1/ListLabels", h.listLabels)
+	mux.HandleFunc("/v1/GetHealth", h.getHealth)
+	mux.HandleFunc("/v1/SetMaintenance", h.setMaintenance)
+	mux.HandleFunc("/v1/SetHealth", h.setHealth)
+	mux.HandleFunc("/v1/ReloadZone", h.reloadZone)
+	mux.HandleFunc("/v1/ExportHealth", h.exportHealth)
+	mux.HandleFunc("/v1/ImportHealth", h.importHealth)
+	mux.HandleFunc("/"+adminGRPCService+"/", h.serveGRPC)
+	return mux
+}
+
+func (h *adminHandler) listZones(w http.ResponseWriter, req *http.Request) {
+	adminJSON(w, h.origins())
+}
+
+// origins returns the names of the zones in order.
+func (h *adminHandler) origins() []string {
+	h.mu.Lock()
+	origins := make([]string, 0, len(h.zones))
+	for origin := range h.zones {
+		origins = append(origins, origin)
+	}
+	h.mu.Unlock()
+	sort.Strings(origins)
+	return origins
+}
+
+func (h *adminHandler) getZone(w http.ResponseWriter, req *http.Request) {
+	z := h.zone(w, req, "GET")
+	if z == nil {
+		return
+	}
+	adminJSON(w, adminZoneInfo(z))
+}
+
+// adminZoneInfo returns the settings and the query counters of the
+// zone.
+func adminZoneInfo(z *Zone) adminZone {
+	serial := z.soa().Serial
+	z.RLock()
+	defer z.RUnlock()
+
+	az := adminZone{
+		Origin:    z.Origin,
+		Serial:    int(serial),
+		Ttl:       z.Options.Ttl,
+		MaxHosts:  z.Options.MaxHosts,
+		Targeting: z.Options.Targeting.String(),
+		Labels:    len(z.Labels),
+		DNSSEC:    z.Signer != nil,
+		Metrics:   map[string]int64{},
+	}
+	if mt := z.Options.Maintenance; mt != nil {
+		active := mt.isActive()
+		az.Maintenance = &active
+	}
+	if z.Metrics.Registry != nil {
+		for name, m := range map[string]interface {
+			Count() int64
+		}{
+			"queries":              z.Metrics.Queries,
+			"queries-edns":         z.Metrics.EdnsQueries,
+			"queries-doh":          z.Metrics.DohQueries,
+			"queries-truncated":    z.Metrics.Truncated,
+			"queries-ratelimited":  z.Metrics.RateLimited,
+			"queries-denied":       z.Metrics.Denied,
+			"queries-qtype-denied": z.Metrics.QtypeDenied,
+			"queries-maintenance":  z.Metrics.Maintenance,
+			"queries-delayed":      z.Metrics.Delayed,
+			"queries-dns64":        z.Metrics.DNS64,
+			"queries-emergency":    z.Metrics.Emergency,
+		} {
+			az.Metrics[name] = m.Count()
+		}
+		for level, m := range z.Metrics.TargetLevels {
+			az.Metrics["queries-target-"+level] = m.Count()
+		}
+		for name, m := range z.Metrics.EdnsOptions {
+			az.Metrics["edns-option-"+name] = m.Count()
+		}
+	}
+	return az
+}
+
+func (h *adminHandler) listLabels(w http.ResponseWriter, req *http.Request) {
+	z := h.zone(w, req, "GET")
+	if z == nil {
+		return
+	}
+	adminJSON(w, adminLabels(z))
+}
+
+// adminLabels returns the labels of the zone with their records, sorted
+// by name.
+func adminLabels(z *Zone) []adminLabel {
+	z.RLock()
+	defer z.RUnlock()
+
+	now := time.Now()
+	list := make([]adminLabel, 0, len(z.Labels))
+	for _, label := range z.Labels {
+		al := adminLabel{
+			Name:     label.Label,
+			Ttl:      label.Ttl,
+			MaxHosts: label.MaxHosts,
+			Order:    label.Order.String(),
+			Closest:  label.Order == OrderNearest,
+			Alias:    label.Alias,
+			Records:  adminRecords(label, false, now),
+		}
+		if backup := adminRecords(label, true, now); len(backup) > 0 {
+			al.Backup = backup
+		}
+		list = append(list, al)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (h *adminHandler) getHealth(w http.ResponseWriter, req *http.Request) {
+	z := h.zone(w, req, "GET")
+	if z == nil {
+		return
+	}
+	label := req.URL.Query().Get("label")
+	if len(label) > 0 {
+		z.RLock()
+		_, ok := z.Labels[label]
+		z.RUnlock()
+		if !ok {
+			http.Error(w, "Label not found", http.StatusNotFound)
+			return
+		}
+	}
+	adminJSON(w, z.HealthStatus(label))
+}
+
+func (h *adminHandler) setMaintenance(w http.ResponseWriter, req *http.Request) {
+	z := h.zone(w, req, "POST")
+	if z == nil {
+		return
+	}
+	mt := z.Options.Maintenance
+	if mt == nil {
+		http.Error(w, "Zone doesn't have a maintenance option", http.StatusBadRequest)
+		return
+	}
+	active, err := strconv.ParseBool(req.URL.Query().Get("active"))
+	if err != nil {
+		http.Error(w, "Bad active parameter", http.StatusBadRequest)
+		return
+	}
+	mt.setActive(active)
+	log.Printf("[zone %s] maintenance mode set to %t", z.Origin, active)
+	adminJSON(w, map[string]bool{"maintenance": active})
+}
+
+func (h *adminHandler) setHealth(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var states map[string]bool
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxHealthBody)).Decode(&states); err != nil {
+		http.Error(w, "Bad health states: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	source := req.URL.Query().Get("source")
+	if err := health.SetExternal(source, states, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	adminJSON(w, map[string]int{"updated": len(states)})
+}
+
+func (h *adminHandler) exportHealth(w http.ResponseWriter, req *http.Request) {
+	if len(req.URL.Query().Get("origin")) > 0 {
+		z := h.zone(w, req, "GET")
+		if z == nil {
+			return
+		}
+		adminJSON(w, z.ExportHealth())
+		return
+	}
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	adminJSON(w, health.TestRunner.Export())
+}
+
+func (h *adminHandler) importHealth(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var window time.Duration
+	if s := req.URL.Query().Get("window"); len(s) > 0 {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil || window <= 0 {
+			http.Error(w, "Bad window parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	var states map[string]health.Status
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxHealthImport)).Decode(&states); err != nil {
+		http.Error(w, "Bad health states: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	health.TestRunner.Import(states, window, time.Now())
+	log.Printf("Imported %d health states with the admin API", len(states))
+	adminJSON(w, map[string]int{"imported": len(states)})
+}
+
+func (h *adminHandler) reloadZone(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if h.reload == nil {
+		http.Error(w, "Zone reloads aren't supported", http.StatusNotImplemented)
+		return
+	}
+	origin := strings.TrimSuffix(strings.ToLower(req.URL.Query().Get("origin")), ".")
+	if len(origin) == 0 {
+		http.Error(w, "Missing origin parameter", http.StatusBadRequest)
+		return
+	}
+	if err := h.reload(origin); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[zone %s] reloaded with the admin API", origin)
+	z, ok := h.lookup(origin)
+	if !ok {
+		// removed since it was reloaded
+		http.Error(w, "Zone not found", http.StatusNotFound)
+		return
+	}
+	adminJSON(w, map[string]int{"serial": int(z.soa().Serial)})
+}
+
+func (h *adminHandler) lookup(origin string) (*Zone, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	z, ok := h.zones[origin]
+	return z, ok
+}
+
+// zone returns the zone in the origin parameter, or sends an error
+// and returns nil if it isn't found or the request doesn't use the
+// method.
+func (h *adminHandler) zone(w http.ResponseWriter, req *http.Request, method string) *Zone {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil
+	}
+	origin := strings.TrimSuffix(strings.ToLower(req.URL.Query().Get("origin")), ".")
+	z, ok := h.lookup(origin)
+	if !ok {
+		http.Error(w, "Zone not found", http.StatusNotFound)
+		return nil
+	}
+	return z
+}
+
+// adminRecords lists the records (or the backup records) of the label
+// with their current share of the answers.
+func adminRecords(label *Label, backup bool, now time.Time) map[string][]adminRecord {
+	records := label.Records
+	if backup {
+		records = label.Backup
+	}
+	result := map[string][]adminRecord{}
+	for qtype, rs := range records {
+		if len(rs) == 0 {
+			continue
+		}
+		shares, backupShares := label.Shares(qtype, now)
+		if backup {
+			shares = backupShares
+		}
+		list := make([]adminRecord, len(rs))
+		for i, r := range rs {
+			list[i] = adminRecord{
+				Data:    strings.TrimSpace(rdataString(r.RR)),
+				Ttl:     r.RR.Header().Ttl,
+				Weight:  r.Weight,
+				Share:   math.Round(shares[i]*100) / 100,
+				Healthy: r.IsServeable(),
+				Meta:    r.Meta,
+			}
+		}
+		qt, ok := dns.TypeToString[qtype]
+		if !ok {
+			qt = fmt.Sprintf("TYPE%d", qtype)
+		}
+		result[qt] = list
+	}
+	return result
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// newAdminTLSConfig returns the TLS configuration for the admin API;
+// with a client CA only clients with a certificate signed by it can
+// connect.
+func newAdminTLSConfig(cfg *AppConfig) (*tls.Config, error) {
+	ac := cfg.Admin
+	if len(ac.CertFile) == 0 {
+		if len(ac.ClientCAFile) > 0 {
+			return nil, fmt.Errorf("clientcafile needs a certfile")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(ac.CertFile, ac.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(ac.ClientCAFile) > 0 {
+		pool, err := loadCertPool(ac.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// listenAndServeAdmin starts the admin API configured in the [admin]
+// section of the configuration file.
+func (srv *Server) listenAndServeAdmin(cfg *AppConfig, zones Zones, dirName string) error {
+	tlsConfig, err := newAdminTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr: cfg.Admin.Listen,
+		Handler: newAdminHandler(zones, srv.zonesMu.RLocker(), func(origin string) error {
+			return srv.reloadZone(dirName, zones, origin)
+		}),
+		TLSConfig: tlsConfig,
+	}
+	// the gRPC service needs HTTP/2, negotiated with TLS or used right
+	// away by the clients without it
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	srv.addHTTPListener(server)
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			log.Printf("Starting admin API (https) on %s", server.Addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting admin API on %s", server.Addr)
+			err = server.ListenAndServe()
+		}
+		if srv.isStopping() {
+			return
+		}
+		log.Fatalf("geodns: admin API server failed: %s", err)
+	}()
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/abh/geodns/health"
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func adminRequest(c *C, h http.Handler, url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	if w.Code == http.StatusOK {
+		c.Check(w.Header().Get("Content-Type"), Equals, "application/json")
+		c.Assert(json.Unmarshal(w.Body.Bytes(), v), IsNil)
+	}
+	return w.Code
+}
+
+func (s *ConfigSuite) TestAdminAPI(c *C) {
+	z, err := readZoneFile("test.example.com", "dns/test.example.com.json")
+	c.Assert(err, IsNil)
+	z.SetupMetrics(nil)
+	defer z.Close()
+	z.Metrics.Queries.Mark(3)
+
+	h := newAdminHandler(Zones{"test.example.com": z}, new(sync.Mutex), nil)
+
+	var origins []string
+	c.Assert(adminRequest(c, h, "/v1/ListZones", &origins), Equals, http.StatusOK)
+	c.Check(origins, DeepEquals, []string{"test.example.com"})
+
+	var az adminZone
+	c.Assert(adminRequest(c, h, "/v1/GetZone?origin=test.example.com.", &az), Equals, http.StatusOK)
+	c.Check(az.Origin, Equals, "test.example.com")
+	c.Check(az.Serial, Equals, z.Options.Serial)
+	c.Check(az.Labels, Equals, len(z.Labels))
+	c.Check(az.Metrics["queries"], Equals, int64(3))
+
+	var labels []adminLabel
+	c.Assert(adminRequest(c, h, "/v1/ListLabels?origin=test.example.com", &labels), Equals, http.StatusOK)
+	c.Assert(labels, HasLen, len(z.Labels))
+	var bar *adminLabel
+	for i := range labels {
+		if labels[i].Name == "bar" {
+			bar = &labels[i]
+		}
+	}
+	c.Assert(bar, NotNil)
+	c.Assert(bar.Records["A"], HasLen, 1)
+	c.Check(bar.Records["A"][0].Data, Equals, "192.168.1.2")
+	c.Check(bar.Records["A"][0].Healthy, Equals, true)
+	c.Check(bar.Records["A"][0].Share, Equals, 100.0)
+
+	var health map[string]interface{}
+	c.Check(adminRequest(c, h, "/v1/GetHealth?origin=test.example.com", &health), Equals, http.StatusOK)
+	c.Check(adminRequest(c, h, "/v1/GetHealth?origin=test.example.com&label=nope", &health), Equals, http.StatusNotFound)
+	c.Check(adminRequest(c, h, "/v1/GetZone?origin=example.net", &az), Equals, http.StatusNotFound)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/GetZone?origin=test.example.com", nil))
+	c.Check(w.Code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *ConfigSuite) TestAdminTLSConfig(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := new(AppConfig)
+	tlsConfig, err := newAdminTLSConfig(cfg)
+	c.Check(err, IsNil)
+	c.Check(tlsConfig, IsNil)
+
+	cfg.Admin.ClientCAFile = dir + "/ca.pem"
+	_, err = newAdminTLSConfig(cfg)
+	c.Check(err, ErrorMatches, "clientcafile needs a certfile")
+
+	cfg.Admin.CertFile, cfg.Admin.KeyFile = writeTestCert(c, dir)
+	cfg.Admin.ClientCAFile = cfg.Admin.CertFile
+	tlsConfig, err = newAdminTLSConfig(cfg)
+	c.Assert(err, IsNil)
+	c.Check(tlsConfig.ClientCAs, NotNil)
+}
+
+func (s *ServeSuite) TestAdminSetHealth(c *C) {
+	h := newAdminHandler(Zones{}, new(sync.Mutex), nil)
+	setHealth := func(method, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/v1/SetHealth?source=admin-test", strings.NewReader(body)))
+		return w.Code
+	}
+	c.Check(setHealth("GET", ""), Equals, http.StatusMethodNotAllowed)
+	c.Check(setHealth("POST", "nope"), Equals, http.StatusBadRequest)
+	c.Check(setHealth("POST", `{"www": true}`), Equals, http.StatusBadRequest)
+	c.Assert(setHealth("POST", `{"192.0.2.1": false}`), Equals, http.StatusOK)
+
+	t, err := health.NewFromMap(map[string]interface{}{"type": "external", "source": "admin-test"})
+	c.Assert(err, IsNil)
+	hc := t.Copy(net.ParseIP("192.0.2.1"))
+	hc.Check()
+	c.Check(hc.IsHealthy(), Equals, false)
+
+	c.Assert(setHealth("POST", `{"192.0.2.1": true}`), Equals, http.StatusOK)
+	hc.Check()
+	c.Check(hc.IsHealthy(), Equals, true)
+}
+
+func (s *ServeSuite) TestAdminExportImportHealth(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/healthstate.example.net.json"
+	data := []byte(`{"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["127.0.0.1", 0]], "health": {"type": "tcp", "port": 1, "frequency": "1h"}}}}`)
+	c.Assert(ioutil.WriteFile(fileName, data, 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	h := newAdminHandler(zones, new(sync.Mutex), nil)
+	ref := "healthstate.example.net/www/A/127.0.0.1"
+	var states map[string]health.Status
+	c.Assert(adminRequest(c, h, "/v1/ExportHealth?origin=healthstate.example.net", &states), Equals, http.StatusOK)
+	c.Assert(states, HasLen, 1)
+	c.Check(states[ref].Healthy, Equals, true)
+	var all map[string]health.Status
+	c.Assert(adminRequest(c, h, "/v1/ExportHealth", &all), Equals, http.StatusOK)
+	c.Check(all[ref].Healthy, Equals, true)
+
+	// the state is imported before the zone is loaded on a new server
+	os.Remove(fileName)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	c.Assert(health.TestRunner.Get(ref), IsNil)
+
+	importHealth := func(method, url, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w.Code
+	}
+	state := states[ref]
+	state.Healthy = false
+	state.Failures = 3
+	body, err := json.Marshal(map[string]health.Status{ref: state})
+	c.Assert(err, IsNil)
+	c.Check(importHealth("GET", "/v1/ImportHealth", string(body)), Equals, http.StatusMethodNotAllowed)
+	c.Check(importHealth("POST", "/v1/ImportHealth?window=soon", string(body)), Equals, http.StatusBadRequest)
+	c.Check(importHealth("POST", "/v1/ImportHealth", "nope"), Equals, http.StatusBadRequest)
+	c.Assert(importHealth("POST", "/v1/ImportHealth?window=1h", string(body)), Equals, http.StatusOK)
+
+	c.Assert(ioutil.WriteFile(fileName, data, 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	record := zones["healthstate.example.net"].Labels["www"].Records[dns.TypeA][0]
+	c.Assert(record.Test, NotNil)
+	c.Check(record.IsHealthy(), Equals, false)
+	c.Check(record.Test.Status().Failures, Equals, 3)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abh/geodns/health"
+)
+
+// The read-only calls of the admin API are served as the gRPC service
+// in admin.proto too, on the admin listener with HTTP/2. The service
+// is small enough that the protobuf messages are encoded here rather
+// than with generated code, so it doesn't need the gRPC and protobuf
+// libraries; compressed messages aren't supported.
+const adminGRPCService = "geodns.admin.v1.Admin"
+
+// maxGRPCRequest is the largest gRPC request message read.
+const maxGRPCRequest = 64 * 1024
+
+// The gRPC status codes used by the service.
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+)
+
+// grpcError is an error returned to the client with a status code.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// adminGRPCRequest has the fields of the request messages; they all
+// have the origin as the first field and the label as the second.
+type adminGRPCRequest struct {
+	origin string
+	label  string
+}
+
+func (h *adminHandler) serveGRPC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if req.ProtoMajor != 2 {
+		http.Error(w, "gRPC needs HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "application/grpc" && ct != "application/grpc+proto" {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	msg, err := readGRPCMessage(req.Body)
+	if err == nil {
+		var r adminGRPCRequest
+		if r, err = decodeAdminGRPCRequest(msg); err == nil {
+			method := strings.TrimPrefix(req.URL.Path, "/"+adminGRPCService+"/")
+			msg, err = h.callGRPC(method, r)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	code := grpcOK
+	if err == nil {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		w.Write(append(frame, msg...))
+	} else {
+		code = grpcInternal
+		if gerr, ok := err.(*grpcError); ok {
+			code = gerr.code
+		}
+		w.Header().Set("Grpc-Message", grpcEscape(err.Error()))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+}
+
+func (h *adminHandler) callGRPC(method string, r adminGRPCRequest) ([]byte, error) {
+	if method == "ListZones" {
+		var p protoBuffer
+		for _, origin := range h.origins() {
+			p.bytes(1, []byte(origin))
+		}
+		return p.b, nil
+	}
+
+	var call func(z *Zone, r adminGRPCRequest) ([]byte, error)
+	switch method {
+	case "GetZone":
+		call = grpcGetZone
+	case "ListLabels":
+		call = grpcListLabels
+	case "GetHealth":
+		call = grpcGetHealth
+	default:
+		return nil, &grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", method)}
+	}
+	z, ok := h.lookup(strings.TrimSuffix(strings.ToLower(r.origin), "."))
+	if !ok {
+		return nil, &grpcError{grpcNotFound, "zone not found"}
+	}
+	return call(z, r)
+}
+
+func grpcGetZone(z *Zone, r adminGRPCRequest) ([]byte, error) {
+	az := adminZoneInfo(z)
+	var p protoBuffer
+	p.string(1, az.Origin)
+	p.uint(2, uint64(az.Serial))
+	p.int(3, int64(az.Ttl))
+	p.int(4, int64(az.MaxHosts))
+	p.string(5, az.Targeting)
+	p.int(6, int64(az.Labels))
+	p.bool(7, az.DNSSEC)
+	if az.Maintenance != nil {
+		// set even when false, as the field is optional
+		p.key(8, protoVarint)
+		if *az.Maintenance {
+			p.varint(1)
+		} else {
+			p.varint(0)
+		}
+	}
+	names := make([]string, 0, len(az.Metrics))
+	for name := range az.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var entry protoBuffer
+		entry.string(1, name)
+		entry.int(2, az.Metrics[name])
+		p.bytes(9, entry.b)
+	}
+	return p.b, nil
+}
+
+func grpcListLabels(z *Zone, r adminGRPCRequest) ([]byte, error) {
+	var p protoBuffer
+	for _, al := range adminLabels(z) {
+		var label protoBuffer
+		label.string(1, al.Name)
+		label.int(2, int64(al.Ttl))
+		label.int(3, int64(al.MaxHosts))
+		label.string(4, al.Order)
+		label.bool(5, al.Closest)
+		label.string(6, al.Alias)
+		label.recordSets(7, al.Records)
+		label.recordSets(8, al.Backup)
+		p.bytes(1, label.b)
+	}
+	return p.b, nil
+}
+
+func grpcGetHealth(z *Zone, r adminGRPCRequest) ([]byte, error) {
+	if len(r.label) > 0 {
+		z.RLock()
+		_, ok := z.Labels[r.label]
+		z.RUnlock()
+		if !ok {
+			return nil, &grpcError{grpcNotFound, "label not found"}
+		}
+	}
+	type check struct {
+		label, qtype, ip string
+		status           health.Status
+	}
+	var checks []check
+	for name, types := range z.HealthStatus(r.label) {
+		for qt, ips := range types {
+			for ip, status := range ips {
+				checks = append(checks, check{name, qt, ip, status})
+			}
+		}
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		a, b := checks[i], checks[j]
+		if a.label != b.label {
+			return a.label < b.label
+		}
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		return a.ip < b.ip
+	})
+
+	var p protoBuffer
+	for _, c := range checks {
+		var m protoBuffer
+		m.string(1, c.label)
+		m.string(2, c.qtype)
+		m.string(3, c.ip)
+		m.bool(4, c.status.Healthy)
+		m.int(5, int64(c.status.Failures))
+		m.int(6, unixTime(c.status.LastCheck))
+		m.string(7, c.status.LastError)
+		m.int(8, unixTime(c.status.Since))
+		m.int(9, int64(c.status.Transitions))
+		m.stringMap(10, c.status.Meta)
+		p.bytes(1, m.b)
+	}
+	return p.b, nil
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// readGRPCMessage reads the (only) message of a request.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages aren't supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCRequest {
+		return nil, &grpcError{grpcInvalidArgument, "request message too large"}
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "short request message"}
+	}
+	return msg, nil
+}
+
+func decodeAdminGRPCRequest(msg []byte) (adminGRPCRequest, error) {
+	var r adminGRPCRequest
+	err := readProto(msg, func(field, wireType int, v uint64, b []byte) error {
+		if wireType != protoBytes {
+			return nil
+		}
+		switch field {
+		case 1:
+			r.origin = string(b)
+		case 2:
+			r.label = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return r, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return r, nil
+}
+
+// grpcEscape percent-encodes the status message for the grpc-message
+// trailer.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// The protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errBadProto = errors.New("bad protobuf message")
+
+// protoBuffer encodes a protobuf message. The fields with the default
+// value are left out, as in proto3.
+type protoBuffer struct {
+	b []byte
+}
+
+func (p *protoBuffer) key(field, wireType int) {
+	p.varint(uint64(field<<3 | wireType))
+}
+
+func (p *protoBuffer) varint(v uint64) {
+	p.b = binary.AppendUvarint(p.b, v)
+}
+
+func (p *protoBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.key(field, protoVarint)
+	p.varint(v)
+}
+
+// int encodes an int32 or int64 field.
+func (p *protoBuffer) int(field int, v int64) {
+	p.uint(field, uint64(v))
+}
+
+func (p *protoBuffer) bool(field int, v bool) {
+	if v {
+		p.uint(field, 1)
+	}
+}
+
+func (p *protoBuffer) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	p.key(field, protoFixed64)
+	p.b = binary.LittleEndian.AppendUint64(p.b, math.Float64bits(v))
+}
+
+func (p *protoBuffer) string(field int, s string) {
+	if len(s) > 0 {
+		p.bytes(field, []byte(s))
+	}
+}
+
+// bytes encodes a bytes, string or message field; it's set even if
+// empty, for the repeated fields.
+func (p *protoBuffer) bytes(field int, b []byte) {
+	p.key(field, protoBytes)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoBuffer) stringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry protoBuffer
+		entry.string(1, k)
+		entry.string(2, m[k])
+		p.bytes(field, entry.b)
+	}
+}
+
+// recordSets encodes the records of a label by type as RecordSet
+// messages.
+func (p *protoBuffer) recordSets(field int, sets map[string][]adminRecord) {
+	types := make([]string, 0, len(sets))
+	for qt := range sets {
+		types = append(types, qt)
+	}
+	sort.Strings(types)
+	for _, qt := range types {
+		var set protoBuffer
+		set.string(1, qt)
+		for _, r := range sets[qt] {
+			var record protoBuffer
+			record.string(1, r.Data)
+			record.uint(2, uint64(r.Ttl))
+			record.int(3, int64(r.Weight))
+			record.double(4, r.Share)
+			record.bool(5, r.Healthy)
+			record.stringMap(6, r.Meta)
+			set.bytes(2, record.b)
+		}
+		p.bytes(field, set.b)
+	}
+}
+
+// readProto calls fn with the fields of a protobuf message; v is the
+// value of the varint and fixed fields and b the data of the others.
+func readProto(msg []byte, fn func(field, wireType int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 || key>>3 == 0 {
+			return errBadProto
+		}
+		msg = msg[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var v uint64
+		var b []byte
+		switch wireType {
+		case protoVarint:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errBadProto
+			}
+			msg = msg[n:]
+		case protoFixed64:
+			if len(msg) < 8 {
+				return errBadProto
+			}
+			v = binary.LittleEndian.Uint64(msg)
+			msg = msg[8:]
+		case protoBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return errBadProto
+			}
+			b = msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+		case protoFixed32:
+			if len(msg) < 4 {
+				return errBadProto
+			}
+			v = uint64(binary.LittleEndian.Uint32(msg))
+			msg = msg[4:]
+		default:
+			return errBadProto
+		}
+		if err := fn(field, wireType, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
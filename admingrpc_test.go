@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// grpcCall calls a method of the admin gRPC service and returns the
+// response message and the status code and message.
+func grpcCall(c *C, ts *httptest.Server, method string, msg []byte) ([]byte, string, string) {
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	req, err := http.NewRequest("POST", ts.URL+"/"+adminGRPCService+"/"+method, bytes.NewReader(append(body, msg...)))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := ts.Client().Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.ProtoMajor, Equals, 2)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "application/grpc")
+
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	var reply []byte
+	if len(data) > 0 {
+		c.Assert(len(data) >= 5, Equals, true)
+		c.Check(int(binary.BigEndian.Uint32(data[1:])), Equals, len(data)-5)
+		reply = data[5:]
+	}
+	return reply, resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+// protoFields decodes a message to its varint and fixed fields and its
+// data fields (strings and messages) by field number.
+func protoFields(c *C, msg []byte) (map[int][]uint64, map[int][]string) {
+	values, data := map[int][]uint64{}, map[int][]string{}
+	c.Assert(readProto(msg, func(field, wireType int, v uint64, b []byte) error {
+		if wireType == protoBytes {
+			data[field] = append(data[field], string(b))
+		} else {
+			values[field] = append(values[field], v)
+		}
+		return nil
+	}), IsNil)
+	return values, data
+}
+
+func (s *ConfigSuite) TestAdminGRPC(c *C) {
+	z, err := readZoneFile("test.example.com", "dns/test.example.com.json")
+	c.Assert(err, IsNil)
+	z.SetupMetrics(nil)
+	defer z.Close()
+	z.Metrics.Queries.Mark(3)
+
+	ts := httptest.NewUnstartedServer(newAdminHandler(Zones{"test.example.com": z}, new(sync.Mutex), nil))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	var origin protoBuffer
+	origin.string(1, "test.example.com.")
+
+	msg, status, _ := grpcCall(c, ts, "ListZones", nil)
+	c.Check(status, Equals, "0")
+	_, data := protoFields(c, msg)
+	c.Check(data[1], DeepEquals, []string{"test.example.com"})
+
+	msg, status, _ = grpcCall(c, ts, "GetZone", origin.b)
+	c.Assert(status, Equals, "0")
+	values, data := protoFields(c, msg)
+	c.Check(data[1], DeepEquals, []string{"test.example.com"})
+	c.Check(values[2], DeepEquals, []uint64{uint64(z.Options.Serial)})
+	c.Check(values[6], DeepEquals, []uint64{uint64(len(z.Labels))})
+	metrics := map[string]uint64{}
+	for _, entry := range data[9] {
+		values, data := protoFields(c, []byte(entry))
+		// the counters at 0 only have a name
+		for _, v := range values[2] {
+			metrics[data[1][0]] = v
+		}
+	}
+	c.Check(metrics["queries"], Equals, uint64(3))
+
+	msg, status, _ = grpcCall(c, ts, "ListLabels", origin.b)
+	c.Assert(status, Equals, "0")
+	_, data = protoFields(c, msg)
+	c.Assert(data[1], HasLen, len(z.Labels))
+	var bar map[int][]string
+	for _, label := range data[1] {
+		_, fields := protoFields(c, []byte(label))
+		if len(fields[1]) > 0 && fields[1][0] == "bar" {
+			bar = fields
+		}
+	}
+	c.Assert(bar, NotNil)
+	c.Assert(bar[7], HasLen, 1)
+	_, set := protoFields(c, []byte(bar[7][0]))
+	c.Check(set[1], DeepEquals, []string{"A"})
+	c.Assert(set[2], HasLen, 1)
+	values, data = protoFields(c, []byte(set[2][0]))
+	c.Check(data[1], DeepEquals, []string{"192.168.1.2"})
+	c.Check(math.Float64frombits(values[4][0]), Equals, 100.0)
+	c.Check(values[5], DeepEquals, []uint64{1})
+
+	var nope protoBuffer
+	nope.string(1, "test.example.com")
+	nope.string(2, "nope")
+	_, status, _ = grpcCall(c, ts, "GetHealth", origin.b)
+	c.Check(status, Equals, "0")
+	_, status, message := grpcCall(c, ts, "GetHealth", nope.b)
+	c.Check(status, Equals, "5")
+	c.Check(message, Equals, "label not found")
+
+	var other protoBuffer
+	other.string(1, "example.net")
+	_, status, _ = grpcCall(c, ts, "GetZone", other.b)
+	c.Check(status, Equals, "5")
+	_, status, _ = grpcCall(c, ts, "SetMaintenance", origin.b)
+	c.Check(status, Equals, "12")
+	_, status, _ = grpcCall(c, ts, "GetZone", []byte{0x0a, 0x10})
+	c.Check(status, Equals, "3")
+
+	// the JSON API is still served on the same listener
+	resp, err := ts.Client().Get(ts.URL + "/v1/ListZones")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ConfigSuite) TestProtoBuffer(c *C) {
+	var p protoBuffer
+	p.string(1, "")
+	p.int(2, 0)
+	p.bool(3, false)
+	c.Check(p.b, HasLen, 0)
+
+	p.string(1, "a")
+	p.int(2, 300)
+	p.int(3, -1)
+	p.bool(4, true)
+	p.double(5, 0.5)
+	c.Check(p.b[:7], DeepEquals, []byte{0x0a, 1, 'a', 0x10, 0xac, 0x02, 0x18})
+
+	values, data := protoFields(c, p.b)
+	c.Check(data[1], DeepEquals, []string{"a"})
+	c.Check(values[2], DeepEquals, []uint64{300})
+	c.Check(int64(values[3][0]), Equals, int64(-1))
+	c.Check(values[4], DeepEquals, []uint64{1})
+	c.Check(math.Float64frombits(values[5][0]), Equals, 0.5)
+
+	noop := func(field, wireType int, v uint64, b []byte) error { return nil }
+	c.Check(readProto([]byte{0x0a, 5, 'a'}, noop), Equals, errBadProto)
+	c.Check(readProto([]byte{0x0b}, noop), Equals, errBadProto)
+	c.Check(readProto([]byte{0x00, 1}, noop), Equals, errBadProto)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// anonymizeConfig is the [privacy] anonymizeips option. When it's set
+// the client IPs are truncated before they're logged or counted in the
+// zone statistics: the last octet of IPv4 addresses and the last 80
+// bits of IPv6 addresses are zeroed. The targeting uses the full IP.
+type anonymizeConfig struct {
+	mu  sync.RWMutex
+	set bool
+}
+
+var anonymizeIPs = &anonymizeConfig{}
+
+const (
+	anonymizeBitsV4 = 24
+	anonymizeBitsV6 = 48
+)
+
+func (a *anonymizeConfig) setup(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.set = enabled
+}
+
+func (a *anonymizeConfig) enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.set
+}
+
+// ip returns the IP to log or count, truncated if anonymization is
+// enabled.
+func (a *anonymizeConfig) ip(ip net.IP) net.IP {
+	if !a.enabled() {
+		return ip
+	}
+	return anonymizeIP(ip)
+}
+
+// addr returns the address of a client for log messages, the truncated
+// IP (without the port) if anonymization is enabled.
+func (a *anonymizeConfig) addr(addr net.Addr) string {
+	if addr == nil || !a.enabled() {
+		return fmtAddr(addr)
+	}
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return anonymizeIP(addr.IP).String()
+	case *net.TCPAddr:
+		return anonymizeIP(addr.IP).String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if ip := net.ParseIP(host); err == nil && ip != nil {
+		return anonymizeIP(ip).String()
+	}
+	return ""
+}
+
+// scope returns the prefix length for a network of the client, at most
+// the truncated prefix if anonymization is enabled.
+func (a *anonymizeConfig) scope(ip net.IP, scope int) int {
+	if !a.enabled() {
+		return scope
+	}
+	bits := anonymizeBitsV6
+	if ip.To4() != nil {
+		bits = anonymizeBitsV4
+	}
+	if scope > bits {
+		return bits
+	}
+	return scope
+}
+
+// anonymizeIP returns the IP with the last octet of an IPv4 address or
+// the last 80 bits of an IPv6 address zeroed.
+func anonymizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(anonymizeBitsV4, net.IPv4len*8))
+	}
+	if len(ip) == net.IPv6len {
+		return ip.Mask(net.CIDRMask(anonymizeBitsV6, net.IPv6len*8))
+	}
+	return ip
+}
+
+func fmtAddr(addr net.Addr) string {
+	if addr == nil {
+		return "<nil>"
+	}
+	return addr.String()
+}
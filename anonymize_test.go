@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/abh/geodns/querylog"
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestAnonymizeIP(c *C) {
+	c.Check(anonymizeIP(net.ParseIP("192.0.2.123")).String(), Equals, "192.0.2.0")
+	c.Check(anonymizeIP(net.ParseIP("2001:db8:1234:5678::1")).String(), Equals, "2001:db8:1234::")
+
+	a := &anonymizeConfig{}
+	ip := net.ParseIP("192.0.2.123")
+	addr := &net.UDPAddr{IP: ip, Port: 5353}
+	c.Check(a.ip(ip).String(), Equals, "192.0.2.123")
+	c.Check(a.addr(addr), Equals, "192.0.2.123:5353")
+	c.Check(a.scope(ip, 32), Equals, 32)
+
+	a.setup(true)
+	c.Check(a.ip(ip).String(), Equals, "192.0.2.0")
+	c.Check(a.addr(addr), Equals, "192.0.2.0")
+	c.Check(a.scope(ip, 32), Equals, 24)
+	c.Check(a.scope(ip, 16), Equals, 16)
+	c.Check(a.scope(net.ParseIP("2001:db8::1"), 64), Equals, 48)
+}
+
+func (s *ServeSuite) TestServingAnonymizeIPs(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/anonymize.example.net.json"
+	data := `{"logging": {"queries": true},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	anonymizeIPs.setup(true)
+	defer anonymizeIPs.setup(false)
+
+	buf := new(syncBuffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	exchange(c, "www.anonymize.example.net.", dns.TypeA)
+	exchangeSubnet(c, "www.anonymize.example.net.", dns.TypeA, "198.51.100.77")
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = regexp.MustCompile(`query (\{.*\})`).FindAllString(buf.String(), -1)
+		if len(lines) >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(lines, HasLen, 2)
+
+	var e querylog.Entry
+	c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(lines[0], "query ")), &e), IsNil)
+	c.Check(e.RemoteAddr, Equals, "127.0.0.0")
+	c.Check(e.ClientAddr, Equals, "127.0.0.0/24")
+
+	e = querylog.Entry{}
+	c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "query ")), &e), IsNil)
+	c.Check(e.HasECS, Equals, true)
+	c.Check(e.ClientAddr, Equals, "198.51.100.0/24")
+	c.Check(buf.String(), Not(Matches), `(?s).*(127\.0\.0\.1|198\.51\.100\.77).*`)
+
+	counts := zones["anonymize.example.net"].Metrics.ClientStats.Counts()
+	c.Check(counts, DeepEquals, map[string]int{"127.0.0.0": 2})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// bindRecordTypes are the record types that can be in a BIND zone file;
+// the same types as in the JSON zone files.
+var bindRecordTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeMX:    true,
+	dns.TypeNS:    true,
+	dns.TypeTXT:   true,
+	dns.TypeSPF:   true,
+	dns.TypeSRV:   true,
+	dns.TypePTR:   true,
+	dns.TypeCAA:   true,
+	dns.TypeNAPTR: true,
+}
+
+// bindMaxIncludes is how deeply $INCLUDE files can be nested.
+const bindMaxIncludes = 7
+
+// isBindZoneFile returns true for zone files in the RFC 1035 master file
+// format (example.com.zone) rather than JSON.
+func isBindZoneFile(fileName string) bool {
+	return strings.HasSuffix(strings.ToLower(fileName), ".zone")
+}
+
+// readBindZoneFile reads a zone in the RFC 1035 master file format. All
+// the records are global (there's no targeting) and the SOA record sets
+// the serial, contact and timers of the zone.
+func readBindZoneFile(zoneName, fileName string) (*Zone, error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		log.Printf("Could not read '%s': %s", fileName, err)
+		return nil, err
+	}
+	defer fh.Close()
+	return readBindZone(zoneName, fileName, filepath.Dir(fileName), fh, sha256File(fileName))
+}
+
+// readBindZone reads a zone in the master file format from r, a file or
+// the data of a zone fetched from a URL (the fileName). $INCLUDE paths
+// are relative to includeDir; the zones fetched from a URL don't have
+// one, they can't include local files.
+func readBindZone(zoneName, fileName, includeDir string, r io.Reader, hash string) (*Zone, error) {
+	zone := NewZone(zoneName)
+	zone.Options.Targeting = TargetGlobal
+	zone.contentHash = hash
+
+	origin := strings.ToLower(dns.Fqdn(zoneName))
+
+	data, err := expandIncludes(r, fileName, includeDir, origin, 0)
+	if err != nil {
+		log.Printf("%s: %s", zoneName, err)
+		return nil, err
+	}
+
+	var errs []error
+	var soa *dns.SOA
+	for t := range dns.ParseZone(strings.NewReader(data), origin, fileName) {
+		if t.Error != nil {
+			errs = append(errs, t.Error)
+			continue
+		}
+		h := t.RR.Header()
+		name := strings.ToLower(h.Name)
+		if !dns.IsSubDomain(origin, name) {
+			errs = append(errs, fmt.Errorf("%s is outside of the zone", h.Name))
+			continue
+		}
+		labelName := strings.TrimSuffix(strings.TrimSuffix(name, origin), ".")
+
+		if h.Rrtype == dns.TypeSOA {
+			if len(labelName) > 0 || soa != nil {
+				errs = append(errs, fmt.Errorf("unexpected SOA record for %s", h.Name))
+				continue
+			}
+			soa = t.RR.(*dns.SOA)
+			continue
+		}
+		if !bindRecordTypes[h.Rrtype] {
+			errs = append(errs, fmt.Errorf("unsupported record type %s for %s",
+				dns.TypeToString[h.Rrtype], h.Name))
+			continue
+		}
+
+		label, ok := zone.Labels[labelName]
+		if !ok {
+			label = zone.AddLabel(labelName)
+		}
+		h.Name = name
+		label.Records[h.Rrtype] = append(label.Records[h.Rrtype], Record{RR: t.RR, Ttl: int(h.Ttl)})
+	}
+
+	if soa == nil {
+		errs = append(errs, fmt.Errorf("no SOA record"))
+	} else {
+		zone.Options.Serial = int(soa.Serial)
+		zone.Options.Contact = strings.TrimSuffix(soa.Mbox, ".")
+		zone.Options.PrimaryNs = strings.ToLower(soa.Ns)
+		zone.Options.Refresh = int(soa.Refresh)
+		zone.Options.Retry = int(soa.Retry)
+		zone.Options.Expire = int(soa.Expire)
+		zone.Options.Minimum = int(soa.Minttl)
+		if err := checkSOATimers(zone.Options); err != nil {
+			errs = append(errs, fmt.Errorf("bad SOA record: %s", err))
+		}
+	}
+
+	for _, label := range zone.Labels {
+		for qtype, records := range label.Records {
+			if selfOrdered(qtype) {
+				sort.Sort(RecordsByWeight{records})
+			}
+		}
+	}
+
+	errs = append(errs, setupLabels(zone)...)
+
+	// the names aren't targeted labels ("www.dk" is just a name)
+	zone.targetedNames = map[string]bool{}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s: %s", zoneName, err)
+		}
+		return nil, zoneErrors(errs)
+	}
+	return zone, nil
+}
+
+// expandIncludes returns the zone data with the $INCLUDE directives
+// replaced by the files they name, so the records are parsed in one go.
+// The included records get the origin of the directive (or the origin
+// where it is), and the origin is set back after them.
+func expandIncludes(r io.Reader, fileName, includeDir, origin string, depth int) (string, error) {
+	var data strings.Builder
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		directive := text
+		if i := strings.Index(directive, ";"); i >= 0 {
+			directive = directive[:i]
+		}
+		fields := strings.Fields(directive)
+		if len(fields) == 0 || !strings.HasPrefix(text, "$") {
+			data.WriteString(text + "\n")
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) > 1 {
+				origin = absoluteName(fields[1], origin)
+			}
+		case "$INCLUDE":
+			if len(includeDir) == 0 {
+				return "", fmt.Errorf("%s line %d: $INCLUDE isn't allowed in zones fetched from a URL", fileName, line)
+			}
+			if len(fields) < 2 {
+				return "", fmt.Errorf("%s line %d: $INCLUDE without a file", fileName, line)
+			}
+			if depth >= bindMaxIncludes {
+				return "", fmt.Errorf("%s line %d: too deeply nested $INCLUDE", fileName, line)
+			}
+			path := fields[1]
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(includeDir, path)
+			}
+			includeOrigin := origin
+			if len(fields) > 2 {
+				includeOrigin = absoluteName(fields[2], origin)
+			}
+			included, err := readInclude(path, includeDir, includeOrigin, depth+1)
+			if err != nil {
+				return "", fmt.Errorf("%s line %d: %s", fileName, line, err)
+			}
+			data.WriteString("$ORIGIN " + includeOrigin + "\n")
+			data.WriteString(included)
+			data.WriteString("$ORIGIN " + origin + "\n")
+			continue
+		}
+		data.WriteString(text + "\n")
+	}
+	return data.String(), scanner.Err()
+}
+
+func readInclude(path, includeDir, origin string, depth int) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	return expandIncludes(fh, path, includeDir, origin, depth)
+}
+
+// absoluteName returns the name relative to the origin as a fully
+// qualified name.
+func absoluteName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return name
+	case origin == ".":
+		return name + "."
+	}
+	return name + "." + origin
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ServeSuite) TestServingBindZone(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	include := dir + "/hosts.inc"
+	c.Assert(ioutil.WriteFile(include, []byte(`
+db1   IN A 192.0.2.21
+db2   IN A 192.0.2.22
+`), 0644), IsNil)
+	// relative to the directory of the zone file
+	c.Assert(os.Mkdir(dir+"/inc", 0755), IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/inc/other.inc", []byte(`
+$ORIGIN deeper.other.bind.example.net.
+app   IN A 192.0.2.31
+`), 0644), IsNil)
+
+	data := `$TTL 300
+@	IN SOA ns1.example.net. hostmaster.example.org. (
+		2024010101 ; serial
+		7200       ; refresh
+		1800       ; retry
+		1209600    ; expire
+		600 )      ; minimum
+	IN NS	ns1.example.net.
+	IN NS	ns2.example.net.
+	IN MX	10 mail
+www	60 IN A	192.0.2.1
+	IN AAAA	2001:db8::1
+www.dk	IN A	192.0.2.2
+mail	IN A	192.0.2.3
+_sip._udp IN SRV 20 0 5060 sip2
+_sip._udp IN SRV 10 0 5060 sip1
+txt	IN TXT	"hello world"
+$ORIGIN sub.bind.example.net.
+host	IN A	192.0.2.10
+$INCLUDE ` + include + `
+$INCLUDE inc/other.inc other.bind.example.net. ; with an origin
+after	IN A	192.0.2.40
+`
+	fileName := dir + "/bind.example.net.zone"
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+
+	zones := make(Zones)
+	srv := Server{}
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+	c.Assert(zones["bind.example.net"], NotNil)
+
+	r := exchange(c, "www.bind.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(60))
+
+	r = exchange(c, "www.bind.example.net.", dns.TypeAAAA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(300))
+
+	// names that look like targeted labels are just names
+	r = exchangeSubnet(c, "www.dk.bind.example.net.", dns.TypeA, "192.0.2.1")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.2")
+
+	r = exchange(c, "bind.example.net.", dns.TypeMX)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.MX).Mx, Equals, "mail.bind.example.net.")
+	c.Check(r.Extra, Not(HasLen), 0)
+
+	r = exchange(c, "bind.example.net.", dns.TypeNS)
+	c.Check(r.Answer, HasLen, 2)
+
+	r = exchange(c, "_sip._udp.bind.example.net.", dns.TypeSRV)
+	c.Assert(r.Answer, HasLen, 2)
+	c.Check(r.Answer[0].(*dns.SRV).Target, Equals, "sip1.bind.example.net.")
+
+	r = exchange(c, "txt.bind.example.net.", dns.TypeTXT)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.TXT).Txt, DeepEquals, []string{"hello world"})
+
+	// $ORIGIN and $INCLUDE
+	r = exchange(c, "host.sub.bind.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	r = exchange(c, "db2.sub.bind.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.22")
+	r = exchange(c, "app.deeper.other.bind.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.31")
+	// the origin is set back after the included file
+	r = exchange(c, "after.sub.bind.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.40")
+
+	// the SOA record sets the zone options
+	r = exchange(c, "bind.example.net.", dns.TypeSOA)
+	c.Assert(r.Answer, HasLen, 1)
+	soa := r.Answer[0].(*dns.SOA)
+	c.Check(soa.Serial, Equals, uint32(2024010101))
+	c.Check(soa.Mbox, Equals, "hostmaster.example.org.")
+	c.Check(soa.Ns, Equals, "ns1.example.net.")
+	c.Check(soa.Refresh, Equals, uint32(7200))
+	c.Check(soa.Retry, Equals, uint32(1800))
+	c.Check(soa.Minttl, Equals, uint32(600))
+
+	r = exchange(c, "nope.bind.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+}
+
+func (s *ConfigSuite) TestBadBindZone(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/bad.example.net.zone"
+	soa := "@ 300 IN SOA ns1.example.net. hostmaster.example.net. 1 7200 1800 1209600 600\n"
+	for _, data := range []string{
+		"www 300 IN A 192.0.2.1\n",
+		soa + "www 300 IN A 192.0.2.300\n",
+		soa + "www.example.com. 300 IN A 192.0.2.1\n",
+		soa + "www 300 IN HINFO \"x\" \"y\"\n",
+		soa + "www 300 IN SOA ns1.example.net. hostmaster.example.net. 1 7200 1800 1209600 600\n",
+		"@ 300 IN SOA ns1.example.net. hostmaster.example.net. 1 7200 1800 3600 600\n",
+		soa + "$INCLUDE " + dir + "/missing.inc\n",
+	} {
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		_, err = readBindZoneFile("bad.example.net", fileName)
+		c.Check(err, NotNil, Commentf("zone %s", data))
+	}
+
+	// zones fetched from a URL can't include local files
+	_, err = readBindZone("bad.example.net", "https://zones.example.net/bad.example.net.zone", "",
+		strings.NewReader(soa+"$INCLUDE /etc/hosts\n"), "")
+	c.Check(err, ErrorMatches, ".*isn't allowed in zones fetched from a URL")
+
+	c.Assert(ioutil.WriteFile(fileName, []byte(soa+"www 300 IN A 192.0.2.1\n"), 0644), IsNil)
+	z, err := readBindZoneFile("bad.example.net", fileName)
+	c.Assert(err, IsNil)
+	c.Check(z.Labels["www"].Records[dns.TypeA], HasLen, 1)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// answerCacheKey returns the key for caching the answer to a query.
+// The answers depend on where the client is, so besides the question
+// the key has the label the answer is from ("www.europe" and "www.us"
+// are cached separately) and the network the answer is valid for (the
+// ECS scope of the response); an answer cached for a client can only
+// be used for other clients with the same key.
+func answerCacheKey(qname string, qtype uint16, dnssecOK bool, label string, network string) string {
+	if len(label) == 0 {
+		label = "@"
+	}
+	key := strings.ToLower(qname) + "/" + dns.TypeToString[qtype] + "/" + label
+	if len(network) > 0 {
+		key += "/" + network
+	}
+	if dnssecOK {
+		key += "/do"
+	}
+	return key
+}
+
+// scopeNetwork returns the network of the IP for the scope (prefix
+// length), or "" if the scope is 0 and the answer is for all clients.
+func scopeNetwork(ip net.IP, scope int) string {
+	if scope <= 0 || ip == nil {
+		return ""
+	}
+	bits := net.IPv6len * 8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = net.IPv4len * 8
+	}
+	if scope > bits {
+		scope = bits
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(scope, bits)), scope)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/abh/geodns/querylog"
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestAnswerCacheKey(c *C) {
+	c.Check(answerCacheKey("WWW.Example.com.", dns.TypeA, false, "www.europe", "192.0.2.0/24"),
+		Equals, "www.example.com./A/www.europe/192.0.2.0/24")
+	c.Check(answerCacheKey("example.com.", dns.TypeMX, true, "", ""), Equals, "example.com./MX/@/do")
+
+	c.Check(scopeNetwork(net.ParseIP("192.0.2.77"), 24), Equals, "192.0.2.0/24")
+	c.Check(scopeNetwork(net.ParseIP("2001:db8:1:2::1"), 48), Equals, "2001:db8:1::/48")
+	c.Check(scopeNetwork(net.ParseIP("192.0.2.77"), 0), Equals, "")
+}
+
+func (s *ServeSuite) TestServingCacheKey(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/cachekey.example.net.json"
+	data := `{"logging": {"queries": true},
+		"target_overrides": {"192.0.2.0/24": "us", "198.51.100.0/24": "europe"},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 0]]},
+		"www.us": {"a": [["192.0.2.2", 0]]},
+		"www.europe": {"a": [["192.0.2.3", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	buf := new(syncBuffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, ip := range []string{"192.0.2.10", "192.0.2.20", "198.51.100.10"} {
+		exchangeSubnet(c, "www.cachekey.example.net.", dns.TypeA, ip)
+	}
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = regexp.MustCompile(`query (\{.*\})`).FindAllString(buf.String(), -1)
+		if len(lines) >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(lines, HasLen, 3)
+
+	var keys []string
+	for _, line := range lines {
+		var e querylog.Entry
+		c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(line, "query ")), &e), IsNil)
+		keys = append(keys, e.CacheKey)
+	}
+	// the US clients share the cache entry, the EU client doesn't
+	c.Check(keys, DeepEquals, []string{
+		"www.cachekey.example.net./A/www.us/192.0.2.0/24",
+		"www.cachekey.example.net./A/www.us/192.0.2.0/24",
+		"www.cachekey.example.net./A/www.europe/198.51.100.0/24",
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Classifier puts client IPs (usually resolvers) in categories, for
+// example "mobile", "datacenter" or "residential", for the "category"
+// targeting. The categories are targets like the countries, so "www.mobile"
+// answers for the clients in the "mobile" category.
+type Classifier interface {
+	// Classify returns the category of the IP and the prefix length
+	// of the network it's for, or "" if the IP isn't classified.
+	Classify(ip net.IP) (string, int)
+	// IsCategory returns true if the name is one of the categories.
+	IsCategory(name string) bool
+}
+
+// cidrClassifier is a Classifier from a list of networks and their
+// categories; the longest prefix matching the IP is used.
+type cidrClassifier struct {
+	networks   targetOverrides
+	categories map[string]bool
+}
+
+func (cc *cidrClassifier) Classify(ip net.IP) (string, int) {
+	if n, ok := cc.networks.lookup(ip); ok {
+		ones, _ := n.network.Mask.Size()
+		return n.target, ones
+	}
+	return "", 0
+}
+
+func (cc *cidrClassifier) IsCategory(name string) bool {
+	return cc.categories[name]
+}
+
+// readCIDRClassifier reads a classifier from lines with a network and
+// its category, with # comments:
+//
+//	198.51.0.0/16     mobile
+//	2001:db8:100::/40 datacenter
+func readCIDRClassifier(r io.Reader) (*cidrClassifier, error) {
+	cc := &cidrClassifier{categories: map[string]bool{}}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a network and a category", line)
+		}
+		_, n, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		category := strings.ToLower(fields[1])
+		if !cc.categories[category] {
+			if err := checkCategoryName(category); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			cc.categories[category] = true
+		}
+		cc.networks = append(cc.networks, targetOverride{network: n, target: category})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(cc.networks)
+	return cc, nil
+}
+
+// checkCategoryName returns an error if the category can't be a target:
+// it must be letters, digits and dashes and not another target.
+func checkCategoryName(category string) error {
+	if len(category) == 0 || strings.Trim(category, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return fmt.Errorf("bad category '%s'", category)
+	}
+	if isTargetName(category) {
+		return fmt.Errorf("category '%s' is a target already", category)
+	}
+	return nil
+}
+
+// categoriesConfig is the classifier from the [categories] section of
+// the configuration, or nil.
+type categoriesConfig struct {
+	mu         sync.RWMutex
+	classifier Classifier
+}
+
+var resolverCategories = &categoriesConfig{}
+
+// setup reads the classifier from the file, or removes it if the file
+// is "".
+func (cc *categoriesConfig) setup(fileName string) error {
+	var classifier Classifier
+	if len(fileName) > 0 {
+		fh, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		classifier, err = readCIDRClassifier(fh)
+		if err != nil {
+			return fmt.Errorf("%s: %s", fileName, err)
+		}
+	}
+	cc.set(classifier)
+	return nil
+}
+
+// set replaces the classifier.
+func (cc *categoriesConfig) set(classifier Classifier) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.classifier = classifier
+}
+
+func (cc *categoriesConfig) classify(ip net.IP) (string, int) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if cc.classifier == nil {
+		return "", 0
+	}
+	return cc.classifier.Classify(ip)
+}
+
+func (cc *categoriesConfig) isCategory(name string) bool {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.classifier != nil && cc.classifier.IsCategory(name)
+}
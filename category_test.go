@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestCategories(c *C) {
+	cc, err := readCIDRClassifier(strings.NewReader(`
+# resolver networks
+198.51.0.0/16      Mobile
+198.51.100.0/24    datacenter # a hosting provider
+2001:db8:100::/40  mobile
+`))
+	c.Assert(err, IsNil)
+	c.Check(cc.IsCategory("mobile"), Equals, true)
+	c.Check(cc.IsCategory("datacenter"), Equals, true)
+	c.Check(cc.IsCategory("residential"), Equals, false)
+
+	for ip, expected := range map[string]string{
+		"198.51.7.1":       "mobile",
+		"198.51.100.10":    "datacenter",
+		"2001:db8:100::53": "mobile",
+		"192.0.2.10":       "",
+	} {
+		category, _ := cc.Classify(net.ParseIP(ip))
+		c.Check(category, Equals, expected, Commentf("%s", ip))
+	}
+	_, netmask := cc.Classify(net.ParseIP("198.51.100.10"))
+	c.Check(netmask, Equals, 24)
+
+	for _, bad := range []string{
+		"198.51.0.0/16",
+		"198.51.0.0/16 mobile extra",
+		"198.51.0.0 mobile",
+		"198.51.0.0/16 dk",
+		"198.51.0.0/16 @",
+		"198.51.0.0/16 mobile.net",
+	} {
+		_, err := readCIDRClassifier(strings.NewReader(bad))
+		c.Check(err, NotNil, Commentf("%s", bad))
+	}
+}
+
+func (s *ServeSuite) TestServingCategories(c *C) {
+	// the tests query from 127.0.0.1
+	cc, err := readCIDRClassifier(strings.NewReader("127.0.0.0/8 mobile\n"))
+	c.Assert(err, IsNil)
+	resolverCategories.set(cc)
+	defer resolverCategories.set(nil)
+
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/category.example.net.json"
+	data := `{"targeting": "category continent @", "target_overrides": {"192.0.2.0/24": "europe"},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 0]]},
+		"www.europe": {"a": [["192.0.2.2", 0]]},
+		"www.mobile": {"a": [["192.0.2.3", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	// the resolver's network gets the category's records, whatever
+	// the client subnet
+	r := exchangeSubnet(c, "www.category.example.net.", dns.TypeA, "198.51.7.1")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.3")
+
+	r = exchange(c, "www.category.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.3")
+
+	// a client subnet in a category's network doesn't get it
+	resolverCategories.set(nil)
+	cc, err = readCIDRClassifier(strings.NewReader("198.51.0.0/16 mobile\n"))
+	c.Assert(err, IsNil)
+	resolverCategories.set(cc)
+	r = exchangeSubnet(c, "www.category.example.net.", dns.TypeA, "198.51.7.1")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+
+	// other resolvers fall through to the geo targets
+	r = exchangeSubnet(c, "www.category.example.net.", dns.TypeA, "192.0.2.10")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.2")
+
+	r = exchangeSubnet(c, "www.category.example.net.", dns.TypeA, "203.0.113.10")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+}
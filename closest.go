@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// locationQtypes are the record types that get a location from the
+// GeoIP database for the "closest" label option.
+var locationQtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+
+func isLocationQtype(qtype uint16) bool {
+	for _, t := range locationQtypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Location is a latitude/longitude position.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+const earthRadius = 6371 // km
+
+// Distance returns the great circle distance in kilometers.
+func (l *Location) Distance(to *Location) float64 {
+	lat1 := l.Latitude * math.Pi / 180
+	lat2 := to.Latitude * math.Pi / 180
+	dlat := lat2 - lat1
+	dlon := (to.Longitude - l.Longitude) * math.Pi / 180
+
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// parseLocation parses the location option of a record:
+//
+//	{ "latitude": 37.77, "longitude": -122.42 }
+func parseLocation(v interface{}) (*Location, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("location must be a map with latitude and longitude")
+	}
+	lat, hasLat := m["latitude"]
+	lon, hasLon := m["longitude"]
+	if !hasLat || !hasLon || len(m) != 2 {
+		return nil, fmt.Errorf("location must be a map with latitude and longitude")
+	}
+	loc := &Location{Latitude: valueToFloat(lat), Longitude: valueToFloat(lon)}
+	if math.Abs(loc.Latitude) > 90 || math.Abs(loc.Longitude) > 180 {
+		return nil, fmt.Errorf("location %v, %v is out of range", lat, lon)
+	}
+	return loc, nil
+}
+
+// SetLocations looks up the location of the records in labels with
+// the closest option, except for the records with a location in the
+// zone file (for anycast addresses, or ones the GeoIP data has wrong).
+func (z *Zone) SetLocations() {
+	for _, label := range z.Labels {
+		if label.Order != OrderNearest {
+			continue
+		}
+		for _, qtype := range locationQtypes {
+			records := label.Records[qtype]
+			for i := range records {
+				if records[i].Loc == nil {
+					records[i].Loc = geoIP.GetLocation(recordIP(records[i].RR))
+				}
+			}
+		}
+	}
+}
+
+// Closest returns up to max records ordered by the distance to loc.
+// Records without a location sort last; ties are ordered by the
+// record data so the answer is stable.
+func (records Records) Closest(loc *Location, max int) Records {
+	return records.ClosestCost(nil, loc, max)
+}
+
+// ClosestCost returns up to max records ordered by the costs of their
+// regions (from a latency matrix) and then, for the records without a
+// cost, by the distance to loc like Closest.
+func (records Records) ClosestCost(costs map[string]float64, loc *Location, max int) Records {
+	sorted := make(recordsByDistance, len(records))
+	for i, r := range records {
+		if cost, ok := costs[r.Region]; ok && len(r.Region) > 0 {
+			sorted[i] = recordDistance{r, true, cost, rdataString(r.RR)}
+			continue
+		}
+		d := math.Inf(1)
+		if loc != nil && r.Loc != nil {
+			d = loc.Distance(r.Loc)
+		}
+		sorted[i] = recordDistance{r, false, d, rdataString(r.RR)}
+	}
+	sort.Sort(sorted)
+
+	if max > len(sorted) {
+		max = len(sorted)
+	}
+	result := make(Records, max)
+	for i := range result {
+		result[i] = sorted[i].Record
+	}
+	return result
+}
+
+// blendMinDistance (in km) is added to the distances for Blend, so
+// the records at the client location don't get all the queries.
+const blendMinDistance = 100
+
+// Blend returns up to max records picked randomly, weighted by their
+// distance to loc to the power of -decay, so the nearer records get
+// more of the queries. Records without a location get the weight of
+// the farthest record; if there are no locations (or loc is nil) the
+// records are picked uniformly.
+func (records Records) Blend(loc *Location, max int, decay float64) Records {
+	if max > len(records) {
+		max = len(records)
+	}
+
+	weights := make([]float64, len(records))
+	min := math.Inf(1)
+	for i, r := range records {
+		if loc == nil || r.Loc == nil {
+			continue
+		}
+		weights[i] = math.Pow(loc.Distance(r.Loc)+blendMinDistance, -decay)
+		min = math.Min(min, weights[i])
+	}
+	if math.IsInf(min, 1) {
+		min = 1
+	}
+	sum := 0.0
+	for i, r := range records {
+		if loc == nil || r.Loc == nil {
+			weights[i] = min
+		}
+		sum += weights[i]
+	}
+
+	servers := make(Records, len(records))
+	copy(servers, records)
+	result := make(Records, max)
+	for si := range result {
+		n := rand.Float64() * sum
+		i := 0
+		for ; i < len(servers)-1; i++ {
+			n -= weights[i]
+			if n < 0 {
+				break
+			}
+		}
+		result[si] = servers[i]
+		sum -= weights[i]
+
+		// remove the server from the list
+		servers = append(servers[:i], servers[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return result
+}
+
+type recordDistance struct {
+	Record
+	hasCost  bool // the distance is the cost from a latency matrix
+	distance float64
+	rdata    string
+}
+
+type recordsByDistance []recordDistance
+
+func (s recordsByDistance) Len() int      { return len(s) }
+func (s recordsByDistance) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s recordsByDistance) Less(i, j int) bool {
+	if s[i].hasCost != s[j].hasCost {
+		return s[i].hasCost
+	}
+	if s[i].distance != s[j].distance {
+		return s[i].distance < s[j].distance
+	}
+	return s[i].rdata < s[j].rdata
+}
+
+// rdataString returns the record data without the header.
+func rdataString(rr dns.RR) string {
+	return rr.String()[len(rr.Header().String()):]
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+type ClosestSuite struct{}
+
+var _ = Suite(&ClosestSuite{})
+
+func closestRecords(locs ...*Location) Records {
+	records := make(Records, len(locs))
+	for i, loc := range locs {
+		ip := net.IPv4(192, 168, 1, byte(i+1))
+		records[i] = Record{
+			RR: &dns.A{
+				Hdr: dns.RR_Header{Name: "closest.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   ip,
+			},
+			Loc: loc,
+		}
+	}
+	return records
+}
+
+func (s *ClosestSuite) TestDistance(c *C) {
+	oslo := &Location{59.91, 10.75}
+	copenhagen := &Location{55.68, 12.57}
+	c.Check(int(oslo.Distance(copenhagen)), Equals, 482)
+	c.Check(oslo.Distance(oslo), Equals, 0.0)
+}
+
+func (s *ClosestSuite) TestClosest(c *C) {
+	la := &Location{34.05, -118.24}
+	ny := &Location{40.71, -74.01}
+	london := &Location{51.51, -0.13}
+
+	ips := func(records Records) []string {
+		r := []string{}
+		for _, record := range records {
+			r = append(r, record.RR.(*dns.A).A.String())
+		}
+		return r
+	}
+
+	records := closestRecords(london, nil, la, ny)
+
+	c.Check(ips(records.Closest(&Location{37.77, -122.42}, 2)), DeepEquals,
+		[]string{"192.168.1.3", "192.168.1.4"})
+	c.Check(ips(records.Closest(&Location{48.86, 2.35}, 3)), DeepEquals,
+		[]string{"192.168.1.1", "192.168.1.4", "192.168.1.3"})
+
+	// records without a location are last
+	c.Check(ips(records.Closest(&Location{48.86, 2.35}, 10)), DeepEquals,
+		[]string{"192.168.1.1", "192.168.1.4", "192.168.1.3", "192.168.1.2"})
+
+	// ties are ordered by the record data, regardless of the order
+	records = closestRecords(nil, ny, ny, nil)
+	c.Check(ips(records.Closest(london, 4)), DeepEquals,
+		[]string{"192.168.1.2", "192.168.1.3", "192.168.1.1", "192.168.1.4"})
+	records[0], records[3] = records[3], records[0]
+	records[1], records[2] = records[2], records[1]
+	c.Check(ips(records.Closest(london, 4)), DeepEquals,
+		[]string{"192.168.1.2", "192.168.1.3", "192.168.1.1", "192.168.1.4"})
+}
+
+func (s *ClosestSuite) TestClosestAAAA(c *C) {
+	c.Check(isLocationQtype(dns.TypeA), Equals, true)
+	c.Check(isLocationQtype(dns.TypeAAAA), Equals, true)
+	c.Check(isLocationQtype(dns.TypeTXT), Equals, false)
+
+	ny := &Location{40.71, -74.01}
+	london := &Location{51.51, -0.13}
+
+	label := pickerLabel(0, 0)
+	label.Order = OrderNearest
+	label.Records[dns.TypeA][0].Loc = ny
+	label.Records[dns.TypeA][1].Loc = london
+	for i, loc := range []*Location{london, ny} {
+		rr := &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+			AAAA: net.ParseIP(fmt.Sprintf("2001:db8::%d", i+1)),
+		}
+		label.Records[dns.TypeAAAA] = append(label.Records[dns.TypeAAAA], Record{RR: rr, Loc: loc})
+	}
+
+	// each family is ordered by its own locations
+	r := label.Records[dns.TypeA].Closest(london, 1)
+	c.Check(r[0].RR.(*dns.A).A.String(), Equals, "192.168.1.2")
+	r = label.Records[dns.TypeAAAA].Closest(london, 1)
+	c.Check(r[0].RR.(*dns.AAAA).AAAA.String(), Equals, "2001:db8::1")
+	r = label.Records[dns.TypeAAAA].Closest(ny, 2)
+	c.Check(r[0].RR.(*dns.AAAA).AAAA.String(), Equals, "2001:db8::2")
+	c.Check(r[1].RR.(*dns.AAAA).AAAA.String(), Equals, "2001:db8::1")
+}
+
+func (s *ClosestSuite) TestBlend(c *C) {
+	paris := &Location{48.86, 2.35}
+	london := &Location{51.51, -0.13}
+	ny := &Location{40.71, -74.01}
+	la := &Location{34.05, -118.24}
+
+	count := func(records Records, loc *Location, decay float64) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			picked := records.Blend(loc, 1, decay)
+			c.Assert(picked, HasLen, 1)
+			counts[picked[0].RR.(*dns.A).A.String()]++
+		}
+		return counts
+	}
+
+	// the nearest records get the most queries, but not all of them
+	records := closestRecords(london, ny, la)
+	counts := count(records, paris, 1)
+	c.Check(counts["192.168.1.1"] > counts["192.168.1.2"], Equals, true, Commentf("%v", counts))
+	c.Check(counts["192.168.1.2"] > counts["192.168.1.3"], Equals, true, Commentf("%v", counts))
+	c.Check(counts["192.168.1.3"] > 0, Equals, true, Commentf("%v", counts))
+
+	// a higher decay skews it further towards the nearest
+	skewed := count(records, paris, 3)
+	c.Check(skewed["192.168.1.1"] > counts["192.168.1.1"], Equals, true, Commentf("%v %v", counts, skewed))
+
+	// without locations the records are picked uniformly
+	for _, counts := range []map[string]int{
+		count(closestRecords(nil, nil, nil), paris, 2),
+		count(records, nil, 2),
+	} {
+		c.Check(counts, HasLen, 3)
+		for ip, n := range counts {
+			c.Check(n > 2800 && n < 3900, Equals, true, Commentf("%s: %d", ip, n))
+		}
+	}
+
+	// all the records are returned (once) if max is large enough
+	picked := records.Blend(paris, 5, 2)
+	c.Assert(picked, HasLen, 3)
+	seen := map[string]bool{}
+	for _, r := range picked {
+		seen[r.RR.(*dns.A).A.String()] = true
+	}
+	c.Check(seen, HasLen, 3)
+}
+
+func (s *ConfigSuite) TestClosestOptions(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(options string) (*Zone, error) {
+		return readTestZone(c, dir, "closest.example.net",
+			`{ `+options+` "data": { "": { "ns": [ "ns1.example.net" ] } } }`)
+	}
+
+	z, err := readZone(``)
+	c.Assert(err, IsNil)
+	c.Check(z.Options.ClosestBlend, Equals, false)
+	c.Check(z.Options.ClosestDecay, Equals, 2.0)
+
+	z, err = readZone(`"closest": { "mode": "blend", "decay": 1.5 },`)
+	c.Assert(err, IsNil)
+	c.Check(z.Options.ClosestBlend, Equals, true)
+	c.Check(z.Options.ClosestDecay, Equals, 1.5)
+
+	_, err = readZone(`"closest": { "mode": "farthest" },`)
+	c.Check(err, ErrorMatches, "Bad closest mode.*")
+	_, err = readZone(`"closest": { "decay": 0 },`)
+	c.Check(err, ErrorMatches, "Bad closest decay.*")
+}
+
+func (s *ConfigSuite) TestRecordLocation(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// the GeoIP data has the anycast network in Sydney
+	overrides := dir + "/overrides.json"
+	c.Assert(ioutil.WriteFile(overrides, []byte(`{
+		"192.0.2.0/24": { "country": "au", "latitude": -33.87, "longitude": 151.21 }
+	}`), 0644), IsNil)
+	p, err := newGeoProvider("override:" + overrides)
+	c.Assert(err, IsNil)
+	saved := geoIP.providers
+	geoIP.providers = []geoProvider{p}
+	defer func() { geoIP.providers = saved }()
+
+	readZone := func(data string) (*Zone, error) {
+		return readTestZone(c, dir, "location.example.net",
+			`{ "data": { "": { "ns": [ "ns1.example.net" ] }, `+data+` } }`)
+	}
+
+	z, err := readZone(`"www": { "order": "nearest", "a": [
+		{ "ip": "192.0.2.1", "location": { "latitude": 50.11, "longitude": 8.68 } },
+		{ "ip": "192.0.2.2" } ] }`)
+	c.Assert(err, IsNil)
+	records := z.Labels["www"].Records[dns.TypeA]
+	c.Assert(records, HasLen, 2)
+	c.Check(records[0].Loc, DeepEquals, &Location{50.11, 8.68})
+	c.Check(records[1].Loc, DeepEquals, &Location{-33.87, 151.21})
+
+	// the explicit location wins for a client in Berlin
+	closest := records.Closest(&Location{52.52, 13.40}, 1)
+	c.Assert(closest, HasLen, 1)
+	c.Check(closest[0].RR.(*dns.A).A.String(), Equals, "192.0.2.1")
+
+	for _, data := range []string{
+		`"www": { "a": [ { "ip": "192.0.2.1", "location": { "latitude": 91, "longitude": 0 } } ] }`,
+		`"www": { "a": [ { "ip": "192.0.2.1", "location": { "latitude": 50.11 } } ] }`,
+		`"www": { "a": [ { "ip": "192.0.2.1", "location": "Frankfurt" } ] }`,
+		`"www": { "mx": [ { "mx": "mx.example.net", "location": { "latitude": 0, "longitude": 0 } } ] }`,
+	} {
+		_, err = readZone(data)
+		c.Check(err, NotNil, Commentf(data))
+	}
+}
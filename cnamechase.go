@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const cnameChaseDepth = 8 // default CNAMEs to follow
+
+// parseCNAMEChase parses the cname_chase zone option, true for the
+// default depth or the number of CNAMEs to follow.
+func parseCNAMEChase(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return cnameChaseDepth, nil
+		}
+		return 0, nil
+	case float64:
+		if v < 0 || v != float64(int(v)) {
+			return 0, fmt.Errorf("bad depth %v", v)
+		}
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("expected true, false or a number, got '%v'", v)
+}
+
+// chaseCNAME returns the records for the target of the CNAME in the
+// answer when the target is in the zone, picked with the targets of the
+// query: the CNAMEs of the chain (up to the cname_chase depth) and the
+// qtype records at the end of it. The chain stops at a name outside the
+// zone, a name without records and a name that was already in it.
+func (z *Zone) chaseCNAME(cname *dns.CNAME, qtype uint16, targets []string, sticky string) []dns.RR {
+	origin := z.Origin + "."
+	seen := map[string]bool{strings.ToLower(cname.Hdr.Name): true}
+
+	var rrs []dns.RR
+	target := cname.Target
+	for depth := 0; depth < z.Options.CNAMEChase; depth++ {
+		name := strings.ToLower(target)
+		if !dns.IsSubDomain(origin, name) || seen[name] {
+			break
+		}
+		seen[name] = true
+
+		label, labelQtype := z.findLabels(strings.TrimSuffix(strings.TrimSuffix(name, origin), "."),
+			targets, qTypes{dns.TypeCNAME, qtype})
+		if label == nil || labelQtype == 0 {
+			break
+		}
+		servers := label.Select(labelQtype, label.MaxHosts, sticky, name, nil)
+		for _, record := range servers {
+			rr := dns.Copy(record.RR)
+			rr.Header().Name = target
+			rrs = append(rrs, rr)
+		}
+		if labelQtype != dns.TypeCNAME || len(servers) == 0 {
+			break
+		}
+		target = servers[0].RR.(*dns.CNAME).Target
+	}
+	return rrs
+}
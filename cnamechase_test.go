@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestCNAMEChaseOption(c *C) {
+	for _, t := range []struct {
+		v     interface{}
+		depth int
+		ok    bool
+	}{
+		{true, cnameChaseDepth, true},
+		{false, 0, true},
+		{float64(3), 3, true},
+		{float64(-1), 0, false},
+		{float64(1.5), 0, false},
+		{"yes", 0, false},
+	} {
+		depth, err := parseCNAMEChase(t.v)
+		c.Check(err == nil, Equals, t.ok, Commentf("%v", t.v))
+		c.Check(depth, Equals, t.depth, Commentf("%v", t.v))
+	}
+}
+
+func (s *ServeSuite) TestServingCNAMEChase(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	records := `{"": {"ns": ["ns1.example.net"]},
+		"www": {"cname": "web"},
+		"web": {"cname": "edge"},
+		"edge": {"a": [["192.0.2.1", 0]]},
+		"edge.dk": {"a": [["192.0.2.2", 0]]},
+		"single": {"cname": "edge"},
+		"out": {"cname": "www.example.org."},
+		"loop1": {"cname": "loop2"},
+		"loop2": {"cname": "loop1"}}`
+	writeZone := func(name, options string) string {
+		fileName := dir + "/" + name + ".json"
+		data := `{` + options + ` "target_overrides": {"192.0.2.0/24": "dk"}, "data": ` + records + `}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		return fileName
+	}
+	chase := writeZone("chase.example.net", `"cname_chase": true,`)
+	short := writeZone("short.example.net", `"cname_chase": 1,`)
+	plain := writeZone("plain.example.net", "")
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(chase)
+		os.Remove(short)
+		os.Remove(plain)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	answer := func(r *dns.Msg) []string {
+		var rrs []string
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				rrs = append(rrs, rr.Hdr.Name+" CNAME "+rr.Target)
+			case *dns.A:
+				rrs = append(rrs, rr.Hdr.Name+" A "+rr.A.String())
+			}
+		}
+		return rrs
+	}
+
+	// one hop
+	r := exchange(c, "single.chase.example.net.", dns.TypeA)
+	c.Check(answer(r), DeepEquals, []string{
+		"single.chase.example.net. CNAME edge.chase.example.net.",
+		"edge.chase.example.net. A 192.0.2.1",
+	})
+
+	// two hops, with the records targeted for the client
+	r = exchangeSubnet(c, "www.chase.example.net.", dns.TypeA, "192.0.2.10")
+	c.Check(answer(r), DeepEquals, []string{
+		"www.chase.example.net. CNAME web.chase.example.net.",
+		"web.chase.example.net. CNAME edge.chase.example.net.",
+		"edge.chase.example.net. A 192.0.2.2",
+	})
+
+	// the chain without records of the type
+	r = exchange(c, "www.chase.example.net.", dns.TypeAAAA)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(answer(r), DeepEquals, []string{
+		"www.chase.example.net. CNAME web.chase.example.net.",
+		"web.chase.example.net. CNAME edge.chase.example.net.",
+	})
+
+	// the chain stops outside the zone and at loops
+	r = exchange(c, "out.chase.example.net.", dns.TypeA)
+	c.Check(answer(r), DeepEquals, []string{"out.chase.example.net. CNAME www.example.org."})
+	r = exchange(c, "loop1.chase.example.net.", dns.TypeA)
+	c.Check(answer(r), DeepEquals, []string{
+		"loop1.chase.example.net. CNAME loop2.chase.example.net.",
+		"loop2.chase.example.net. CNAME loop1.chase.example.net.",
+	})
+
+	// CNAME queries only get the CNAME
+	r = exchange(c, "www.chase.example.net.", dns.TypeCNAME)
+	c.Check(answer(r), DeepEquals, []string{"www.chase.example.net. CNAME web.chase.example.net."})
+
+	// up to the depth
+	r = exchange(c, "www.short.example.net.", dns.TypeA)
+	c.Check(answer(r), DeepEquals, []string{
+		"www.short.example.net. CNAME web.short.example.net.",
+		"web.short.example.net. CNAME edge.short.example.net.",
+	})
+
+	// not chased without the option
+	r = exchange(c, "www.plain.example.net.", dns.TypeA)
+	c.Check(answer(r), DeepEquals, []string{"www.plain.example.net. CNAME web.plain.example.net."})
+
+	c.Check(zones["chase.example.net"].Options.CNAMEChase, Equals, cnameChaseDepth)
+	c.Check(zones["short.example.net"].Options.CNAMEChase, Equals, 1)
+}
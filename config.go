@@ -17,24 +17,94 @@ type AppConfig struct {
 	}
 	Flags struct {
 		HasStatHat bool
+		Hostname   string
 	}
 	GeoIP struct {
 		Directory string
+		Database  []string
 	}
 	HTTP struct {
 		User     string
 		Password string
 	}
+	EDNS struct {
+		NSID string
+	}
+	Cookie struct {
+		Secret         string
+		PreviousSecret string
+		UnverifiedSize int
+	}
 	QueryLog struct {
 		Path    string
 		MaxSize int
 		Keep    int
 	}
+	DoT struct {
+		Port              string
+		CertFile          string
+		KeyFile           string
+		ClientCAFile      string
+		RequireClientCert bool
+		ReadTimeout       string
+		WriteTimeout      string
+		IdleTimeout       string
+		ShutdownTimeout   string
+	}
+	Flatten struct {
+		CacheSize int
+	}
+	DoH struct {
+		Listen       string
+		Path         string
+		CertFile     string
+		KeyFile      string
+		TrustedProxy []string
+	}
+	Admin struct {
+		Listen       string
+		CertFile     string
+		KeyFile      string
+		ClientCAFile string
+	}
+	Shutdown struct {
+		Timeout string
+	}
+	Workers struct {
+		Count int
+		Queue int
+	}
+	Debug struct {
+		Delay           bool
+		MaxDelay        string
+		Provenance      bool
+		ProvenanceAllow []string
+	}
+	Privacy struct {
+		AnonymizeIPs bool
+	}
+	Categories struct {
+		File string
+	}
+	// zones fetched from a URL instead of the zones directory, by
+	// zone name
+	ZoneSource map[string]*ZoneSourceConfig
+}
+
+type ZoneSourceConfig struct {
+	URL      string
+	Interval string
+	Header   []string
 }
 
 var Config = new(AppConfig)
 var cfgMutex sync.RWMutex
 
+func init() {
+	// the NSID is the hostname without a configuration file too
+	Config.Flags.Hostname, _ = os.Hostname()
+}
+
 func (conf *AppConfig) HasStatHat() bool {
 	cfgMutex.RLock()
 	defer cfgMutex.RUnlock()
@@ -53,6 +123,18 @@ func (conf *AppConfig) GeoIPDirectory() string {
 	return conf.GeoIP.Directory
 }
 
+// NSID returns the name server identifier for the EDNS NSID option;
+// the hostname (from when the configuration was read) if it's not
+// configured.
+func (conf *AppConfig) NSID() string {
+	cfgMutex.RLock()
+	defer cfgMutex.RUnlock()
+	if len(conf.EDNS.NSID) == 0 {
+		return conf.Flags.Hostname
+	}
+	return conf.EDNS.NSID
+}
+
 func configWatcher(fileName string) {
 
 	watcher, err := fsnotify.NewWatcher()
@@ -114,6 +196,37 @@ func configReader(fileName string) error {
 	}
 
 	cfg.Flags.HasStatHat = len(cfg.StatHat.ApiKey) > 0
+	cfg.Flags.Hostname, _ = os.Hostname()
+
+	if err := cookies.setup(cfg.Cookie.Secret, cfg.Cookie.PreviousSecret, cfg.Cookie.UnverifiedSize); err != nil {
+		log.Printf("Bad cookie configuration: %s\n", err)
+		return err
+	}
+
+	if err := debugDelays.setup(cfg.Debug.Delay, cfg.Debug.MaxDelay); err != nil {
+		log.Printf("Bad debug configuration: %s\n", err)
+		return err
+	}
+	if cfg.Debug.Delay {
+		log.Println("Debug delays of labels are enabled")
+	}
+	if err := debugProvenance.setup(cfg.Debug.Provenance, cfg.Debug.ProvenanceAllow); err != nil {
+		log.Printf("Bad debug configuration: %s\n", err)
+		return err
+	}
+	anonymizeIPs.setup(cfg.Privacy.AnonymizeIPs)
+	if err := resolverCategories.setup(cfg.Categories.File); err != nil {
+		log.Printf("Bad categories configuration: %s\n", err)
+		return err
+	}
+	if err := queryWorkers.setup(cfg.Workers.Count, cfg.Workers.Queue); err != nil {
+		log.Printf("Bad workers configuration: %s\n", err)
+		return err
+	}
+	if err := zoneSources.setup(cfg.ZoneSource); err != nil {
+		log.Printf("Bad zone source configuration: %s\n", err)
+		return err
+	}
 
 	// log.Println("STATHAT APIKEY:", cfg.StatHat.ApiKey)
 	// log.Println("STATHAT FLAG  :", cfg.Flags.HasStatHat)
@@ -122,5 +235,13 @@ func configReader(fileName string) error {
 	*Config = *cfg // shallow copy to prevent race conditions in referring to Config.foo()
 	cfgMutex.Unlock()
 
+	cacheSize := cfg.Flatten.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = flattenCacheSize
+	}
+	flattenLookups.setSize(cacheSize)
+
+	geoIP.setupProviders(cfg.GeoIP.Database)
+
 	return nil
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The DNS cookie option (RFC 7873) isn't in the dns package; the
+// option is unpacked as an EDNS0_LOCAL option.
+const (
+	edns0Cookie    = 10
+	rcodeBadCookie = 23
+)
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16
+
+	// server cookies are valid for an hour, allowing for some clock
+	// skew between the servers
+	cookieLifetime = time.Hour
+	cookieSkew     = 5 * time.Minute
+
+	// the largest UDP response for clients without a valid cookie
+	cookieDefaultUnverifiedSize = dns.MinMsgSize
+)
+
+type cookieState int
+
+const (
+	cookieNone       cookieState = iota // no cookie option
+	cookieUnverified                    // no or a bad server cookie
+	cookieValid
+)
+
+// cookieConfig has the secrets for the server cookies, from the
+// [cookie] section of the configuration. The previous secret is
+// accepted too, so the secret can be changed on all the servers without
+// the cookies the clients have becoming invalid.
+type cookieConfig struct {
+	mu             sync.RWMutex
+	secret         []byte
+	previous       []byte
+	unverifiedSize int
+}
+
+var cookies = new(cookieConfig)
+
+// setup sets the secrets (in hex); cookies are disabled if the secret
+// is empty.
+func (cc *cookieConfig) setup(secret, previous string, unverifiedSize int) error {
+	s, err := parseCookieSecret(secret)
+	if err != nil {
+		return fmt.Errorf("bad secret: %s", err)
+	}
+	p, err := parseCookieSecret(previous)
+	if err != nil {
+		return fmt.Errorf("bad previoussecret: %s", err)
+	}
+	if unverifiedSize <= 0 {
+		unverifiedSize = cookieDefaultUnverifiedSize
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.secret, cc.previous = s, p
+	cc.unverifiedSize = unverifiedSize
+	return nil
+}
+
+func parseCookieSecret(s string) ([]byte, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	secret, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("must be at least 16 bytes")
+	}
+	return secret, nil
+}
+
+func (cc *cookieConfig) enabled() bool {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.secret != nil
+}
+
+// maxUnverifiedSize returns the largest UDP response for clients
+// without a valid cookie.
+func (cc *cookieConfig) maxUnverifiedSize() int {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.unverifiedSize
+}
+
+// check returns the client cookie from the cookie option data and if
+// the server cookie is valid for the client IP. An error is returned if
+// the option is malformed.
+func (cc *cookieConfig) check(data []byte, ip net.IP, now time.Time) ([]byte, cookieState, error) {
+	if len(data) != clientCookieLen && (len(data) < clientCookieLen+8 || len(data) > clientCookieLen+32) {
+		return nil, cookieNone, fmt.Errorf("bad cookie length %d", len(data))
+	}
+	client := data[:clientCookieLen]
+	server := data[clientCookieLen:]
+	if len(server) != serverCookieLen || server[0] != 1 {
+		// only a client cookie, or a server cookie from another
+		// implementation
+		return client, cookieUnverified, nil
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if now.Sub(ts) > cookieLifetime || ts.Sub(now) > cookieSkew {
+		return client, cookieUnverified, nil
+	}
+
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	for _, secret := range [][]byte{cc.secret, cc.previous} {
+		if secret != nil && hmac.Equal(cookieHash(secret, client, server[:8], ip), server[8:]) {
+			return client, cookieValid, nil
+		}
+	}
+	return client, cookieUnverified, nil
+}
+
+// option returns the cookie option for a response; the client cookie
+// and a new server cookie.
+func (cc *cookieConfig) option(client []byte, ip net.IP, now time.Time) *dns.EDNS0_LOCAL {
+	// the server cookie is in the format of RFC 9018 (version,
+	// reserved, timestamp and hash), with an HMAC-SHA256 hash
+	header := make([]byte, 8)
+	header[0] = 1
+	binary.BigEndian.PutUint32(header[4:], uint32(now.Unix()))
+
+	cc.mu.RLock()
+	hash := cookieHash(cc.secret, client, header, ip)
+	cc.mu.RUnlock()
+
+	data := make([]byte, 0, clientCookieLen+serverCookieLen)
+	data = append(data, client...)
+	data = append(data, header...)
+	data = append(data, hash...)
+	return &dns.EDNS0_LOCAL{Code: edns0Cookie, Data: data}
+}
+
+func cookieHash(secret, client, header []byte, ip net.IP) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(client)
+	h.Write(header)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h.Write(ip)
+	return h.Sum(nil)[:serverCookieLen-8]
+}
+
+// badCookie turns the response into a BADCOOKIE error with just the
+// OPT record, so the client retries with the new server cookie.
+func badCookie(m *dns.Msg) {
+	opt := m.IsEdns0()
+	m.Answer, m.Ns = nil, nil
+	m.Extra = []dns.RR{opt}
+	m.Rcode = rcodeBadCookie
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testCookieSecret  = "000102030405060708090a0b0c0d0e0f"
+	testCookieSecret2 = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+)
+
+func responseCookie(c *C, r *dns.Msg) []byte {
+	opt := r.IsEdns0()
+	c.Assert(opt, NotNil)
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == edns0Cookie {
+			return l.Data
+		}
+	}
+	return nil
+}
+
+func (s *ConfigSuite) TestCookieCheck(c *C) {
+	cc := new(cookieConfig)
+	c.Check(cc.setup("", "", 0), IsNil)
+	c.Check(cc.enabled(), Equals, false)
+	c.Check(cc.setup("0102", "", 0), ErrorMatches, "bad secret.*")
+	c.Check(cc.setup(testCookieSecret, "zz", 0), ErrorMatches, "bad previoussecret.*")
+	c.Assert(cc.setup(testCookieSecret, "", 0), IsNil)
+	c.Check(cc.enabled(), Equals, true)
+	c.Check(cc.maxUnverifiedSize(), Equals, 512)
+
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	cookie, state, err := cc.check(client, ip, now)
+	c.Assert(err, IsNil)
+	c.Check(cookie, DeepEquals, client)
+	c.Check(state, Equals, cookieUnverified)
+
+	for _, data := range [][]byte{client[:5], make([]byte, 12), make([]byte, 41)} {
+		_, _, err = cc.check(data, ip, now)
+		c.Check(err, NotNil, Commentf("%d bytes", len(data)))
+	}
+
+	data := cc.option(client, ip, now).Data
+	c.Assert(data, HasLen, 24)
+	c.Check(data[:8], DeepEquals, client)
+
+	_, state, _ = cc.check(data, ip, now)
+	c.Check(state, Equals, cookieValid)
+
+	// the cookie is for the client IP and expires
+	_, state, _ = cc.check(data, net.ParseIP("192.0.2.2"), now)
+	c.Check(state, Equals, cookieUnverified)
+	_, state, _ = cc.check(data, ip, now.Add(2*time.Hour))
+	c.Check(state, Equals, cookieUnverified)
+
+	// cookies made with the previous secret are still valid
+	c.Assert(cc.setup(testCookieSecret2, testCookieSecret, 0), IsNil)
+	_, state, _ = cc.check(data, ip, now)
+	c.Check(state, Equals, cookieValid)
+	c.Assert(cc.setup(testCookieSecret2, "", 0), IsNil)
+	_, state, _ = cc.check(data, ip, now)
+	c.Check(state, Equals, cookieUnverified)
+}
+
+func (s *ServeSuite) TestServingCookies(c *C) {
+	c.Assert(cookies.setup(testCookieSecret, "", 0), IsNil)
+	defer cookies.setup("", "", 0)
+
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	request := func(name string, cookie []byte) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(4096, false)
+		if cookie != nil {
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edns0Cookie, Data: cookie})
+		}
+		return dorequest(c, msg)
+	}
+
+	// a client cookie gets a server cookie
+	r := request("bar.test.example.com.", client)
+	c.Assert(r.Answer, HasLen, 1)
+	cookie := responseCookie(c, r)
+	c.Assert(cookie, HasLen, 24)
+	c.Check(cookie[:8], DeepEquals, client)
+
+	// large responses need a valid cookie
+	r = request("big.test.example.com.", cookie)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Truncated, Equals, false)
+	c.Check(r.Answer, HasLen, 60)
+	c.Check(responseCookie(c, r), HasLen, 24)
+
+	r = request("big.test.example.com.", client)
+	c.Check(r.Rcode|int(r.IsEdns0().ExtendedRcode())<<4, Equals, rcodeBadCookie)
+	c.Check(r.Answer, HasLen, 0)
+	c.Check(responseCookie(c, r), HasLen, 24)
+
+	// without a cookie the client has to use TCP
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.test.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	r, _, err := new(dns.Client).Exchange(msg, "127.0.0.1"+PORT)
+	c.Check(err, Equals, dns.ErrTruncated)
+	c.Assert(r, NotNil)
+	c.Check(r.Truncated, Equals, true)
+
+	r = request("bar.test.example.com.", []byte{1, 2, 3})
+	c.Check(r.Rcode, Equals, dns.RcodeFormatError)
+}
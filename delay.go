@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultMaxDebugDelay caps the debug_delay of the labels unless the
+// [debug] section of the configuration sets maxdelay.
+const defaultMaxDebugDelay = 10 * time.Second
+
+// debugDelayConfig is the [debug] section of the configuration for the
+// debug_delay label option, an artificial delay before answering for
+// testing how resolvers handle slow servers. The option is ignored
+// unless delay is enabled, so a zone file can't slow down a production
+// server.
+type debugDelayConfig struct {
+	mu      sync.RWMutex
+	enabled bool
+	max     time.Duration
+}
+
+var debugDelays = &debugDelayConfig{max: defaultMaxDebugDelay}
+
+func (d *debugDelayConfig) setup(enabled bool, max string) error {
+	maxDelay := defaultMaxDebugDelay
+	if len(max) > 0 {
+		var err error
+		maxDelay, err = time.ParseDuration(max)
+		if err != nil || maxDelay <= 0 {
+			return fmt.Errorf("bad debug maxdelay '%s'", max)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enabled = enabled
+	d.max = maxDelay
+	return nil
+}
+
+// delay returns how long to delay an answer from a label with the
+// debug_delay, or 0 if delays aren't enabled.
+func (d *debugDelayConfig) delay(labelDelay time.Duration) time.Duration {
+	if labelDelay <= 0 {
+		return 0
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if !d.enabled {
+		return 0
+	}
+	if labelDelay > d.max {
+		return d.max
+	}
+	return labelDelay
+}
+
+// parseDebugDelay parses the debug_delay label option, a duration like
+// "500ms".
+func parseDebugDelay(v interface{}) (time.Duration, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("debug_delay must be a duration like \"500ms\"")
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad debug_delay '%s'", s)
+	}
+	return d, nil
+}
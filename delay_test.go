@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestDebugDelay(c *C) {
+	d := &debugDelayConfig{max: defaultMaxDebugDelay}
+	c.Check(d.delay(time.Second), Equals, time.Duration(0))
+
+	c.Assert(d.setup(true, ""), IsNil)
+	c.Check(d.delay(time.Second), Equals, time.Second)
+	c.Check(d.delay(time.Minute), Equals, defaultMaxDebugDelay)
+	c.Check(d.delay(0), Equals, time.Duration(0))
+
+	c.Assert(d.setup(true, "2s"), IsNil)
+	c.Check(d.delay(time.Minute), Equals, 2*time.Second)
+
+	c.Check(d.setup(true, "2"), NotNil)
+	c.Check(d.setup(true, "-1s"), NotNil)
+
+	delay, err := parseDebugDelay("250ms")
+	c.Assert(err, IsNil)
+	c.Check(delay, Equals, 250*time.Millisecond)
+	for _, v := range []interface{}{"soon", "-1s", 1.0} {
+		_, err = parseDebugDelay(v)
+		c.Check(err, NotNil, Commentf("delay %v", v))
+	}
+}
+
+func (s *ServeSuite) TestServingDebugDelay(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/delay.example.net.json"
+	data := `{"data": {"": {"ns": ["ns1.example.net"]},
+		"slow": {"a": [["192.0.2.1", 0]], "debug_delay": "300ms"}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+	defer debugDelays.setup(false, "")
+
+	// without the [debug] delay option the label isn't delayed
+	start := time.Now()
+	r := exchange(c, "slow.delay.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(time.Since(start) < 300*time.Millisecond, Equals, true)
+
+	c.Assert(debugDelays.setup(true, "200ms"), IsNil)
+	start = time.Now()
+	r = exchange(c, "slow.delay.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	elapsed := time.Since(start)
+	c.Check(elapsed >= 200*time.Millisecond, Equals, true, Commentf("answered in %s", elapsed))
+
+	c.Check(zones["delay.example.net"].Metrics.Delayed.Count(), Equals, int64(1))
+}
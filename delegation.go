@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// setupDelegations sets the names delegated to other name servers, the
+// base names of the labels with the delegate option. A delegation can
+// have different NS records for each target ("sub.europe",
+// "sub.north-america"), so the referral depends on the client.
+func (z *Zone) setupDelegations() error {
+	z.delegations = map[string]bool{}
+	for k, label := range z.Labels {
+		if !label.Delegate {
+			continue
+		}
+		base, _ := targetLabelBase(k)
+		if len(base) == 0 {
+			return fmt.Errorf("Bad delegate for %s: the zone apex can't be delegated", k)
+		}
+		if len(label.Records[dns.TypeNS]) == 0 {
+			return fmt.Errorf("Bad delegate for %s: no NS records", k)
+		}
+		z.delegations[base] = true
+	}
+	return nil
+}
+
+// delegationFor returns the delegated name the name is at or below, or
+// "" if it's not delegated. With delegations below a delegation the
+// closest one to the apex is used, as the name servers of the others
+// are the ones it's delegated to.
+func (z *Zone) delegationFor(s string) string {
+	if len(z.delegations) == 0 {
+		return ""
+	}
+	cut := ""
+	for name := s; len(name) > 0; {
+		if z.delegations[name] {
+			cut = name
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return cut
+}
+
+// referral sets the authority section of m to the NS records of the
+// delegated name for the targets, with the glue for the name servers
+// in the zone in the additional section. The response isn't
+// authoritative. It returns false if the delegation has no NS records
+// for the targets.
+func (z *Zone) referral(m *dns.Msg, cut string, targets []string, ecsFamily uint16, sticky string) (*Label, bool) {
+	label, qtype := z.findLabels(cut, targets, qTypes{dns.TypeNS})
+	if label == nil || qtype != dns.TypeNS {
+		return nil, false
+	}
+	families := label.addressFamilies(ecsFamily)
+	name := dns.Fqdn(cut + "." + z.Origin)
+	var glue []dns.RR
+	for _, record := range label.Select(dns.TypeNS, label.MaxHosts, sticky, name, nil) {
+		rr := dns.Copy(record.RR)
+		rr.Header().Name = name
+		m.Ns = append(m.Ns, rr)
+		glue = append(glue, z.additionalAddresses(rr.(*dns.NS).Ns, families, targets, sticky)...)
+	}
+	m.Extra = append(glue, m.Extra...)
+	m.Authoritative = false
+	return label, true
+}
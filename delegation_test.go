@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestDelegations(c *C) {
+	z := NewZone("example.com")
+	z.Labels["sub"] = &Label{Label: "sub", Delegate: true,
+		Records: map[uint16]Records{dns.TypeNS: {{RR: &dns.NS{Ns: "ns1.example.net."}}}}}
+	z.Labels["a.sub.europe"] = &Label{Label: "a.sub.europe", Delegate: true,
+		Records: map[uint16]Records{dns.TypeNS: {{RR: &dns.NS{Ns: "ns2.example.net."}}}}}
+	c.Assert(z.setupDelegations(), IsNil)
+	c.Check(z.delegations, DeepEquals, map[string]bool{"sub": true, "a.sub": true})
+	c.Check(z.delegationFor("sub"), Equals, "sub")
+	c.Check(z.delegationFor("www.a.sub"), Equals, "sub")
+	c.Check(z.delegationFor("www.notsub"), Equals, "")
+	c.Check(z.delegationFor(""), Equals, "")
+
+	z.Labels["www"] = &Label{Label: "www", Delegate: true}
+	c.Check(z.setupDelegations(), ErrorMatches, ".*no NS records")
+	delete(z.Labels, "www")
+	z.Labels["europe"] = &Label{Label: "europe", Delegate: true,
+		Records: map[uint16]Records{dns.TypeNS: {{RR: &dns.NS{Ns: "ns1.example.net."}}}}}
+	c.Check(z.setupDelegations(), ErrorMatches, ".*apex can't be delegated")
+}
+
+func (s *ServeSuite) TestServingDelegation(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/deleg.example.net.json"
+	data := `{"target_overrides": {"192.0.2.0/24": "europe", "198.51.100.0/24": "north-america"},
+		"data": {"": {"ns": ["ns1.deleg.example.net"]},
+		"ns1": {"a": [["192.0.2.1", 0]]},
+		"sub": {"ns": ["ns.example.com"], "delegate": true},
+		"sub.europe": {"ns": ["ns1.sub.deleg.example.net", "ns2.sub.deleg.example.net"]},
+		"sub.north-america": {"ns": ["ns-us.sub.deleg.example.net"]},
+		"ns1.sub": {"a": [["192.0.2.53", 0]]},
+		"ns1.sub.europe": {"a": [["192.0.2.54", 0]]},
+		"ns2.sub": {"aaaa": [["2001:db8::53", 0]]},
+		"ns-us.sub": {"a": [["198.51.100.53", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	referral := func(r *dns.Msg) (ns []string, glue map[string]string) {
+		c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+		c.Check(r.Authoritative, Equals, false)
+		c.Check(r.Answer, HasLen, 0)
+		glue = map[string]string{}
+		for _, rr := range r.Ns {
+			c.Check(rr.Header().Name, Equals, "sub.deleg.example.net.")
+			ns = append(ns, rr.(*dns.NS).Ns)
+		}
+		for _, rr := range r.Extra {
+			switch rr := rr.(type) {
+			case *dns.A:
+				glue[rr.Hdr.Name] = rr.A.String()
+			case *dns.AAAA:
+				glue[rr.Hdr.Name] = rr.AAAA.String()
+			}
+		}
+		return ns, glue
+	}
+
+	// the name servers and the glue are targeted for the client
+	ns, glue := referral(exchangeSubnet(c, "www.sub.deleg.example.net.", dns.TypeA, "192.0.2.10"))
+	c.Check(ns, HasLen, 2)
+	c.Check(glue, DeepEquals, map[string]string{
+		"ns1.sub.deleg.example.net.": "192.0.2.54",
+		"ns2.sub.deleg.example.net.": "2001:db8::53",
+	})
+
+	ns, glue = referral(exchangeSubnet(c, "www.sub.deleg.example.net.", dns.TypeA, "198.51.100.10"))
+	c.Check(ns, DeepEquals, []string{"ns-us.sub.deleg.example.net."})
+	c.Check(glue, DeepEquals, map[string]string{"ns-us.sub.deleg.example.net.": "198.51.100.53"})
+
+	// name servers outside the zone don't get glue
+	ns, glue = referral(exchange(c, "sub.deleg.example.net.", dns.TypeNS))
+	c.Check(ns, DeepEquals, []string{"ns.example.com."})
+	c.Check(glue, HasLen, 0)
+
+	// the names of the glue records are delegated too
+	ns, _ = referral(exchange(c, "ns1.sub.deleg.example.net.", dns.TypeA))
+	c.Check(ns, DeepEquals, []string{"ns.example.com."})
+
+	r := exchange(c, "ns1.deleg.example.net.", dns.TypeA)
+	c.Check(r.Authoritative, Equals, true)
+	c.Check(r.Answer, HasLen, 1)
+}
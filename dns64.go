@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// dns64WellKnownPrefix is the default prefix for the synthesized
+// addresses (RFC 6052).
+const dns64WellKnownPrefix = "64:ff9b::/96"
+
+// dns64 is the "dns64" zone option (RFC 6147); the AAAA queries for
+// names without AAAA records (or with only excluded ones) are answered
+// with AAAA records synthesized from the A records for the client.
+type dns64 struct {
+	prefix      *net.IPNet
+	clients     netRanges // everyone if empty
+	exclude     netRanges // AAAA records treated as missing
+	excludeIPv4 netRanges // A records not synthesized
+}
+
+// parseDNS64 parses the "dns64" zone option, true for the defaults or:
+//
+//	{ "prefix": "64:ff9b::/96", "clients": [ "2001:db8::/32" ],
+//	  "exclude": [ "::ffff:0:0/96" ], "exclude_ipv4": [ "10.0.0.0/8" ] }
+func parseDNS64(v interface{}) (*dns64, error) {
+	d := &dns64{}
+	_, d.prefix, _ = net.ParseCIDR(dns64WellKnownPrefix)
+	_, mapped, _ := net.ParseCIDR("::ffff:0:0/96")
+	d.exclude = newNetRanges([]*net.IPNet{mapped})
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		if b, ok := v.(bool); ok {
+			if !b {
+				return nil, nil
+			}
+			return d, nil
+		}
+		return nil, fmt.Errorf("dns64 must be true or a map of options")
+	}
+	for k, v := range m {
+		switch k {
+		case "prefix":
+			_, n, err := net.ParseCIDR(valueToString(v))
+			if err != nil || n.IP.To4() != nil {
+				return nil, fmt.Errorf("Bad dns64 prefix '%v'", v)
+			}
+			switch ones, _ := n.Mask.Size(); ones {
+			case 32, 40, 48, 56, 64, 96:
+			default:
+				return nil, fmt.Errorf("Bad dns64 prefix length %d (32, 40, 48, 56, 64 or 96)", ones)
+			}
+			if ones, _ := n.Mask.Size(); ones > 64 && n.IP[8] != 0 {
+				return nil, fmt.Errorf("Bad dns64 prefix '%v', bits 64 to 71 must be zero", v)
+			}
+			d.prefix = n
+		case "clients", "exclude", "exclude_ipv4":
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("dns64 %s must be a list of networks", k)
+			}
+			var networks []*net.IPNet
+			for _, s := range list {
+				n, err := parsePeer(valueToString(s))
+				if err != nil {
+					return nil, fmt.Errorf("Bad dns64 %s: %s", k, err)
+				}
+				networks = append(networks, n)
+			}
+			switch k {
+			case "clients":
+				d.clients = newNetRanges(networks)
+			case "exclude":
+				d.exclude = newNetRanges(networks)
+			default:
+				d.excludeIPv4 = newNetRanges(networks)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown dns64 option '%s'", k)
+		}
+	}
+	return d, nil
+}
+
+// applies returns true if AAAA records are synthesized for the client IP.
+func (d *dns64) applies(ip net.IP) bool {
+	return d != nil && (len(d.clients) == 0 || d.clients.contains(ip))
+}
+
+// excluded returns true if the label has no AAAA records outside the
+// excluded networks, so the AAAA records are synthesized instead.
+func (d *dns64) excluded(label *Label) bool {
+	for _, r := range label.Records[dns.TypeAAAA] {
+		if aaaa, ok := r.RR.(*dns.AAAA); ok && !d.exclude.contains(aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// address embeds the IPv4 address in the prefix as in RFC 6052, section
+// 2.2, skipping bits 64 to 71.
+func (d *dns64) address(ip net.IP) net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	addr := make(net.IP, net.IPv6len)
+	copy(addr, d.prefix.IP.To16())
+	ones, _ := d.prefix.Mask.Size()
+	i := ones / 8
+	for _, b := range ip4 {
+		if i == 8 {
+			i++
+		}
+		addr[i] = b
+		i++
+	}
+	return addr
+}
+
+// synthesize replaces the A records with AAAA records for the addresses
+// in the prefix, leaving out the excluded A records.
+func (d *dns64) synthesize(rrs []dns.RR) []dns.RR {
+	var synthesized []dns.RR
+	for _, rr := range rrs {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		if d.excludeIPv4.contains(a.A) {
+			continue
+		}
+		h := a.Hdr
+		h.Rrtype = dns.TypeAAAA
+		h.Rdlength = 0
+		synthesized = append(synthesized, &dns.AAAA{Hdr: h, AAAA: d.address(a.A)})
+	}
+	return synthesized
+}
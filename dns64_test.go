@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestDNS64Options(c *C) {
+	d, err := parseDNS64(true)
+	c.Assert(err, IsNil)
+	c.Check(d.prefix.String(), Equals, dns64WellKnownPrefix)
+	c.Check(d.address(net.ParseIP("192.0.2.33")).String(), Equals, "64:ff9b::c000:221")
+	c.Check(d.applies(net.ParseIP("2001:db8::1")), Equals, true)
+
+	d, err = parseDNS64(false)
+	c.Assert(err, IsNil)
+	c.Check(d.applies(net.ParseIP("2001:db8::1")), Equals, false)
+
+	// the examples in RFC 6052, section 2.4
+	for prefix, addr := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+		"64:ff9b:1:fffe::/96":   "64:ff9b:1:fffe::c000:221",
+	} {
+		d, err := parseDNS64(map[string]interface{}{"prefix": prefix})
+		c.Assert(err, IsNil, Commentf("prefix %s", prefix))
+		c.Check(d.address(net.ParseIP("192.0.2.33")).String(), Equals, addr, Commentf("prefix %s", prefix))
+	}
+
+	d, err = parseDNS64(map[string]interface{}{
+		"clients":      []interface{}{"2001:db8::/32"},
+		"exclude":      []interface{}{"2001:db8:bad::/48"},
+		"exclude_ipv4": []interface{}{"10.0.0.0/8"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(d.applies(net.ParseIP("2001:db8::1")), Equals, true)
+	c.Check(d.applies(net.ParseIP("2001:db9::1")), Equals, false)
+	c.Check(d.applies(net.ParseIP("192.0.2.1")), Equals, false)
+
+	rrs := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "www.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600}, A: net.ParseIP("10.1.1.1")},
+		&dns.A{Hdr: dns.RR_Header{Name: "www.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600}, A: net.ParseIP("192.0.2.1")},
+	}
+	synthesized := d.synthesize(rrs)
+	c.Assert(synthesized, HasLen, 1)
+	aaaa := synthesized[0].(*dns.AAAA)
+	c.Check(aaaa.AAAA.String(), Equals, "64:ff9b::c000:201")
+	c.Check(aaaa.Hdr.Ttl, Equals, uint32(600))
+	c.Check(aaaa.Hdr.Name, Equals, "www.")
+
+	for _, v := range []interface{}{
+		"yes",
+		map[string]interface{}{"prefix": "2001:db8::/60"},
+		map[string]interface{}{"prefix": "192.0.2.0/24"},
+		map[string]interface{}{"prefix": "2001:db8:0:0:100::/96"},
+		map[string]interface{}{"clients": "2001:db8::/32"},
+		map[string]interface{}{"exclude_ipv4": []interface{}{"10.0.0.0/33"}},
+		map[string]interface{}{"suffix": "::"},
+	} {
+		_, err := parseDNS64(v)
+		c.Check(err, NotNil, Commentf("dns64 %v", v))
+	}
+}
+
+// exchangeSubnet6 queries with an IPv6 client subnet.
+func exchangeSubnet6(c *C, name string, dnstype uint16, ip string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dnstype)
+	o := new(dns.OPT)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	e := new(dns.EDNS0_SUBNET)
+	e.Code = dns.EDNS0SUBNET
+	e.Address = net.ParseIP(ip)
+	e.Family = 2 // IP6
+	e.SourceNetmask = 56
+	o.Option = append(o.Option, e)
+	msg.Extra = append(msg.Extra, o)
+	return dorequest(c, msg)
+}
+
+func (s *ServeSuite) TestServingDNS64(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/dns64.example.net.json"
+	data := `{"target_overrides": {"2001:db8:1::/48": "europe"},
+		"dns64": {"clients": ["2001:db8::/32"], "exclude_ipv4": ["10.0.0.0/8"]},
+		"data": {"": {"ns": ["ns1.example.net"]},
+			"www": {"a": [["192.0.2.1", 0]], "ttl": 300},
+			"www.europe": {"a": [["198.51.100.1", 0]]},
+			"dual": {"a": [["192.0.2.2", 0]], "aaaa": [["2001:db8::2", 0]]},
+			"mapped": {"a": [["192.0.2.3", 0]], "aaaa": [["::ffff:192.0.2.3", 0]]},
+			"private": {"a": [["10.0.0.1", 0]]},
+			"alias": {"cname": "www.dns64.example.net"},
+			"text": {"txt": "no addresses"}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	aaaa := func(r *dns.Msg) []string {
+		var addrs []string
+		for _, rr := range r.Answer {
+			if rr, ok := rr.(*dns.AAAA); ok {
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+		return addrs
+	}
+
+	r := exchangeSubnet6(c, "www.dns64.example.net.", dns.TypeAAAA, "2001:db8:2::")
+	c.Check(aaaa(r), DeepEquals, []string{"64:ff9b::c000:201"})
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(300))
+	c.Check(r.Answer[0].Header().Name, Equals, "www.dns64.example.net.")
+
+	// synthesized from the A record for the client's target
+	r = exchangeSubnet6(c, "www.dns64.example.net.", dns.TypeAAAA, "2001:db8:1::")
+	c.Check(aaaa(r), DeepEquals, []string{"64:ff9b::c633:6401"})
+
+	// A queries aren't changed
+	r = exchangeSubnet6(c, "www.dns64.example.net.", dns.TypeA, "2001:db8:2::")
+	c.Check(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Rrtype, Equals, dns.TypeA)
+
+	// names with AAAA records get those
+	r = exchangeSubnet6(c, "dual.dns64.example.net.", dns.TypeAAAA, "2001:db8:2::")
+	c.Check(aaaa(r), DeepEquals, []string{"2001:db8::2"})
+
+	// the IPv4-mapped addresses are excluded by default
+	r = exchangeSubnet6(c, "mapped.dns64.example.net.", dns.TypeAAAA, "2001:db8:2::")
+	c.Check(aaaa(r), DeepEquals, []string{"64:ff9b::c000:203"})
+
+	// excluded A records aren't synthesized
+	r = exchangeSubnet6(c, "private.dns64.example.net.", dns.TypeAAAA, "2001:db8:2::")
+	c.Check(r.Answer, HasLen, 0)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Ns, HasLen, 1)
+
+	// the CNAME is answered and the target synthesized by the resolver
+	r = exchangeSubnet6(c, "alias.dns64.example.net.", dns.TypeAAAA, "2001:db8:2::")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Rrtype, Equals, dns.TypeCNAME)
+
+	r = exchangeSubnet6(c, "text.dns64.example.net.", dns.TypeAAAA, "2001:db8:2::")
+	c.Check(r.Answer, HasLen, 0)
+	r = exchangeSubnet6(c, "missing.dns64.example.net.", dns.TypeAAAA, "2001:db8:2::")
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+
+	// other clients don't get synthesized records
+	r = exchange(c, "www.dns64.example.net.", dns.TypeAAAA)
+	c.Check(r.Answer, HasLen, 0)
+
+	c.Check(zones["dns64.example.net"].Metrics.DNS64.Count(), Equals, int64(4))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// signatures are valid for a week and renewed after half that
+	signatureValidity  = 7 * 24 * time.Hour
+	signatureInception = time.Hour // clock skew
+
+	signatureCacheSize = 10000
+)
+
+// ZoneSigner signs responses for a zone with the KSK (the DNSKEY set)
+// and the ZSK (everything else).
+type ZoneSigner struct {
+	KSK *dns.DNSKEY
+	ZSK *dns.DNSKEY
+
+	kskSigner crypto.Signer
+	zskSigner crypto.Signer
+
+	mu    sync.Mutex
+	cache map[string]*dns.RRSIG
+}
+
+// NewZoneSigner loads the keys specified in the dnssec zone option; the
+// base name of the BIND style .key and .private files for "ksk" and
+// "zsk" (relative to dir) and optionally the "algorithm" they should
+// use.
+func NewZoneSigner(origin, dir string, config map[string]interface{}) (*ZoneSigner, error) {
+	s := &ZoneSigner{cache: map[string]*dns.RRSIG{}}
+
+	for _, k := range []string{"ksk", "zsk"} {
+		name, ok := config[k].(string)
+		if !ok {
+			return nil, fmt.Errorf("dnssec '%s' key file not specified", k)
+		}
+		if !path.IsAbs(name) {
+			name = path.Join(dir, name)
+		}
+		key, signer, err := readKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(key.Hdr.Name, origin+".") {
+			return nil, fmt.Errorf("dnssec key %s is for %s, not %s", name, key.Hdr.Name, origin)
+		}
+		if k == "ksk" {
+			s.KSK, s.kskSigner = key, signer
+		} else {
+			s.ZSK, s.zskSigner = key, signer
+		}
+	}
+
+	if alg, ok := config["algorithm"]; ok {
+		algorithm, ok := dns.StringToAlgorithm[strings.ToUpper(valueToString(alg))]
+		if !ok {
+			return nil, fmt.Errorf("Unknown dnssec algorithm '%s'", alg)
+		}
+		if s.KSK.Algorithm != algorithm || s.ZSK.Algorithm != algorithm {
+			return nil, fmt.Errorf("dnssec keys don't use the %s algorithm", alg)
+		}
+	}
+
+	return s, nil
+}
+
+func readKey(name string) (*dns.DNSKEY, crypto.Signer, error) {
+	fh, err := os.Open(name + ".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fh.Close()
+	rr, err := dns.ReadRR(fh, name+".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s.key is not a DNSKEY record", name)
+	}
+
+	fh, err = os.Open(name + ".private")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fh.Close()
+	priv, err := key.ReadPrivateKey(fh, name+".private")
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s.private can't be used for signing", name)
+	}
+	return key, signer, nil
+}
+
+// DNSKEYs returns the DNSKEY records with the ttl.
+func (s *ZoneSigner) DNSKEYs(ttl int) []dns.RR {
+	rrs := []dns.RR{dns.Copy(s.KSK), dns.Copy(s.ZSK)}
+	for _, rr := range rrs {
+		rr.Header().Ttl = uint32(ttl)
+	}
+	return rrs
+}
+
+// Sign returns the RRSIG records for each RRset in rrs.
+func (s *ZoneSigner) Sign(rrs []dns.RR) ([]dns.RR, error) {
+	var sigs []dns.RR
+	for _, rrset := range splitRRsets(rrs) {
+		sig, err := s.signRRset(rrset)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+func (s *ZoneSigner) signRRset(rrset []dns.RR) (*dns.RRSIG, error) {
+	key, signer := s.ZSK, s.zskSigner
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, signer = s.KSK, s.kskSigner
+	}
+
+	rrStrings := make([]string, len(rrset))
+	for i, rr := range rrset {
+		rrStrings[i] = strings.ToLower(rr.String())
+	}
+	sort.Strings(rrStrings)
+	cacheKey := strings.Join(rrStrings, "\n")
+
+	now := time.Now()
+
+	s.mu.Lock()
+	sig, ok := s.cache[cacheKey]
+	s.mu.Unlock()
+	if ok && now.Add(signatureValidity/2).Before(time.Unix(int64(sig.Expiration), 0)) {
+		return s.copySig(sig, rrset), nil
+	}
+
+	sig = &dns.RRSIG{
+		Algorithm:  key.Algorithm,
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+		Inception:  uint32(now.Add(-signatureInception).Unix()),
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+	}
+	if err := sig.Sign(signer, rrset); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if len(s.cache) >= signatureCacheSize {
+		s.cache = map[string]*dns.RRSIG{}
+	}
+	s.cache[cacheKey] = sig
+	s.mu.Unlock()
+
+	return s.copySig(sig, rrset), nil
+}
+
+// copySig returns a copy of the cached signature with the owner name
+// (and case) of the RRset that's being answered.
+func (s *ZoneSigner) copySig(sig *dns.RRSIG, rrset []dns.RR) *dns.RRSIG {
+	sig = dns.Copy(sig).(*dns.RRSIG)
+	sig.Hdr.Name = rrset[0].Header().Name
+	sig.Hdr.Ttl = rrset[0].Header().Ttl
+	return sig
+}
+
+// splitRRsets groups the records by name and type, in the order they
+// first appear.
+func splitRRsets(rrs []dns.RR) [][]dns.RR {
+	var rrsets [][]dns.RR
+	index := map[string]int{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return rrsets
+}
+
+// signMsg adds the signatures for the records in m if the zone is
+// signed.
+func (z *Zone) signMsg(m *dns.Msg) error {
+	if z.Signer == nil {
+		return nil
+	}
+	for _, section := range []*[]dns.RR{&m.Answer, &m.Ns, &m.Extra} {
+		sigs, err := z.Signer.Sign(*section)
+		if err != nil {
+			return err
+		}
+		*section = append(*section, sigs...)
+	}
+	return nil
+}
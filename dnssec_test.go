@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func writeTestKey(c *C, dir, origin string, flags uint16) string {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	c.Assert(err, IsNil)
+
+	name := fmt.Sprintf("%s/K%s+%03d+%05d", dir, origin, key.Algorithm, key.KeyTag())
+	c.Assert(ioutil.WriteFile(name+".key", []byte(key.String()+"\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(name+".private", []byte(key.PrivateKeyString(priv)), 0600), IsNil)
+	return name
+}
+
+func (s *ConfigSuite) TestDNSSEC(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	ksk := writeTestKey(c, dir, "signed.example.net.", 257)
+	zsk := writeTestKey(c, dir, "signed.example.net.", 256)
+
+	writeZone := func(dnssec string) (*Zone, error) {
+		fileName := dir + "/signed.example.net.json"
+		data := `{"dnssec": ` + dnssec + `, "data": {"": {"ns": ["ns1.example.net"]},
+			"www": {"a": [["192.0.2.1", 10], ["192.0.2.2", 10]], "txt": "www"}}}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		return readZoneFile("signed.example.net", fileName)
+	}
+
+	_, err = writeZone(`{"ksk": "` + ksk + `", "zsk": "` + zsk + `", "algorithm": "RSASHA256"}`)
+	c.Check(err, NotNil)
+	_, err = writeZone(`{"ksk": "` + ksk + `"}`)
+	c.Check(err, NotNil)
+
+	z, err := writeZone(`{"ksk": "` + ksk + `", "zsk": "` + zsk + `", "algorithm": "ECDSAP256SHA256"}`)
+	c.Assert(err, IsNil)
+	c.Assert(z.Signer, NotNil)
+
+	verify := func(rrs []dns.RR, key *dns.DNSKEY) {
+		var sig *dns.RRSIG
+		var rrset []dns.RR
+		for _, rr := range rrs {
+			if s, ok := rr.(*dns.RRSIG); ok {
+				sig = s
+				continue
+			}
+			rrset = append(rrset, rr)
+		}
+		c.Assert(sig, NotNil)
+		c.Check(sig.KeyTag, Equals, key.KeyTag())
+		c.Check(sig.Verify(key, rrset), IsNil)
+	}
+
+	m := new(dns.Msg)
+	for _, r := range z.Labels["www"].Records[dns.TypeA] {
+		rr := dns.Copy(r.RR)
+		rr.Header().Name = "WWW.signed.example.net."
+		m.Answer = append(m.Answer, rr)
+	}
+	m.Ns = []dns.RR{z.SoaRR()}
+	c.Assert(z.signMsg(m), IsNil)
+	c.Assert(m.Answer, HasLen, 3)
+	c.Check(m.Answer[2].Header().Name, Equals, "WWW.signed.example.net.")
+	verify(m.Answer, z.Signer.ZSK)
+	verify(m.Ns, z.Signer.ZSK)
+
+	// cached signatures are reused
+	m2 := &dns.Msg{Answer: []dns.RR{m.Answer[1], m.Answer[0]}}
+	c.Assert(z.signMsg(m2), IsNil)
+	c.Check(m2.Answer[2].(*dns.RRSIG).Signature, Equals, m.Answer[2].(*dns.RRSIG).Signature)
+
+	// the DNSKEY set is signed with the KSK
+	m = &dns.Msg{Answer: z.Signer.DNSKEYs(z.Options.Ttl)}
+	c.Assert(z.signMsg(m), IsNil)
+	verify(m.Answer, z.Signer.KSK)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	dohDefaultPath = "/dns-query"
+	dohMaxSize     = 65535
+)
+
+// dohHandler answers DNS over HTTPS (RFC 8484) requests with the same
+// handler as the UDP and TCP listeners.
+type dohHandler struct {
+	handler dns.Handler
+	// X-Forwarded-For is only used for requests from these networks
+	trustedProxies []*net.IPNet
+}
+
+func newDohHandler(handler dns.Handler, trustedProxies []string) (*dohHandler, error) {
+	h := &dohHandler{handler: handler}
+	for _, s := range trustedProxies {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy '%s': %s", s, err)
+		}
+		h.trustedProxies = append(h.trustedProxies, n)
+	}
+	return h, nil
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+
+	switch r.Method {
+	case "GET":
+		param := r.URL.Query().Get("dns")
+		if len(param) == 0 {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		buf, err = base64.RawURLEncoding.DecodeString(param)
+	case "POST":
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dohMaxSize+1))
+		if err == nil && len(buf) > dohMaxSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err != nil {
+		http.Error(w, "bad dns message", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{remote: &net.TCPAddr{IP: h.clientIP(r)}}
+	h.handler.ServeDNS(dw, req)
+	if dw.msg == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := dw.msg.Pack()
+	if err != nil {
+		log.Printf("Could not pack DNS over HTTPS response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(dw.msg)))
+	w.Write(out)
+}
+
+// clientIP returns the address of the HTTP client, or the last address
+// in X-Forwarded-For that isn't a trusted proxy if the request is from
+// a trusted proxy.
+func (h *dohHandler) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	if !h.trusted(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !h.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (h *dohHandler) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dohMaxAge returns the smallest TTL in the response, for the HTTP
+// cache lifetime.
+func dohMaxAge(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// dohWriter is the dns.ResponseWriter for a DNS over HTTPS request; it
+// keeps the response to be sent as the HTTP response.
+type dohWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(buf), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// listenAndServeDoh starts the DNS over HTTPS server configured in the
+// [doh] section of the configuration file. Without a certificate it
+// serves plain HTTP, for use behind a proxy terminating TLS.
+func (srv *Server) listenAndServeDoh(cfg *AppConfig) error {
+	dc := cfg.DoH
+	h, err := newDohHandler(queryWorkers.handler(dns.DefaultServeMux), dc.TrustedProxy)
+	if err != nil {
+		return err
+	}
+	path := dc.Path
+	if len(path) == 0 {
+		path = dohDefaultPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, h)
+	server := &http.Server{Addr: dc.Listen, Handler: mux}
+	srv.addHTTPListener(server)
+
+	go func() {
+		var err error
+		if len(dc.CertFile) > 0 {
+			log.Printf("Starting DNS over HTTPS on %s%s", dc.Listen, path)
+			err = server.ListenAndServeTLS(dc.CertFile, dc.KeyFile)
+		} else {
+			log.Printf("Starting DNS over HTTP on %s%s", dc.Listen, path)
+			err = server.ListenAndServe()
+		}
+		if srv.isStopping() {
+			return
+		}
+		log.Fatalf("geodns: DNS over HTTPS server failed: %s", err)
+	}()
+	return nil
+}
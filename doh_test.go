@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func dohRequest(c *C, h http.Handler, method string, msg *dns.Msg, forwarded string) (*httptest.ResponseRecorder, *dns.Msg) {
+	buf, err := msg.Pack()
+	c.Assert(err, IsNil)
+
+	var req *http.Request
+	if method == "GET" {
+		req = httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		req = httptest.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+		req.Header.Set("Content-Type", dohContentType)
+	}
+	req.RemoteAddr = "127.0.0.1:5000"
+	if len(forwarded) > 0 {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	c.Check(w.Header().Get("Content-Type"), Equals, dohContentType)
+	r := new(dns.Msg)
+	c.Assert(r.Unpack(w.Body.Bytes()), IsNil)
+	return w, r
+}
+
+func (s *ServeSuite) TestServingDoh(c *C) {
+	h, err := newDohHandler(dns.DefaultServeMux, []string{"127.0.0.1"})
+	c.Assert(err, IsNil)
+
+	// a separate zone for counting the queries
+	z, err := readZoneFile("test.example.com", "dns/test.example.com.json")
+	c.Assert(err, IsNil)
+	z.SetupMetrics(nil)
+	defer z.Close()
+	srv := Server{}
+	zh, err := newDohHandler(dns.HandlerFunc(srv.setupServerFunc(z)), nil)
+	c.Assert(err, IsNil)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+	msg.Id = 0
+
+	for _, method := range []string{"GET", "POST"} {
+		w, r := dohRequest(c, zh, method, msg, "")
+		c.Assert(r, NotNil, Commentf("%s: %d %s", method, w.Code, w.Body.String()))
+		c.Assert(r.Answer, HasLen, 1)
+		c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.168.1.2")
+		c.Check(w.Header().Get("Cache-Control"), Matches, "max-age=[0-9]+")
+	}
+	c.Check(z.Metrics.DohQueries.Count(), Equals, int64(2))
+	c.Check(z.Metrics.Queries.Count(), Equals, int64(2))
+	c.Check(z.Metrics.QueryTime.Count(), Equals, int64(2))
+	c.Check(z.Metrics.GeoIPTime.Count(), Equals, int64(2))
+
+	// the forwarded address is used from a trusted proxy
+	msg.SetQuestion("_country.foo.pgeodns.", dns.TypeTXT)
+	_, r := dohRequest(c, h, "GET", msg, "192.0.2.1, 127.0.0.2")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.TXT).Txt[1], Equals, "127.0.0.2")
+
+	h.trustedProxies = nil
+	_, r = dohRequest(c, h, "GET", msg, "192.0.2.1")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.TXT).Txt[1], Equals, "127.0.0.1")
+
+	// no zone transfers
+	msg.SetQuestion("test.example.com.", dns.TypeAXFR)
+	_, r = dohRequest(c, h, "POST", msg, "")
+	c.Check(r.Rcode, Equals, dns.RcodeRefused)
+}
+
+func (s *ServeSuite) TestDohErrors(c *C) {
+	h, err := newDohHandler(dns.DefaultServeMux, nil)
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		req  *http.Request
+		code int
+	}{
+		{httptest.NewRequest("GET", "/dns-query", nil), http.StatusBadRequest},
+		{httptest.NewRequest("GET", "/dns-query?dns=AAAA", nil), http.StatusBadRequest},
+		{httptest.NewRequest("POST", "/dns-query", nil), http.StatusUnsupportedMediaType},
+		{httptest.NewRequest("PUT", "/dns-query", nil), http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, t.req)
+		c.Check(w.Code, Equals, t.code, Commentf("%s %s", t.req.Method, t.req.URL))
+	}
+
+	_, err = newDohHandler(dns.DefaultServeMux, []string{"10.0.0.0/33"})
+	c.Check(err, NotNil)
+}
+
+func (s *ConfigSuite) TestDohClientIP(c *C) {
+	h, err := newDohHandler(nil, []string{"10.0.0.0/8", "2001:db8::1"})
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		remote, forwarded, ip string
+	}{
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.1.1.1:1234", "", "10.1.1.1"},
+		{"10.1.1.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.1.1.1:1234", "198.51.100.2, 198.51.100.1, 10.2.2.2", "198.51.100.1"},
+		{"[2001:db8::1]:1234", "2001:db8::2", "2001:db8::2"},
+		{"10.1.1.1:1234", "junk", "10.1.1.1"},
+	} {
+		req := httptest.NewRequest("GET", "/dns-query", nil)
+		req.RemoteAddr = t.remote
+		if len(t.forwarded) > 0 {
+			req.Header.Set("X-Forwarded-For", t.forwarded)
+		}
+		c.Check(h.clientIP(req).String(), Equals, t.ip, Commentf("%s %s", t.remote, t.forwarded))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dotDefaultShutdownTimeout = 5 * time.Second
+
+// dotOptions are the settings for the DNS over TLS listeners, from the
+// [dot] section of the configuration file.
+type dotOptions struct {
+	tlsConfig       *tls.Config
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+}
+
+// newDotOptions loads the certificate (and the client CA, if set) and
+// parses the timeouts in the configuration.
+func newDotOptions(cfg *AppConfig) (*dotOptions, error) {
+	dc := cfg.DoT
+
+	cert, err := tls.LoadX509KeyPair(dc.CertFile, dc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate: %s", err)
+	}
+
+	opts := &dotOptions{
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		shutdownTimeout: dotDefaultShutdownTimeout,
+	}
+
+	if len(dc.ClientCAFile) > 0 {
+		pool, err := loadCertPool(dc.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.tlsConfig.ClientCAs = pool
+		opts.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if dc.RequireClientCert {
+		if opts.tlsConfig.ClientCAs == nil {
+			return nil, fmt.Errorf("requireclientcert needs a clientcafile")
+		}
+		opts.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	for _, t := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"readtimeout", dc.ReadTimeout, &opts.readTimeout},
+		{"writetimeout", dc.WriteTimeout, &opts.writeTimeout},
+		{"idletimeout", dc.IdleTimeout, &opts.idleTimeout},
+		{"shutdowntimeout", dc.ShutdownTimeout, &opts.shutdownTimeout},
+	} {
+		if len(t.value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(t.value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad %s '%s'", t.name, t.value)
+		}
+		*t.d = d
+	}
+
+	return opts, nil
+}
+
+// loadCertPool reads the CA certificates for verifying clients.
+func loadCertPool(fileName string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", fileName)
+	}
+	return pool, nil
+}
+
+// dotAddress returns the address for the DNS over TLS listener on the
+// same IP as a UDP/TCP listener.
+func dotAddress(host, port string) string {
+	ip, _, err := net.SplitHostPort(host)
+	if err != nil {
+		ip = host
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// listenAndServeTLS starts a DNS over TLS server on the address. The
+// queries are handled by the same zones as the UDP and TCP listeners.
+func (srv *Server) listenAndServeTLS(addr string, opts *dotOptions) error {
+	l, err := tls.Listen("tcp", addr, opts.tlsConfig)
+	if err != nil {
+		return err
+	}
+	server := &dns.Server{
+		Addr:         addr,
+		Net:          "tcp-tls",
+		Listener:     l,
+		Handler:      queryWorkers.handler(dns.DefaultServeMux),
+		ReadTimeout:  opts.readTimeout,
+		WriteTimeout: opts.writeTimeout,
+	}
+	if opts.idleTimeout > 0 {
+		server.IdleTimeout = func() time.Duration { return opts.idleTimeout }
+	}
+
+	srv.addDNSListener(server, opts.shutdownTimeout)
+
+	go func() {
+		log.Printf("Opening on %s tcp-tls", addr)
+		if err := server.ActivateAndServe(); err != nil && !srv.isStopping() {
+			log.Printf("geodns: DNS over TLS server on %s stopped: %s", addr, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+const dotPort = ":8855"
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its
+// key to the directory.
+func writeTestCert(c *C, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "geodns test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	certFile, keyFile = dir+"/cert.pem", dir+"/key.pem"
+	c.Assert(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600), IsNil)
+	return certFile, keyFile
+}
+
+func (s *ServeSuite) TestServingTLS(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := new(AppConfig)
+	cfg.DoT.CertFile, cfg.DoT.KeyFile = writeTestCert(c, dir)
+	cfg.DoT.IdleTimeout = "1s"
+	cfg.DoT.ShutdownTimeout = "2s"
+
+	opts, err := newDotOptions(cfg)
+	c.Assert(err, IsNil)
+	c.Check(opts.idleTimeout, Equals, time.Second)
+
+	srv := Server{}
+	c.Assert(srv.listenAndServeTLS("127.0.0.1"+dotPort, opts), IsNil)
+	defer srv.Shutdown(context.Background(), nil)
+
+	pool := x509.NewCertPool()
+	certPEM, _ := ioutil.ReadFile(cfg.DoT.CertFile)
+	pool.AppendCertsFromPEM(certPEM)
+	cli := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool}}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+	var r *dns.Msg
+	for i := 0; i < 20; i++ {
+		r, _, err = cli.Exchange(msg, "127.0.0.1"+dotPort)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.168.1.2")
+
+	// the TCP source address is used for targeting
+	msg.SetQuestion("_country.foo.pgeodns.", dns.TypeTXT)
+	r, _, err = cli.Exchange(msg, "127.0.0.1"+dotPort)
+	c.Assert(err, IsNil)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.TXT).Txt[0], Matches, "127.0.0.1:.*")
+}
+
+func (s *ConfigSuite) TestDotOptions(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cfg := new(AppConfig)
+	cfg.DoT.CertFile, cfg.DoT.KeyFile = writeTestCert(c, dir)
+
+	opts, err := newDotOptions(cfg)
+	c.Assert(err, IsNil)
+	c.Check(opts.shutdownTimeout, Equals, dotDefaultShutdownTimeout)
+	c.Check(opts.tlsConfig.ClientAuth, Equals, tls.NoClientCert)
+
+	cfg.DoT.ClientCAFile = cfg.DoT.CertFile
+	cfg.DoT.RequireClientCert = true
+	opts, err = newDotOptions(cfg)
+	c.Assert(err, IsNil)
+	c.Check(opts.tlsConfig.ClientAuth, Equals, tls.RequireAndVerifyClientCert)
+
+	cfg.DoT.ClientCAFile = ""
+	_, err = newDotOptions(cfg)
+	c.Check(err, ErrorMatches, "requireclientcert needs a clientcafile")
+
+	cfg.DoT.RequireClientCert = false
+	cfg.DoT.ReadTimeout = "soon"
+	_, err = newDotOptions(cfg)
+	c.Check(err, ErrorMatches, "bad readtimeout 'soon'")
+
+	cfg.DoT.ReadTimeout = ""
+	cfg.DoT.KeyFile = dir + "/missing.pem"
+	_, err = newDotOptions(cfg)
+	c.Check(err, ErrorMatches, "could not load certificate.*")
+
+	c.Check(dotAddress("192.0.2.1:53", "853"), Equals, "192.0.2.1:853")
+	c.Check(dotAddress("[2001:db8::1]:53", "853"), Equals, "[2001:db8::1]:853")
+}
@@ -0,0 +1,36 @@
+package main
+
+import "github.com/miekg/dns"
+
+const (
+	edns0Keepalive = 11 // edns-tcp-keepalive (RFC 7828)
+	edns0Padding   = 12 // padding (RFC 7830)
+)
+
+// ednsOptionNames are the EDNS options counted by name in the
+// "edns-option-" zone metrics; the other options are counted as
+// "other".
+var ednsOptionNames = map[uint16]string{
+	dns.EDNS0NSID:        "nsid",
+	dns.EDNS0DAU:         "dau",
+	dns.EDNS0DHU:         "dhu",
+	dns.EDNS0N3U:         "n3u",
+	dns.EDNS0SUBNET:      "ecs",
+	dns.EDNS0SUBNETDRAFT: "ecs",
+	dns.EDNS0EXPIRE:      "expire",
+	edns0Cookie:          "cookie",
+	edns0Keepalive:       "keepalive",
+	edns0Padding:         "padding",
+}
+
+// markEdnsOption counts an EDNS option in a query.
+func (z *Zone) markEdnsOption(code uint16) {
+	name, ok := ednsOptionNames[code]
+	if !ok {
+		name = "other"
+		logPrintf("[zone %s] unknown EDNS option %d\n", z.Origin, code)
+	}
+	if m, ok := z.Metrics.EdnsOptions[name]; ok {
+		m.Mark(1)
+	}
+}
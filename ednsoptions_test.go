@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ServeSuite) TestServingEdnsOptions(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/edns.example.net.json"
+	data := `{"data": {"": {"ns": ["ns1.example.net"]}, "www": {"a": [["192.0.2.1", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	query := func(options ...dns.EDNS0) {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.edns.example.net.", dns.TypeA)
+		msg.SetEdns0(4096, false)
+		opt := msg.IsEdns0()
+		opt.Option = options
+		r := dorequest(c, msg)
+		c.Assert(r, NotNil)
+		c.Check(r.Answer, HasLen, 1)
+	}
+
+	query(&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")})
+	query(&dns.EDNS0_LOCAL{Code: edns0Cookie, Data: []byte("12345678")},
+		&dns.EDNS0_LOCAL{Code: edns0Keepalive},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1}})
+	query(&dns.EDNS0_LOCAL{Code: edns0Keepalive})
+	query()
+
+	counts := map[string]int64{}
+	for name, m := range zones["edns.example.net"].Metrics.EdnsOptions {
+		if n := m.Count(); n > 0 {
+			counts[name] = n
+		}
+	}
+	c.Check(counts, DeepEquals, map[string]int64{
+		"nsid": 1, "ecs": 1, "cookie": 1, "keepalive": 2, "other": 1,
+	})
+	c.Check(zones["edns.example.net"].Metrics.Registry.Get("edns-option-keepalive"), NotNil)
+}
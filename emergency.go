@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// emergency is the "emergency" zone option: the A and AAAA records
+// served, with a short TTL, for a name whose records all fail their
+// health checks, instead of the unhealthy records. Unlike the backup
+// records of a label it applies to the whole zone and is the last
+// resort, after the backup records and the min_healthy labels.
+type emergency struct {
+	ttl     int
+	records map[uint16]Records
+}
+
+// parseEmergency parses the "emergency" zone option:
+//
+//	{ "a": [ "192.0.2.99" ], "aaaa": [ "2001:db8::99" ], "ttl": 30 }
+func parseEmergency(v interface{}) (*emergency, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("emergency must be a map of options")
+	}
+	e := &emergency{ttl: 30, records: map[uint16]Records{}}
+	if ttl, ok := m["ttl"]; ok {
+		t, ok := ttl.(float64)
+		if !ok || t < 1 {
+			return nil, fmt.Errorf("Bad emergency ttl '%v'", ttl)
+		}
+		e.ttl = int(t)
+	}
+	for k, v := range m {
+		var qtype uint16
+		switch k {
+		case "ttl":
+			continue
+		case "a":
+			qtype = dns.TypeA
+		case "aaaa":
+			qtype = dns.TypeAAAA
+		default:
+			return nil, fmt.Errorf("Unknown emergency option '%s'", k)
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("emergency %s must be a list of IPs", k)
+		}
+		for _, s := range list {
+			str, _ := s.(string)
+			ip := net.ParseIP(str)
+			if ip == nil || (ip.To4() != nil) != (qtype == dns.TypeA) {
+				return nil, fmt.Errorf("Bad emergency %s IP '%v'", k, s)
+			}
+			h := dns.RR_Header{Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(e.ttl)}
+			var rr dns.RR
+			if qtype == dns.TypeA {
+				rr = &dns.A{Hdr: h, A: ip.To4()}
+			} else {
+				rr = &dns.AAAA{Hdr: h, AAAA: ip}
+			}
+			e.records[qtype] = append(e.records[qtype], Record{RR: rr, Weight: 1})
+		}
+	}
+	if len(e.records) == 0 {
+		return nil, fmt.Errorf("emergency needs a or aaaa records")
+	}
+	return e, nil
+}
+
+// replace returns the emergency records of the qtype if the label has
+// records of the type and they all fail their health checks, or nil.
+func (e *emergency) replace(label *Label, qtype uint16) Records {
+	if e == nil || len(e.records[qtype]) == 0 {
+		return nil
+	}
+	records, _ := label.activeRecords(qtype)
+	if len(records) == 0 {
+		return nil
+	}
+	for _, r := range records {
+		if r.IsHealthy() {
+			return nil
+		}
+	}
+	return e.records[qtype]
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestEmergencyOptions(c *C) {
+	for _, bad := range []interface{}{
+		true,
+		map[string]interface{}{"ttl": 10.0},
+		map[string]interface{}{"a": []interface{}{"2001:db8::1"}},
+		map[string]interface{}{"aaaa": []interface{}{"192.0.2.1"}},
+		map[string]interface{}{"a": "192.0.2.1"},
+		map[string]interface{}{"a": []interface{}{"192.0.2.1"}, "ttl": 0.0},
+		map[string]interface{}{"a": []interface{}{"192.0.2.1"}, "cname": []interface{}{"www"}},
+	} {
+		_, err := parseEmergency(bad)
+		c.Check(err, NotNil, Commentf("%v", bad))
+	}
+
+	e, err := parseEmergency(map[string]interface{}{"a": []interface{}{"192.0.2.99"}})
+	c.Assert(err, IsNil)
+	c.Check(e.ttl, Equals, 30)
+	c.Assert(e.records[dns.TypeA], HasLen, 1)
+	c.Check(e.records[dns.TypeA][0].RR.Header().Ttl, Equals, uint32(30))
+	c.Check(e.records[dns.TypeAAAA], HasLen, 0)
+}
+
+func (s *ServeSuite) TestServingEmergency(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/emergency.example.net.json"
+	data := `{"ttl": 300, "emergency": {"a": ["192.0.2.99"], "ttl": 10},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 0], ["192.0.2.2", 0]], "aaaa": [["2001:db8::1", 0]],
+			"health": {"type": "picker-down", "retries": 1, "frequency": "1h"}}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+	z := zones["emergency.example.net"]
+	records := z.Labels["www"].Records[dns.TypeA]
+
+	// one of the records is still healthy
+	defer setDown(c, records[0], false)
+	setDown(c, records[0], true)
+	r := exchange(c, "www.emergency.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.2")
+	c.Check(z.Metrics.Emergency.Count(), Equals, int64(0))
+
+	// all the records are down
+	defer setDown(c, records[1], false)
+	setDown(c, records[1], true)
+	r = exchange(c, "www.emergency.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Name, Equals, "www.emergency.example.net.")
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(10))
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.99")
+	c.Check(z.Metrics.Emergency.Count(), Equals, int64(1))
+
+	// without emergency records of the type the records are served
+	r = exchange(c, "www.emergency.example.net.", dns.TypeAAAA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.AAAA).AAAA.String(), Equals, "2001:db8::1")
+
+	// and names without records of the type get no answer
+	r = exchange(c, "emergency.example.net.", dns.TypeA)
+	c.Check(r.Answer, HasLen, 0)
+	c.Check(z.Metrics.Emergency.Count(), Equals, int64(1))
+}
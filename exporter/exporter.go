@@ -0,0 +1,261 @@
+// Package exporter serves go-metrics registries in the Prometheus
+// text exposition format. The metrics are read on each scrape.
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Zone is the data exported for each zone.
+type Zone struct {
+	Name     string
+	Registry metrics.Registry
+	// Qtypes has a counter for each query type, named by type
+	Qtypes metrics.Registry
+	// Health has the health check metrics named by the metric and
+	// "label/qtype/ip", for example "healthy www/A/192.0.2.1"
+	Health metrics.Registry
+	// Labels has the query count for each label in the recent
+	// query window
+	Labels map[string]int
+	// LabelLevels has the query count for each label by the
+	// targeting level of the answers, in the recent query window
+	LabelLevels map[string]map[string]int
+}
+
+// ZoneLister returns the zones to export. It's called on each scrape,
+// and the returned zones are read without locks, so it should take
+// what's needed (the metrics registries are safe to read) while holding
+// the locks of the zones.
+type ZoneLister func() []Zone
+
+type label struct {
+	name  string
+	value string
+}
+
+type family struct {
+	typ     string
+	help    string
+	samples []string
+}
+
+type families map[string]*family
+
+var quantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+type handler struct {
+	global metrics.Registry
+	zones  ZoneLister
+}
+
+// NewHandler returns an http.Handler exporting the global metrics
+// registry and the metrics for each zone returned by zones.
+func NewHandler(zones ZoneLister) http.Handler {
+	return &handler{global: metrics.DefaultRegistry, zones: zones}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fams := families{}
+
+	if h.global != nil {
+		fams.addRegistry("geodns_", h.global, nil)
+	}
+
+	if h.zones != nil {
+		// a copy taken by the lister, see ZoneLister
+		zones := h.zones()
+		sort.Sort(zonesByName(zones))
+		for _, z := range zones {
+			zl := []label{{"zone", z.Name}}
+			if z.Registry != nil {
+				fams.addRegistry("geodns_zone_", z.Registry, zl)
+			}
+			if z.Qtypes != nil {
+				z.Qtypes.Each(func(qtype string, i interface{}) {
+					if c, ok := i.(metrics.Counter); ok {
+						fams.add("geodns_zone_qtype_queries_total", "counter",
+							"Queries by query type",
+							append(zl, label{"qtype", qtype}), float64(c.Count()))
+					}
+				})
+			}
+			if z.Health != nil {
+				z.Health.Each(func(name string, i interface{}) {
+					metric, hl, ok := healthLabels(name)
+					if !ok {
+						return
+					}
+					fams.addMetric("geodns_zone_health_"+sanitizeName(metric),
+						"Health check "+metric, append(append([]label{}, zl...), hl...), i)
+				})
+			}
+			for _, l := range sortedKeys(z.Labels) {
+				fams.add("geodns_zone_label_queries", "gauge",
+					"Queries by label in the recent query window",
+					append(zl, label{"label", l}), float64(z.Labels[l]))
+			}
+			labels := make([]string, 0, len(z.LabelLevels))
+			for l := range z.LabelLevels {
+				labels = append(labels, l)
+			}
+			sort.Strings(labels)
+			for _, l := range labels {
+				for _, level := range sortedKeys(z.LabelLevels[l]) {
+					fams.add("geodns_zone_label_target_level_queries", "gauge",
+						"Queries by label and targeting level in the recent query window",
+						append(zl, label{"label", l}, label{"level", level}), float64(z.LabelLevels[l][level]))
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fams.write(w)
+}
+
+func (fams families) add(name, typ, help string, labels []label, value float64) {
+	f, ok := fams[name]
+	if !ok {
+		f = &family{typ: typ, help: help}
+		fams[name] = f
+	}
+	f.samples = append(f.samples, name+formatLabels(labels)+" "+formatValue(value))
+}
+
+// addRegistry adds all the metrics in the registry with the names
+// prefixed and the labels added to each sample.
+func (fams families) addRegistry(prefix string, r metrics.Registry, labels []label) {
+	r.Each(func(metricName string, i interface{}) {
+		fams.addMetric(prefix+sanitizeName(metricName), "geodns metric "+metricName, labels, i)
+	})
+}
+
+// healthLabels splits the name of a health metric into the metric and
+// the label, qtype and ip labels.
+func healthLabels(name string) (string, []label, bool) {
+	parts := strings.SplitN(name, " ", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	ref := parts[1]
+	i := strings.LastIndex(ref, "/")
+	if i < 0 {
+		return "", nil, false
+	}
+	j := strings.LastIndex(ref[:i], "/")
+	if j < 0 {
+		return "", nil, false
+	}
+	return parts[0], []label{{"label", ref[:j]}, {"qtype", ref[j+1 : i]}, {"ip", ref[i+1:]}}, true
+}
+
+// addMetric adds the go-metrics metric with the name and labels.
+func (fams families) addMetric(name, help string, labels []label, i interface{}) {
+	switch m := i.(type) {
+	case metrics.Meter:
+		fams.add(name+"_total", "counter", help, labels, float64(m.Count()))
+	case metrics.Counter:
+		fams.add(name+"_total", "counter", help, labels, float64(m.Count()))
+	case metrics.Gauge:
+		fams.add(name, "gauge", help, labels, float64(m.Value()))
+	case metrics.GaugeFloat64:
+		fams.add(name, "gauge", help, labels, m.Value())
+	case metrics.Histogram:
+		h := m.Snapshot()
+		fams.addSummary(name, help, labels, h.Percentiles(quantiles),
+			float64(h.Sum()), h.Count(), 1)
+	case metrics.Timer:
+		t := m.Snapshot()
+		// timers are in nanoseconds, export them as seconds
+		fams.addSummary(name+"_seconds", help, labels, t.Percentiles(quantiles),
+			float64(t.Sum()), t.Count(), 1e-9)
+	}
+}
+
+func (fams families) addSummary(name, help string, labels []label, values []float64, sum float64, count int64, scale float64) {
+	for i, q := range quantiles {
+		ql := append(append([]label{}, labels...), label{"quantile", formatValue(q)})
+		fams.add(name, "summary", help, ql, values[i]*scale)
+	}
+	f := fams[name]
+	f.samples = append(f.samples,
+		name+"_sum"+formatLabels(labels)+" "+formatValue(sum*scale),
+		name+"_count"+formatLabels(labels)+" "+formatValue(float64(count)),
+	)
+}
+
+func (fams families) write(w io.Writer) {
+	names := make([]string, 0, len(fams))
+	for name := range fams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	for _, name := range names {
+		f := fams[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, f.typ)
+		for _, s := range f.samples {
+			buf.WriteString(s)
+			buf.WriteByte('\n')
+		}
+	}
+	w.Write(buf.Bytes())
+}
+
+func formatLabels(labels []label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	l := make([]string, len(labels))
+	for i, lbl := range labels {
+		l[i] = lbl.name + `="` + escapeValue(lbl.value) + `"`
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+var valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeValue(s string) string {
+	return valueEscaper.Replace(s)
+}
+
+// sanitizeName makes a go-metrics name a valid Prometheus metric name,
+// "queries-edns" becomes "queries_edns".
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type zonesByName []Zone
+
+func (s zonesByName) Len() int           { return len(s) }
+func (s zonesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s zonesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
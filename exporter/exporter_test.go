@@ -0,0 +1,76 @@
+package exporter
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ExporterSuite struct{}
+
+var _ = Suite(&ExporterSuite{})
+
+func (s *ExporterSuite) TestHandler(c *C) {
+	reg := metrics.NewRegistry()
+	metrics.GetOrRegisterMeter("queries", reg).Mark(3)
+	metrics.GetOrRegisterMeter("queries-edns", reg).Mark(1)
+	metrics.GetOrRegisterHistogram("size", reg, metrics.NewUniformSample(10)).Update(2)
+
+	qtypes := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("A", qtypes).Inc(2)
+	metrics.GetOrRegisterCounter("AAAA", qtypes).Inc(1)
+
+	healthReg := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("transitions www/A/192.0.2.1", healthReg).Inc(2)
+	metrics.GetOrRegisterGauge("healthy www/A/192.0.2.1", healthReg).Update(1)
+	metrics.GetOrRegisterGauge("healthy a.b/AAAA/2001:db8::1", healthReg).Update(0)
+
+	h := &handler{zones: func() []Zone {
+		return []Zone{
+			{Name: "example.com", Registry: reg, Qtypes: qtypes, Health: healthReg,
+				Labels:      map[string]int{"www": 4, `a"b`: 1},
+				LabelLevels: map[string]map[string]int{"www": {"country": 3, "global": 1}}},
+		}
+	}}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE geodns_zone_queries_total counter",
+		`geodns_zone_queries_total{zone="example.com"} 3`,
+		`geodns_zone_queries_edns_total{zone="example.com"} 1`,
+		`geodns_zone_qtype_queries_total{zone="example.com",qtype="A"} 2`,
+		`geodns_zone_qtype_queries_total{zone="example.com",qtype="AAAA"} 1`,
+		"# TYPE geodns_zone_label_queries gauge",
+		`geodns_zone_label_queries{zone="example.com",label="www"} 4`,
+		`geodns_zone_label_queries{zone="example.com",label="a\"b"} 1`,
+		"# TYPE geodns_zone_label_target_level_queries gauge",
+		`geodns_zone_label_target_level_queries{zone="example.com",label="www",level="country"} 3`,
+		`geodns_zone_label_target_level_queries{zone="example.com",label="www",level="global"} 1`,
+		"# TYPE geodns_zone_size summary",
+		`geodns_zone_size{zone="example.com",quantile="0.5"} 2`,
+		`geodns_zone_size_count{zone="example.com"} 1`,
+		"# TYPE geodns_zone_health_transitions_total counter",
+		`geodns_zone_health_transitions_total{zone="example.com",label="www",qtype="A",ip="192.0.2.1"} 2`,
+		"# TYPE geodns_zone_health_healthy gauge",
+		`geodns_zone_health_healthy{zone="example.com",label="www",qtype="A",ip="192.0.2.1"} 1`,
+		`geodns_zone_health_healthy{zone="example.com",label="a.b",qtype="AAAA",ip="2001:db8::1"} 0`,
+	} {
+		c.Check(strings.Contains(body, line+"\n"), Equals, true, Commentf("missing %q", line))
+	}
+
+	// each family has just one TYPE line
+	c.Check(strings.Count(body, "# TYPE geodns_zone_qtype_queries_total "), Equals, 1)
+}
+
+func (s *ExporterSuite) TestSanitizeName(c *C) {
+	c.Check(sanitizeName("queries-edns"), Equals, "queries_edns")
+	c.Check(sanitizeName("a.b c"), Equals, "a_b_c")
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	flattenTimeout     = 2 * time.Second
+	flattenNegativeTtl = 60 // seconds to cache lookups without records
+	flattenMaxDepth    = 8  // CNAMEs to follow in the zone
+	flattenCacheSize   = 10000
+
+	// stale records are served with this TTL, and the resolver isn't
+	// tried again for the name until it's passed (RFC 8767)
+	flattenStaleTtl = 30
+	// how long after they expire stale records can be served
+	flattenMaxStale = 24 * time.Hour
+	// cached records are looked up again in the background when a
+	// query uses them in the last 10% of their TTL
+	flattenPrefetch = 10
+)
+
+// flattenSource is where the records of a lookup came from.
+type flattenSource int
+
+const (
+	flattenResolved flattenSource = iota
+	flattenCached
+	flattenStale
+)
+
+// flattenCache caches the lookups of flattened CNAME targets outside
+// of the zone, until the TTL from the resolver expires. When the cache
+// is full the least recently used entry is removed. The lookups don't
+// depend on the client (the targets in the zone are looked up for each
+// query), so the entries are keyed by the name and not the region.
+// Queries for a name that's being looked up wait for that lookup
+// instead of querying the resolver again.
+type flattenCache struct {
+	mu       sync.Mutex
+	size     int
+	entries  map[string]*list.Element
+	lru      *list.List // of *flattenEntry, most recently used first
+	inflight map[string]*flattenCall
+}
+
+type flattenEntry struct {
+	key     string
+	rrs     []dns.RR
+	expires time.Time
+	refresh time.Time // when a query starts a lookup in the background
+	retry   time.Time // after a failed lookup, when to try the resolver again
+}
+
+// flattenCall is a lookup waiting for the resolver. The entry and
+// error are set when done is closed.
+type flattenCall struct {
+	done  chan struct{}
+	entry *flattenEntry
+	err   error
+}
+
+var flattenLookups = newFlattenCache(flattenCacheSize)
+
+func newFlattenCache(size int) *flattenCache {
+	return &flattenCache{
+		size:     size,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		inflight: map[string]*flattenCall{},
+	}
+}
+
+// setSize changes the maximum number of entries in the cache.
+func (fc *flattenCache) setSize(size int) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.size = size
+	fc.evict()
+}
+
+func (fc *flattenCache) get(key string) *flattenEntry {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	el, ok := fc.entries[key]
+	if !ok {
+		return nil
+	}
+	fc.lru.MoveToFront(el)
+	return el.Value.(*flattenEntry)
+}
+
+func (fc *flattenCache) add(entry *flattenEntry) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if el, ok := fc.entries[entry.key]; ok {
+		el.Value = entry
+		fc.lru.MoveToFront(el)
+		return
+	}
+	fc.entries[entry.key] = fc.lru.PushFront(entry)
+	fc.evict()
+}
+
+func (fc *flattenCache) evict() {
+	for fc.lru.Len() > fc.size && fc.lru.Len() > 0 {
+		el := fc.lru.Back()
+		fc.lru.Remove(el)
+		delete(fc.entries, el.Value.(*flattenEntry).key)
+	}
+}
+
+func isFlattenQtype(qtype uint16) bool {
+	return qtype == dns.TypeA || qtype == dns.TypeAAAA
+}
+
+// flattenCNAME returns the A or AAAA records for the target of a CNAME
+// in a label with the flatten option, with the name and TTL of the
+// CNAME. Names in the zone are looked up with the targets of the
+// query; other names are looked up with the zone's resolver.
+func (z *Zone) flattenCNAME(cname *dns.CNAME, qtype uint16, targets []string, sticky string) ([]dns.RR, error) {
+	rrs, err := z.flattenTarget(cname.Target, qtype, targets, sticky, 0)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = cname.Hdr.Name
+		if rr.Header().Ttl > cname.Hdr.Ttl {
+			rr.Header().Ttl = cname.Hdr.Ttl
+		}
+		result = append(result, rr)
+	}
+	return result, nil
+}
+
+func (z *Zone) flattenTarget(target string, qtype uint16, targets []string, sticky string, depth int) ([]dns.RR, error) {
+	if depth > flattenMaxDepth {
+		return nil, fmt.Errorf("too many CNAMEs flattening %s", target)
+	}
+
+	if !dns.IsSubDomain(z.Origin+".", strings.ToLower(target)) {
+		var maxStale time.Duration
+		if z.Options.FlattenStale {
+			maxStale = z.Options.FlattenMaxStale
+		}
+		rrs, source, err := flattenLookups.lookup(z.Options.FlattenResolver, target, qtype, maxStale)
+		switch source {
+		case flattenCached:
+			z.Metrics.FlattenCacheHits.Mark(1)
+		case flattenStale:
+			z.Metrics.FlattenStale.Mark(1)
+		default:
+			z.Metrics.FlattenCacheMisses.Mark(1)
+		}
+		return rrs, err
+	}
+
+	lx := dns.SplitDomainName(strings.ToLower(target))
+	name := strings.Join(lx[0:len(lx)-z.LabelCount], ".")
+
+	label, labelQtype := z.findLabels(name, targets, qTypes{dns.TypeCNAME, qtype})
+	if label == nil || labelQtype == 0 {
+		return nil, nil
+	}
+	servers := label.Select(labelQtype, label.MaxHosts, sticky, target, nil)
+	if labelQtype == dns.TypeCNAME {
+		if len(servers) == 0 {
+			return nil, nil
+		}
+		next := servers[0].RR.(*dns.CNAME).Target
+		return z.flattenTarget(next, qtype, targets, sticky, depth+1)
+	}
+
+	rrs := make([]dns.RR, len(servers))
+	for i, r := range servers {
+		rrs[i] = r.RR
+	}
+	return rrs, nil
+}
+
+// lookup returns the qtype records for the name from the cache or the
+// resolver, and where they came from. If the lookup fails, records
+// from the cache that expired less than maxStale ago are returned
+// instead of the error. Records close to expiring are returned from
+// the cache while they're looked up again in the background.
+func (fc *flattenCache) lookup(resolver, name string, qtype uint16, maxStale time.Duration) ([]dns.RR, flattenSource, error) {
+	if len(resolver) == 0 {
+		resolver = defaultResolver()
+	}
+	key := resolver + "/" + strings.ToLower(name) + "/" + dns.TypeToString[qtype]
+	now := time.Now()
+
+	entry := fc.get(key)
+	if entry != nil && now.Before(entry.expires) {
+		if now.After(entry.refresh) {
+			fc.prefetch(key, resolver, name, qtype)
+		}
+		return entry.withTtl(now), flattenCached, nil
+	}
+	stale := entry != nil && now.Before(entry.expires.Add(maxStale))
+	if stale && now.Before(entry.retry) {
+		return entry.staleRecords(), flattenStale, nil
+	}
+
+	fetched, err := fc.fetch(key, resolver, name, qtype)
+	if err != nil {
+		if stale {
+			log.Printf("Using stale records for %s: %s", name, err)
+			retry := *entry
+			retry.retry = now.Add(flattenStaleTtl * time.Second)
+			fc.add(&retry)
+			return entry.staleRecords(), flattenStale, nil
+		}
+		return nil, flattenResolved, err
+	}
+
+	return fetched.withTtl(time.Now()), flattenResolved, nil
+}
+
+// fetch looks up the key with the resolver and caches the records. If
+// the key is already being looked up it waits for that lookup.
+func (fc *flattenCache) fetch(key, resolver, name string, qtype uint16) (*flattenEntry, error) {
+	call, started := fc.startCall(key)
+	if started {
+		fc.runCall(call, key, resolver, name, qtype)
+	} else {
+		<-call.done
+	}
+	return call.entry, call.err
+}
+
+// prefetch looks up the key in the background, unless it's already
+// being looked up. If the lookup fails the cached records are used
+// until they expire.
+func (fc *flattenCache) prefetch(key, resolver, name string, qtype uint16) {
+	if call, started := fc.startCall(key); started {
+		go fc.runCall(call, key, resolver, name, qtype)
+	}
+}
+
+// startCall returns the lookup in progress for the key, or a new one
+// and true if there wasn't one.
+func (fc *flattenCache) startCall(key string) (*flattenCall, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if call, ok := fc.inflight[key]; ok {
+		return call, false
+	}
+	call := &flattenCall{done: make(chan struct{})}
+	fc.inflight[key] = call
+	return call, true
+}
+
+func (fc *flattenCache) runCall(call *flattenCall, key, resolver, name string, qtype uint16) {
+	rrs, ttl, err := resolve(resolver, name, qtype)
+	if err == nil {
+		now := time.Now()
+		cacheTime := time.Duration(ttl) * time.Second
+		call.entry = &flattenEntry{
+			key:     key,
+			rrs:     rrs,
+			expires: now.Add(cacheTime),
+			refresh: now.Add(cacheTime * (100 - flattenPrefetch) / 100),
+		}
+		fc.add(call.entry)
+	}
+	call.err = err
+
+	fc.mu.Lock()
+	delete(fc.inflight, key)
+	fc.mu.Unlock()
+	close(call.done)
+}
+
+// staleRecords returns the expired records with the stale TTL.
+func (e *flattenEntry) staleRecords() []dns.RR {
+	return e.withTtl(e.expires.Add(-flattenStaleTtl * time.Second))
+}
+
+// withTtl returns the records with the remaining cache time as the TTL
+// (at least one second).
+func (e *flattenEntry) withTtl(now time.Time) []dns.RR {
+	ttl := uint32(1)
+	if left := e.expires.Sub(now) / time.Second; left > 1 {
+		ttl = uint32(left)
+	}
+	rrs := make([]dns.RR, len(e.rrs))
+	for i, rr := range e.rrs {
+		rrs[i] = dns.Copy(rr)
+		rrs[i].Header().Ttl = ttl
+	}
+	return rrs
+}
+
+// resolve queries the resolver for the qtype records of the name and
+// returns them with the time they can be cached for.
+func resolve(resolver, name string, qtype uint16) ([]dns.RR, uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+
+	c := &dns.Client{DialTimeout: flattenTimeout, ReadTimeout: flattenTimeout}
+	r, _, err := c.Exchange(m, resolver)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, 0, fmt.Errorf("lookup of %s failed: %s", name, dns.RcodeToString[r.Rcode])
+	}
+
+	var rrs []dns.RR
+	ttl := uint32(0)
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		if len(rrs) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		rrs = append(rrs, rr)
+	}
+	if len(rrs) == 0 {
+		ttl = flattenNegativeTtl
+	}
+	return rrs, ttl, nil
+}
+
+var (
+	defaultResolverOnce sync.Once
+	defaultResolverAddr = "127.0.0.1:53"
+)
+
+// defaultResolver returns the first nameserver in /etc/resolv.conf.
+func defaultResolver() string {
+	defaultResolverOnce.Do(func() {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil || len(config.Servers) == 0 {
+			log.Printf("No resolver for flattening CNAMEs, using %s", defaultResolverAddr)
+			return
+		}
+		defaultResolverAddr = net.JoinHostPort(config.Servers[0], config.Port)
+	})
+	return defaultResolverAddr
+}
+
+// resolverAddress adds the default port to the resolver address if it
+// doesn't have one.
+func resolverAddress(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+}
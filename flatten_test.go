@@ -0,0 +1,339 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+type FlattenSuite struct {
+}
+
+var _ = Suite(&FlattenSuite{})
+
+// startResolver runs a resolver on a random local port answering A
+// queries with 192.0.2.1 (with the TTL) until it's shut down.
+func startResolver(c *C, ttl uint32, queries *int32) (*dns.Server, string) {
+	return startFailingResolver(c, ttl, queries, nil)
+}
+
+// startFailingResolver is startResolver answering SERVFAIL while
+// failing is set.
+func startFailingResolver(c *C, ttl uint32, queries, failing *int32) (*dns.Server, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(queries, 1)
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if failing != nil && atomic.LoadInt32(failing) > 0 {
+				m.Rcode = dns.RcodeServerFailure
+			} else if req.Question[0].Qtype == dns.TypeA {
+				m.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+					A:   net.ParseIP("192.0.2.1"),
+				}}
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	return server, pc.LocalAddr().String()
+}
+
+func (s *FlattenSuite) TestLookup(c *C) {
+	var queries int32
+	server, addr := startResolver(c, 300, &queries)
+
+	cache := newFlattenCache(10)
+	rrs, source, err := cache.lookup(addr, "backend.example.net.", dns.TypeA, 0)
+	c.Assert(err, IsNil)
+	c.Check(source, Equals, flattenResolved)
+	c.Assert(rrs, HasLen, 1)
+	c.Check(rrs[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+	c.Check(rrs[0].Header().Ttl <= 300, Equals, true)
+
+	// cached
+	rrs, source, err = cache.lookup(addr, "backend.example.net.", dns.TypeA, 0)
+	c.Assert(err, IsNil)
+	c.Check(source, Equals, flattenCached)
+	c.Check(rrs, HasLen, 1)
+	c.Check(atomic.LoadInt32(&queries), Equals, int32(1))
+
+	// no AAAA records is cached too
+	rrs, _, err = cache.lookup(addr, "backend.example.net.", dns.TypeAAAA, 0)
+	c.Assert(err, IsNil)
+	c.Check(rrs, HasLen, 0)
+
+	server.Shutdown()
+
+	// expire the entry; with the resolver gone the lookup fails unless
+	// stale records are allowed for long enough
+	for _, el := range cache.entries {
+		e := el.Value.(*flattenEntry)
+		e.expires = e.expires.Add(-time.Hour)
+	}
+	_, _, err = cache.lookup(addr, "backend.example.net.", dns.TypeA, 0)
+	c.Check(err, NotNil)
+	_, _, err = cache.lookup(addr, "backend.example.net.", dns.TypeA, 30*time.Minute)
+	c.Check(err, NotNil)
+	rrs, source, err = cache.lookup(addr, "backend.example.net.", dns.TypeA, 2*time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(source, Equals, flattenStale)
+	c.Assert(rrs, HasLen, 1)
+	c.Check(rrs[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+	c.Check(rrs[0].Header().Ttl, Equals, uint32(flattenStaleTtl))
+	_, _, err = cache.lookup(addr, "other.example.net.", dns.TypeA, 2*time.Hour)
+	c.Check(err, NotNil)
+}
+
+func (s *FlattenSuite) TestServeStale(c *C) {
+	var queries int32
+	server, addr := startResolver(c, 300, &queries)
+	defer server.Shutdown()
+
+	cache := newFlattenCache(10)
+	_, _, err := cache.lookup(addr, "backend.example.net.", dns.TypeA, time.Hour)
+	c.Assert(err, IsNil)
+	key := addr + "/backend.example.net./A"
+	c.Assert(cache.get(key), NotNil)
+
+	// the resolver fails after the records expire
+	broken := "127.0.0.1:1"
+	expired := *cache.get(key)
+	expired.key = broken + "/backend.example.net./A"
+	expired.expires = time.Now().Add(-time.Minute)
+	cache.add(&expired)
+
+	rrs, source, err := cache.lookup(broken, "backend.example.net.", dns.TypeA, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(source, Equals, flattenStale)
+	c.Assert(rrs, HasLen, 1)
+	c.Check(rrs[0].Header().Ttl, Equals, uint32(flattenStaleTtl))
+
+	// until the retry time the stale records are served without trying
+	// the resolver again
+	entry := cache.get(broken + "/backend.example.net./A")
+	c.Check(entry.retry.After(time.Now()), Equals, true)
+	c.Check(entry.expires, Equals, expired.expires)
+	retry := *entry
+	retry.retry = time.Now().Add(time.Hour)
+	retry.rrs = nil
+	cache.add(&retry)
+	rrs, source, err = cache.lookup(broken, "backend.example.net.", dns.TypeA, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(source, Equals, flattenStale)
+	c.Check(rrs, HasLen, 0)
+
+	// a working resolver replaces the stale records
+	expired.key = key
+	cache.add(&expired)
+	rrs, source, err = cache.lookup(addr, "backend.example.net.", dns.TypeA, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(source, Equals, flattenResolved)
+	c.Assert(rrs, HasLen, 1)
+	c.Check(rrs[0].Header().Ttl > flattenStaleTtl, Equals, true)
+	c.Check(atomic.LoadInt32(&queries), Equals, int32(2))
+}
+
+func (s *FlattenSuite) TestConcurrentLookups(c *C) {
+	var queries int32
+	release := make(chan struct{})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			<-release
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("192.0.2.1"),
+			}}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+	addr := pc.LocalAddr().String()
+
+	// the queries for the name while it's being looked up wait for
+	// the first lookup
+	cache := newFlattenCache(10)
+	var wg sync.WaitGroup
+	results := make([][]dns.RR, 10)
+	errs := make([]error, len(results))
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, errs[i] = cache.lookup(addr, "backend.example.net.", dns.TypeA, 0)
+		}(i)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&queries) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	c.Check(atomic.LoadInt32(&queries), Equals, int32(1))
+	for i, rrs := range results {
+		c.Check(errs[i], IsNil)
+		c.Check(rrs, HasLen, 1)
+	}
+	c.Check(cache.inflight, HasLen, 0)
+}
+
+func (s *FlattenSuite) TestPrefetch(c *C) {
+	var queries int32
+	server, addr := startResolver(c, 300, &queries)
+	defer server.Shutdown()
+
+	cache := newFlattenCache(10)
+	_, _, err := cache.lookup(addr, "backend.example.net.", dns.TypeA, 0)
+	c.Assert(err, IsNil)
+	key := addr + "/backend.example.net./A"
+	entry := cache.get(key)
+	c.Assert(entry, NotNil)
+	c.Check(entry.refresh.After(time.Now().Add(260*time.Second)), Equals, true)
+	c.Check(entry.refresh.Before(entry.expires), Equals, true)
+
+	// close to expiring the cached records are returned and looked up
+	// again in the background
+	old := *entry
+	old.expires = time.Now().Add(10 * time.Second)
+	old.refresh = time.Now().Add(-time.Second)
+	cache.add(&old)
+	rrs, source, err := cache.lookup(addr, "backend.example.net.", dns.TypeA, 0)
+	c.Assert(err, IsNil)
+	c.Check(source, Equals, flattenCached)
+	c.Check(rrs, HasLen, 1)
+	c.Check(rrs[0].Header().Ttl <= 10, Equals, true)
+
+	for i := 0; i < 200 && cache.get(key).expires.Equal(old.expires); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(atomic.LoadInt32(&queries), Equals, int32(2))
+	c.Check(cache.get(key).expires.After(time.Now().Add(time.Minute)), Equals, true)
+}
+
+func (s *FlattenSuite) TestCacheEviction(c *C) {
+	cache := newFlattenCache(2)
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"a", "b"} {
+		cache.add(&flattenEntry{key: key, expires: expires})
+	}
+	// "a" is used, so "b" is the least recently used
+	c.Check(cache.get("a"), NotNil)
+	cache.add(&flattenEntry{key: "c", expires: expires})
+	c.Check(cache.get("b"), IsNil)
+	c.Check(cache.get("a"), NotNil)
+	c.Check(cache.get("c"), NotNil)
+
+	cache.setSize(1)
+	c.Check(cache.lru.Len(), Equals, 1)
+	c.Check(cache.get("c"), NotNil)
+}
+
+func (s *ConfigSuite) TestFlattenInZone(c *C) {
+	ex := s.zones["test.example.com"]
+	label, qtype := ex.findLabels("flat", []string{"@"}, qTypes{dns.TypeCNAME, dns.TypeA})
+	c.Assert(qtype, Equals, dns.TypeCNAME)
+	c.Check(label.Flatten, Equals, true)
+	cname := dns.Copy(label.firstRR(dns.TypeCNAME)).(*dns.CNAME)
+	cname.Hdr.Name = "flat.test.example.com."
+
+	rrs, err := ex.flattenCNAME(cname, dns.TypeA, []string{"@"}, "")
+	c.Assert(err, IsNil)
+	c.Assert(rrs, HasLen, 1)
+	c.Check(rrs[0].Header().Name, Equals, "flat.test.example.com.")
+	c.Check(rrs[0].(*dns.A).A.String(), Equals, "192.168.1.2")
+	c.Check(rrs[0].Header().Ttl, Equals, cname.Hdr.Ttl)
+
+	// the target is geo targeted
+	rrs, err = ex.flattenCNAME(cname, dns.TypeA, []string{"de.berlin", "de", "europe", "@"}, "")
+	c.Assert(err, IsNil)
+	c.Assert(rrs, HasLen, 1)
+	c.Check(rrs[0].(*dns.A).A.String(), Equals, "192.168.1.8")
+
+	// no AAAA records
+	rrs, err = ex.flattenCNAME(cname, dns.TypeAAAA, []string{"@"}, "")
+	c.Assert(err, IsNil)
+	c.Check(rrs, HasLen, 0)
+}
+
+func (s *ServeSuite) TestServingStale(c *C) {
+	var queries, failing int32
+	server, addr := startFailingResolver(c, 300, &queries, &failing)
+	defer server.Shutdown()
+
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/stale.example.net.json"
+	data := `{"flatten": {"resolver": "` + addr + `", "failure": "stale", "max_stale": "1h"},
+		"data": {"": {"ns": ["ns1.example.net"], "cname": "backend.example.org.", "flatten": true}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+	z := zones["stale.example.net"]
+	c.Check(z.Options.FlattenMaxStale, Equals, time.Hour)
+
+	r := exchange(c, "stale.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+
+	// the resolver fails and the records expire
+	atomic.StoreInt32(&failing, 1)
+	expire := func(d time.Duration) {
+		flattenLookups.mu.Lock()
+		defer flattenLookups.mu.Unlock()
+		for key, el := range flattenLookups.entries {
+			if strings.HasPrefix(key, addr+"/") {
+				e := *el.Value.(*flattenEntry)
+				e.expires = time.Now().Add(-d)
+				e.retry = time.Time{}
+				el.Value = &e
+			}
+		}
+	}
+	expire(time.Minute)
+
+	r = exchange(c, "stale.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(flattenStaleTtl))
+	c.Check(z.Metrics.FlattenStale.Count(), Equals, int64(1))
+
+	// records older than max_stale aren't served
+	expire(2 * time.Hour)
+	r = exchange(c, "stale.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeServerFailure)
+	c.Check(z.Metrics.FlattenStale.Count(), Equals, int64(1))
+}
@@ -17,6 +17,7 @@ package main
 */
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -27,6 +28,7 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/abh/geodns/querylog"
@@ -55,6 +57,7 @@ var (
 	flagconfig       = flag.String("config", "./dns/", "directory of zone files")
 	flagconfigfile   = flag.String("configfile", "geodns.conf", "filename of config file (in 'config' directory)")
 	flagcheckconfig  = flag.Bool("checkconfig", false, "check configuration and exit")
+	flagvalidate     = flag.Bool("validate", false, "check the zones for consistency and exit")
 	flagidentifier   = flag.String("identifier", "", "identifier (hostname, pop name or similar)")
 	flaginter        = flag.String("interface", "*", "set the listener address")
 	flagport         = flag.String("port", "53", "default port number")
@@ -118,6 +121,17 @@ func main() {
 		configFileName = filepath.Clean(filepath.Join(*flagconfig, *flagconfigfile))
 	}
 
+	if *flagvalidate {
+		if err := configReader(configFileName); err != nil {
+			log.Println("Errors reading config", err)
+			os.Exit(2)
+		}
+		if !validateZonesDir(*flagconfig, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *flagcheckconfig {
 		dirName := *flagconfig
 
@@ -197,11 +211,16 @@ func main() {
 
 	inter := getInterfaces()
 
+	stopTimeout, err := shutdownTimeout(Config)
+	if err != nil {
+		log.Fatalf("Could not setup the shutdown: %s", err)
+	}
+
 	go statHatPoster()
 
 	Zones := make(Zones)
 
-	go monitor(Zones)
+	go monitor(Zones, srv.zonesMu.RLocker())
 	go Zones.statHatPoster()
 
 	srv.setupRootZone()
@@ -209,17 +228,53 @@ func main() {
 
 	dirName := *flagconfig
 	go srv.zonesReader(dirName, Zones)
+	go srv.zoneSourcesReader(dirName, Zones)
+	go geoIP.providersReloader()
 
 	for _, host := range inter {
 		go srv.listenAndServe(host)
 	}
 
-	terminate := make(chan os.Signal)
-	signal.Notify(terminate, os.Interrupt)
+	if len(Config.DoT.CertFile) > 0 {
+		dot, err := newDotOptions(Config)
+		if err != nil {
+			log.Fatalf("Could not setup DNS over TLS: %s", err)
+		}
+		port := Config.DoT.Port
+		if len(port) == 0 {
+			port = "853"
+		}
+		for _, host := range inter {
+			if err := srv.listenAndServeTLS(dotAddress(host, port), dot); err != nil {
+				log.Fatalf("geodns: failed to setup %s tcp-tls: %s", host, err)
+			}
+		}
+	}
+
+	if len(Config.DoH.Listen) > 0 {
+		if err := srv.listenAndServeDoh(Config); err != nil {
+			log.Fatalf("Could not setup DNS over HTTPS: %s", err)
+		}
+	}
+
+	if len(Config.Admin.Listen) > 0 {
+		if err := srv.listenAndServeAdmin(Config, Zones, dirName); err != nil {
+			log.Fatalf("Could not setup the admin API: %s", err)
+		}
+	}
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
 
 	<-terminate
 	log.Printf("geodns: signal received, stopping")
 
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	if err := srv.Shutdown(ctx, Zones); err != nil {
+		log.Printf("geodns: shutdown: %s", err)
+	}
+	cancel()
+
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/abh/geodns/countries"
+	"github.com/miekg/dns"
+)
+
+// geoFence is the "geo_fence" label option; the name only resolves for
+// clients in the allowed countries and continents.
+type geoFence struct {
+	allow   map[string]bool
+	rcode   int
+	unknown bool // allow the clients GeoIP can't place
+}
+
+// parseGeoFence parses the "geo_fence" label option:
+//
+//	{ "allow": [ "dk", "europe" ], "response": "refused", "unknown": "allow" }
+func parseGeoFence(m map[string]interface{}) (*geoFence, error) {
+	f := &geoFence{allow: map[string]bool{}, rcode: dns.RcodeNameError}
+	for k, v := range m {
+		switch k {
+		case "allow":
+			for _, code := range valueToStrings(v) {
+				code = strings.ToLower(code)
+				if len(countries.CountryContinent[code]) == 0 && len(countries.ContinentCountries[code]) == 0 {
+					return nil, fmt.Errorf("unknown country or continent '%s'", code)
+				}
+				f.allow[code] = true
+			}
+		case "response":
+			switch valueToString(v) {
+			case "nxdomain":
+				f.rcode = dns.RcodeNameError
+			case "refused":
+				f.rcode = dns.RcodeRefused
+			default:
+				return nil, fmt.Errorf("bad response '%s'", v)
+			}
+		case "unknown":
+			switch valueToString(v) {
+			case "allow":
+				f.unknown = true
+			case "deny":
+				f.unknown = false
+			default:
+				return nil, fmt.Errorf("bad unknown policy '%s'", v)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", k)
+		}
+	}
+	if len(f.allow) == 0 {
+		return nil, fmt.Errorf("no allowed countries or continents")
+	}
+	return f, nil
+}
+
+// allowed returns true if one of the regions (country and continent) of
+// the client is allowed, or the unknown policy if there are none.
+func (f *geoFence) allowed(regions []string) bool {
+	if len(regions) == 0 {
+		return f.unknown
+	}
+	for _, r := range regions {
+		if f.allow[r] {
+			return true
+		}
+	}
+	return false
+}
+
+// labelGeoFence returns the geo fence of the name, or nil. Targeted
+// labels queried directly ("www.dk") have the fence of their base name.
+func (z *Zone) labelGeoFence(s string) *geoFence {
+	z.RLock()
+	defer z.RUnlock()
+	if label, ok := z.Labels[s]; ok && label.GeoFence != nil {
+		return label.GeoFence
+	}
+	if base, ok := targetLabelBase(s); ok {
+		if label, ok := z.Labels[base]; ok {
+			return label.GeoFence
+		}
+	}
+	return nil
+}
+
+// fenceRegions returns the country and continent of the IP, from the
+// zone's target overrides or the GeoIP data, and the netmask they're
+// valid for.
+func (z *Zone) fenceRegions(ip net.IP) ([]string, int) {
+	if to, ok := z.Options.TargetOverrides.lookup(ip); ok {
+		ones, _ := to.network.Mask.Size()
+		return overrideTargets(to.target, 0), ones
+	}
+	var regions []string
+	country, continent, netmask := geoIP.GetCountry(ip)
+	for _, r := range []string{country, continent} {
+		if len(r) > 0 {
+			regions = append(regions, r)
+		}
+	}
+	return regions, netmask
+}
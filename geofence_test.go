@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestGeoFence(c *C) {
+	f, err := parseGeoFence(map[string]interface{}{
+		"allow": []interface{}{"DK", "north-america"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(f.rcode, Equals, dns.RcodeNameError)
+	c.Check(f.allowed([]string{"dk", "europe"}), Equals, true)
+	c.Check(f.allowed([]string{"us", "north-america"}), Equals, true)
+	c.Check(f.allowed([]string{"se", "europe"}), Equals, false)
+	c.Check(f.allowed(nil), Equals, false)
+
+	f, err = parseGeoFence(map[string]interface{}{
+		"allow": "dk, se", "response": "refused", "unknown": "allow",
+	})
+	c.Assert(err, IsNil)
+	c.Check(f.rcode, Equals, dns.RcodeRefused)
+	c.Check(f.allowed([]string{"se", "europe"}), Equals, true)
+	c.Check(f.allowed(nil), Equals, true)
+
+	for _, m := range []map[string]interface{}{
+		{"allow": []interface{}{"xx"}},
+		{"allow": []interface{}{}},
+		{"allow": "dk", "response": "servfail"},
+		{"allow": "dk", "unknown": "maybe"},
+		{"allow": "dk", "deny": "se"},
+	} {
+		_, err = parseGeoFence(m)
+		c.Check(err, NotNil, Commentf("geo_fence %v", m))
+	}
+}
+
+func (s *ServeSuite) TestServingGeoFence(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	data := `{"target_overrides": {"192.0.2.0/24": "dk", "198.51.100.0/24": "us"},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1"]], "geo_fence": {"allow": ["europe"]}},
+		"www.dk": {"a": [["192.0.2.2"]]},
+		"api": {"a": [["192.0.2.3"]],
+			"geo_fence": {"allow": ["dk"], "response": "refused", "unknown": "allow"}}}}`
+	fileName := dir + "/fence.example.net.json"
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	// allowed
+	r := exchangeSubnet(c, "www.fence.example.net.", dns.TypeA, "192.0.2.10")
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.2")
+
+	// denied
+	r = exchangeSubnet(c, "www.fence.example.net.", dns.TypeA, "198.51.100.10")
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	c.Check(r.Answer, HasLen, 0)
+	c.Assert(r.Ns, HasLen, 1)
+	c.Check(r.Ns[0].Header().Rrtype, Equals, dns.TypeSOA)
+	r = exchangeSubnet(c, "www.dk.fence.example.net.", dns.TypeA, "198.51.100.10")
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	r = exchangeSubnet(c, "api.fence.example.net.", dns.TypeA, "198.51.100.10")
+	c.Check(r.Rcode, Equals, dns.RcodeRefused)
+	c.Check(r.Answer, HasLen, 0)
+
+	// unknown; the test GeoIP data can't place the client
+	r = exchangeSubnet(c, "www.fence.example.net.", dns.TypeTXT, "203.0.113.10")
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	r = exchangeSubnet(c, "api.fence.example.net.", dns.TypeA, "203.0.113.10")
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Answer, HasLen, 1)
+
+	// a bad geo_fence fails the zone
+	bad := `{"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1"]], "geo_fence": {"allow": ["atlantis"]}}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(bad), 0644), IsNil)
+	_, err = readZoneFile("fence.example.net", fileName)
+	c.Check(err, ErrorMatches, ".*Bad geo_fence.*")
+}
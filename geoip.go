@@ -2,10 +2,12 @@ package main
 
 import (
 	"github.com/abh/geodns/countries"
+	"github.com/abh/geodns/geoip6"
 	"github.com/abh/geoip"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,45 +17,72 @@ type GeoIP struct {
 	countryLastLoad time.Time
 
 	city         *geoip.GeoIP
+	city6        *geoip6.City
 	cityLastLoad time.Time
 	hasCity      bool
 
 	asn         *geoip.GeoIP
 	hasAsn      bool
 	asnLastLoad time.Time
+
+	// databases from the configuration, consulted before the ones
+	// above
+	mu        sync.RWMutex
+	providers []geoProvider
 }
 
 var geoIP = new(GeoIP)
 
-func (g *GeoIP) GetCountry(ip net.IP) (country, continent string, netmask int) {
+func (g *GeoIP) hasProviders() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.providers) > 0
+}
+
+// countryRecord returns the country from the country database.
+func (g *GeoIP) countryRecord(ip net.IP) geoRecord {
 	if g.country == nil {
-		return "", "", 0
+		return geoRecord{}
 	}
+	country, netmask := g.country.GetCountry(ip.String())
+	return geoRecord{country: strings.ToLower(country), netmask: netmask}
+}
 
-	country, netmask = geoIP.country.GetCountry(ip.String())
+func (g *GeoIP) GetCountry(ip net.IP) (country, continent string, netmask int) {
+	r := g.lookupProviders(ip)
+	if len(r.country) == 0 {
+		r.merge(g.countryRecord(ip))
+	}
+
+	country, netmask = r.country, r.netmask
 	if len(country) > 0 {
-		country = strings.ToLower(country)
 		continent = countries.CountryContinent[country]
 	}
 	return
 }
 
-func (g *GeoIP) GetCountryRegion(ip net.IP) (country, continent, regionGroup, region string, netmask int) {
-	if g.city == nil {
-		log.Println("No city database available")
-		country, continent, netmask = g.GetCountry(ip)
-		return
-	}
+func (g *GeoIP) GetCountryRegion(ip net.IP) (country, continent, regionGroup, region, city string, netmask int) {
+	r := g.lookupProviders(ip)
 
-	record := geoIP.city.GetRecord(ip.String())
-	if record == nil {
-		return
+	if g.city == nil {
+		if !g.hasProviders() {
+			log.Println("No city database available")
+		}
+		if len(r.country) == 0 {
+			r.merge(g.countryRecord(ip))
+		}
+	} else if len(r.country) == 0 || len(r.region) == 0 || len(r.city) == 0 {
+		if record := g.city.GetRecord(ip.String()); record != nil {
+			r.merge(geoRecord{
+				country: strings.ToLower(record.CountryCode),
+				region:  record.Region,
+				city:    record.City,
+			})
+		}
 	}
 
-	country = record.CountryCode
-	region = record.Region
+	country, region, netmask = r.country, r.region, r.netmask
 	if len(country) > 0 {
-		country = strings.ToLower(country)
 		continent = countries.CountryContinent[country]
 
 		if len(region) > 0 {
@@ -61,13 +90,59 @@ func (g *GeoIP) GetCountryRegion(ip net.IP) (country, continent, regionGroup, re
 			regionGroup = countries.CountryRegionGroup(country, region)
 		}
 
+		// not all records in the database have a city
+		if len(r.city) > 0 {
+			city = country + "." + cityTarget(r.city)
+		}
 	}
 	return
 }
 
+// cityTarget makes a city name usable as part of a label,
+// "San Francisco" becomes "san-francisco".
+func cityTarget(city string) string {
+	return strings.Join(strings.Fields(strings.ToLower(city)), "-")
+}
+
+// GetLocation returns the location of the IP from the city (or the
+// IPv6 city) database or nil if it's not known.
+func (g *GeoIP) GetLocation(ip net.IP) *Location {
+	if ip == nil {
+		return nil
+	}
+	if loc := g.lookupProviders(ip).location; loc != nil {
+		return loc
+	}
+
+	var record *geoip.GeoIPRecord
+	if ip.To4() != nil {
+		if g.city == nil {
+			return nil
+		}
+		record = g.city.GetRecord(ip.String())
+	} else {
+		if g.city6 == nil {
+			return nil
+		}
+		record = g.city6.GetRecord(ip.String())
+	}
+	if record == nil {
+		return nil
+	}
+	return &Location{
+		Latitude:  float64(record.Latitude),
+		Longitude: float64(record.Longitude),
+	}
+}
+
 func (g *GeoIP) GetASN(ip net.IP) (asn string, netmask int) {
+	if r := g.lookupProviders(ip); len(r.asn) > 0 {
+		return r.asn, r.netmask
+	}
 	if g.asn == nil {
-		log.Println("No asn database available")
+		if !g.hasProviders() {
+			log.Println("No asn database available")
+		}
 		return
 	}
 	name, netmask := g.asn.GetName(ip.String())
@@ -121,6 +196,13 @@ func (g *GeoIP) setupGeoIPCity() {
 	g.hasCity = true
 	g.city = gi
 
+	// the IPv6 database is optional, it's only used for locations
+	city6, err := geoip6.OpenDefault()
+	if err != nil {
+		log.Printf("Could not open IPv6 city GeoIP database: %s\n", err)
+		return
+	}
+	g.city6 = city6
 }
 
 func (g *GeoIP) setupGeoIPASN() {
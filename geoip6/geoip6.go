@@ -0,0 +1,97 @@
+// Package geoip6 looks up IPv6 addresses in the GeoIP (legacy .dat
+// format) IPv6 city databases with libgeoip. The vendored
+// github.com/abh/geoip only has the IPv6 lookups of the country and
+// name databases.
+package geoip6
+
+/*
+#cgo pkg-config: geoip
+#include <stdlib.h>
+#include <GeoIP.h>
+#include <GeoIPCity.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/abh/geoip"
+)
+
+// City is an IPv6 city database.
+type City struct {
+	db *C.GeoIP
+
+	// libgeoip keeps the netmask of the last lookup in the database,
+	// so the lookups are serialized as in github.com/abh/geoip
+	mu sync.Mutex
+}
+
+// Open opens an IPv6 city database file.
+func Open(file string) (*City, error) {
+	// libgeoip prints errors if it can't open the file, so check first
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	cfile := C.CString(file)
+	defer C.free(unsafe.Pointer(cfile))
+	return newCity(C.GeoIP_open(cfile, C.GEOIP_MEMORY_CACHE), file)
+}
+
+// OpenDefault opens the IPv6 city database in the default (or the
+// geoip.SetCustomDirectory) directory.
+func OpenDefault() (*City, error) {
+	return newCity(C.GeoIP_open_type(C.GEOIP_CITY_EDITION_REV1_V6, C.GEOIP_MEMORY_CACHE), "GeoIPCityv6.dat")
+}
+
+func newCity(db *C.GeoIP, name string) (*City, error) {
+	if db == nil {
+		return nil, fmt.Errorf("didn't open GeoIP database %s", name)
+	}
+	switch C.GeoIP_database_edition(db) {
+	case C.GEOIP_CITY_EDITION_REV0_V6, C.GEOIP_CITY_EDITION_REV1_V6:
+	default:
+		C.GeoIP_delete(db)
+		return nil, fmt.Errorf("%s isn't an IPv6 city database", name)
+	}
+	C.GeoIP_set_charset(db, C.GEOIP_CHARSET_UTF8)
+	c := &City{db: db}
+	runtime.SetFinalizer(c, (*City).free)
+	return c, nil
+}
+
+func (c *City) free() {
+	C.GeoIP_delete(c.db)
+}
+
+// GetRecord returns the city record for an IPv6 address, or nil if
+// the database doesn't have it. The metro and area codes aren't set.
+func (c *City) GetRecord(ip string) *geoip.GeoIPRecord {
+	cip := C.CString(ip)
+	defer C.free(unsafe.Pointer(cip))
+
+	c.mu.Lock()
+	record := C.GeoIP_record_by_addr_v6(c.db, cip)
+	c.mu.Unlock()
+	if record == nil {
+		return nil
+	}
+	defer C.GeoIPRecord_delete(record)
+
+	return &geoip.GeoIPRecord{
+		CountryCode:   C.GoString(record.country_code),
+		CountryCode3:  C.GoString(record.country_code3),
+		CountryName:   C.GoString(record.country_name),
+		Region:        C.GoString(record.region),
+		City:          C.GoString(record.city),
+		PostalCode:    C.GoString(record.postal_code),
+		Latitude:      float32(record.latitude),
+		Longitude:     float32(record.longitude),
+		CharSet:       int(record.charset),
+		ContinentCode: C.GoString(record.continent_code),
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abh/geodns/geoip6"
+	"github.com/abh/geoip"
+)
+
+// geoRecord is what a GeoIP database has for an IP; the fields it
+// doesn't have are empty.
+type geoRecord struct {
+	country  string // lowercase country code
+	region   string // region code, without the country
+	city     string
+	asn      string // lowercase, "as64500"
+	location *Location
+	netmask  int
+}
+
+// geoProvider is a GeoIP database from the [geoip] section of the
+// configuration. The databases are consulted in the order they're
+// configured, before the default databases.
+type geoProvider interface {
+	lookup(ip net.IP) geoRecord
+	// reload reopens the database if the file changed
+	reload() error
+	// spec is the database as configured, "city:/path/to/file.dat"
+	spec() string
+}
+
+// newGeoProvider opens a database from the configuration; the type (a
+// GeoIP "country", "city" or "asn" database, or "override" for a JSON
+// file of networks) and the file name.
+func newGeoProvider(spec string) (geoProvider, error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("database '%s' must be type:file", spec)
+	}
+	kind, file := strings.ToLower(spec[:i]), spec[i+1:]
+
+	var p geoProvider
+	switch kind {
+	case "country", "city", "asn":
+		p = &geoipDatabase{kind: kind, file: file, specStr: spec}
+	case "override":
+		p = &geoOverrides{file: file, specStr: spec}
+	default:
+		return nil, fmt.Errorf("unknown database type '%s'", kind)
+	}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// fileChanged returns the modification time of the file and if it
+// changed since the last time.
+func fileChanged(file string, last time.Time) (time.Time, bool, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return last, false, err
+	}
+	return fi.ModTime(), !fi.ModTime().Equal(last), nil
+}
+
+// geoipDatabase is a GeoIP (legacy .dat format) database file.
+type geoipDatabase struct {
+	kind    string
+	file    string
+	specStr string
+
+	mu      sync.RWMutex
+	gi      *geoip.GeoIP
+	city6   *geoip6.City // if it's an IPv6 city database
+	modTime time.Time
+}
+
+func (d *geoipDatabase) spec() string { return d.specStr }
+
+func (d *geoipDatabase) reload() error {
+	d.mu.RLock()
+	modTime, changed, err := fileChanged(d.file, d.modTime)
+	d.mu.RUnlock()
+	if err != nil || !changed {
+		return err
+	}
+
+	gi, err := geoip.Open(d.file)
+	if gi == nil || err != nil {
+		return fmt.Errorf("could not open %s: %v", d.file, err)
+	}
+
+	var city6 *geoip6.City
+	if d.kind == "city" {
+		// the IPv6 city records are looked up with geoip6
+		city6, _ = geoip6.Open(d.file)
+	}
+
+	d.mu.Lock()
+	d.gi, d.city6, d.modTime = gi, city6, modTime
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *geoipDatabase) lookup(ip net.IP) geoRecord {
+	d.mu.RLock()
+	gi, city6 := d.gi, d.city6
+	d.mu.RUnlock()
+
+	var r geoRecord
+	v4 := ip.To4() != nil
+	switch d.kind {
+	case "country":
+		if v4 {
+			r.country, r.netmask = gi.GetCountry(ip.String())
+		} else {
+			r.country, r.netmask = gi.GetCountry_v6(ip.String())
+		}
+	case "city":
+		var record *geoip.GeoIPRecord
+		if v4 {
+			record = gi.GetRecord(ip.String())
+		} else if city6 != nil {
+			record = city6.GetRecord(ip.String())
+		}
+		if record == nil {
+			return r
+		}
+		r.country, r.region, r.city = record.CountryCode, record.Region, record.City
+		r.location = &Location{
+			Latitude:  float64(record.Latitude),
+			Longitude: float64(record.Longitude),
+		}
+	case "asn":
+		var name string
+		if v4 {
+			name, r.netmask = gi.GetName(ip.String())
+		} else {
+			name, r.netmask = gi.GetNameV6(ip.String())
+		}
+		if i := strings.Index(name, " "); i > 0 {
+			r.asn = strings.ToLower(name[:i])
+		}
+	}
+	r.country = strings.ToLower(r.country)
+	return r
+}
+
+// geoOverrides is a JSON file with the GeoIP data for networks, for
+// networks the other databases don't have or have wrong:
+//
+//	{ "192.0.2.0/24": { "country": "us", "region": "ca",
+//	  "city": "San Francisco", "asn": "as64500",
+//	  "latitude": 37.77, "longitude": -122.42 } }
+//
+// The most specific (longest prefix) network matching the IP is used.
+type geoOverrides struct {
+	file    string
+	specStr string
+
+	mu       sync.RWMutex
+	networks []geoOverride
+	modTime  time.Time
+}
+
+type geoOverride struct {
+	network *net.IPNet
+	record  geoRecord
+}
+
+type geoOverrideJSON struct {
+	Country   string
+	Region    string
+	City      string
+	ASN       string
+	Latitude  *float64
+	Longitude *float64
+}
+
+func (o *geoOverrides) spec() string { return o.specStr }
+
+func (o *geoOverrides) reload() error {
+	o.mu.RLock()
+	modTime, changed, err := fileChanged(o.file, o.modTime)
+	o.mu.RUnlock()
+	if err != nil || !changed {
+		return err
+	}
+
+	fh, err := os.Open(o.file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	var data map[string]geoOverrideJSON
+	if err := json.NewDecoder(fh).Decode(&data); err != nil {
+		return fmt.Errorf("could not parse %s: %s", o.file, err)
+	}
+
+	var networks []geoOverride
+	for cidr, v := range data {
+		n, err := parsePeer(cidr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", o.file, err)
+		}
+		ones, _ := n.Mask.Size()
+		r := geoRecord{
+			country: strings.ToLower(v.Country),
+			region:  v.Region,
+			city:    v.City,
+			asn:     strings.ToLower(v.ASN),
+			netmask: ones,
+		}
+		if v.Latitude != nil && v.Longitude != nil {
+			r.location = &Location{Latitude: *v.Latitude, Longitude: *v.Longitude}
+		}
+		networks = append(networks, geoOverride{n, r})
+	}
+
+	o.mu.Lock()
+	o.networks, o.modTime = networks, modTime
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *geoOverrides) lookup(ip net.IP) geoRecord {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var best geoRecord
+	found := false
+	for _, n := range o.networks {
+		if n.network.Contains(ip) && (!found || n.record.netmask > best.netmask) {
+			best, found = n.record, true
+		}
+	}
+	return best
+}
+
+// setupProviders sets the databases from the configuration, keeping
+// the ones that are already open. A database that can't be opened is
+// left out.
+func (g *GeoIP) setupProviders(specs []string) {
+	g.mu.RLock()
+	open := map[string]geoProvider{}
+	for _, p := range g.providers {
+		open[p.spec()] = p
+	}
+	g.mu.RUnlock()
+
+	var providers []geoProvider
+	for _, spec := range specs {
+		if p, ok := open[spec]; ok {
+			providers = append(providers, p)
+			continue
+		}
+		p, err := newGeoProvider(spec)
+		if err != nil {
+			log.Printf("Could not open GeoIP database %s: %s", spec, err)
+			continue
+		}
+		providers = append(providers, p)
+	}
+
+	g.mu.Lock()
+	g.providers = providers
+	g.mu.Unlock()
+}
+
+// geoipReloadInterval is how often the configured databases are
+// checked for changes.
+const geoipReloadInterval = time.Minute
+
+// providersReloader reloads the changed databases periodically.
+func (g *GeoIP) providersReloader() {
+	for {
+		time.Sleep(geoipReloadInterval)
+		g.reloadProviders()
+	}
+}
+
+// reloadProviders reopens the configured databases that changed. A
+// database that fails to load keeps the previous data.
+func (g *GeoIP) reloadProviders() {
+	g.mu.RLock()
+	providers := g.providers
+	g.mu.RUnlock()
+
+	for _, p := range providers {
+		if err := p.reload(); err != nil {
+			log.Printf("Could not reload GeoIP database %s: %s", p.spec(), err)
+		}
+	}
+}
+
+// lookupProviders merges the data from the configured databases; each
+// field is from the first database that has it. The region and city
+// are only used from a database that agrees on the country. The
+// netmask is the most specific of the databases used.
+func (g *GeoIP) lookupProviders(ip net.IP) geoRecord {
+	g.mu.RLock()
+	providers := g.providers
+	g.mu.RUnlock()
+
+	var r geoRecord
+	for _, p := range providers {
+		r.merge(p.lookup(ip))
+	}
+	return r
+}
+
+// merge sets the fields that aren't set from the other record.
+func (r *geoRecord) merge(o geoRecord) {
+	used := false
+	if len(r.country) == 0 && len(o.country) > 0 {
+		r.country = o.country
+		used = true
+	}
+	if len(o.country) == 0 || o.country == r.country {
+		if len(r.region) == 0 && len(o.region) > 0 {
+			r.region = o.region
+			used = true
+		}
+		if len(r.city) == 0 && len(o.city) > 0 {
+			r.city = o.city
+			used = true
+		}
+	}
+	if len(r.asn) == 0 && len(o.asn) > 0 {
+		r.asn = o.asn
+		used = true
+	}
+	if r.location == nil && o.location != nil {
+		r.location = o.location
+		used = true
+	}
+	if used && o.netmask > r.netmask {
+		r.netmask = o.netmask
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type GeoIPSuite struct{}
+
+var _ = Suite(&GeoIPSuite{})
+
+// testGeoProvider is a database with the same record for all IPs.
+type testGeoProvider struct {
+	record geoRecord
+}
+
+func (p *testGeoProvider) lookup(ip net.IP) geoRecord { return p.record }
+func (p *testGeoProvider) reload() error              { return nil }
+func (p *testGeoProvider) spec() string               { return "test" }
+
+func (s *GeoIPSuite) TestProviderChain(c *C) {
+	g := new(GeoIP)
+	ip := net.ParseIP("192.0.2.1")
+
+	// the precise database has the city, but not the ASN
+	g.providers = []geoProvider{
+		&testGeoProvider{geoRecord{country: "us", region: "CA", city: "San Francisco", netmask: 24}},
+		&testGeoProvider{geoRecord{country: "us", asn: "as64500", netmask: 16}},
+	}
+	country, continent, regionGroup, region, city, netmask := g.GetCountryRegion(ip)
+	c.Check(country, Equals, "us")
+	c.Check(continent, Equals, "north-america")
+	c.Check(regionGroup, Equals, "us-west")
+	c.Check(region, Equals, "us-ca")
+	c.Check(city, Equals, "us.san-francisco")
+	c.Check(netmask, Equals, 24)
+	asn, netmask := g.GetASN(ip)
+	c.Check(asn, Equals, "as64500")
+	c.Check(netmask, Equals, 24)
+
+	// a database without the IP is skipped; the region and city are
+	// only from a database with the same country
+	g.providers = []geoProvider{
+		&testGeoProvider{},
+		&testGeoProvider{geoRecord{country: "dk", netmask: 16}},
+		&testGeoProvider{geoRecord{country: "us", region: "CA", city: "San Francisco", netmask: 24}},
+	}
+	country, _, _, region, city, netmask = g.GetCountryRegion(ip)
+	c.Check(country, Equals, "dk")
+	c.Check(region, Equals, "")
+	c.Check(city, Equals, "")
+	c.Check(netmask, Equals, 16)
+
+	g.providers = nil
+	country, _, _ = g.GetCountry(ip)
+	c.Check(country, Equals, "")
+}
+
+func (s *GeoIPSuite) TestOverrides(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/overrides.json"
+	c.Assert(ioutil.WriteFile(fileName, []byte(`{
+		"192.0.2.0/24": { "country": "US", "asn": "AS64500" },
+		"192.0.2.128/25": { "country": "us", "region": "ca", "latitude": 37.77, "longitude": -122.42 },
+		"2001:db8::/32": { "country": "dk" }
+	}`), 0644), IsNil)
+
+	_, err = newGeoProvider("overrides:" + fileName)
+	c.Check(err, ErrorMatches, "unknown database type.*")
+	_, err = newGeoProvider(fileName)
+	c.Check(err, ErrorMatches, ".*must be type:file")
+
+	p, err := newGeoProvider("override:" + fileName)
+	c.Assert(err, IsNil)
+
+	r := p.lookup(net.ParseIP("192.0.2.1"))
+	c.Check(r, DeepEquals, geoRecord{country: "us", asn: "as64500", netmask: 24})
+	r = p.lookup(net.ParseIP("192.0.2.200"))
+	c.Check(r.region, Equals, "ca")
+	c.Check(r.location, DeepEquals, &Location{37.77, -122.42})
+	c.Check(r.netmask, Equals, 25)
+	c.Check(p.lookup(net.ParseIP("2001:db8::1")).country, Equals, "dk")
+	c.Check(p.lookup(net.ParseIP("198.51.100.1")), DeepEquals, geoRecord{})
+
+	// the file is reloaded when it changes, and a bad file keeps the
+	// previous data
+	g := new(GeoIP)
+	g.providers = []geoProvider{p}
+	c.Assert(ioutil.WriteFile(fileName, []byte(`{ "192.0.2.0/24": { "country": "dk" } }`), 0644), IsNil)
+	mtime := time.Now().Add(time.Minute)
+	os.Chtimes(fileName, mtime, mtime)
+	g.reloadProviders()
+	country, _, _ := g.GetCountry(net.ParseIP("192.0.2.200"))
+	c.Check(country, Equals, "dk")
+
+	c.Assert(ioutil.WriteFile(fileName, []byte(`{ "192.0.2.0/24": `), 0644), IsNil)
+	mtime = mtime.Add(time.Minute)
+	os.Chtimes(fileName, mtime, mtime)
+	g.reloadProviders()
+	country, _, _ = g.GetCountry(net.ParseIP("192.0.2.200"))
+	c.Check(country, Equals, "dk")
+
+	// the open databases are kept when the configuration is reloaded
+	g.setupProviders([]string{"override:" + fileName, "city:" + dir + "/missing.dat"})
+	c.Assert(g.providers, HasLen, 1)
+	c.Check(g.providers[0], Equals, p)
+}
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	RegisterType("dns", newDNSTester)
+}
+
+// dnsTester sends a query to the record IP and checks for a NOERROR
+// response and optionally an expected answer.
+type dnsTester struct {
+	port   int
+	qname  string
+	qtype  uint16
+	expect string
+}
+
+func newDNSTester(config map[string]interface{}) (Tester, error) {
+	t := &dnsTester{port: 53, qtype: dns.TypeA}
+
+	qname, ok := config["qname"].(string)
+	if !ok || len(qname) == 0 {
+		return nil, fmt.Errorf("dns health check qname missing")
+	}
+	if _, ok := dns.IsDomainName(qname); !ok {
+		return nil, fmt.Errorf("invalid dns health check qname '%s'", qname)
+	}
+	t.qname = dns.Fqdn(qname)
+
+	if v, ok := config["qtype"].(string); ok {
+		qtype, ok := dns.StringToType[strings.ToUpper(v)]
+		if !ok {
+			return nil, fmt.Errorf("invalid dns health check qtype '%s'", v)
+		}
+		t.qtype = qtype
+	}
+	if v, ok := config["port"]; ok {
+		port, err := configInt(v)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid dns health check port '%v'", v)
+		}
+		t.port = port
+	}
+	if v, ok := config["expect"].(string); ok {
+		t.expect = v
+	}
+
+	return t, nil
+}
+
+func (t *dnsTester) Test(ip net.IP, timeout time.Duration) error {
+	m := new(dns.Msg)
+	m.SetQuestion(t.qname, t.qtype)
+
+	c := &dns.Client{DialTimeout: timeout, ReadTimeout: timeout, WriteTimeout: timeout}
+	r, _, err := c.Exchange(m, net.JoinHostPort(ip.String(), strconv.Itoa(t.port)))
+	if err != nil && !(err == dns.ErrTruncated && r != nil) {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[r.Rcode])
+	}
+
+	if len(t.expect) == 0 {
+		return nil
+	}
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == t.qtype && t.matches(rr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no %s answer matching '%s'", dns.TypeToString[t.qtype], t.expect)
+}
+
+// matches returns true if the record data is the expected value; IP
+// addresses and names are compared in their normal forms.
+func (t *dnsTester) matches(rr dns.RR) bool {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.Equal(net.ParseIP(t.expect))
+	case *dns.AAAA:
+		return rr.AAAA.Equal(net.ParseIP(t.expect))
+	case *dns.CNAME:
+		return strings.EqualFold(rr.Target, dns.Fqdn(t.expect))
+	case *dns.TXT:
+		return strings.Join(rr.Txt, "") == t.expect
+	}
+	rdata := strings.TrimPrefix(rr.String(), rr.Header().String())
+	return strings.TrimSpace(rdata) == t.expect
+}
+
+func (t *dnsTester) String() string {
+	return fmt.Sprintf("dns/%d/%s/%s", t.port, strings.TrimSuffix(t.qname, "."), dns.TypeToString[t.qtype])
+}
@@ -0,0 +1,186 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterType("external", newExternalTester)
+}
+
+const (
+	// the external checks only look up the state, so they run more
+	// often and don't retry
+	externalFrequency = 10 * time.Second
+	externalRetries   = 1
+
+	defaultExternalStale = 5 * time.Minute
+	defaultExternalPoll  = 10 * time.Second
+
+	// maxExternalSize is how much of a polled health state is read
+	maxExternalSize = 1024 * 1024
+)
+
+// externalState is the health of an IP from an external system.
+type externalState struct {
+	healthy bool
+	updated time.Time
+}
+
+// externalStates are the states set with SetExternal, by source and IP.
+var externalStates = struct {
+	sync.RWMutex
+	sources map[string]map[string]externalState
+}{sources: map[string]map[string]externalState{}}
+
+// SetExternal sets the health of the IPs for the "external" health
+// checks of the source, for example from the alerts of a monitoring
+// system. The IPs that aren't in states keep their state.
+func SetExternal(source string, states map[string]bool, now time.Time) error {
+	parsed, err := parseExternal(states, now)
+	if err != nil {
+		return err
+	}
+	externalStates.Lock()
+	defer externalStates.Unlock()
+	m := externalStates.sources[source]
+	if m == nil {
+		m = map[string]externalState{}
+		externalStates.sources[source] = m
+	}
+	for ip, state := range parsed {
+		m[ip] = state
+	}
+	return nil
+}
+
+func parseExternal(states map[string]bool, now time.Time) (map[string]externalState, error) {
+	parsed := make(map[string]externalState, len(states))
+	for s, healthy := range states {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP '%s'", s)
+		}
+		parsed[ip.String()] = externalState{healthy: healthy, updated: now}
+	}
+	return parsed, nil
+}
+
+// externalTester uses the health of the IP set by an external system,
+// either pushed with SetExternal or polled from a URL returning a JSON
+// object of IPs and booleans. The IP is unhealthy if its state hasn't
+// been updated within stale.
+type externalTester struct {
+	source string
+	url    string
+	poll   time.Duration
+	stale  time.Duration
+
+	mu     sync.Mutex
+	polled time.Time
+	states map[string]externalState
+}
+
+func newExternalTester(config map[string]interface{}) (Tester, error) {
+	t := &externalTester{
+		poll:  defaultExternalPoll,
+		stale: defaultExternalStale,
+	}
+	var err error
+	if v, ok := config["source"].(string); ok {
+		t.source = v
+	}
+	if v, ok := config["url"].(string); ok {
+		t.url = v
+	}
+	if v, ok := config["poll"]; ok {
+		if t.poll, err = configDuration(v); err != nil {
+			return nil, fmt.Errorf("external health check poll: %s", err)
+		}
+	}
+	if v, ok := config["stale"]; ok {
+		if t.stale, err = configDuration(v); err != nil || t.stale <= 0 {
+			return nil, fmt.Errorf("invalid external health check stale '%v'", v)
+		}
+	}
+	if len(t.url) > 0 && len(t.source) > 0 {
+		return nil, fmt.Errorf("external health check can't have both a url and a source")
+	}
+	return t, nil
+}
+
+func (t *externalTester) defaults() (time.Duration, int) {
+	return externalFrequency, externalRetries
+}
+
+func (t *externalTester) Test(ip net.IP, timeout time.Duration) error {
+	var state externalState
+	var ok bool
+	if len(t.url) > 0 {
+		state, ok = t.fetch(timeout)[ip.String()]
+	} else {
+		externalStates.RLock()
+		state, ok = externalStates.sources[t.source][ip.String()]
+		externalStates.RUnlock()
+	}
+	if !ok {
+		return fmt.Errorf("no external health state")
+	}
+	if age := time.Since(state.updated); age > t.stale {
+		return fmt.Errorf("external health state not updated for %s", age)
+	}
+	if !state.healthy {
+		return fmt.Errorf("unhealthy")
+	}
+	return nil
+}
+
+// fetch returns the states from the URL, polling it if it hasn't been
+// polled for the poll interval. The states from the last successful
+// poll are kept if it fails, until they're stale.
+func (t *externalTester) fetch(timeout time.Duration) map[string]externalState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.polled) < t.poll {
+		return t.states
+	}
+	t.polled = now
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(t.url)
+	if err != nil {
+		return t.states
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return t.states
+	}
+	var states map[string]bool
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxExternalSize)).Decode(&states); err != nil {
+		return t.states
+	}
+	parsed, err := parseExternal(states, now)
+	if err != nil {
+		return t.states
+	}
+	t.states = parsed
+	return t.states
+}
+
+func (t *externalTester) String() string {
+	if len(t.url) > 0 {
+		return "external/" + t.url
+	}
+	if len(t.source) > 0 {
+		return "external/" + t.source
+	}
+	return "external"
+}
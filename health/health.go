@@ -0,0 +1,413 @@
+// Package health runs health checks for the IP addresses in the zones.
+package health
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Qtypes are the record types that can have health checks
+var Qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+
+const (
+	defaultFrequency = 30 * time.Second
+	defaultTimeout   = 5 * time.Second
+	defaultRetries   = 3
+
+	// slowStartMin is the share of its weight a record gets when it
+	// has just recovered, with a slow_start period
+	slowStartMin = 0.1
+)
+
+// minFrequency is the shortest time between checks; shorter
+// frequencies are raised to it so a zone can't flood the backends.
+var minFrequency = time.Second
+
+// Tester runs a single check against an IP.
+type Tester interface {
+	Test(ip net.IP, timeout time.Duration) error
+	String() string
+}
+
+// testerDefaults is implemented by the testers with a different default
+// frequency and number of retries.
+type testerDefaults interface {
+	defaults() (frequency time.Duration, retries int)
+}
+
+// NewTesterFunc makes a Tester from the health check configuration.
+type NewTesterFunc func(config map[string]interface{}) (Tester, error)
+
+var testerTypes = map[string]NewTesterFunc{}
+
+// RegisterType makes a health check type available to NewFromMap.
+func RegisterType(name string, fn NewTesterFunc) {
+	testerTypes[name] = fn
+}
+
+// HealthTest has the configuration of a health check and, once it's
+// been copied for a record IP, the state of the check for that IP.
+type HealthTest struct {
+	Type      string
+	Frequency time.Duration
+	Timeout   time.Duration
+	Retries   int
+
+	// a random delay up to Jitter is added before the first check and
+	// to the Frequency between checks, to spread the checks of many
+	// records over time
+	Jitter time.Duration
+
+	// the TTL for the record while it's unhealthy (and still served
+	// because all the records are unhealthy) and for RecoveryPeriod
+	// after it's healthy again; 0 to always use the normal TTL
+	DegradedTtl    int
+	RecoveryPeriod time.Duration
+
+	// the weight of a record that recovered ramps up from slowStartMin
+	// to the full weight over SlowStart
+	SlowStart time.Duration
+
+	tester Tester
+	config map[string]interface{}
+	ip     net.IP
+
+	mu          sync.RWMutex
+	healthy     bool
+	failures    int
+	lastCheck   time.Time
+	lastError   error
+	since       time.Time // when the current state started
+	transitions int
+	imported    time.Time // when the imported state expires, until checked
+	onChange    func(healthy bool, inState time.Duration)
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// NewFromMap returns a HealthTest from the health configuration in a
+// zone file, for example {"type":"tcp","port":443,"timeout":"2s"}.
+func NewFromMap(config map[string]interface{}) (*HealthTest, error) {
+	t := &HealthTest{
+		Frequency: defaultFrequency,
+		Timeout:   defaultTimeout,
+		Retries:   defaultRetries,
+		config:    config,
+		healthy:   true,
+	}
+
+	var err error
+
+	typ, ok := config["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("health check type missing")
+	}
+	newTester, ok := testerTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown health check type '%s'", typ)
+	}
+	t.Type = typ
+
+	if v, ok := config["frequency"]; ok {
+		if t.Frequency, err = configDuration(v); err != nil {
+			return nil, fmt.Errorf("health check frequency: %s", err)
+		}
+	}
+	if v, ok := config["timeout"]; ok {
+		if t.Timeout, err = configDuration(v); err != nil {
+			return nil, fmt.Errorf("health check timeout: %s", err)
+		}
+	}
+	if v, ok := config["retries"]; ok {
+		if t.Retries, err = configInt(v); err != nil {
+			return nil, fmt.Errorf("health check retries: %s", err)
+		}
+		if t.Retries < 1 {
+			t.Retries = 1
+		}
+	}
+	if v, ok := config["jitter"]; ok {
+		if t.Jitter, err = configDuration(v); err != nil {
+			return nil, fmt.Errorf("health check jitter: %s", err)
+		}
+	}
+	if v, ok := config["degraded_ttl"]; ok {
+		if t.DegradedTtl, err = configInt(v); err != nil {
+			return nil, fmt.Errorf("health check degraded_ttl: %s", err)
+		}
+	}
+	if v, ok := config["recovery_period"]; ok {
+		if t.RecoveryPeriod, err = configDuration(v); err != nil {
+			return nil, fmt.Errorf("health check recovery_period: %s", err)
+		}
+	}
+	if v, ok := config["slow_start"]; ok {
+		if t.SlowStart, err = configDuration(v); err != nil {
+			return nil, fmt.Errorf("health check slow_start: %s", err)
+		}
+	}
+
+	t.tester, err = newTester(config)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := t.tester.(testerDefaults); ok {
+		frequency, retries := d.defaults()
+		if _, ok := config["frequency"]; !ok {
+			t.Frequency = frequency
+		}
+		if _, ok := config["retries"]; !ok {
+			t.Retries = retries
+		}
+	}
+	if t.Frequency < minFrequency {
+		t.Frequency = minFrequency
+	}
+	if t.Jitter > t.Frequency {
+		t.Jitter = t.Frequency
+	}
+
+	return t, nil
+}
+
+// Copy returns a new (not running) HealthTest with the same
+// configuration for the IP.
+func (t *HealthTest) Copy(ip net.IP) *HealthTest {
+	n := &HealthTest{
+		Type:      t.Type,
+		Frequency: t.Frequency,
+		Timeout:   t.Timeout,
+		Retries:   t.Retries,
+		Jitter:    t.Jitter,
+		tester:    t.tester,
+		config:    t.config,
+		ip:        ip,
+		healthy:   true,
+		since:     time.Now(),
+
+		DegradedTtl:    t.DegradedTtl,
+		RecoveryPeriod: t.RecoveryPeriod,
+		SlowStart:      t.SlowStart,
+	}
+	return n
+}
+
+// Equal returns true if the tests have the same configuration and IP.
+func (t *HealthTest) Equal(o *HealthTest) bool {
+	return t.ip.Equal(o.ip) && reflect.DeepEqual(t.config, o.config)
+}
+
+// CopyState sets the health state from another test, so a test
+// with a changed configuration doesn't start over as healthy.
+func (t *HealthTest) CopyState(o *HealthTest) {
+	o.mu.RLock()
+	healthy, failures, lastCheck := o.healthy, o.failures, o.lastCheck
+	since, transitions, imported := o.since, o.transitions, o.imported
+	o.mu.RUnlock()
+
+	t.mu.Lock()
+	t.healthy, t.failures, t.lastCheck = healthy, failures, lastCheck
+	t.since, t.transitions, t.imported = since, transitions, imported
+	t.mu.Unlock()
+}
+
+// SetOnChange sets a function that's called when the test changes
+// between healthy and unhealthy, with the new state and how long the
+// test was in the previous state.
+func (t *HealthTest) SetOnChange(fn func(healthy bool, inState time.Duration)) {
+	t.mu.Lock()
+	t.onChange = fn
+	t.mu.Unlock()
+}
+
+// IP returns the IP address the test checks.
+func (t *HealthTest) IP() net.IP {
+	return t.ip
+}
+
+func (t *HealthTest) String() string {
+	return fmt.Sprintf("%s %s", t.tester, t.ip)
+}
+
+// IsHealthy returns the current health of the IP. Tests are healthy
+// until they have failed Retries times in a row.
+func (t *HealthTest) IsHealthy() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.healthy || t.importExpired(time.Now())
+}
+
+// Degraded returns true if the IP is unhealthy or became healthy
+// again less than RecoveryPeriod ago.
+func (t *HealthTest) Degraded() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.importExpired(time.Now()) {
+		return false
+	}
+	if !t.healthy {
+		return true
+	}
+	return t.transitions > 0 && time.Since(t.since) < t.RecoveryPeriod
+}
+
+// WeightFactor returns the share of its weight the record should get; it
+// ramps up linearly from slowStartMin when the test became healthy again
+// to 1 after SlowStart. A record that fails again during the ramp starts
+// over when it recovers.
+func (t *HealthTest) WeightFactor(now time.Time) float64 {
+	if t.SlowStart <= 0 {
+		return 1
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !t.healthy || t.transitions == 0 {
+		return 1
+	}
+	elapsed := now.Sub(t.since)
+	if elapsed >= t.SlowStart {
+		return 1
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return slowStartMin + (1-slowStartMin)*float64(elapsed)/float64(t.SlowStart)
+}
+
+// Status is the state of a health test, for the HTTP interface.
+type Status struct {
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"`
+	LastCheck   time.Time `json:"last_check"`
+	LastError   string    `json:"last_error,omitempty"`
+	Since       time.Time `json:"since"`
+	Transitions int       `json:"transitions"`
+
+	// Meta is the metadata of the record that's checked
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Status returns the current state of the test.
+func (t *HealthTest) Status() Status {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s := Status{
+		Healthy:     t.healthy || t.importExpired(time.Now()),
+		Failures:    t.failures,
+		LastCheck:   t.lastCheck,
+		Since:       t.since,
+		Transitions: t.transitions,
+	}
+	if t.lastError != nil {
+		s.LastError = t.lastError.Error()
+	}
+	return s
+}
+
+// Check runs the check once and updates the health state.
+func (t *HealthTest) Check() {
+	err := t.tester.Test(t.ip, t.Timeout)
+
+	t.mu.Lock()
+
+	now := time.Now()
+	t.lastCheck = now
+	t.lastError = err
+	t.imported = time.Time{}
+
+	healthy := t.healthy
+	if err == nil {
+		t.failures = 0
+		healthy = true
+	} else {
+		t.failures++
+		if t.failures >= t.Retries {
+			healthy = false
+		}
+	}
+
+	if healthy == t.healthy {
+		t.mu.Unlock()
+		return
+	}
+
+	inState := now.Sub(t.since)
+	t.healthy = healthy
+	t.since = now
+	t.transitions++
+	onChange := t.onChange
+	t.mu.Unlock()
+
+	if onChange != nil {
+		onChange(healthy, inState)
+	}
+}
+
+func (t *HealthTest) start() {
+	t.closing = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.run()
+}
+
+func (t *HealthTest) run() {
+	defer close(t.done)
+
+	timer := time.NewTimer(t.firstCheck())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-t.closing:
+			return
+		case <-timer.C:
+			t.Check()
+			timer.Reset(t.Frequency + t.jitter())
+		}
+	}
+}
+
+// jitter returns a random delay from 0 up to Jitter.
+func (t *HealthTest) jitter() time.Duration {
+	if t.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(t.Jitter)))
+}
+
+func (t *HealthTest) stop() {
+	if t.closing == nil {
+		return
+	}
+	close(t.closing)
+	<-t.done
+	t.closing = nil
+}
+
+func configDuration(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case string:
+		return time.ParseDuration(v)
+	case float64:
+		// plain numbers are seconds
+		return time.Duration(v * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("invalid duration '%v'", v)
+}
+
+func configInt(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case string:
+		return strconv.Atoi(v)
+	case float64:
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("invalid number '%v'", v)
+}
@@ -0,0 +1,539 @@
+package health
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type HealthSuite struct{}
+
+var _ = Suite(&HealthSuite{})
+
+func (s *HealthSuite) TestNewFromMap(c *C) {
+	t, err := NewFromMap(map[string]interface{}{"type": "tcp", "port": 443.0, "timeout": "2s"})
+	c.Assert(err, IsNil)
+	c.Check(t.Type, Equals, "tcp")
+	c.Check(t.Timeout, Equals, 2*time.Second)
+	c.Check(t.Retries, Equals, 3)
+	c.Check(t.Frequency, Equals, defaultFrequency)
+	c.Check(t.tester.String(), Equals, "tcp/443")
+
+	t, err = NewFromMap(map[string]interface{}{"type": "tcp", "port": "80", "retries": 1.0, "frequency": 10.0})
+	c.Assert(err, IsNil)
+	c.Check(t.Retries, Equals, 1)
+	c.Check(t.Frequency, Equals, 10*time.Second)
+
+	_, err = NewFromMap(map[string]interface{}{"type": "tcp"})
+	c.Check(err, ErrorMatches, "tcp health check port missing")
+
+	_, err = NewFromMap(map[string]interface{}{"type": "tcp", "port": 70000.0})
+	c.Check(err, NotNil)
+
+	_, err = NewFromMap(map[string]interface{}{"type": "tcp", "port": 80.0, "timeout": "soon"})
+	c.Check(err, NotNil)
+
+	_, err = NewFromMap(map[string]interface{}{"type": "carrier-pigeon"})
+	c.Check(err, ErrorMatches, "unknown health check type 'carrier-pigeon'")
+}
+
+func (s *HealthSuite) TestTCP(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	port := ln.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	config := map[string]interface{}{"type": "tcp", "port": strconv.Itoa(port), "timeout": "1s"}
+	tmpl, err := NewFromMap(config)
+	c.Assert(err, IsNil)
+
+	t := tmpl.Copy(net.ParseIP("127.0.0.1"))
+	t.Check()
+	c.Check(t.IsHealthy(), Equals, true)
+
+	// stop listening; the state only flips after three failures
+	ln.Close()
+	t.Check()
+	c.Check(t.IsHealthy(), Equals, true)
+	t.Check()
+	c.Check(t.IsHealthy(), Equals, true)
+	t.Check()
+	c.Check(t.IsHealthy(), Equals, false)
+
+	status := t.Status()
+	c.Check(status.Healthy, Equals, false)
+	c.Check(status.Failures, Equals, 3)
+	c.Check(status.Transitions, Equals, 1)
+	c.Check(time.Since(status.Since) < time.Minute, Equals, true)
+	c.Check(status.LastError, Not(Equals), "")
+	c.Check(time.Since(status.LastCheck) < time.Minute, Equals, true)
+}
+
+func (s *HealthSuite) TestOnChange(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	tmpl, err := NewFromMap(map[string]interface{}{"type": "tcp", "port": strconv.Itoa(port), "retries": 1.0,
+		"degraded_ttl": 10.0, "recovery_period": "1h"})
+	c.Assert(err, IsNil)
+	t := tmpl.Copy(net.ParseIP("127.0.0.1"))
+	c.Check(t.DegradedTtl, Equals, 10)
+	c.Check(t.Degraded(), Equals, false)
+
+	var changes []bool
+	t.SetOnChange(func(healthy bool, inState time.Duration) {
+		changes = append(changes, healthy)
+		c.Check(inState >= 0, Equals, true)
+	})
+
+	t.Check()
+	t.Check()
+	c.Check(changes, DeepEquals, []bool{false})
+	c.Check(t.Degraded(), Equals, true)
+
+	ln, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	t.Check()
+	c.Check(changes, DeepEquals, []bool{false, true})
+	c.Check(t.Status().Transitions, Equals, 2)
+
+	// recovered recently
+	c.Check(t.Degraded(), Equals, true)
+	t.RecoveryPeriod = 0
+	c.Check(t.Degraded(), Equals, false)
+
+	// the state is copied with the transitions
+	n := tmpl.Copy(net.ParseIP("127.0.0.1"))
+	n.CopyState(t)
+	c.Check(n.Status().Transitions, Equals, 2)
+	c.Check(n.Status().Since, Equals, t.Status().Since)
+}
+
+// flapTester fails while down is set.
+type flapTester struct{ down bool }
+
+func (f *flapTester) Test(ip net.IP, timeout time.Duration) error {
+	if f.down {
+		return io.EOF
+	}
+	return nil
+}
+func (f *flapTester) String() string { return "flap" }
+
+func (s *HealthSuite) TestSlowStart(c *C) {
+	tmpl, err := NewFromMap(map[string]interface{}{"type": "tcp", "port": 80.0, "retries": 1.0,
+		"slow_start": "10m"})
+	c.Assert(err, IsNil)
+	t := tmpl.Copy(net.ParseIP("127.0.0.1"))
+	c.Check(t.SlowStart, Equals, 10*time.Minute)
+	flap := &flapTester{}
+	t.tester = flap
+
+	// a new record gets its full weight
+	now := time.Now()
+	c.Check(t.WeightFactor(now), Equals, 1.0)
+
+	// ... and so does an unhealthy one (only served as a last resort)
+	flap.down = true
+	t.Check()
+	c.Check(t.WeightFactor(time.Now()), Equals, 1.0)
+
+	// after recovering the weight ramps up linearly from 10%
+	flap.down = false
+	t.Check()
+	since := t.Status().Since
+	for _, tc := range []struct {
+		after  time.Duration
+		factor float64
+	}{
+		{0, 0.1},
+		{time.Minute, 0.19},
+		{5 * time.Minute, 0.55},
+		{9 * time.Minute, 0.91},
+		{10 * time.Minute, 1},
+		{time.Hour, 1},
+	} {
+		f := t.WeightFactor(since.Add(tc.after))
+		c.Check(f > tc.factor-1e-9 && f < tc.factor+1e-9, Equals, true,
+			Commentf("after %s: %f", tc.after, f))
+	}
+
+	// failing again during the ramp starts it over
+	t.mu.Lock()
+	t.since = time.Now().Add(-8 * time.Minute)
+	t.mu.Unlock()
+	c.Check(t.WeightFactor(time.Now()) > 0.8, Equals, true)
+	flap.down = true
+	t.Check()
+	flap.down = false
+	t.Check()
+	c.Check(t.WeightFactor(time.Now()) < 0.11, Equals, true)
+
+	// without slow_start the weight isn't changed
+	t.SlowStart = 0
+	c.Check(t.WeightFactor(time.Now()), Equals, 1.0)
+}
+
+func (s *HealthSuite) TestRunner(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	defer func(min time.Duration) { minFrequency = min }(minFrequency)
+	minFrequency = time.Millisecond
+
+	tmpl, err := NewFromMap(map[string]interface{}{
+		"type": "tcp", "port": float64(port), "retries": 1.0, "frequency": "10ms"})
+	c.Assert(err, IsNil)
+
+	r := NewRunner()
+	c.Check(r.IsHealthy("example.com/www/1/127.0.0.1"), Equals, true)
+
+	r.Add("example.com/www/1/127.0.0.1", tmpl.Copy(net.ParseIP("127.0.0.1")))
+	for i := 0; i < 100 && r.IsHealthy("example.com/www/1/127.0.0.1"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(r.IsHealthy("example.com/www/1/127.0.0.1"), Equals, false)
+
+	r.Remove("example.com/www/1/127.0.0.1")
+	c.Check(r.Get("example.com/www/1/127.0.0.1"), IsNil)
+	c.Check(r.IsHealthy("example.com/www/1/127.0.0.1"), Equals, true)
+}
+
+// countTester counts the checks.
+type countTester struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (ct *countTester) Test(ip net.IP, timeout time.Duration) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.count++
+	return nil
+}
+func (ct *countTester) String() string { return "count" }
+
+func (ct *countTester) checks() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.count
+}
+
+func (s *HealthSuite) TestSchedule(c *C) {
+	t, err := NewFromMap(map[string]interface{}{"type": "tcp", "port": 80.0, "frequency": "1m", "jitter": "20s"})
+	c.Assert(err, IsNil)
+	c.Check(t.Jitter, Equals, 20*time.Second)
+	t = t.Copy(net.ParseIP("127.0.0.1"))
+	c.Check(t.Jitter, Equals, 20*time.Second)
+	for i := 0; i < 100; i++ {
+		d := t.jitter()
+		c.Assert(d >= 0 && d < 20*time.Second, Equals, true, Commentf("%s", d))
+	}
+
+	// too short frequencies are raised, and the jitter is at most the
+	// frequency
+	t, err = NewFromMap(map[string]interface{}{"type": "tcp", "port": 80.0, "frequency": "1ms", "jitter": "1h"})
+	c.Assert(err, IsNil)
+	c.Check(t.Frequency, Equals, minFrequency)
+	c.Check(t.Jitter, Equals, minFrequency)
+
+	_, err = NewFromMap(map[string]interface{}{"type": "tcp", "port": 80.0, "jitter": "soon"})
+	c.Check(err, ErrorMatches, "health check jitter: .*")
+
+	// each test is checked at its own frequency
+	defer func(min time.Duration) { minFrequency = min }(minFrequency)
+	minFrequency = time.Millisecond
+	r := NewRunner()
+	counts := map[string]*countTester{}
+	for _, frequency := range []string{"20ms", "100ms"} {
+		tmpl, err := NewFromMap(map[string]interface{}{"type": "tcp", "port": 80.0,
+			"frequency": frequency, "jitter": "5ms"})
+		c.Assert(err, IsNil)
+		t := tmpl.Copy(net.ParseIP("127.0.0.1"))
+		counts[frequency] = &countTester{}
+		t.tester = counts[frequency]
+		r.Add(frequency, t)
+	}
+	time.Sleep(450 * time.Millisecond)
+	r.Remove("20ms")
+	r.Remove("100ms")
+
+	fast, slow := counts["20ms"].checks(), counts["100ms"].checks()
+	c.Check(fast >= 10 && fast <= 23, Equals, true, Commentf("%d checks", fast))
+	c.Check(slow >= 3 && slow <= 5, Equals, true, Commentf("%d checks", slow))
+}
+
+func (s *HealthSuite) TestHTTP(c *C) {
+	var host string
+	status := 200
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, "all OK here")
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	ip := net.ParseIP("127.0.0.1")
+
+	tmpl, err := NewFromMap(map[string]interface{}{
+		"type": "http", "port": float64(port), "path": "/healthz",
+		"host": "www.example.com", "expect_status": []interface{}{200.0, 204.0},
+		"expect_body": "OK",
+	})
+	c.Assert(err, IsNil)
+
+	tester := tmpl.tester
+	c.Check(tester.Test(ip, time.Second), IsNil)
+	c.Check(host, Equals, "www.example.com")
+
+	status = 503
+	c.Check(tester.Test(ip, time.Second), ErrorMatches, "unexpected status 503")
+
+	tmpl, err = NewFromMap(map[string]interface{}{
+		"type": "http", "port": float64(port), "path": "/healthz",
+		"expect_status": []interface{}{200.0, 204.0},
+	})
+	c.Assert(err, IsNil)
+	status = 204
+	c.Check(tmpl.tester.Test(ip, time.Second), IsNil)
+	status = 200
+	c.Check(tmpl.tester.Test(ip, time.Second), IsNil)
+	status = 500
+	c.Check(tmpl.tester.Test(ip, time.Second), NotNil)
+
+	tmpl, err = NewFromMap(map[string]interface{}{
+		"type": "http", "port": float64(port), "path": "healthz", "expect_body": "^nope",
+	})
+	c.Assert(err, IsNil)
+	status = 200
+	c.Check(tmpl.tester.Test(ip, time.Second), ErrorMatches, "body didn't match.*")
+
+	_, err = NewFromMap(map[string]interface{}{"type": "http", "expect_body": "("})
+	c.Check(err, NotNil)
+}
+
+func (s *HealthSuite) TestHTTPS(c *C) {
+	var host string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		io.WriteString(w, "OK")
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	ip := net.ParseIP("127.0.0.1")
+
+	tmpl, err := NewFromMap(map[string]interface{}{
+		"type": "https", "port": float64(port), "host": "www.example.com",
+	})
+	c.Assert(err, IsNil)
+	// the test server certificate isn't trusted
+	c.Check(tmpl.tester.Test(ip, time.Second), NotNil)
+
+	tmpl, err = NewFromMap(map[string]interface{}{
+		"type": "https", "port": float64(port), "host": "www.example.com",
+		"sni": "sni.example.com", "skip_verify": true,
+	})
+	c.Assert(err, IsNil)
+	c.Check(tmpl.tester.(*httpTester).transport.TLSClientConfig.ServerName, Equals, "sni.example.com")
+	c.Check(tmpl.tester.Test(ip, time.Second), IsNil)
+	c.Check(host, Equals, "www.example.com")
+}
+
+func (s *HealthSuite) TestDNS(c *C) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			q := req.Question[0]
+			switch {
+			case q.Name != "health.internal.":
+				m.Rcode = dns.RcodeNameError
+			case q.Qtype == dns.TypeA:
+				m.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("10.0.0.1"),
+				}}
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	ip := net.ParseIP("127.0.0.1")
+	test := func(config map[string]interface{}) error {
+		config["type"] = "dns"
+		config["port"] = float64(port)
+		t, err := NewFromMap(config)
+		c.Assert(err, IsNil)
+		return t.tester.Test(ip, time.Second)
+	}
+
+	c.Check(test(map[string]interface{}{"qname": "health.internal", "qtype": "A", "expect": "10.0.0.1"}), IsNil)
+	c.Check(test(map[string]interface{}{"qname": "health.internal"}), IsNil)
+	// NODATA is NOERROR
+	c.Check(test(map[string]interface{}{"qname": "health.internal", "qtype": "aaaa"}), IsNil)
+	c.Check(test(map[string]interface{}{"qname": "health.internal", "expect": "10.0.0.2"}),
+		ErrorMatches, "no A answer matching '10.0.0.2'")
+	c.Check(test(map[string]interface{}{"qname": "other.internal"}), ErrorMatches, "unexpected rcode NXDOMAIN")
+
+	for _, config := range []map[string]interface{}{
+		{"type": "dns"},
+		{"type": "dns", "qname": "health.internal", "qtype": "BOGUS"},
+		{"type": "dns", "qname": "health.internal", "port": 0.0},
+	} {
+		_, err := NewFromMap(config)
+		c.Check(err, NotNil, Commentf("config %v", config))
+	}
+}
+
+func (s *HealthSuite) TestExternal(c *C) {
+	ip := net.ParseIP("192.0.2.1")
+
+	t, err := NewFromMap(map[string]interface{}{"type": "external", "source": "test", "stale": "1m"})
+	c.Assert(err, IsNil)
+	c.Check(t.Frequency, Equals, externalFrequency)
+	c.Check(t.Retries, Equals, externalRetries)
+	c.Check(t.tester.String(), Equals, "external/test")
+
+	c.Check(t.tester.Test(ip, time.Second), ErrorMatches, "no external health state")
+	c.Assert(SetExternal("test", map[string]bool{"192.0.2.1": false}, time.Now()), IsNil)
+	c.Check(t.tester.Test(ip, time.Second), ErrorMatches, "unhealthy")
+	c.Assert(SetExternal("test", map[string]bool{"192.0.2.1": true}, time.Now()), IsNil)
+	c.Check(t.tester.Test(ip, time.Second), IsNil)
+	c.Assert(SetExternal("test", map[string]bool{"192.0.2.1": true}, time.Now().Add(-2*time.Minute)), IsNil)
+	c.Check(t.tester.Test(ip, time.Second), ErrorMatches, "external health state not updated .*")
+
+	// other sources are separate
+	c.Assert(SetExternal("", map[string]bool{"192.0.2.1": true}, time.Now()), IsNil)
+	c.Check(t.tester.Test(ip, time.Second), NotNil)
+
+	c.Check(SetExternal("test", map[string]bool{"www": true}, time.Now()), NotNil)
+
+	_, err = NewFromMap(map[string]interface{}{"type": "external", "stale": "0s"})
+	c.Check(err, NotNil)
+	_, err = NewFromMap(map[string]interface{}{"type": "external", "source": "a", "url": "http://localhost/"})
+	c.Check(err, NotNil)
+
+	polls := 0
+	body := `{"192.0.2.1": true, "192.0.2.2": false}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		io.WriteString(w, body)
+	}))
+	defer ts.Close()
+
+	t, err = NewFromMap(map[string]interface{}{"type": "external", "url": ts.URL, "poll": "1h", "retries": 2.0})
+	c.Assert(err, IsNil)
+	c.Check(t.Retries, Equals, 2)
+	c.Check(t.tester.Test(ip, time.Second), IsNil)
+	c.Check(t.tester.Test(net.ParseIP("192.0.2.2"), time.Second), ErrorMatches, "unhealthy")
+	c.Check(t.tester.Test(net.ParseIP("192.0.2.3"), time.Second), ErrorMatches, "no external health state")
+	c.Check(polls, Equals, 1)
+
+	// a failed poll keeps the last states
+	body = "nope"
+	t.tester.(*externalTester).polled = time.Time{}
+	c.Check(t.tester.Test(ip, time.Second), IsNil)
+	c.Check(polls, Equals, 2)
+}
+
+func (s *HealthSuite) TestImport(c *C) {
+	tmpl, err := NewFromMap(map[string]interface{}{"type": "tcp", "port": 80.0, "retries": 1.0, "frequency": "1h"})
+	c.Assert(err, IsNil)
+	now := time.Now()
+
+	r := NewRunner()
+	running := tmpl.Copy(net.ParseIP("127.0.0.1"))
+	flap := &flapTester{down: true}
+	running.tester = flap
+	r.Add("example.com/www/A/127.0.0.1", running)
+	for i := 0; i < 100 && running.IsHealthy(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(running.IsHealthy(), Equals, false)
+	states := r.Export()
+	c.Assert(states, HasLen, 1)
+	c.Check(states["example.com/www/A/127.0.0.1"].Healthy, Equals, false)
+	r.Remove("example.com/www/A/127.0.0.1")
+
+	// a new test starts with the imported state, without checking
+	// right away
+	n := NewRunner()
+	n.Import(states, time.Hour, now)
+	t := tmpl.Copy(net.ParseIP("127.0.0.1"))
+	t.tester = &flapTester{}
+	n.Add("example.com/www/A/127.0.0.1", t)
+	defer n.Remove("example.com/www/A/127.0.0.1")
+	c.Check(t.IsHealthy(), Equals, false)
+	c.Check(t.Status().Transitions, Equals, 1)
+	c.Check(t.firstCheck() < time.Hour, Equals, true)
+
+	// until it's checked
+	t.Check()
+	c.Check(t.IsHealthy(), Equals, true)
+
+	// imported states expire if they aren't confirmed in time
+	t2 := tmpl.Copy(net.ParseIP("127.0.0.2"))
+	t2.tester = &flapTester{}
+	n.Add("example.com/www/A/127.0.0.2", t2)
+	defer n.Remove("example.com/www/A/127.0.0.2")
+	n.Import(map[string]Status{"example.com/www/A/127.0.0.2": {Healthy: false}}, time.Hour, now.Add(-2*time.Hour))
+	c.Check(t2.IsHealthy(), Equals, true)
+	c.Check(t2.Status().Healthy, Equals, true)
+
+	// and aren't used by the tests started after they expired
+	n.Import(map[string]Status{"example.com/www/A/127.0.0.3": {Healthy: false}}, time.Minute, now.Add(-time.Hour))
+	t3 := tmpl.Copy(net.ParseIP("127.0.0.3"))
+	t3.tester = &flapTester{}
+	n.Add("example.com/www/A/127.0.0.3", t3)
+	defer n.Remove("example.com/www/A/127.0.0.3")
+	c.Check(t3.IsHealthy(), Equals, true)
+}
@@ -0,0 +1,161 @@
+package health
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterType("http", newHTTPTester)
+	RegisterType("https", newHTTPTester)
+}
+
+// maxBodySize is how much of the response is read for expect_body
+const maxBodySize = 64 * 1024
+
+// httpTester makes a GET request to the record IP and checks the
+// response status and optionally the body.
+type httpTester struct {
+	scheme       string
+	port         int
+	path         string
+	host         string
+	expectStatus []int
+	expectBody   *regexp.Regexp
+
+	transport *http.Transport
+}
+
+func newHTTPTester(config map[string]interface{}) (Tester, error) {
+	t := &httpTester{
+		scheme:       config["type"].(string),
+		path:         "/",
+		expectStatus: []int{http.StatusOK},
+	}
+
+	if t.scheme == "https" {
+		t.port = 443
+	} else {
+		t.port = 80
+	}
+
+	var err error
+
+	if v, ok := config["port"]; ok {
+		t.port, err = configInt(v)
+		if err != nil || t.port < 1 || t.port > 65535 {
+			return nil, fmt.Errorf("invalid http health check port '%v'", v)
+		}
+	}
+	if v, ok := config["path"].(string); ok {
+		if !strings.HasPrefix(v, "/") {
+			v = "/" + v
+		}
+		t.path = v
+	}
+	if v, ok := config["host"].(string); ok {
+		t.host = v
+	}
+	if v, ok := config["expect_status"]; ok {
+		t.expectStatus = nil
+		switch v := v.(type) {
+		case []interface{}:
+			for _, s := range v {
+				status, err := configInt(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid http health check status '%v'", s)
+				}
+				t.expectStatus = append(t.expectStatus, status)
+			}
+		default:
+			status, err := configInt(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid http health check status '%v'", v)
+			}
+			t.expectStatus = append(t.expectStatus, status)
+		}
+	}
+	if v, ok := config["expect_body"].(string); ok {
+		t.expectBody, err = regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http health check expect_body: %s", err)
+		}
+	}
+
+	tlsConfig := &tls.Config{ServerName: t.host}
+	if v, ok := config["sni"].(string); ok {
+		tlsConfig.ServerName = v
+	}
+	if v, ok := config["skip_verify"].(bool); ok {
+		tlsConfig.InsecureSkipVerify = v
+	}
+
+	t.transport = &http.Transport{
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: true,
+	}
+
+	return t, nil
+}
+
+func (t *httpTester) Test(ip net.IP, timeout time.Duration) error {
+	// connect to the record IP; the Host header is set separately
+	url := t.scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(t.port)) + t.path
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if len(t.host) > 0 {
+		req.Host = t.host
+	}
+
+	client := &http.Client{
+		Transport: t.transport,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	statusOk := false
+	for _, s := range t.expectStatus {
+		if resp.StatusCode == s {
+			statusOk = true
+			break
+		}
+	}
+	if !statusOk {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if t.expectBody != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+		if err != nil {
+			return err
+		}
+		if !t.expectBody.Match(body) {
+			return fmt.Errorf("body didn't match '%s'", t.expectBody)
+		}
+	}
+
+	return nil
+}
+
+func (t *httpTester) String() string {
+	return fmt.Sprintf("%s/%d%s", t.scheme, t.port, t.path)
+}
@@ -0,0 +1,75 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// Runner keeps track of the running health tests by a reference
+// string (for example "zone/label/qtype/ip").
+type Runner struct {
+	mu    sync.RWMutex
+	tests map[string]*HealthTest
+
+	// the states from Import for the tests that aren't running yet
+	imported map[string]importedState
+}
+
+// TestRunner runs the health tests for all the zones.
+var TestRunner = NewRunner()
+
+// NewRunner returns a new Runner.
+func NewRunner() *Runner {
+	return &Runner{tests: make(map[string]*HealthTest)}
+}
+
+// Add starts running the test with the reference. A test already
+// running with the reference is stopped first; a new test starts with
+// the state imported for the reference, if there's one.
+func (r *Runner) Add(ref string, t *HealthTest) {
+	r.mu.Lock()
+	old := r.tests[ref]
+	r.tests[ref] = t
+	imported, ok := r.imported[ref]
+	delete(r.imported, ref)
+	r.mu.Unlock()
+
+	if old != nil && old != t {
+		old.stop()
+	}
+	if old == nil && ok && time.Now().Before(imported.expires) {
+		t.importState(imported.status, imported.expires)
+	}
+	if old != t {
+		t.start()
+	}
+}
+
+// Remove stops the test with the reference.
+func (r *Runner) Remove(ref string) {
+	r.mu.Lock()
+	t := r.tests[ref]
+	delete(r.tests, ref)
+	r.mu.Unlock()
+
+	if t != nil {
+		t.stop()
+	}
+}
+
+// Get returns the running test with the reference, or nil.
+func (r *Runner) Get(ref string) *HealthTest {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tests[ref]
+}
+
+// IsHealthy returns false if the test with the reference is running
+// and currently failing.
+func (r *Runner) IsHealthy(ref string) bool {
+	t := r.Get(ref)
+	if t == nil {
+		return true
+	}
+	return t.IsHealthy()
+}
@@ -0,0 +1,95 @@
+package health
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// defaultImportWindow is how long an imported state is used without
+// being confirmed by a check.
+const defaultImportWindow = 5 * time.Minute
+
+// importedState is a state from Import for a test that isn't running
+// yet.
+type importedState struct {
+	status  Status
+	expires time.Time
+}
+
+// Export returns the state of the running tests by reference, for
+// Import on another server (or after a restart).
+func (r *Runner) Export() map[string]Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	states := make(map[string]Status, len(r.tests))
+	for ref, t := range r.tests {
+		states[ref] = t.Status()
+	}
+	return states
+}
+
+// Import sets the state of the tests by reference. The running tests
+// get the state right away; the tests started later within the window
+// (when their zone is loaded) start with it instead of as healthy, with
+// their first checks spread over the frequency rather than all at once.
+// An imported state that isn't confirmed by a check within the window
+// (default 5 minutes) expires, and the test is healthy until it's
+// checked.
+func (r *Runner) Import(states map[string]Status, window time.Duration, now time.Time) {
+	if window <= 0 {
+		window = defaultImportWindow
+	}
+	expires := now.Add(window)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.imported == nil {
+		r.imported = map[string]importedState{}
+	}
+	for ref, s := range r.imported {
+		if now.After(s.expires) {
+			delete(r.imported, ref)
+		}
+	}
+	for ref, s := range states {
+		if t := r.tests[ref]; t != nil {
+			t.importState(s, expires)
+			continue
+		}
+		r.imported[ref] = importedState{status: s, expires: expires}
+	}
+}
+
+// importState sets the state of the test until expires, or until it's
+// checked.
+func (t *HealthTest) importState(s Status, expires time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy, t.failures, t.lastCheck = s.Healthy, s.Failures, s.LastCheck
+	t.since, t.transitions = s.Since, s.Transitions
+	t.lastError = nil
+	if len(s.LastError) > 0 {
+		t.lastError = errors.New(s.LastError)
+	}
+	t.imported = expires
+}
+
+// importExpired returns true if the state of the test was imported and
+// wasn't confirmed by a check before it expired.
+func (t *HealthTest) importExpired(now time.Time) bool {
+	return !t.imported.IsZero() && now.After(t.imported)
+}
+
+// firstCheck returns the delay before the first check: up to the
+// Jitter, or up to the Frequency if the state was imported so the
+// checks of a server starting with imported states are spread out.
+func (t *HealthTest) firstCheck() time.Duration {
+	t.mu.RLock()
+	imported := !t.imported.IsZero()
+	t.mu.RUnlock()
+	if imported && t.Frequency > 0 {
+		return time.Duration(rand.Int63n(int64(t.Frequency)))
+	}
+	return t.jitter()
+}
@@ -0,0 +1,42 @@
+package health
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+func init() {
+	RegisterType("tcp", newTCPTester)
+}
+
+// tcpTester checks that a TCP connection can be opened to the port.
+type tcpTester struct {
+	port int
+}
+
+func newTCPTester(config map[string]interface{}) (Tester, error) {
+	v, ok := config["port"]
+	if !ok {
+		return nil, fmt.Errorf("tcp health check port missing")
+	}
+	port, err := configInt(v)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid tcp health check port '%v'", v)
+	}
+	return &tcpTester{port: port}, nil
+}
+
+func (c *tcpTester) Test(ip net.IP, timeout time.Duration) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(c.port))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *tcpTester) String() string {
+	return fmt.Sprintf("tcp/%d", c.port)
+}
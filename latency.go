@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// latencyMatrix is the cost (for example the round trip time in ms)
+// from the clients of a target to the records of a region, for the
+// labels with the closest option and a latency matrix.
+type latencyMatrix map[string]map[string]float64
+
+// parseLatencyMatrices parses the latency option of the closest zone
+// option, the matrices by name:
+//
+//	{ "rtt": { "europe": { "europe": 10, "north-america": 90 },
+//	           "north-america": { "europe": 90, "north-america": 20 } } }
+func parseLatencyMatrices(v interface{}) (map[string]latencyMatrix, error) {
+	matrices, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("latency must be a map of matrices by name")
+	}
+	result := make(map[string]latencyMatrix, len(matrices))
+	for name, mv := range matrices {
+		rows, ok := mv.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("latency matrix '%s' must be a map of targets", name)
+		}
+		matrix := make(latencyMatrix, len(rows))
+		for from, rv := range rows {
+			costs, ok := rv.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("latency matrix '%s': '%s' must be a map of regions and costs", name, from)
+			}
+			row := make(map[string]float64, len(costs))
+			for to, cv := range costs {
+				cost := valueToFloat(cv)
+				if cost < 0 || math.IsNaN(cost) {
+					return nil, fmt.Errorf("latency matrix '%s': bad cost %v from '%s' to '%s'", name, cv, from, to)
+				}
+				row[to] = cost
+			}
+			matrix[from] = row
+		}
+		result[name] = matrix
+	}
+	return result, nil
+}
+
+// costs returns the costs for the most specific of the client's
+// targets with a row in the matrix, or nil if there isn't one.
+func (lm latencyMatrix) costs(targets []string) map[string]float64 {
+	for _, target := range targets {
+		if row, ok := lm[target]; ok {
+			return row
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ClosestSuite) TestClosestCost(c *C) {
+	berlin := &Location{52.52, 13.40}
+	records := closestRecords(&Location{40.71, -74.01}, &Location{51.51, -0.13},
+		&Location{34.05, -118.24}, &Location{50.11, 8.68})
+	records[1].Region = "lon"
+	records[2].Region = "lax"
+	records[3].Region = "fra"
+
+	ips := func(records Records) []string {
+		r := []string{}
+		for _, record := range records {
+			r = append(r, record.RR.(*dns.A).A.String())
+		}
+		return r
+	}
+
+	// London is farther from Berlin than Frankfurt but has the lower
+	// cost; the records without a cost are ordered by the distance
+	costs := map[string]float64{"lon": 10, "fra": 30}
+	c.Check(ips(records.ClosestCost(costs, berlin, 4)), DeepEquals,
+		[]string{"192.168.1.2", "192.168.1.4", "192.168.1.1", "192.168.1.3"})
+	c.Check(ips(records.ClosestCost(costs, nil, 4)), DeepEquals,
+		[]string{"192.168.1.2", "192.168.1.4", "192.168.1.1", "192.168.1.3"})
+
+	// without costs it's the distance
+	c.Check(ips(records.ClosestCost(nil, berlin, 2)), DeepEquals,
+		[]string{"192.168.1.4", "192.168.1.2"})
+
+	matrix := latencyMatrix{"europe": costs}
+	c.Check(matrix.costs([]string{"de", "europe", "@"}), DeepEquals, costs)
+	c.Check(matrix.costs([]string{"us", "north-america", "@"}), IsNil)
+	c.Check(latencyMatrix(nil).costs([]string{"europe"}), IsNil)
+}
+
+func (s *ConfigSuite) TestLatencyOptions(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(options, data string) (*Zone, error) {
+		return readTestZone(c, dir, "latency.example.net",
+			`{ `+options+` "data": { "": { "ns": [ "ns1.example.net" ] }, `+data+` } }`)
+	}
+
+	options := `"closest": { "latency": { "rtt": { "europe": { "lon": 10, "fra": 30 } } } },`
+	z, err := readZone(options, `"www": { "closest": true, "latency": "rtt",
+		"a": [ { "ip": "192.0.2.1", "region": "lon" }, [ "192.0.2.2" ] ] }`)
+	c.Assert(err, IsNil)
+	c.Check(z.Options.Latency["rtt"], DeepEquals, latencyMatrix{"europe": {"lon": 10, "fra": 30}})
+	label := z.Labels["www"]
+	c.Check(label.Latency, DeepEquals, z.Options.Latency["rtt"])
+	c.Check(label.Records[dns.TypeA][0].Region, Equals, "lon")
+	c.Check(label.Records[dns.TypeA][1].Region, Equals, "")
+
+	for _, bad := range []string{
+		`"closest": { "latency": [ "rtt" ] },`,
+		`"closest": { "latency": { "rtt": { "europe": 10 } } },`,
+		`"closest": { "latency": { "rtt": { "europe": { "lon": -1 } } } },`,
+		`"closest": { "mode": "blend", "latency": { "rtt": { "europe": { "lon": 10 } } } },`,
+	} {
+		_, err = readZone(bad, `"www": { "a": [ [ "192.0.2.1" ] ] }`)
+		c.Check(err, ErrorMatches, "Bad closest latency.*", Commentf(bad))
+	}
+	for _, data := range []string{
+		`"www": { "closest": true, "latency": "ping", "a": [ [ "192.0.2.1" ] ] }`,
+		`"www": { "mx": [ { "mx": "mx.example.net", "region": "lon" } ] }`,
+	} {
+		_, err = readZone(options, data)
+		c.Check(err, NotNil, Commentf(data))
+	}
+}
+
+func (s *ServeSuite) TestServingClosestLatency(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// the clients are in Berlin and Munich
+	overrides := dir + "/overrides.json"
+	c.Assert(ioutil.WriteFile(overrides, []byte(`{
+		"192.0.2.0/24": { "country": "de", "latitude": 52.52, "longitude": 13.40 },
+		"203.0.113.0/24": { "country": "de", "latitude": 48.14, "longitude": 11.58 }
+	}`), 0644), IsNil)
+	p, err := newGeoProvider("override:" + overrides)
+	c.Assert(err, IsNil)
+	saved := geoIP.providers
+	geoIP.providers = []geoProvider{p}
+	defer func() { geoIP.providers = saved }()
+
+	zones := make(Zones)
+	srv := Server{}
+	data := `{"target_overrides": {"192.0.2.0/24": "europe", "203.0.113.0/24": "asia"},
+		"closest": {"latency": {"rtt": {"europe": {"lon": 10, "fra": 30}}}},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"closest": true, "latency": "rtt", "max_hosts": 1, "a": [
+			{"ip": "198.51.100.1", "region": "fra", "location": {"latitude": 50.11, "longitude": 8.68}},
+			{"ip": "198.51.100.2", "region": "lon", "location": {"latitude": 51.51, "longitude": -0.13}}]}}}`
+	fileName := writeTestZone(c, dir, "latency.example.net", data)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	// the matrix has London faster from europe than the nearer Frankfurt
+	r := exchangeSubnet(c, "www.latency.example.net.", dns.TypeA, "192.0.2.10")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "198.51.100.2")
+
+	// without a row for the client's targets it's the nearest
+	r = exchangeSubnet(c, "www.latency.example.net.", dns.TypeA, "203.0.113.10")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "198.51.100.1")
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"os"
 	"time"
+
+	"github.com/abh/geodns/querylog"
 )
 
 type logToFile struct {
@@ -34,6 +37,17 @@ func logPrintln(a ...interface{}) {
 	}
 }
 
+// logQuery writes the query log entry as a JSON line in the log, for
+// zones with query logging.
+func logQuery(e *querylog.Entry) {
+	js, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Could not encode query log entry: %s", err)
+		return
+	}
+	log.Printf("query %s", js)
+}
+
 func logToFileMonitor() {
 	for {
 		select {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// maintenance is the "maintenance" zone option: while it's active the
+// names in the zone are answered with the records of a fixed label,
+// without targeting and health checks, for example to send all the
+// traffic to a status page. It's switched on and off with the admin
+// API, so it doesn't need a change to the zone file.
+type maintenance struct {
+	labelName string
+	ttl       int
+
+	// the names answered from the label, or all the names in the
+	// zone if it's nil
+	names map[string]bool
+
+	// the records served, a copy of the configured label without
+	// health checks and with the maintenance TTL
+	label *Label
+
+	active int32 // accessed atomically
+	// set when the admin API changed active, so a reload of the zone
+	// file doesn't change it back
+	toggled int32
+}
+
+// parseMaintenance parses the "maintenance" zone option:
+//
+//	{ "label": "maintenance", "labels": ["", "www"], "ttl": 30, "active": false }
+func parseMaintenance(m map[string]interface{}) (*maintenance, error) {
+	mt := &maintenance{ttl: 30}
+	for k, v := range m {
+		switch k {
+		case "label":
+			mt.labelName = strings.ToLower(valueToString(v))
+		case "labels":
+			mt.names = map[string]bool{}
+			for _, name := range valueToStrings(v) {
+				name = strings.ToLower(name)
+				if name == "@" {
+					name = ""
+				}
+				mt.names[name] = true
+			}
+		case "ttl":
+			mt.ttl = valueToInt(v)
+			if mt.ttl <= 0 {
+				return nil, fmt.Errorf("Bad maintenance ttl %v", v)
+			}
+		case "active":
+			if valueToBool(v) {
+				mt.active = 1
+			}
+		default:
+			return nil, fmt.Errorf("Unknown maintenance option '%s'", k)
+		}
+	}
+	if len(mt.labelName) == 0 {
+		return nil, fmt.Errorf("maintenance needs a label with the records")
+	}
+	return mt, nil
+}
+
+// setup makes the label served during maintenance from the label in
+// the zone data.
+func (mt *maintenance) setup(z *Zone) error {
+	for name := range mt.names {
+		if !z.nameExists(name) {
+			return fmt.Errorf("maintenance label '%s' isn't in the zone", name)
+		}
+	}
+	z.RLock()
+	label, ok := z.Labels[mt.labelName]
+	z.RUnlock()
+	if !ok {
+		return fmt.Errorf("maintenance label '%s' isn't in the zone", mt.labelName)
+	}
+
+	ml := &Label{
+		Label:    label.Label,
+		MaxHosts: label.MaxHosts,
+		Ttl:      mt.ttl,
+		Records:  make(map[uint16]Records, len(label.Records)),
+		Weight:   make(map[uint16]int, len(label.Weight)),
+	}
+	for qtype, records := range label.Records {
+		rs := make(Records, len(records))
+		for i, r := range records {
+			rs[i] = Record{RR: dns.Copy(r.RR), Weight: r.Weight, Ttl: mt.ttl, Loc: r.Loc, Region: r.Region, Meta: r.Meta}
+			rs[i].RR.Header().Ttl = uint32(mt.ttl)
+		}
+		ml.Records[qtype] = rs
+		ml.Weight[qtype] = label.Weight[qtype]
+	}
+	mt.label = ml
+	return nil
+}
+
+// isActive returns true if the zone is in maintenance.
+func (mt *maintenance) isActive() bool {
+	return mt != nil && atomic.LoadInt32(&mt.active) == 1
+}
+
+// setActive switches the maintenance mode on or off.
+func (mt *maintenance) setActive(active bool) {
+	var v int32
+	if active {
+		v = 1
+	}
+	atomic.StoreInt32(&mt.active, v)
+	atomic.StoreInt32(&mt.toggled, 1)
+}
+
+// lookup returns the maintenance label and the qtype found in it if
+// the zone is in maintenance and the name is answered from it. The
+// SOA, NS and DNSKEY records of the zone are still served as usual.
+func (mt *maintenance) lookup(z *Zone, s string, qts qTypes) (*Label, uint16, bool) {
+	if !mt.isActive() {
+		return nil, 0, false
+	}
+	if mt.names == nil {
+		if !z.nameExists(s) {
+			return nil, 0, false
+		}
+	} else if !mt.names[s] {
+		base, ok := targetLabelBase(s)
+		if !ok || !mt.names[base] {
+			return nil, 0, false
+		}
+	}
+	for _, qtype := range qts {
+		switch qtype {
+		case dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY:
+			if len(s) == 0 {
+				return nil, 0, false
+			}
+		}
+	}
+	for _, qtype := range qts {
+		if qtype == dns.TypeANY || len(mt.label.Records[qtype]) > 0 {
+			return mt.label, qtype, true
+		}
+	}
+	return mt.label, 0, true
+}
+
+// setupMaintenance keeps the maintenance mode set with the admin API
+// when the zone is reloaded.
+func (z *Zone) setupMaintenance(old *Zone) {
+	mt := z.Options.Maintenance
+	if mt == nil || old == nil || old.Options.Maintenance == nil {
+		return
+	}
+	if atomic.LoadInt32(&old.Options.Maintenance.toggled) == 1 {
+		mt.setActive(old.Options.Maintenance.isActive())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestMaintenanceOptions(c *C) {
+	_, err := parseMaintenance(map[string]interface{}{"ttl": 30.0})
+	c.Check(err, NotNil)
+	_, err = parseMaintenance(map[string]interface{}{"label": "status", "ttl": 0.0})
+	c.Check(err, NotNil)
+	_, err = parseMaintenance(map[string]interface{}{"label": "status", "names": []interface{}{"www"}})
+	c.Check(err, NotNil)
+
+	mt, err := parseMaintenance(map[string]interface{}{"label": "Status", "labels": []interface{}{"@", "WWW"}, "active": true})
+	c.Assert(err, IsNil)
+	c.Check(mt.labelName, Equals, "status")
+	c.Check(mt.names, DeepEquals, map[string]bool{"": true, "www": true})
+	c.Check(mt.ttl, Equals, 30)
+	c.Check(mt.isActive(), Equals, true)
+
+	var nilMt *maintenance
+	c.Check(nilMt.isActive(), Equals, false)
+}
+
+func (s *ServeSuite) TestServingMaintenance(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/maint.example.net.json"
+	data := `{"maintenance": {"label": "status", "ttl": 20},
+		"target_overrides": {"192.0.2.0/24": "europe"},
+		"data": {"": {"ns": ["ns1.example.net"], "a": [["192.0.2.1", 0]]},
+		"www": {"a": [["192.0.2.2", 0]], "aaaa": [["2001:db8::2", 0]]},
+		"www.europe": {"a": [["192.0.2.3", 0]]},
+		"status": {"a": [["198.51.100.1", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	r := exchangeSubnet(c, "www.maint.example.net.", dns.TypeA, "192.0.2.10")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.3")
+
+	h := newAdminHandler(zones, new(sync.Mutex), nil)
+	setMaintenance := func(active string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/SetMaintenance?origin=maint.example.net&active="+active, nil))
+		return w.Code
+	}
+	c.Check(setMaintenance("maybe"), Equals, http.StatusBadRequest)
+	c.Assert(setMaintenance("true"), Equals, http.StatusOK)
+
+	var az adminZone
+	c.Assert(adminRequest(c, h, "/v1/GetZone?origin=maint.example.net", &az), Equals, http.StatusOK)
+	c.Assert(az.Maintenance, NotNil)
+	c.Check(*az.Maintenance, Equals, true)
+
+	// the targeted and the apex names get the maintenance records
+	for _, name := range []string{"www.maint.example.net.", "maint.example.net.", "www.europe.maint.example.net."} {
+		r = exchangeSubnet(c, name, dns.TypeA, "192.0.2.10")
+		c.Assert(r.Answer, HasLen, 1, Commentf(name))
+		c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "198.51.100.1")
+		c.Check(r.Answer[0].Header().Name, Equals, name)
+		c.Check(r.Answer[0].Header().Ttl, Equals, uint32(20))
+	}
+	r = exchange(c, "www.maint.example.net.", dns.TypeAAAA)
+	c.Check(r.Answer, HasLen, 0)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	r = exchange(c, "nope.maint.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	r = exchange(c, "maint.example.net.", dns.TypeNS)
+	c.Check(r.Answer, HasLen, 1)
+
+	c.Check(zones["maint.example.net"].Metrics.Maintenance.Count(), Equals, int64(4))
+
+	// the mode set with the API is kept when the zone is reloaded
+	c.Assert(ioutil.WriteFile(fileName, []byte(data+" "), 0644), IsNil)
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(fileName, future, future), IsNil)
+	old := zones["maint.example.net"]
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	c.Assert(zones["maint.example.net"], Not(Equals), old)
+	r = exchange(c, "www.maint.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "198.51.100.1")
+
+	c.Assert(setMaintenance("false"), Equals, http.StatusOK)
+	r = exchange(c, "www.maint.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.2")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/SetMaintenance?origin=maint.example.net&active=true", nil))
+	c.Check(w.Code, Equals, http.StatusMethodNotAllowed)
+}
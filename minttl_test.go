@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestMinTTLOption(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(options string) (*Zone, error) {
+		return readTestZone(c, dir, "minttl.example.net",
+			`{ `+options+` "data": { "": { "ns": [ "ns1.example.net" ] } } }`)
+	}
+
+	z, err := readZone(`"min_ttl": 60, "ttl_jitter": { "percent": 10, "floor": 30 },`)
+	c.Assert(err, IsNil)
+	c.Check(z.Options.MinTTL, Equals, 60)
+	// the jitter doesn't lower the TTLs below min_ttl
+	c.Check(z.Options.TTLJitter.floor, Equals, uint32(60))
+
+	_, err = readZone(`"min_ttl": -1,`)
+	c.Check(err, NotNil)
+}
+
+func (s *ServeSuite) TestServingMinTTL(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	data := `{"min_ttl": 60, "minimum": 10,
+		"data": {"": {"ns": ["ns1.example.net"]},
+			"fast": {"a": [["192.0.2.1", 0]], "ttl": 1},
+			"slow": {"a": [["192.0.2.2", 0]], "ttl": 600}}}`
+	fileName := writeTestZone(c, dir, "minttl.example.net", data)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	r := exchange(c, "fast.minttl.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(60))
+
+	r = exchange(c, "slow.minttl.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(600))
+
+	// the zone's records aren't changed
+	label := zones["minttl.example.net"].Labels["fast"]
+	c.Check(label.Records[dns.TypeA][0].RR.Header().Ttl, Equals, uint32(1))
+
+	// the SOA of negative answers keeps the SOA minimum
+	r = exchange(c, "fast.minttl.example.net.", dns.TypeAAAA)
+	c.Assert(r.Answer, HasLen, 0)
+	c.Assert(r.Ns, HasLen, 1)
+	c.Check(r.Ns[0].Header().Ttl, Equals, uint32(10))
+}
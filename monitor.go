@@ -13,8 +13,11 @@ import (
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/abh/geodns/exporter"
 	"github.com/rcrowley/go-metrics"
 	"golang.org/x/net/websocket"
 )
@@ -159,13 +162,13 @@ func initialStatus() string {
 	return string(message)
 }
 
-func monitor(zones Zones) {
+func monitor(zones Zones, mu sync.Locker) {
 
 	if len(*flaghttp) == 0 {
 		return
 	}
 	go hub.run()
-	go httpHandler(zones)
+	go httpHandler(zones, mu)
 
 	qCounter := metrics.Get("queries").(metrics.Meter)
 	lastQueryCount := qCounter.Count()
@@ -269,16 +272,18 @@ func topParam(req *http.Request, def int) int {
 	return topOption
 }
 
-func StatusJSONHandler(zones Zones) func(http.ResponseWriter, *http.Request) {
+func StatusJSONHandler(zones Zones, mu sync.Locker) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 
 		zonemetrics := make(map[string]metrics.Registry)
 
+		mu.Lock()
 		for name, zone := range zones {
 			zone.Lock()
 			zonemetrics[name] = zone.Metrics.Registry
 			zone.Unlock()
 		}
+		mu.Unlock()
 
 		type statusData struct {
 			Version   string
@@ -319,7 +324,43 @@ func StatusJSONHandler(zones Zones) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func StatusHandler(zones Zones) func(http.ResponseWriter, *http.Request) {
+// HealthJSONHandler returns the health check state for the zone (and
+// optionally label) in the query parameters. mu is held while the zone
+// is looked up, as the zones are added and removed while the server is
+// running.
+func HealthJSONHandler(zones Zones, mu sync.Locker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("zone")
+		mu.Lock()
+		zone, ok := zones[name]
+		mu.Unlock()
+		if !ok {
+			http.Error(w, "Zone not found", 404)
+			return
+		}
+
+		label := req.URL.Query().Get("label")
+		if len(label) > 0 {
+			zone.RLock()
+			_, ok = zone.Labels[label]
+			zone.RUnlock()
+			if !ok {
+				http.Error(w, "Label not found", 404)
+				return
+			}
+		}
+
+		b, err := json.Marshal(zone.HealthStatus(label))
+		if err != nil {
+			http.Error(w, "Error encoding JSON", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+func StatusHandler(zones Zones, mu sync.Locker) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, req *http.Request) {
 
@@ -327,6 +368,7 @@ func StatusHandler(zones Zones) func(http.ResponseWriter, *http.Request) {
 
 		rates := make(Rates, 0)
 
+		mu.Lock()
 		for name, zone := range zones {
 			count := zone.Metrics.Queries.Count()
 			rates = append(rates, &rate{
@@ -335,6 +377,7 @@ func StatusHandler(zones Zones) func(http.ResponseWriter, *http.Request) {
 				Metrics: zone.Metrics,
 			})
 		}
+		mu.Unlock()
 
 		sort.Sort(RatesByCount{rates})
 
@@ -386,6 +429,57 @@ func StatusHandler(zones Zones) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// PrometheusHandler exports the metrics of the zones. mu is held while
+// the zones are copied for a scrape, as they're added and removed while
+// the server is running.
+func PrometheusHandler(zones Zones, mu sync.Locker) http.Handler {
+	return exporter.NewHandler(func() []exporter.Zone {
+		mu.Lock()
+		snapshot := make(Zones, len(zones))
+		for name, zone := range zones {
+			snapshot[name] = zone
+		}
+		mu.Unlock()
+
+		list := make([]exporter.Zone, 0, len(snapshot))
+		for name, zone := range snapshot {
+			zone.RLock()
+			ez := exporter.Zone{
+				Name:     name,
+				Registry: zone.Metrics.Registry,
+				Qtypes:   zone.Metrics.Qtypes,
+				Health:   zone.Metrics.Health,
+			}
+			labelStats := zone.Metrics.LabelStats
+			labelLevelStats := zone.Metrics.LabelLevelStats
+			zone.RUnlock()
+
+			if labelStats != nil {
+				ez.Labels = make(map[string]int)
+				for _, l := range labelStats.TopCounts(100) {
+					ez.Labels[l.Label] = l.Count
+				}
+			}
+			if labelLevelStats != nil {
+				ez.LabelLevels = make(map[string]map[string]int)
+				for _, l := range labelLevelStats.TopCounts(100) {
+					// "level label", except for the "Others" count
+					parts := strings.SplitN(l.Label, " ", 2)
+					if len(parts) != 2 {
+						continue
+					}
+					if ez.LabelLevels[parts[1]] == nil {
+						ez.LabelLevels[parts[1]] = make(map[string]int)
+					}
+					ez.LabelLevels[parts[1]][parts[0]] = l.Count
+				}
+			}
+			list = append(list, ez)
+		}
+		return list
+	})
+}
+
 type basicauth struct {
 	h http.Handler
 }
@@ -422,10 +516,12 @@ func (b *basicauth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func httpHandler(zones Zones) {
+func httpHandler(zones Zones, mu sync.Locker) {
 	http.Handle("/monitor", websocket.Handler(wsHandler))
-	http.HandleFunc("/status", StatusHandler(zones))
-	http.HandleFunc("/status.json", StatusJSONHandler(zones))
+	http.HandleFunc("/status", StatusHandler(zones, mu))
+	http.HandleFunc("/status.json", StatusJSONHandler(zones, mu))
+	http.HandleFunc("/health.json", HealthJSONHandler(zones, mu))
+	http.Handle("/metrics", PrometheusHandler(zones, mu))
 	http.HandleFunc("/", MainServer)
 
 	log.Println("Starting HTTP interface on", *flaghttp)
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/abh/geodns/health"
+	"github.com/miekg/dns"
 	. "gopkg.in/check.v1"
 )
 
@@ -31,7 +37,7 @@ func (s *MonitorSuite) SetUpSuite(c *C) {
 
 	srv := Server{}
 	srv.zonesReadDir("dns", s.zones)
-	go httpHandler(s.zones)
+	go httpHandler(s.zones, new(sync.Mutex))
 	time.Sleep(500 * time.Millisecond)
 }
 
@@ -52,4 +58,86 @@ func (s *MonitorSuite) TestMonitorVersion(c *C) {
 	// page has <html>
 	c.Check(isOk, Equals, true)
 
+	res, err = http.Get("http://localhost:8881/metrics")
+	c.Assert(err, IsNil)
+	page, _ = ioutil.ReadAll(res.Body)
+	c.Check(string(page), Matches, `(?s).*# TYPE geodns_zone_queries_total counter\n.*`)
+	c.Check(string(page), Matches, `(?s).*geodns_zone_queries_total\{zone="test.example.com"\} [0-9]+\n.*`)
+
+}
+
+func (s *MonitorSuite) TestHealthJSON(c *C) {
+	label := pickerLabel(10, 10)
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	label.Records[dns.TypeA][1].Test = label.Records[dns.TypeA][0].Test.Copy(net.ParseIP("192.168.1.2"))
+	label.Records[dns.TypeA][0].Meta = map[string]string{"node": "fra-1"}
+
+	z := NewZone("example.com")
+	z.Labels["www"] = label
+	mu := new(sync.Mutex)
+	handler := HealthJSONHandler(Zones{"example.com": z}, mu)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/health.json?zone=example.com&label=www", nil))
+	c.Assert(w.Code, Equals, 200)
+
+	var status map[string]map[string]map[string]health.Status
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &status), IsNil)
+	c.Check(status["www"]["A"]["192.168.1.1"].Healthy, Equals, false)
+	c.Check(status["www"]["A"]["192.168.1.1"].Failures, Equals, 1)
+	c.Check(status["www"]["A"]["192.168.1.1"].LastError, Equals, "down")
+	c.Check(status["www"]["A"]["192.168.1.1"].Meta, DeepEquals, map[string]string{"node": "fra-1"})
+	c.Check(status["www"]["A"]["192.168.1.2"].Meta, IsNil)
+	c.Check(status["www"]["A"]["192.168.1.2"].Healthy, Equals, true)
+	c.Check(status["www"]["A"]["192.168.1.2"].LastCheck.IsZero(), Equals, true)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/health.json?zone=example.com&label=nope", nil))
+	c.Check(w.Code, Equals, 404)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/health.json?zone=example.net", nil))
+	c.Check(w.Code, Equals, 404)
+
+	// the zone is looked up with the zones lock
+	mu.Lock()
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/health.json?zone=example.com", nil))
+		done <- w.Code
+	}()
+	select {
+	case <-done:
+		c.Fatal("the zone was looked up without the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Unlock()
+	c.Check(<-done, Equals, 200)
+}
+
+func (s *MonitorSuite) TestPrometheusZonesLock(c *C) {
+	z := NewZone("example.com")
+	z.SetupMetrics(nil)
+	defer z.Close()
+	zones := Zones{}
+	mu := new(sync.Mutex)
+	handler := PrometheusHandler(zones, mu)
+
+	// the zones are listed with the lock held, so a zone added while
+	// it's held is in the scrape
+	mu.Lock()
+	done := make(chan string)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		done <- w.Body.String()
+	}()
+	select {
+	case <-done:
+		c.Fatal("the zones were listed without the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	zones["example.com"] = z
+	mu.Unlock()
+	c.Check(<-done, Matches, `(?s).*geodns_zone_queries_total\{zone="example.com"\} 0\n.*`)
 }
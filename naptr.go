@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseNAPTR parses a NAPTR record (RFC 3403) in the object syntax:
+//
+//	{ "order": 100, "preference": 10, "flags": "u", "service": "E2U+sip",
+//	  "regexp": "!^.*$!sip:info@example.com!" }
+func parseNAPTR(rec map[string]interface{}, h dns.RR_Header, origin string) (*dns.NAPTR, error) {
+	rr := &dns.NAPTR{Hdr: h, Replacement: "."}
+
+	for _, k := range []string{"order", "preference"} {
+		if rec[k] == nil {
+			continue
+		}
+		n := valueToInt(rec[k])
+		if n < 0 || n > 65535 {
+			return nil, fmt.Errorf("bad %s %d", k, n)
+		}
+		if k == "order" {
+			rr.Order = uint16(n)
+		} else {
+			rr.Preference = uint16(n)
+		}
+	}
+
+	for _, k := range []string{"flags", "service", "regexp", "replacement"} {
+		if rec[k] == nil {
+			continue
+		}
+		s, ok := rec[k].(string)
+		if !ok {
+			return nil, fmt.Errorf("bad %s %v", k, rec[k])
+		}
+		if len(s) > 255 {
+			return nil, fmt.Errorf("%s is longer than 255 characters", k)
+		}
+		switch k {
+		case "flags":
+			for _, c := range s {
+				if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+					return nil, fmt.Errorf("bad flags '%s'", s)
+				}
+			}
+			rr.Flags = s
+		case "service":
+			rr.Service = escapeCharString(s)
+		case "regexp":
+			if err := checkNAPTRRegexp(s); err != nil {
+				return nil, fmt.Errorf("bad regexp '%s': %s", s, err)
+			}
+			rr.Regexp = escapeCharString(s)
+		case "replacement":
+			if len(s) > 0 && s != "." {
+				if !dns.IsFqdn(s) {
+					s = s + "." + origin
+				}
+				if _, ok := dns.IsDomainName(s); !ok {
+					return nil, fmt.Errorf("bad replacement '%s'", s)
+				}
+				rr.Replacement = dns.Fqdn(s)
+			}
+		}
+	}
+
+	if len(rr.Regexp) > 0 && rr.Replacement != "." {
+		return nil, fmt.Errorf("regexp and replacement can't both be set")
+	}
+
+	return rr, nil
+}
+
+// escapeCharString escapes the backslashes and quotes in s; the dns
+// package keeps character strings in the presentation format.
+func escapeCharString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// checkNAPTRRegexp checks the syntax of a NAPTR substitution expression
+// (RFC 3402), delim-char ERE delim-char replacement delim-char flags.
+func checkNAPTRRegexp(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	delim := s[0]
+	if delim == '\\' || delim == 'i' || ('0' <= delim && delim <= '9') {
+		return fmt.Errorf("bad delimiter '%c'", delim)
+	}
+
+	// split on the delimiters that aren't escaped
+	var parts []string
+	var part []byte
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			part = append(part, delim)
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			part = append(part, s[i], s[i+1])
+			i++
+		case s[i] == delim:
+			parts = append(parts, string(part))
+			part = nil
+		default:
+			part = append(part, s[i])
+		}
+	}
+	if len(parts) != 2 {
+		return fmt.Errorf("expected 3 delimiters")
+	}
+	if flags := string(part); flags != "" && flags != "i" {
+		return fmt.Errorf("bad flags '%s'", flags)
+	}
+	if len(parts[0]) == 0 {
+		return fmt.Errorf("empty expression")
+	}
+
+	re, err := regexp.CompilePOSIX(parts[0])
+	if err != nil {
+		return err
+	}
+
+	// back references in the replacement must be to a subexpression
+	repl := parts[1]
+	for i := strings.IndexByte(repl, '\\'); i >= 0; i = strings.IndexByte(repl, '\\') {
+		if i+1 == len(repl) {
+			return fmt.Errorf("trailing backslash in the replacement")
+		}
+		if c := repl[i+1]; '1' <= c && c <= '9' && int(c-'0') > re.NumSubexp() {
+			return fmt.Errorf("back reference \\%c without a subexpression", c)
+		}
+		repl = repl[i+2:]
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestNAPTRRegexp(c *C) {
+	for _, re := range []string{
+		"",
+		"!^.*$!sip:info@example.com!",
+		"!^\\+1(.*)$!sip:\\1@example.com!i",
+		"/^(\\+45)([0-9]+)$/sip:\\2@\\1.example.com/",
+		"!^a\\!b$!x!",
+	} {
+		c.Check(checkNAPTRRegexp(re), IsNil, Commentf("regexp %s", re))
+	}
+	for _, re := range []string{
+		"!^.*$!sip:info@example.com",
+		"!^.*$!sip:info@example.com!x",
+		"1^.*$1x1",
+		"\\^.*$\\x\\",
+		"!!x!",
+		"!^(.*$!x!",
+		"!^.*$!sip:\\1@example.com!",
+		"!^(.*)$!sip:\\1\\!",
+	} {
+		c.Check(checkNAPTRRegexp(re), NotNil, Commentf("regexp %s", re))
+	}
+
+	h := dns.RR_Header{Name: "4.3.2.1.example.com.", Rrtype: dns.TypeNAPTR, Class: dns.ClassINET}
+	rr, err := parseNAPTR(map[string]interface{}{
+		"order": 100.0, "preference": 10.0, "flags": "s", "service": "SIP+D2U",
+		"replacement": "_sip._udp",
+	}, h, "example.com")
+	c.Assert(err, IsNil)
+	c.Check(rr.Replacement, Equals, "_sip._udp.example.com.")
+	c.Check(rr.Regexp, Equals, "")
+
+	for _, rec := range []map[string]interface{}{
+		{"order": 70000.0},
+		{"flags": "u!"},
+		{"service": 1.0},
+		{"regexp": "!^.*$!sip:info@example.com!", "replacement": "sip.example.com."},
+		{"regexp": "!^.*$"},
+	} {
+		_, err = parseNAPTR(rec, h, "example.com")
+		c.Check(err, NotNil, Commentf("record %v", rec))
+	}
+}
+
+func (s *ServeSuite) TestServingNAPTR(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	data := `{"target_overrides": {"127.0.0.1": "europe"}, "targeting": "@ continent",
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"4.3.2.1": {"naptr": [
+			{"order": 100, "preference": 10, "flags": "u", "service": "E2U+sip",
+			 "regexp": "!^.*$!sip:info@example.com!"}]},
+		"4.3.2.1.europe": {"naptr": [
+			{"order": 100, "preference": 20, "flags": "s", "service": "SIP+D2U",
+			 "replacement": "_sip._udp.eu"},
+			{"order": 50, "preference": 10, "flags": "u", "service": "E2U+sip",
+			 "regexp": "!^\\+45(.*)$!sip:\\1@eu.example.com!"}]}}}`
+	fileName := dir + "/naptr.example.net.json"
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	// the targeted records, ordered by order and preference
+	r := exchange(c, "4.3.2.1.naptr.example.net.", dns.TypeNAPTR)
+	c.Assert(r.Answer, HasLen, 2)
+	first := r.Answer[0].(*dns.NAPTR)
+	c.Check(first.Order, Equals, uint16(50))
+	c.Check(first.Flags, Equals, "u")
+	c.Check(first.Service, Equals, "E2U+sip")
+	// in the presentation format, with the backslashes escaped
+	c.Check(first.Regexp, Equals, `!^\\+45(.*)$!sip:\\1@eu.example.com!`)
+	c.Check(first.Replacement, Equals, ".")
+	second := r.Answer[1].(*dns.NAPTR)
+	c.Check(second.Preference, Equals, uint16(20))
+	c.Check(second.Replacement, Equals, "_sip._udp.eu.naptr.example.net.")
+
+	// the records are the same in the presentation format
+	for _, rr := range r.Answer {
+		parsed, err := dns.NewRR(rr.String())
+		c.Assert(err, IsNil)
+		c.Check(parsed.String(), Equals, rr.String())
+	}
+
+	z := zones["naptr.example.net"]
+	label, qtype := z.findLabels("4.3.2.1", []string{"@"}, qTypes{dns.TypeNAPTR})
+	c.Check(qtype, Equals, dns.TypeNAPTR)
+	c.Assert(label.Records[dns.TypeNAPTR], HasLen, 1)
+	c.Check(label.Records[dns.TypeNAPTR][0].RR.(*dns.NAPTR).Service, Equals, "E2U+sip")
+
+	// a malformed regexp fails the zone
+	bad := `{"data": {"": {"ns": ["ns1.example.net"]},
+		"4.3.2.1": {"naptr": [{"order": 100, "regexp": "!^(.*$!x!"}]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(bad), 0644), IsNil)
+	_, err = readZoneFile("naptr.example.net", fileName)
+	c.Check(err, ErrorMatches, ".*Bad NAPTR record.*")
+}
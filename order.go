@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OrderPolicy is how the healthy records of a label are picked and
+// ordered for an answer, set with the "order" label option (or the
+// older "closest", "random_n" and "round_robin" options).
+type OrderPolicy int
+
+const (
+	// OrderAuto picks the records by weight if they have weights and
+	// returns them all otherwise, the default
+	OrderAuto OrderPolicy = iota
+	// OrderFixed returns all the records in the order of the zone
+	// (the heaviest first)
+	OrderFixed
+	// OrderRandom returns max_hosts records in random order, ignoring
+	// the weights
+	OrderRandom
+	// OrderWeighted picks max_hosts records randomly by weight (or by
+	// the client with sticky_weight)
+	OrderWeighted
+	// OrderNearest returns the max_hosts records nearest to the client
+	// (or picked by distance with the blend closest mode), for A and
+	// AAAA records; the others and clients with an unknown location
+	// are picked as with OrderAuto
+	OrderNearest
+	// OrderRoundRobin returns max_hosts records starting one record
+	// further along for each query
+	OrderRoundRobin
+	// OrderConsistentHash picks max_hosts records by hashing the query
+	// name, so a name gets the same records for all clients
+	OrderConsistentHash
+)
+
+var orderPolicyNames = map[OrderPolicy]string{
+	OrderAuto:           "auto",
+	OrderFixed:          "fixed",
+	OrderRandom:         "random",
+	OrderWeighted:       "weighted",
+	OrderNearest:        "nearest",
+	OrderRoundRobin:     "round_robin",
+	OrderConsistentHash: "consistent_hash",
+}
+
+func (o OrderPolicy) String() string {
+	if name, ok := orderPolicyNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("OrderPolicy(%d)", int(o))
+}
+
+func parseOrderPolicy(s string) (OrderPolicy, error) {
+	s = strings.ToLower(s)
+	for o, name := range orderPolicyNames {
+		if s == name {
+			return o, nil
+		}
+	}
+	return OrderAuto, fmt.Errorf("unknown order '%s'", s)
+}
+
+// setOrder sets the order policy of the label, returning an error if
+// another option already set a different one.
+func (label *Label) setOrder(o OrderPolicy, option string) error {
+	if label.Order != OrderAuto && label.Order != o {
+		return fmt.Errorf("%s conflicts with the %s order", option, label.Order)
+	}
+	label.Order = o
+	return nil
+}
+
+// orderPolicy returns the policy used for the records of the qtype with
+// the total weight, resolving OrderAuto. OrderNearest is returned for
+// the location record types only.
+func (label *Label) orderPolicy(qtype uint16, weight int) OrderPolicy {
+	order := label.Order
+	if order == OrderNearest && !isLocationQtype(qtype) {
+		order = OrderAuto
+	}
+	if order == OrderAuto {
+		if weight > 0 {
+			return OrderWeighted
+		}
+		return OrderFixed
+	}
+	return order
+}
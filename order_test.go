@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *PickerSuite) TestOrderFixed(c *C) {
+	// all the healthy records, in order, whatever the weights
+	label := pickerLabel(10, 30, 20)
+	label.Order = OrderFixed
+	for i := 0; i < 10; i++ {
+		c.Check(pickerIPs(label.Picker(dns.TypeA, 1, "")), DeepEquals,
+			[]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	}
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	c.Check(pickerIPs(label.Picker(dns.TypeA, 1, "")), DeepEquals, []string{"192.168.1.1", "192.168.1.3"})
+
+	// the default for records without weights
+	label = pickerLabel(0, 0)
+	c.Check(label.orderPolicy(dns.TypeA, 0), Equals, OrderFixed)
+	c.Check(pickerIPs(label.Picker(dns.TypeA, 1, "")), DeepEquals, []string{"192.168.1.1", "192.168.1.2"})
+}
+
+func (s *PickerSuite) TestOrderWeighted(c *C) {
+	label := pickerLabel(10, 0)
+	c.Check(label.orderPolicy(dns.TypeA, 10), Equals, OrderWeighted)
+	for i := 0; i < 10; i++ {
+		c.Check(pickerIPs(label.Picker(dns.TypeA, 2, "")), DeepEquals, []string{"192.168.1.1"})
+	}
+
+	// picked by weight even without weights
+	label = pickerLabel(0, 0, 0)
+	label.Order = OrderWeighted
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 2)
+}
+
+func (s *PickerSuite) TestOrderNearest(c *C) {
+	label := pickerLabel(10, 10, 10)
+	label.Order = OrderNearest
+
+	var got Records
+	nearest := func(records Records, max int) Records {
+		got = records
+		return Records{records[len(records)-1]}
+	}
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	c.Check(pickerIPs(label.Select(dns.TypeA, 2, "", "", nearest)), DeepEquals, []string{"192.168.1.3"})
+	// only the healthy records are ordered by distance
+	c.Check(pickerIPs(got), DeepEquals, []string{"192.168.1.2", "192.168.1.3"})
+
+	// picked by weight when the client location isn't known
+	unknown := func(records Records, max int) Records { return nil }
+	c.Check(label.Select(dns.TypeA, 1, "", "", unknown), HasLen, 1)
+	c.Check(label.Picker(dns.TypeA, 1, ""), HasLen, 1)
+
+	// and for the other record types
+	c.Check(label.orderPolicy(dns.TypeTXT, 10), Equals, OrderWeighted)
+	c.Check(label.orderPolicy(dns.TypeTXT, 0), Equals, OrderFixed)
+}
+
+func (s *ConfigSuite) TestOrderOptions(c *C) {
+	for _, name := range []string{"auto", "fixed", "random", "weighted", "nearest", "round_robin"} {
+		o, err := parseOrderPolicy(name)
+		c.Assert(err, IsNil)
+		c.Check(o.String(), Equals, name)
+	}
+	_, err := parseOrderPolicy("sorted")
+	c.Check(err, NotNil)
+
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	fileName := dir + "/order.example.net.json"
+	readLabel := func(options string) (*Label, error) {
+		data := fmt.Sprintf(`{"data": {"": {"ns": ["ns1.example.net"]},
+			"www": {%s "a": [["192.0.2.1", 10], ["192.0.2.2", 0]]}}}`, options)
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		z, err := readZoneFile("order.example.net", fileName)
+		if err != nil {
+			return nil, err
+		}
+		return z.Labels["www"], nil
+	}
+
+	for options, order := range map[string]OrderPolicy{
+		``:                                       OrderAuto,
+		`"order": "Fixed",`:                      OrderFixed,
+		`"random_n": true,`:                      OrderRandom,
+		`"round_robin": true,`:                   OrderRoundRobin,
+		`"closest": true,`:                       OrderNearest,
+		`"closest": true, "order": "nearest",`:   OrderNearest,
+		`"closest": false, "order": "weighted",`: OrderWeighted,
+	} {
+		label, err := readLabel(options)
+		c.Assert(err, IsNil, Commentf(options))
+		c.Check(label.Order, Equals, order, Commentf(options))
+	}
+
+	for _, options := range []string{
+		`"order": "sorted",`,
+		`"random_n": true, "round_robin": true,`,
+		`"closest": true, "order": "fixed",`,
+	} {
+		_, err := readLabel(options)
+		c.Check(err, NotNil, Commentf(options))
+	}
+}
+
+func pickerIPs(records Records) []string {
+	ips := make([]string, len(records))
+	for i, r := range records {
+		ips[i] = r.RR.(*dns.A).A.String()
+	}
+	return ips
+}
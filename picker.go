@@ -1,18 +1,42 @@
 package main
 
 import (
+	"hash/fnv"
+	"math"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
-func (label *Label) Picker(qtype uint16, max int) Records {
+// Picker returns up to max records of the qtype. If the records are
+// weighted they are picked randomly by weight; if a sticky key (for
+// example the client IP) is specified the same key will consistently
+// get the same records. The nearest order isn't used as there's no
+// client location.
+func (label *Label) Picker(qtype uint16, max int, sticky string) Records {
+	return label.Select(qtype, max, sticky, "", nil)
+}
+
+// nearestFunc returns up to max of the records by their distance to the
+// client, or nil if the client location isn't known.
+type nearestFunc func(records Records, max int) Records
+
+// Select returns the records of the qtype for an answer: the healthy
+// records (or all of them if none are healthy, or the backup records)
+// picked and ordered by the label's order policy. The name queried is
+// the key for the consistent_hash order; without it the records are
+// picked as with the weighted order.
+func (label *Label) Select(qtype uint16, max int, sticky, name string, nearest nearestFunc) Records {
 
 	if qtype == dns.TypeANY {
 		var result []Record
 		for rtype := range label.Records {
 
-			rtypeRecords := label.Picker(rtype, max)
+			rtypeRecords := label.Select(rtype, max, sticky, name, nearest)
 
 			tmpResult := make(Records, len(result)+len(rtypeRecords))
 
@@ -24,45 +48,224 @@ func (label *Label) Picker(qtype uint16, max int) Records {
 		return result
 	}
 
-	if labelRR := label.Records[qtype]; labelRR != nil {
+	labelRR, weight := label.activeRecords(qtype)
+	if labelRR == nil {
+		return nil
+	}
+	healthy := labelRR.Healthy()
+
+	// SRV and NAPTR records have their own ordering for the client to
+	// pick from
+	if selfOrdered(qtype) {
+		return healthy
+	}
+
+	order := label.orderPolicy(qtype, weight)
+	if order == OrderFixed {
+		return healthy
+	}
+
+	if qtype == dns.TypeCNAME {
+		max = 1
+	}
 
-		// not "balanced", just return all
-		if label.Weight[qtype] == 0 {
-			return labelRR
+	switch order {
+	case OrderRandom:
+		return healthy.shuffle(max)
+	case OrderRoundRobin:
+		return healthy.rotate(max, atomic.AddUint32(&label.rotation, 1)-1)
+	case OrderConsistentHash:
+		// rendezvous hashing on the name: the records that aren't
+		// healthy are skipped for the next ones in the order of the
+		// name, and removing a record only moves the names it had
+		if len(name) > 0 {
+			return healthy.pick(max, strings.ToLower(dns.Fqdn(name)))
+		}
+	case OrderNearest:
+		if nearest != nil {
+			if servers := nearest(healthy, max); servers != nil {
+				return servers
+			}
 		}
+		if weight == 0 {
+			return healthy
+		}
+	}
+	return healthy.pick(max, sticky)
+}
+
+// pick returns up to max records picked randomly by weight, or
+// consistently for the sticky key. Records with weight 0 are draining
+// and only picked (evenly) if there are no other records.
+func (records Records) pick(max int, sticky string) Records {
+	records, draining := records.withoutDraining()
 
-		if qtype == dns.TypeCNAME || qtype == dns.TypeMF {
-			max = 1
+	rrCount := len(records)
+	if max > rrCount {
+		max = rrCount
+	}
+
+	now := time.Now()
+
+	if len(sticky) > 0 {
+		return stickyPick(records, max, sticky, draining, now)
+	}
+
+	if draining {
+		return records.shuffle(max)
+	}
+
+	servers := make([]Record, len(records))
+	copy(servers, records)
+	weights := make([]float64, len(servers))
+	result := make([]Record, max)
+	sum := 0.0
+	for i, r := range servers {
+		weights[i] = r.effectiveWeight(now)
+		sum += weights[i]
+	}
+
+	for si := 0; si < max; si++ {
+		n := rand.Float64() * sum
+		s := 0.0
+
+		i := len(servers) - 1
+		for j, w := range weights {
+			s += w
+			if s > n {
+				i = j
+				break
+			}
 		}
+		sum -= weights[i]
+		result[si] = servers[i]
+
+		// remove the server from the list
+		servers = append(servers[:i], servers[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+
+	return result
+}
 
-		rrCount := len(labelRR)
-		if max > rrCount {
-			max = rrCount
+// withoutDraining returns the records with a weight, or all the records
+// and true if they're all draining (have weight 0).
+func (records Records) withoutDraining() (Records, bool) {
+	var weighted Records
+	for _, r := range records {
+		if r.Weight > 0 {
+			weighted = append(weighted, r)
 		}
+	}
+	if len(weighted) == 0 {
+		return records, true
+	}
+	return weighted, false
+}
 
-		servers := make([]Record, len(labelRR))
-		copy(servers, labelRR)
-		result := make([]Record, max)
-		sum := label.Weight[qtype]
-
-		for si := 0; si < max; si++ {
-			n := rand.Intn(sum + 1)
-			s := 0
-
-			for i := range servers {
-				s += int(servers[i].Weight)
-				if s >= n {
-					sum -= servers[i].Weight
-					result[si] = servers[i]
-
-					// remove the server from the list
-					servers = append(servers[:i], servers[i+1:]...)
-					break
-				}
-			}
+// shuffle returns up to max of the records in random order, ignoring
+// the weights.
+func (records Records) shuffle(max int) Records {
+	if max > len(records) {
+		max = len(records)
+	}
+	result := make(Records, max)
+	for i, j := range rand.Perm(len(records))[:max] {
+		result[i] = records[j]
+	}
+	return result
+}
+
+// spills returns true if the query should be answered from the next
+// target, for the label's spillover percentage of the queries.
+func (label *Label) spills(sticky string) bool {
+	if len(sticky) == 0 {
+		return rand.Intn(100) < label.Spillover
+	}
+	h := fnv.New64a()
+	h.Write([]byte(sticky))
+	h.Write([]byte{0})
+	h.Write([]byte(label.Label))
+	return int(mix64(h.Sum64())%100) < label.Spillover
+}
+
+// rotate returns up to max of the records starting at offset n,
+// wrapping around to the first record.
+func (records Records) rotate(max int, n uint32) Records {
+	if max > len(records) {
+		max = len(records)
+	}
+	if max <= 0 {
+		return nil
+	}
+	result := make(Records, max)
+	start := int(n % uint32(len(records)))
+	for i := range result {
+		result[i] = records[(start+i)%len(records)]
+	}
+	return result
+}
+
+type scoredRecord struct {
+	Record
+	score float64
+}
+
+type scoredRecords []scoredRecord
+
+func (s scoredRecords) Len() int           { return len(s) }
+func (s scoredRecords) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s scoredRecords) Less(i, j int) bool { return s[i].score > s[j].score }
+
+// stickyPick picks max records with weighted rendezvous hashing on the
+// key and the record data. The result only depends on the key and the
+// record set (not the order or the zone reloading), and if a record is
+// removed only the keys that had that record get a different answer.
+// If even is set the weights are ignored.
+func stickyPick(records Records, max int, key string, even bool, now time.Time) Records {
+	scored := make(scoredRecords, len(records))
+	for i, r := range records {
+		weight := 1.0
+		if !even {
+			weight = r.effectiveWeight(now)
 		}
+		scored[i] = scoredRecord{r, rendezvousScore(key, r, weight)}
+	}
+	sort.Stable(scored)
 
-		return result
+	result := make(Records, max)
+	for i := range result {
+		result[i] = scored[i].Record
 	}
-	return nil
+	return result
+}
+
+func rendezvousScore(key string, r Record, weight float64) float64 {
+	if weight <= 0 {
+		return 0
+	}
+	// only hash the record data so changing the TTL doesn't
+	// change which records are picked
+	rdata := rdataString(r.RR)
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(rdata))
+
+	// uniform number in (0,1) from the top 53 bits of the hash
+	u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+
+	return weight / -math.Log(u)
+}
+
+// mix64 is the MurmurHash3 finalizer. FNV doesn't spread small
+// differences in the input to the high bits of the hash.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
 }
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abh/geodns/health"
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+type PickerSuite struct {
+}
+
+var _ = Suite(&PickerSuite{})
+
+func pickerLabel(weights ...int) *Label {
+	z := NewZone("example.com")
+	label := z.AddLabel("www")
+	for i, w := range weights {
+		rr := &dns.A{
+			Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 168, 1, byte(i+1)),
+		}
+		label.Records[dns.TypeA] = append(label.Records[dns.TypeA], Record{RR: rr, Weight: w})
+		label.Weight[dns.TypeA] += w
+	}
+	return label
+}
+
+func (s *PickerSuite) TestStickyPicker(c *C) {
+	label := pickerLabel(10, 20, 30, 40)
+
+	first := label.Picker(dns.TypeA, 1, "10.0.0.1")
+	c.Assert(first, HasLen, 1)
+	for i := 0; i < 10; i++ {
+		r := label.Picker(dns.TypeA, 1, "10.0.0.1")
+		c.Check(r[0].RR.String(), Equals, first[0].RR.String())
+	}
+
+	// two records, still the same for the same client
+	two := label.Picker(dns.TypeA, 2, "10.0.0.1")
+	c.Check(two, HasLen, 2)
+	c.Check(two[0].RR.String(), Equals, first[0].RR.String())
+
+	// the distribution over many clients follows the weights
+	counts := map[string]int{}
+	n := 10000
+	for i := 0; i < n; i++ {
+		r := label.Picker(dns.TypeA, 1, fmt.Sprintf("10.%d.%d.1", i/256, i%256))
+		counts[r[0].RR.(*dns.A).A.String()]++
+	}
+	c.Check(counts["192.168.1.4"] > counts["192.168.1.1"]*3, Equals, true)
+	c.Check(counts["192.168.1.1"] > n/20, Equals, true)
+	c.Check(counts["192.168.1.4"] < n/2, Equals, true)
+}
+
+func (s *PickerSuite) TestStickyPickerFailover(c *C) {
+	label := pickerLabel(10, 10, 10, 10)
+
+	before := map[string]string{}
+	for i := 0; i < 200; i++ {
+		client := fmt.Sprintf("10.0.%d.1", i)
+		before[client] = label.Picker(dns.TypeA, 1, client)[0].RR.(*dns.A).A.String()
+	}
+
+	// remove the first record; only the clients that had it move
+	// and they stay on their new record
+	removed := label.Records[dns.TypeA][0].RR.(*dns.A).A.String()
+	label.Weight[dns.TypeA] -= label.Records[dns.TypeA][0].Weight
+	label.Records[dns.TypeA] = label.Records[dns.TypeA][1:]
+
+	moved := 0
+	for client, ip := range before {
+		now := label.Picker(dns.TypeA, 1, client)[0].RR.(*dns.A).A.String()
+		if ip == removed {
+			c.Check(now, Not(Equals), removed)
+			moved++
+		} else {
+			c.Check(now, Equals, ip)
+		}
+		c.Check(label.Picker(dns.TypeA, 1, client)[0].RR.(*dns.A).A.String(), Equals, now)
+	}
+	c.Check(moved > 0, Equals, true)
+}
+
+func (s *PickerSuite) TestStickyPickerTTL(c *C) {
+	// changing the TTL (for example on a zone reload) doesn't change the pick
+	label := pickerLabel(10, 20, 30, 40)
+	r := label.Picker(dns.TypeA, 1, "10.1.2.3")[0].RR.(*dns.A).A.String()
+	for _, rec := range label.Records[dns.TypeA] {
+		rec.RR.Header().Ttl = 300
+	}
+	c.Check(label.Picker(dns.TypeA, 1, "10.1.2.3")[0].RR.(*dns.A).A.String(), Equals, r)
+}
+
+type failTester struct{}
+
+func (failTester) Test(ip net.IP, timeout time.Duration) error { return fmt.Errorf("down") }
+func (failTester) String() string                              { return "fail" }
+
+// flapTester fails while pickerFlapDown is set.
+type flapTester struct{}
+
+var pickerFlapDown int32
+
+func (flapTester) Test(ip net.IP, timeout time.Duration) error {
+	if atomic.LoadInt32(&pickerFlapDown) == 1 {
+		return fmt.Errorf("down")
+	}
+	return nil
+}
+func (flapTester) String() string { return "flap" }
+
+// downTester fails for the IPs set down with setDown, for changing the
+// health of the records in a zone that's being served.
+type downTester struct{}
+
+var downIPs = struct {
+	sync.Mutex
+	ips map[string]bool
+}{ips: map[string]bool{}}
+
+func (downTester) Test(ip net.IP, timeout time.Duration) error {
+	downIPs.Lock()
+	defer downIPs.Unlock()
+	if downIPs.ips[ip.String()] {
+		return fmt.Errorf("down")
+	}
+	return nil
+}
+func (downTester) String() string { return "down" }
+
+// setDown sets the IP of the record with a "picker-down" health check
+// down (or up again) and runs the check.
+func setDown(c *C, r Record, down bool) {
+	downIPs.Lock()
+	if down {
+		downIPs.ips[r.Test.IP().String()] = true
+	} else {
+		delete(downIPs.ips, r.Test.IP().String())
+	}
+	downIPs.Unlock()
+	r.Test.Check()
+	c.Assert(r.IsHealthy(), Equals, !down)
+}
+
+func init() {
+	health.RegisterType("picker-fail", func(map[string]interface{}) (health.Tester, error) {
+		return failTester{}, nil
+	})
+	health.RegisterType("picker-down", func(map[string]interface{}) (health.Tester, error) {
+		return downTester{}, nil
+	})
+	health.RegisterType("picker-flap", func(map[string]interface{}) (health.Tester, error) {
+		return flapTester{}, nil
+	})
+}
+
+// setUnhealthy adds a failing health check to the record.
+func setUnhealthy(c *C, r *Record) {
+	test, err := health.NewFromMap(map[string]interface{}{"type": "picker-fail", "retries": 1.0})
+	c.Assert(err, IsNil)
+	r.Test = test.Copy(r.RR.(*dns.A).A)
+	r.Test.Check()
+	c.Assert(r.IsHealthy(), Equals, false)
+}
+
+func (s *PickerSuite) TestHealthyPicker(c *C) {
+	label := pickerLabel(1000, 1)
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+
+	for i := 0; i < 20; i++ {
+		r := label.Picker(dns.TypeA, 1, "")
+		c.Assert(r, HasLen, 1)
+		c.Check(r[0].RR.(*dns.A).A.String(), Equals, "192.168.1.2")
+
+		r = label.Picker(dns.TypeA, 1, fmt.Sprintf("10.0.0.%d", i))
+		c.Check(r[0].RR.(*dns.A).A.String(), Equals, "192.168.1.2")
+	}
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 1)
+
+	// unweighted records are filtered too
+	label = pickerLabel(0, 0, 0)
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 2)
+
+	// when all records are unhealthy they're all used
+	label = pickerLabel(10, 10)
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 2)
+}
+
+func (s *PickerSuite) TestBackupPicker(c *C) {
+	label := pickerLabel(10, 10)
+	backup := pickerLabel(5, 5, 0)
+	label.Backup[dns.TypeA] = backup.Records[dns.TypeA][1:]
+
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	for i := 0; i < 10; i++ {
+		r := label.Picker(dns.TypeA, 1, "")
+		c.Assert(r, HasLen, 1)
+		c.Check(r[0].RR.(*dns.A).A.String(), Equals, "192.168.1.2")
+	}
+
+	// the backup records are used when all the records are unhealthy,
+	// picked by their own weight
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	for i := 0; i < 10; i++ {
+		r := label.Picker(dns.TypeA, 1, "")
+		c.Assert(r, HasLen, 1)
+		c.Check(r[0].RR.(*dns.A).A.String(), Equals, "192.168.1.2")
+		c.Check(r[0].Weight, Equals, 5)
+	}
+	// the backup record with weight 0 is draining
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 1)
+
+	// ... unless they're unhealthy too
+	setUnhealthy(c, &label.Backup[dns.TypeA][0])
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 1)
+	c.Check(label.Picker(dns.TypeA, 2, "")[0].RR.(*dns.A).A.String(), Equals, "192.168.1.3")
+}
+
+func (s *PickerSuite) TestSlowStartPicker(c *C) {
+	label := pickerLabel(10, 10)
+	test, err := health.NewFromMap(map[string]interface{}{"type": "picker-flap", "retries": 1.0,
+		"slow_start": "1h"})
+	c.Assert(err, IsNil)
+	r := &label.Records[dns.TypeA][0]
+	r.Test = test.Copy(r.RR.(*dns.A).A)
+
+	// the first record just recovered, so it gets about a tenth of
+	// its weight
+	atomic.StoreInt32(&pickerFlapDown, 1)
+	r.Test.Check()
+	atomic.StoreInt32(&pickerFlapDown, 0)
+	r.Test.Check()
+	c.Assert(r.IsHealthy(), Equals, true)
+
+	share := func(sticky bool) float64 {
+		n, first := 5000, 0
+		for i := 0; i < n; i++ {
+			key := ""
+			if sticky {
+				key = fmt.Sprintf("10.%d.%d.1", i/256, i%256)
+			}
+			if label.Picker(dns.TypeA, 1, key)[0].RR.(*dns.A).A.String() == "192.168.1.1" {
+				first++
+			}
+		}
+		return float64(first) / float64(n)
+	}
+	for _, sticky := range []bool{false, true} {
+		f := share(sticky)
+		c.Check(f > 0.05 && f < 0.14, Equals, true, Commentf("sticky %t: %f", sticky, f))
+	}
+
+	// both records are still returned
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 2)
+
+	// and after the slow start period they're even again
+	r.Test.SlowStart = 0
+	f := share(false)
+	c.Check(f > 0.45 && f < 0.55, Equals, true, Commentf("%f", f))
+}
+
+func (s *PickerSuite) TestDrainPicker(c *C) {
+	label := pickerLabel(10, 0, 10)
+
+	// records with weight 0 aren't picked while there are others
+	for i := 0; i < 50; i++ {
+		for _, r := range label.Picker(dns.TypeA, 3, "") {
+			c.Check(r.Weight, Equals, 10)
+		}
+		r := label.Picker(dns.TypeA, 3, fmt.Sprintf("10.0.%d.1", i))
+		c.Check(r, HasLen, 2)
+		for _, r := range r {
+			c.Check(r.Weight, Equals, 10)
+		}
+	}
+
+	// ... but are used when they're the only healthy records
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	setUnhealthy(c, &label.Records[dns.TypeA][2])
+	for i := 0; i < 10; i++ {
+		r := label.Picker(dns.TypeA, 2, fmt.Sprintf("10.0.%d.1", i))
+		c.Assert(r, HasLen, 1)
+		c.Check(r[0].RR.(*dns.A).A.String(), Equals, "192.168.1.2")
+	}
+
+	// when all the records are draining they're picked evenly, and
+	// consistently for a sticky key
+	label = pickerLabel(10, 0, 0, 0)
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		client := fmt.Sprintf("10.%d.%d.1", i/256, i%256)
+		r := label.Picker(dns.TypeA, 1, client)
+		c.Assert(r, HasLen, 1)
+		c.Check(label.Picker(dns.TypeA, 1, client)[0].RR.String(), Equals, r[0].RR.String())
+		counts[r[0].RR.(*dns.A).A.String()]++
+		c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 2)
+	}
+	c.Check(counts, HasLen, 3)
+	for _, n := range counts {
+		c.Check(n > 500, Equals, true)
+	}
+}
+
+func (s *PickerSuite) TestRoundRobinPicker(c *C) {
+	label := pickerLabel(0, 0, 0, 0)
+	label.Order = OrderRoundRobin
+
+	first := func(r Records) string { return r[0].RR.(*dns.A).A.String() }
+	for i := 0; i < 8; i++ {
+		r := label.Picker(dns.TypeA, 2, "")
+		c.Assert(r, HasLen, 2)
+		c.Check(first(r), Equals, fmt.Sprintf("192.168.1.%d", i%4+1))
+		c.Check(r[1].RR.(*dns.A).A.String(), Equals, fmt.Sprintf("192.168.1.%d", (i+1)%4+1))
+	}
+
+	// unhealthy records are skipped
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		seen[first(label.Picker(dns.TypeA, 1, ""))]++
+	}
+	c.Check(seen, DeepEquals, map[string]int{"192.168.1.1": 2, "192.168.1.3": 2, "192.168.1.4": 2})
+	c.Check(label.Picker(dns.TypeA, 10, ""), HasLen, 3)
+}
+
+func (s *PickerSuite) TestRandomNPicker(c *C) {
+	label := pickerLabel(1000, 1, 0, 1, 1)
+	label.Order = OrderRandom
+	setUnhealthy(c, &label.Records[dns.TypeA][4])
+
+	counts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		r := label.Picker(dns.TypeA, 2, "10.0.0.1")
+		c.Assert(r, HasLen, 2)
+		c.Check(r[0].RR.String(), Not(Equals), r[1].RR.String())
+		for _, rr := range r {
+			counts[rr.RR.(*dns.A).A.String()]++
+		}
+	}
+	// the weights (and sticky key) are ignored; each healthy record
+	// is picked about half the time
+	c.Check(counts["192.168.1.5"], Equals, 0)
+	for i := 1; i <= 4; i++ {
+		n := counts[fmt.Sprintf("192.168.1.%d", i)]
+		c.Check(n > 800 && n < 1200, Equals, true, Commentf("192.168.1.%d: %d", i, n))
+	}
+
+	// unweighted records are picked too
+	label = pickerLabel(0, 0, 0)
+	label.Order = OrderRandom
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 2)
+}
+
+func (s *PickerSuite) TestConsistentHashPicker(c *C) {
+	label := pickerLabel(0, 0, 0, 0)
+	label.Order = OrderConsistentHash
+
+	ip := func(r Records) string { return r[0].RR.(*dns.A).A.String() }
+	names := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("item%d.cdn.example.com.", i)
+		r := label.Select(dns.TypeA, 1, "", name, nil)
+		c.Assert(r, HasLen, 1)
+		names[name] = ip(r)
+		counts[ip(r)]++
+		// the same for all clients and the case of the name
+		c.Check(ip(label.Select(dns.TypeA, 1, "10.0.0.1", name, nil)), Equals, names[name])
+		c.Check(ip(label.Select(dns.TypeA, 1, "", strings.ToUpper(name), nil)), Equals, names[name])
+	}
+	c.Check(counts, HasLen, 4)
+	for _, n := range counts {
+		c.Check(n > 350 && n < 650, Equals, true, Commentf("%v", counts))
+	}
+	second := map[string]string{}
+	for name := range names {
+		second[name] = label.Select(dns.TypeA, 2, "", name, nil)[1].RR.(*dns.A).A.String()
+	}
+
+	// an unhealthy record moves only its names, to the next record
+	// for each name
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	moved := 0
+	for name, before := range names {
+		now := ip(label.Select(dns.TypeA, 1, "", name, nil))
+		if before == "192.168.1.2" {
+			c.Check(now, Not(Equals), before)
+			c.Check(now, Equals, second[name])
+			moved++
+		} else {
+			c.Check(now, Equals, before)
+		}
+	}
+	c.Check(moved, Equals, counts["192.168.1.2"])
+	label.Records[dns.TypeA][1].Test = nil
+
+	// a record leaving the label only moves the names it had
+	label.Records[dns.TypeA] = label.Records[dns.TypeA][1:]
+	for name, before := range names {
+		now := ip(label.Select(dns.TypeA, 1, "", name, nil))
+		if before == "192.168.1.1" {
+			c.Check(now, Not(Equals), before)
+		} else {
+			c.Check(now, Equals, before)
+		}
+	}
+
+	// without a name the records are picked as weighted
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 2)
+}
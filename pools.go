@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// labelPool is a label the answers for a label with the "pools" option
+// are drawn from, and its weight.
+type labelPool struct {
+	label  string
+	weight int
+}
+
+// parsePools parses the "pools" label option, a list of labels and
+// their weights:
+//
+//	"pools": [ [ "www.de", 60 ], [ "www.fr", 40 ] ]
+func parsePools(v interface{}) ([]labelPool, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("expected a list of labels and weights")
+	}
+	var pools []labelPool
+	seen := map[string]bool{}
+	for _, p := range list {
+		rec, ok := p.([]interface{})
+		if !ok || len(rec) != 2 {
+			return nil, fmt.Errorf("expected a label and weight, got '%v'", p)
+		}
+		name, ok := rec[0].(string)
+		weight, isNumber := rec[1].(float64)
+		if !ok || !isNumber || weight < 0 || weight != float64(int(weight)) {
+			return nil, fmt.Errorf("bad label and weight '%v'", p)
+		}
+		name = strings.ToLower(name)
+		if name == "@" {
+			name = ""
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("label '%s' is in the pools twice", name)
+		}
+		seen[name] = true
+		pools = append(pools, labelPool{label: name, weight: int(weight)})
+	}
+	return pools, nil
+}
+
+// checkPools returns an error if a label in the pools of a label isn't
+// in the zone or the pools refer back to the label.
+func (z *Zone) checkPools() error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("pools loop: %s", strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, p := range z.Labels[name].Pools {
+			if _, ok := z.Labels[p.label]; !ok {
+				return fmt.Errorf("pool label '%s' of %s isn't in the zone", p.label, name)
+			}
+			if err := visit(p.label, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for name := range z.Labels {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pickPool returns the name of one of the pools of the label that can
+// answer the qtypes, picked randomly by weight (evenly if none of them
+// have a weight), or "" if none can. The zone must be locked.
+func (z *Zone) pickPool(label *Label, qts qTypes) string {
+	var names []string
+	var weights []int
+	total := 0
+	for _, p := range label.Pools {
+		if l, ok := z.Labels[p.label]; ok && l.canAnswer(qts) {
+			names = append(names, p.label)
+			weights = append(weights, p.weight)
+			total += p.weight
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	if total == 0 {
+		return names[rand.Intn(len(names))]
+	}
+	n := rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return names[i]
+		}
+		n -= w
+	}
+	return names[len(names)-1]
+}
+
+// canAnswer returns true if the label has serveable records of one of
+// the qtypes, or pools or an alias to look them up in.
+func (label *Label) canAnswer(qts qTypes) bool {
+	if len(label.Pools) > 0 || len(label.Alias) > 0 {
+		return true
+	}
+	for _, qtype := range qts {
+		if qtype == dns.TypeANY {
+			return len(label.Records) > 0
+		}
+		for _, r := range label.Records[qtype] {
+			if r.IsServeable() {
+				return true
+			}
+		}
+	}
+	return false
+}
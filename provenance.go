@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/abh/geodns/querylog"
+	"github.com/miekg/dns"
+)
+
+// provenanceLabel is the first label of the debug queries; a TXT query
+// for _geo.www.example.com describes the A and AAAA answers for
+// www.example.com.
+const provenanceLabel = "_geo"
+
+// provenanceConfig is the provenance option of the [debug] section of
+// the configuration. The _geo queries are only answered when it's
+// enabled, and only for the clients in the allowed networks (the
+// loopback addresses if none are configured).
+type provenanceConfig struct {
+	mu      sync.RWMutex
+	enabled bool
+	allow   netRanges
+}
+
+var debugProvenance = &provenanceConfig{}
+
+func (p *provenanceConfig) setup(enabled bool, allow []string) error {
+	var networks []*net.IPNet
+	for _, s := range allow {
+		n, err := parsePeer(s)
+		if err != nil {
+			return fmt.Errorf("bad debug provenanceallow: %s", err)
+		}
+		networks = append(networks, n)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enabled = enabled
+	p.allow = newNetRanges(networks)
+	return nil
+}
+
+// allowed returns true if the client (the address the query came from,
+// not the client subnet) gets answers to the _geo queries.
+func (p *provenanceConfig) allowed(ip net.IP) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.enabled || ip == nil {
+		return false
+	}
+	if len(p.allow) == 0 {
+		return ip.IsLoopback()
+	}
+	return p.allow.contains(ip)
+}
+
+// isProvenanceQuery returns true for the _geo queries, the name without
+// the zone.
+func isProvenanceQuery(label string) bool {
+	return label == provenanceLabel || strings.HasPrefix(label, provenanceLabel+".")
+}
+
+// provenanceWriter gets the answer to one of the queries made for a _geo
+// query, with the query log entry filled in by serve.
+type provenanceWriter struct {
+	dns.ResponseWriter
+	entry *querylog.Entry
+	msg   *dns.Msg
+}
+
+func (w *provenanceWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// serveProvenance answers a _geo query with TXT records describing how
+// the A and AAAA answers for the name are picked for the client: the
+// client address and its targets, the GeoIP data, and for each type the
+// label (and its target level) the answer came from and the records in
+// it. The answers are made like any other, so with weighted records the
+// records are one possible answer.
+func (srv *Server) serveProvenance(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
+	qname := req.Question[0].Name
+	qtype := req.Question[0].Qtype
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	if qtype != dns.TypeTXT && qtype != dns.TypeANY {
+		m.Ns = append(m.Ns, z.NegativeSoaRR())
+		w.WriteMsg(m)
+		return
+	}
+
+	name := dns.Fqdn(strings.Join(dns.SplitDomainName(qname)[1:], "."))
+	h := dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
+
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := req.Copy()
+		q.Question[0] = dns.Question{Name: name, Qtype: t, Qclass: dns.ClassINET}
+		pw := &provenanceWriter{ResponseWriter: w, entry: &querylog.Entry{}}
+		srv.serve(pw, q, z)
+		e := pw.entry
+
+		if len(m.Answer) == 0 {
+			txt := []string{
+				"client=" + e.ClientAddr,
+				fmt.Sprintf("ecs=%t", e.ECSUsed),
+				"targets=" + strings.Join(e.Targets, " "),
+			}
+			if ip, _, err := net.ParseCIDR(e.ClientAddr); err == nil {
+				country, continent, regionGroup, region, city, _ := geoIP.GetCountryRegion(ip)
+				asn, _ := geoIP.GetASN(ip)
+				for _, kv := range [][2]string{
+					{"country", country}, {"continent", continent},
+					{"region-group", regionGroup}, {"region", region},
+					{"city", city}, {"asn", asn},
+				} {
+					if len(kv[1]) > 0 {
+						txt = append(txt, kv[0]+"="+kv[1])
+					}
+				}
+			}
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: h, Txt: txt})
+		}
+
+		rcode := dns.RcodeServerFailure
+		if pw.msg != nil {
+			rcode = pw.msg.Rcode
+		}
+		txt := []string{
+			"qtype=" + dns.TypeToString[t],
+			"rcode=" + dns.RcodeToString[rcode],
+		}
+		if e.Answers > 0 {
+			txt = append(txt, "label="+labelDisplayName(e.LabelName),
+				"level="+labelTargetLevel(e.LabelName))
+		}
+		for _, r := range e.Records {
+			txt = append(txt, "record="+r)
+		}
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: h, Txt: txt})
+	}
+
+	w.WriteMsg(m)
+}
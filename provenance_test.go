@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestProvenanceConfig(c *C) {
+	p := &provenanceConfig{}
+	c.Check(p.allowed(net.ParseIP("127.0.0.1")), Equals, false)
+
+	c.Assert(p.setup(true, nil), IsNil)
+	c.Check(p.allowed(net.ParseIP("127.0.0.1")), Equals, true)
+	c.Check(p.allowed(net.ParseIP("::1")), Equals, true)
+	c.Check(p.allowed(net.ParseIP("192.0.2.1")), Equals, false)
+
+	c.Assert(p.setup(true, []string{"192.0.2.0/24", "2001:db8::1"}), IsNil)
+	c.Check(p.allowed(net.ParseIP("192.0.2.1")), Equals, true)
+	c.Check(p.allowed(net.ParseIP("2001:db8::1")), Equals, true)
+	c.Check(p.allowed(net.ParseIP("127.0.0.1")), Equals, false)
+
+	c.Check(p.setup(true, []string{"192.0.2.0/33"}), NotNil)
+
+	c.Check(isProvenanceQuery("_geo"), Equals, true)
+	c.Check(isProvenanceQuery("_geo.www"), Equals, true)
+	c.Check(isProvenanceQuery("_geography"), Equals, false)
+	c.Check(isProvenanceQuery("www._geo"), Equals, false)
+}
+
+func (s *ServeSuite) TestServingProvenance(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/prov.example.net.json"
+	data := `{"target_overrides": {"192.0.2.0/24": "dk"},
+		"data": {"": {"ns": ["ns1.example.net"], "a": [["192.0.2.9", 0]]},
+			"www": {"a": [["192.0.2.1", 0]]},
+			"www.dk": {"a": [["192.0.2.2", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+	defer debugProvenance.setup(false, nil)
+
+	// not enabled
+	r := exchangeSubnet(c, "_geo.www.prov.example.net.", dns.TypeTXT, "192.0.2.10")
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+
+	c.Assert(debugProvenance.setup(true, nil), IsNil)
+	r = exchangeSubnet(c, "_geo.www.prov.example.net.", dns.TypeTXT, "192.0.2.10")
+	c.Assert(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Assert(r.Answer, HasLen, 3)
+	client := r.Answer[0].(*dns.TXT).Txt
+	c.Assert(len(client) >= 3, Equals, true)
+	c.Check(client[:2], DeepEquals, []string{"client=192.0.2.10/32", "ecs=true"})
+	c.Check(client[2], Matches, "targets=dk .*@")
+	c.Check(r.Answer[1].(*dns.TXT).Txt, DeepEquals, []string{"qtype=A", "rcode=NOERROR",
+		"label=www.dk", "level=country", "record=192.0.2.2"})
+	c.Check(r.Answer[2].(*dns.TXT).Txt, DeepEquals, []string{"qtype=AAAA", "rcode=NOERROR"})
+	c.Check(r.Answer[0].Header().Name, Equals, "_geo.www.prov.example.net.")
+
+	// the zone apex, without the client subnet
+	r = exchange(c, "_geo.prov.example.net.", dns.TypeTXT)
+	c.Assert(r.Answer, HasLen, 3)
+	client = r.Answer[0].(*dns.TXT).Txt
+	c.Check(client[0], Matches, "client=127.0.0.1/.*")
+	c.Check(client[1], Equals, "ecs=false")
+	c.Check(r.Answer[1].(*dns.TXT).Txt, DeepEquals, []string{"qtype=A", "rcode=NOERROR",
+		"label=@", "level=global", "record=192.0.2.9"})
+
+	r = exchange(c, "_geo.missing.prov.example.net.", dns.TypeTXT)
+	c.Assert(r.Answer, HasLen, 3)
+	c.Check(r.Answer[1].(*dns.TXT).Txt, DeepEquals, []string{"qtype=A", "rcode=NXDOMAIN"})
+
+	// only TXT queries are answered
+	r = exchange(c, "_geo.www.prov.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Answer, HasLen, 0)
+
+	// clients outside the allowed networks
+	c.Assert(debugProvenance.setup(true, []string{"192.0.2.0/24"}), IsNil)
+	r = exchangeSubnet(c, "_geo.www.prov.example.net.", dns.TypeTXT, "192.0.2.10")
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+}
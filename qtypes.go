@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// zoneQtypes is the "qtypes" zone option, the query types the zone
+// answers and the response for the others.
+type zoneQtypes struct {
+	allow  map[uint16]bool // all types if empty
+	deny   map[uint16]bool
+	nodata bool // NOERROR without records instead of NOTIMP
+}
+
+// parseQtypes parses the "qtypes" zone option:
+//
+//	{ "allow": [ "A", "AAAA", "SOA", "NS" ], "deny": [ "TXT" ], "response": "nodata" }
+func parseQtypes(m map[string]interface{}) (*zoneQtypes, error) {
+	qt := &zoneQtypes{allow: map[uint16]bool{}, deny: map[uint16]bool{}}
+	for k, v := range m {
+		switch k {
+		case "allow", "deny":
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("qtypes %s must be a list of types", k)
+			}
+			for _, s := range list {
+				name := strings.ToUpper(valueToString(s))
+				qtype, ok := dns.StringToType[name]
+				if !ok {
+					return nil, fmt.Errorf("Bad qtypes %s type '%s'", k, s)
+				}
+				if k == "allow" {
+					qt.allow[qtype] = true
+				} else {
+					qt.deny[qtype] = true
+				}
+			}
+		case "response":
+			switch valueToString(v) {
+			case "notimp":
+				qt.nodata = false
+			case "nodata":
+				qt.nodata = true
+			default:
+				return nil, fmt.Errorf("Bad qtypes response '%s'", v)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown qtypes option '%s'", k)
+		}
+	}
+	return qt, nil
+}
+
+// allowed returns true if the zone answers queries of the type; it's in
+// the allowed types (if there are any) and not in the denied types.
+func (qt *zoneQtypes) allowed(qtype uint16) bool {
+	if qt.deny[qtype] {
+		return false
+	}
+	return len(qt.allow) == 0 || qt.allow[qtype]
+}
+
+// filter returns the records of the allowed types, for the answers to
+// ANY queries.
+func (qt *zoneQtypes) filter(rrs []dns.RR) []dns.RR {
+	result := rrs[:0]
+	for _, rr := range rrs {
+		if qt.allowed(rr.Header().Rrtype) {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestQtypes(c *C) {
+	qt, err := parseQtypes(map[string]interface{}{
+		"allow": []interface{}{"A", "aaaa", "TXT", "SOA"},
+		"deny":  []interface{}{"txt"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(qt.nodata, Equals, false)
+	for qtype, allowed := range map[uint16]bool{
+		dns.TypeA:    true,
+		dns.TypeAAAA: true,
+		dns.TypeSOA:  true,
+		dns.TypeTXT:  false,
+		dns.TypeMX:   false,
+	} {
+		c.Check(qt.allowed(qtype), Equals, allowed, Commentf("%s", dns.TypeToString[qtype]))
+	}
+
+	// without an allow list all the types not denied are allowed
+	qt, err = parseQtypes(map[string]interface{}{
+		"deny":     []interface{}{"TXT", "SPF"},
+		"response": "nodata",
+	})
+	c.Assert(err, IsNil)
+	c.Check(qt.nodata, Equals, true)
+	c.Check(qt.allowed(dns.TypeMX), Equals, true)
+	c.Check(qt.allowed(dns.TypeSPF), Equals, false)
+
+	for _, m := range []map[string]interface{}{
+		{"allow": []interface{}{"NOTATYPE"}},
+		{"deny": "TXT"},
+		{"response": "refused"},
+		{"types": []interface{}{"A"}},
+	} {
+		_, err = parseQtypes(m)
+		c.Check(err, NotNil, Commentf("%v", m))
+	}
+}
+
+func (s *ServeSuite) TestServingQtypes(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	records := `{"": {"ns": ["ns1.example.net"], "txt": "secret"},
+		"www": {"a": [["192.0.2.1", 0]], "txt": "secret", "mx": [{"mx": "mail.example.net"}]}}`
+	writeZone := func(name, options string) string {
+		fileName := dir + "/" + name + ".json"
+		data := `{` + options + ` "data": ` + records + `}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		return fileName
+	}
+	notimp := writeZone("notimp.example.net", `"qtypes": {"deny": ["TXT"]}, "any": "full",`)
+	nodata := writeZone("nodata.example.net", `"qtypes": {"allow": ["A", "SOA", "NS"], "response": "nodata"},`)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(notimp)
+		os.Remove(nodata)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	r := exchange(c, "www.notimp.example.net.", dns.TypeTXT)
+	c.Check(r.Rcode, Equals, dns.RcodeNotImplemented)
+	c.Check(r.Answer, HasLen, 0)
+	r = exchange(c, "www.notimp.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Answer, HasLen, 1)
+	r = exchange(c, "www.notimp.example.net.", dns.TypeMX)
+	c.Check(r.Answer, HasLen, 1)
+	// the full ANY answers leave out the denied types
+	r = exchange(c, "www.notimp.example.net.", dns.TypeANY)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Answer, HasLen, 2)
+	for _, rr := range r.Answer {
+		c.Check(rr.Header().Rrtype, Not(Equals), dns.TypeTXT)
+	}
+
+	r = exchange(c, "www.nodata.example.net.", dns.TypeTXT)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Authoritative, Equals, true)
+	c.Check(r.Answer, HasLen, 0)
+	c.Assert(r.Ns, HasLen, 1)
+	c.Check(r.Ns[0].Header().Rrtype, Equals, dns.TypeSOA)
+	r = exchange(c, "www.nodata.example.net.", dns.TypeMX)
+	c.Check(r.Answer, HasLen, 0)
+	r = exchange(c, "www.nodata.example.net.", dns.TypeA)
+	c.Check(r.Answer, HasLen, 1)
+	r = exchange(c, "nodata.example.net.", dns.TypeSOA)
+	c.Check(r.Answer, HasLen, 1)
+
+	c.Check(zones["notimp.example.net"].Metrics.QtypeDenied.Count(), Equals, int64(1))
+	c.Check(zones["nodata.example.net"].Metrics.QtypeDenied.Count(), Equals, int64(2))
+}
@@ -23,6 +23,21 @@ type Entry struct {
 	RemoteAddr string
 	ClientAddr string
 	HasECS     bool
+
+	// for the zone query logging
+	ECSUsed     bool     `json:",omitempty"`
+	LabelTarget string   `json:",omitempty"`
+	Records     []string `json:",omitempty"`
+
+	// the key for caching the answer; the question, the label the
+	// answer is from and the network (ECS scope) it's valid for
+	CacheKey string `json:",omitempty"`
+
+	// metadata of the records in the answer, by record data
+	Meta map[string]map[string]string `json:",omitempty"`
+
+	// the answer has the emergency records of the zone
+	Emergency bool `json:",omitempty"`
 }
 
 type FileLogger struct {
@@ -48,3 +63,8 @@ func (l *FileLogger) Write(e *Entry) error {
 	_, err = l.logger.Write(js)
 	return err
 }
+
+// Close closes the log file.
+func (l *FileLogger) Close() error {
+	return l.logger.Close()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) TestRateLimiter(c *C) {
+	rl := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		c.Check(rl.Allow("a", now), Equals, true)
+	}
+	c.Check(rl.Allow("a", now), Equals, false)
+	c.Check(rl.Allow("b", now), Equals, true)
+
+	// 2 qps; one token after half a second
+	now = now.Add(500 * time.Millisecond)
+	c.Check(rl.Allow("a", now), Equals, true)
+	c.Check(rl.Allow("a", now), Equals, false)
+
+	// the bucket doesn't fill beyond the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		c.Check(rl.Allow("a", now), Equals, true)
+	}
+	c.Check(rl.Allow("a", now), Equals, false)
+
+	// full buckets are removed
+	now = now.Add(time.Hour)
+	rl.Allow("c", now)
+	c.Check(rl.buckets, HasLen, 1)
+}
+
+func (s *RateLimitSuite) TestRateLimitKey(c *C) {
+	c.Check(rateLimitKey(net.ParseIP("192.0.2.77"), 32, 128), Equals, "192.0.2.77")
+	c.Check(rateLimitKey(net.ParseIP("192.0.2.77"), 24, 64), Equals, "192.0.2.0")
+	c.Check(rateLimitKey(net.ParseIP("2001:db8:1:2:3::1"), 24, 64), Equals, "2001:db8:1:2::")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -22,32 +23,54 @@ func getQuestionName(z *Zone, req *dns.Msg) string {
 }
 
 func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
+	start := time.Now()
 
 	qname := req.Question[0].Name
 	qtype := req.Question[0].Qtype
 
 	var qle *querylog.Entry
 
-	if srv.queryLogger != nil {
+	// the queries for a _geo query fill in an entry instead of logging
+	pw, provenance := w.(*provenanceWriter)
+	zoneLog := !provenance && z.Logging.sampleQuery()
+
+	if provenance {
+		qle = pw.entry
+		qle.Origin = z.Origin
+		qle.Name = qname
+		qle.Qtype = qtype
+	} else if srv.queryLogger != nil || zoneLog {
 		qle = &querylog.Entry{
 			Time:   time.Now().UnixNano(),
 			Origin: z.Origin,
 			Name:   qname,
 			Qtype:  qtype,
 		}
-		defer srv.queryLogger.Write(qle)
+		if srv.queryLogger != nil {
+			defer srv.queryLogger.Write(qle)
+		}
+		if zoneLog {
+			defer logQuery(qle)
+		}
 	}
 
 	logPrintf("[zone %s] incoming  %s %s (id %d) from %s\n", z.Origin, qname,
-		dns.TypeToString[qtype], req.Id, w.RemoteAddr())
+		dns.TypeToString[qtype], req.Id, anonymizeIPs.addr(w.RemoteAddr()))
 
 	// Global meter
 	metrics.Get("queries").(metrics.Meter).Mark(1)
 
 	// Zone meter
 	z.Metrics.Queries.Mark(1)
+	metrics.GetOrRegisterCounter(dns.Type(qtype).String(), z.Metrics.Qtypes).Inc(1)
+	if _, ok := w.(*dohWriter); ok {
+		z.Metrics.DohQueries.Mark(1)
+	}
 
-	logPrintln("Got request", req)
+	if !anonymizeIPs.enabled() {
+		// the messages have the client subnet
+		logPrintln("Got request", req)
+	}
 
 	label := getQuestionName(z, req)
 
@@ -63,35 +86,87 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
 		realIP = make(net.IP, len(addr.IP))
 		copy(realIP, addr.IP)
 	}
+	// the IPs in the query log are anonymized with the [privacy]
+	// option, except for the _geo answers that aren't logged
+	anon := anonymizeIPs
+	if provenance {
+		anon = &anonymizeConfig{}
+	}
 	if qle != nil {
-		qle.RemoteAddr = realIP.String()
+		qle.RemoteAddr = anon.ip(realIP).String()
+	}
+
+	z.Metrics.ClientStats.Add(anonymizeIPs.ip(realIP).String())
+
+	if acl := z.Options.ACL; acl != nil && !acl.allowed(realIP) {
+		z.Metrics.Denied.Mark(1)
+		if acl.drop {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(req, acl.rcode)
+		if qle != nil {
+			qle.Rcode = m.Rcode
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	if qt := z.Options.Qtypes; qt != nil && !qt.allowed(qtype) {
+		z.Metrics.QtypeDenied.Mark(1)
+		m := new(dns.Msg)
+		if qt.nodata {
+			m.SetReply(req)
+			m.Authoritative = true
+			m.Ns = []dns.RR{z.NegativeSoaRR()}
+		} else {
+			m.SetRcode(req, dns.RcodeNotImplemented)
+		}
+		if qle != nil {
+			qle.Rcode = m.Rcode
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	if isProvenanceQuery(label) && debugProvenance.allowed(realIP) {
+		srv.serveProvenance(w, req, z)
+		return
+	}
+
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		srv.serveXfr(w, req, z, realIP)
+		return
 	}
 
-	z.Metrics.ClientStats.Add(realIP.String())
+	defer z.Metrics.QueryTime.UpdateSince(start)
 
 	var ip net.IP // EDNS or real IP
 	var edns *dns.EDNS0_SUBNET
-	var opt_rr *dns.OPT
+	var nsid bool
+	var cookie *dns.EDNS0_LOCAL
 
 	for _, extra := range req.Extra {
 
 		switch extra.(type) {
 		case *dns.OPT:
 			for _, o := range extra.(*dns.OPT).Option {
-				opt_rr = extra.(*dns.OPT)
+				z.markEdnsOption(o.Option())
 				switch e := o.(type) {
 				case *dns.EDNS0_NSID:
-					// do stuff with e.Nsid
+					nsid = true
+				case *dns.EDNS0_LOCAL:
+					if e.Code == edns0Cookie {
+						cookie = e
+					}
 				case *dns.EDNS0_SUBNET:
 					z.Metrics.EdnsQueries.Mark(1)
-					logPrintln("Got edns", e.Address, e.Family, e.SourceNetmask, e.SourceScope)
+					logPrintln("Got edns", anonymizeIPs.ip(e.Address), e.Family, e.SourceNetmask, e.SourceScope)
 					if e.Address != nil {
 						edns = e
-						ip = e.Address
 
 						if qle != nil {
 							qle.HasECS = true
-							qle.ClientAddr = fmt.Sprintf("%s/%d", ip, e.SourceNetmask)
 						}
 					}
 				}
@@ -99,14 +174,76 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
 		}
 	}
 
-	if len(ip) == 0 { // no edns subnet
+	// only use the client subnet for targeting if the zone allows it
+	ecsUsed := edns != nil && !z.Options.DisableECS && ecsFamilyMatches(edns, qtype)
+
+	if ecsUsed {
+		ip = edns.Address
+		if qle != nil {
+			qle.ClientAddr = fmt.Sprintf("%s/%d", anon.ip(ip), anon.scope(ip, int(edns.SourceNetmask)))
+			qle.ECSUsed = true
+		}
+	}
+
+	if len(ip) == 0 { // no (usable) edns subnet
 		ip = realIP
 		if qle != nil {
-			qle.ClientAddr = fmt.Sprintf("%s/%d", ip, len(ip)*8)
+			qle.ClientAddr = fmt.Sprintf("%s/%d", anon.ip(ip), anon.scope(ip, len(ip)*8))
+		}
+	}
+
+	// DNS cookies (RFC 7873); clients with a valid server cookie
+	// aren't spoofing their address
+	var cookieOpt *dns.EDNS0_LOCAL
+	var cookieState cookieState
+	if cookie != nil && cookies.enabled() {
+		now := time.Now()
+		clientCookie, state, err := cookies.check(cookie.Data, realIP, now)
+		if err != nil {
+			logPrintf("[zone %s] %s from %s\n", z.Origin, err, anonymizeIPs.addr(w.RemoteAddr()))
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeFormatError)
+			w.WriteMsg(m)
+			return
+		}
+		cookieState = state
+		cookieOpt = cookies.option(clientCookie, realIP, now)
+	}
+
+	if z.limiter != nil && cookieState != cookieValid {
+		key := rateLimitKey(ip, z.Options.RateLimitV4, z.Options.RateLimitV6)
+		if !z.limiter.Allow(key, time.Now()) {
+			z.Metrics.RateLimited.Mark(1)
+			if z.Options.RateLimitDrop {
+				return
+			}
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeRefused)
+			if qle != nil {
+				qle.Rcode = m.Rcode
+			}
+			w.WriteMsg(m)
+			return
 		}
 	}
 
-	targets, netmask := z.Options.Targeting.GetTargets(ip)
+	geoStart := time.Now()
+	targets, netmask := z.getTargets(ip, realIP)
+	// names answered by a wildcard have the options of the wildcard
+	optionsLabel := label
+	if wildcard := z.wildcardName(label); len(wildcard) > 0 {
+		optionsLabel = wildcard
+	}
+	fence := z.labelGeoFence(optionsLabel)
+	fenced := false
+	if fence != nil {
+		regions, fenceNetmask := z.fenceRegions(ip)
+		if fenceNetmask > netmask {
+			netmask = fenceNetmask
+		}
+		fenced = !fence.allowed(regions)
+	}
+	z.Metrics.GeoIPTime.UpdateSince(geoStart)
 
 	if qle != nil {
 		qle.Targets = targets
@@ -122,26 +259,114 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
 	}
 
 	m.SetReply(req)
-	if e := m.IsEdns0(); e != nil {
-		m.SetEdns0(4096, e.Do())
+	var dnssecOK bool
+	if e := req.IsEdns0(); e != nil {
+		dnssecOK = e.Do()
+		m.SetEdns0(4096, dnssecOK)
+		if nsid {
+			if id := Config.NSID(); len(id) > 0 {
+				opt := m.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+					Code: dns.EDNS0NSID,
+					Nsid: hex.EncodeToString([]byte(id)),
+				})
+			}
+		}
+		if cookieOpt != nil {
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, cookieOpt)
+		}
 	}
 	m.Authoritative = true
 
 	// TODO: set scope to 0 if there are no alternate responses
 	if edns != nil {
 		if edns.Family != 0 {
-			if netmask < 16 {
-				netmask = 16
+			if ecsUsed {
+				if netmask < 16 {
+					netmask = 16
+				}
+				edns.SourceScope = uint8(netmask)
+			} else {
+				// the client subnet wasn't used for targeting so
+				// the answer is valid for any client
+				edns.SourceScope = 0
+			}
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, edns)
+		}
+	}
+
+	if fenced {
+		logPrintf("[zone %s] %s is geo fenced for %s\n", z.Origin, qname, anonymizeIPs.ip(ip))
+		if fence.rcode == dns.RcodeRefused {
+			m.SetRcode(req, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Ns = []dns.RR{z.NegativeSoaRR()}
+		if dnssecOK {
+			if err := z.signMsg(m); err != nil {
+				log.Printf("[zone %s] signing failed: %s", z.Origin, err)
+				dns.HandleFailed(w, req)
+				return
+			}
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	// the names at and below a delegation get a referral, except for
+	// the DS records of the delegation that are in this zone
+	if cut := z.delegationFor(label); len(cut) > 0 && (qtype != dns.TypeDS || cut != label) {
+		var sticky string
+		if z.Options.StickyWeight {
+			sticky = stickyKey(ip, edns, ecsUsed)
+		}
+		if ns, ok := z.referral(m, cut, targets, ecsFamily(edns, ecsUsed), sticky); ok {
+			if qle != nil {
+				qle.LabelName = ns.Label
 			}
-			edns.SourceScope = uint8(netmask)
-			m.Extra = append(m.Extra, opt_rr)
+			if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+				truncateMsg(m, udpSize(req), nil)
+				if len(m.Ns) == 0 {
+					// the referral doesn't fit without the NS records
+					m.Truncated = true
+				}
+			}
+			w.WriteMsg(m)
+			return
 		}
 	}
 
-	labels, labelQtype := z.findLabels(label, targets, qTypes{dns.TypeMF, dns.TypeCNAME, qtype})
+	labels, labelQtype, err := z.lookupLabels(label, targets, qTypes{dns.TypeCNAME, qtype})
+	if err != nil {
+		log.Printf("[zone %s] %s: %s", z.Origin, qname, err)
+		dns.HandleFailed(w, req)
+		return
+	}
+	if labels != nil && labels.Flatten && labelQtype == dns.TypeCNAME && !isFlattenQtype(qtype) {
+		// the flattened CNAME only answers A and AAAA queries
+		labels, labelQtype = z.findLabels(label, targets, qTypes{qtype})
+	}
+	qts := qTypes{dns.TypeCNAME, qtype}
+	var synthesize *dns64
+	if d := z.Options.DNS64; qtype == dns.TypeAAAA && d.applies(ip) && labels != nil &&
+		labelQtype != dns.TypeCNAME && (labelQtype != dns.TypeAAAA || d.excluded(labels)) {
+		// the A records for the client are looked up with the same
+		// targets, so the synthesized records follow the geo targeting
+		if a, aQtype := z.findLabels(label, targets, qTypes{dns.TypeA}); aQtype == dns.TypeA {
+			labels, labelQtype, qts = a, aQtype, qTypes{dns.TypeA}
+			synthesize = d
+		}
+	}
 	if labelQtype == 0 {
 		labelQtype = qtype
 	}
+	if mt := z.Options.Maintenance; mt != nil && labels != nil && labels == mt.label {
+		z.Metrics.Maintenance.Mark(1)
+	}
 
 	if labels == nil {
 
@@ -155,9 +380,9 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
 
 		if permitDebug && firstLabel == "_status" {
 			if qtype == dns.TypeANY || qtype == dns.TypeTXT {
-				m.Answer = statusRR(label + "." + z.Origin + ".")
+				m.Answer = statusRR(qname)
 			} else {
-				m.Ns = append(m.Ns, z.SoaRR())
+				m.Ns = append(m.Ns, z.NegativeSoaRR())
 			}
 			m.Authoritative = true
 			w.WriteMsg(m)
@@ -167,14 +392,14 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
 		if firstLabel == "_country" {
 			if qtype == dns.TypeANY || qtype == dns.TypeTXT {
 				h := dns.RR_Header{Ttl: 1, Class: dns.ClassINET, Rrtype: dns.TypeTXT}
-				h.Name = label + "." + z.Origin + "."
+				h.Name = qname
 
 				txt := []string{
 					w.RemoteAddr().String(),
 					ip.String(),
 				}
 
-				targets, netmask := z.Options.Targeting.GetTargets(ip)
+				targets, netmask := z.getTargets(ip, realIP)
 				txt = append(txt, strings.Join(targets, " "))
 				txt = append(txt, fmt.Sprintf("/%d", netmask), serverID, serverIP)
 
@@ -182,7 +407,7 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
 					Txt: txt,
 				}}
 			} else {
-				m.Ns = append(m.Ns, z.SoaRR())
+				m.Ns = append(m.Ns, z.NegativeSoaRR())
 			}
 
 			m.Authoritative = true
@@ -191,45 +416,279 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *Zone) {
 			return
 		}
 
-		// return NXDOMAIN
-		m.SetRcode(req, dns.RcodeNameError)
+		if !z.nameExists(optionsLabel) {
+			// return NXDOMAIN
+			m.SetRcode(req, dns.RcodeNameError)
+		}
 		m.Authoritative = true
 
-		m.Ns = []dns.RR{z.SoaRR()}
+		m.Ns = []dns.RR{z.NegativeSoaRR()}
+
+		if dnssecOK {
+			if err := z.signMsg(m); err != nil {
+				log.Printf("[zone %s] signing failed: %s", z.Origin, err)
+				dns.HandleFailed(w, req)
+				return
+			}
+		}
+		z.Options.TTLJitter.apply(m, time.Now())
 
 		w.WriteMsg(m)
 		return
 	}
 
-	if servers := labels.Picker(labelQtype, labels.MaxHosts); servers != nil {
+	var sticky string
+	if z.Options.StickyWeight {
+		sticky = stickyKey(ip, edns, ecsUsed)
+	}
+
+	labels, labelQtype = z.spillover(label, labels, labelQtype, targets, qts, sticky)
+	labels = z.minHealthy(label, labels, labelQtype, targets)
+
+	level := labelTargetLevel(labels.Label)
+	if m, ok := z.Metrics.TargetLevels[level]; ok {
+		m.Mark(1)
+	}
+	if stats := z.Metrics.LabelLevelStats; stats != nil {
+		stats.Add(level + " " + label)
+	}
+
+	nearest := func(records Records, max int) Records {
+		loc := geoIP.GetLocation(ip)
+		costs := labels.Latency.costs(targets)
+		switch {
+		case z.Options.ClosestBlend:
+			return records.Blend(loc, max, z.Options.ClosestDecay)
+		case loc != nil || costs != nil:
+			return records.ClosestCost(costs, loc, max)
+		}
+		return nil
+	}
+	var servers Records
+	if labelQtype == dns.TypeANY && !z.Options.FullANY {
+		m.Answer = []dns.RR{z.minimalANY(qname, labels)}
+	} else {
+		servers = labels.Select(labelQtype, labels.MaxHosts, sticky, qname, nearest)
+		if records := z.Options.Emergency.replace(labels, labelQtype); records != nil {
+			log.Printf("[zone %s] all the %s records for %s are unhealthy, serving the emergency records",
+				z.Origin, dns.TypeToString[labelQtype], qname)
+			z.Metrics.Emergency.Mark(1)
+			servers = records
+			if qle != nil {
+				qle.Emergency = true
+			}
+		}
+	}
+
+	if qle != nil {
+		for _, record := range servers {
+			if len(record.Meta) == 0 {
+				continue
+			}
+			if qle.Meta == nil {
+				qle.Meta = map[string]map[string]string{}
+			}
+			qle.Meta[strings.TrimSpace(rdataString(record.RR))] = record.Meta
+		}
+	}
+
+	var preferred []int
+	if servers != nil {
+		preferred = preferredRecords(servers)
+		// a degraded record shortens the TTL of the whole RRset
+		var degradedTtl uint32
+		for _, record := range servers {
+			if ttl := record.degradedTtl(); ttl > 0 && (degradedTtl == 0 || ttl < degradedTtl) {
+				degradedTtl = ttl
+			}
+		}
 		var rrs []dns.RR
 		for _, record := range servers {
 			rr := dns.Copy(record.RR)
 			rr.Header().Name = qname
+			if degradedTtl > 0 && rr.Header().Ttl > degradedTtl {
+				rr.Header().Ttl = degradedTtl
+			}
 			rrs = append(rrs, rr)
 		}
 		m.Answer = rrs
 	}
 
+	if qt := z.Options.Qtypes; qt != nil && qtype == dns.TypeANY && z.Options.FullANY {
+		m.Answer = qt.filter(m.Answer)
+	}
+
+	if synthesize != nil {
+		m.Answer = synthesize.synthesize(m.Answer)
+		z.Metrics.DNS64.Mark(1)
+	}
+
+	if labels.Flatten && labelQtype == dns.TypeCNAME && isFlattenQtype(qtype) && len(m.Answer) > 0 {
+		rrs, err := z.flattenCNAME(m.Answer[0].(*dns.CNAME), qtype, targets, sticky)
+		if err != nil {
+			log.Printf("[zone %s] flattening %s failed: %s", z.Origin, qname, err)
+			dns.HandleFailed(w, req)
+			return
+		}
+		m.Answer = rrs
+	} else if labelQtype == dns.TypeCNAME && qtype != dns.TypeCNAME && qtype != dns.TypeANY &&
+		z.Options.CNAMEChase > 0 && len(m.Answer) > 0 {
+		m.Answer = append(m.Answer, z.chaseCNAME(m.Answer[0].(*dns.CNAME), qtype, targets, sticky)...)
+	}
+
+	if labelQtype == dns.TypeNS || labelQtype == dns.TypeSRV || labelQtype == dns.TypeMX || isSVCBType(labelQtype) {
+		families := labels.addressFamilies(ecsFamily(edns, ecsUsed))
+		var extra []dns.RR
+		seen := map[string]bool{}
+		for _, rr := range m.Answer {
+			target := additionalTarget(rr)
+			if len(target) == 0 || seen[target] {
+				continue
+			}
+			seen[target] = true
+			extra = append(extra, z.additionalAddresses(target, families, targets, sticky)...)
+		}
+		m.Extra = append(extra, m.Extra...)
+	}
+
+	if len(m.Answer) == 0 && qtype == dns.TypeDNSKEY && len(label) == 0 && z.Signer != nil {
+		m.Answer = z.Signer.DNSKEYs(z.Options.Ttl)
+	}
+
 	if len(m.Answer) == 0 {
 		// Return a SOA so the NOERROR answer gets cached
-		m.Ns = append(m.Ns, z.SoaRR())
+		m.Ns = append(m.Ns, z.NegativeSoaRR())
+	}
+
+	z.answerRecords(qtype).Update(int64(len(m.Answer)))
+	z.floorTTLs(m)
+
+	if dnssecOK {
+		if err := z.signMsg(m); err != nil {
+			log.Printf("[zone %s] signing failed: %s", z.Origin, err)
+			dns.HandleFailed(w, req)
+			return
+		}
+	}
+	z.Options.TTLJitter.apply(m, time.Now())
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if udp && (z.labelTCPOnly(optionsLabel) || z.labelTCPOnly(labels.Label)) {
+		truncateAll(m)
+		z.Metrics.Truncated.Mark(1)
+	} else if udp {
+		size := udpSize(req)
+		if cookies.enabled() && cookieState != cookieValid {
+			if limit := cookies.maxUnverifiedSize(); size > limit && m.Len() > limit {
+				if cookieState == cookieUnverified {
+					// the client can retry with the server cookie
+					badCookie(m)
+				} else {
+					size = limit
+				}
+			}
+		}
+		if truncateMsg(m, size, preferred) {
+			z.Metrics.Truncated.Mark(1)
+		}
 	}
 
-	logPrintln(m)
+	if !anonymizeIPs.enabled() {
+		logPrintln(m)
+	}
 
 	if qle != nil {
 		qle.LabelName = labels.Label
+		qle.LabelTarget = "@"
+		if base, ok := targetLabelBase(labels.Label); ok {
+			qle.LabelTarget = strings.TrimPrefix(labels.Label[len(base):], ".")
+		}
+		qle.CacheKey = answerCacheKey(qname, qtype, dnssecOK, labels.Label, scopeNetwork(ip, anon.scope(ip, netmask)))
 		qle.Answers = len(m.Answer)
 		qle.Rcode = m.Rcode
+		for _, rr := range m.Answer {
+			qle.Records = append(qle.Records, strings.TrimSpace(rdataString(rr)))
+		}
 	}
+	if delay := debugDelays.delay(labels.DebugDelay); delay > 0 && !provenance {
+		z.Metrics.Delayed.Mark(1)
+		// UDP answers are sent from a timer so the handler returns; TCP
+		// and DoH answers must be written before it does, which only
+		// holds up the connection of the query
+		if udp && srv.startQuery() {
+			time.AfterFunc(delay, func() {
+				defer srv.finishQuery()
+				writeMsg(w, req, m)
+			})
+			return
+		}
+		time.Sleep(delay)
+	}
+	writeMsg(w, req, m)
+}
+
+func writeMsg(w dns.ResponseWriter, req, m *dns.Msg) {
 	err := w.WriteMsg(m)
 	if err != nil {
 		// if Pack'ing fails the Write fails. Return SERVFAIL.
 		log.Println("Error writing packet", m)
 		dns.HandleFailed(w, req)
 	}
-	return
+}
+
+// minimalANY returns the answer to ANY queries unless the zone has the
+// "any" option set to "full": a synthesized HINFO record (RFC 8482,
+// section 4.2) rather than all the records of the name, so the queries
+// can't be used for amplification attacks.
+func (z *Zone) minimalANY(qname string, label *Label) dns.RR {
+	ttl := label.Ttl
+	if ttl == 0 {
+		ttl = z.Options.Ttl
+	}
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: uint32(ttl)},
+		Cpu: "RFC8482",
+	}
+}
+
+// ecsFamilyMatches returns false if the address family of the client
+// subnet doesn't match the query type (an IPv4 subnet for an AAAA
+// query or vice versa). In that case the resolver IP is used for
+// targeting instead.
+func ecsFamilyMatches(e *dns.EDNS0_SUBNET, qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA:
+		return e.Family != 2
+	case dns.TypeAAAA:
+		return e.Family != 1
+	}
+	return true
+}
+
+// ecsFamily returns the address family (dns.TypeA or dns.TypeAAAA) of
+// the client subnet if it was used for the targeting, or 0.
+func ecsFamily(edns *dns.EDNS0_SUBNET, ecsUsed bool) uint16 {
+	if !ecsUsed {
+		return 0
+	}
+	if edns.Family == 2 {
+		return dns.TypeAAAA
+	}
+	return dns.TypeA
+}
+
+// stickyKey returns the key for sticky weighted selection; the client
+// subnet if it was used for targeting or otherwise the client IP.
+func stickyKey(ip net.IP, edns *dns.EDNS0_SUBNET, ecsUsed bool) string {
+	if ecsUsed {
+		bits := net.IPv4len * 8
+		if edns.Family == 2 {
+			bits = net.IPv6len * 8
+		}
+		mask := net.CIDRMask(int(edns.SourceNetmask), bits)
+		return fmt.Sprintf("%s/%d", ip.Mask(mask), edns.SourceNetmask)
+	}
+	return ip.String()
 }
 
 func statusRR(label string) []dns.RR {
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"math/rand"
 	"net"
+	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/abh/geodns/querylog"
 	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
 	. "gopkg.in/check.v1"
 )
 
@@ -82,11 +92,51 @@ func (s *ServeSuite) TestServing(c *C) {
 	soa2 := r.Ns[0].(*dns.SOA)
 	c.Check(soa, DeepEquals, soa2)
 
+	// the SOA timers and negative caching TTL
+	r = exchange(c, "test.example.org.", dns.TypeSOA)
+	soa = r.Answer[0].(*dns.SOA)
+	c.Check(soa.Refresh, Equals, uint32(3600))
+	c.Check(soa.Retry, Equals, uint32(600))
+	c.Check(soa.Expire, Equals, uint32(604800))
+	c.Check(soa.Minttl, Equals, uint32(300))
+	c.Check(soa.Hdr.Ttl, Equals, uint32(1200))
+	r = exchange(c, "nxdomain.test.example.org.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	c.Check(r.Ns[0].Header().Ttl, Equals, uint32(300))
+	r = exchange(c, "bar.test.example.org.", dns.TypeMX)
+	c.Check(r.Ns[0].Header().Ttl, Equals, uint32(300))
+
+	// names that only exist for other targets are NODATA, not NXDOMAIN
+	r = exchange(c, "geo-only.sub.test.example.com.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Answer, HasLen, 0)
+	c.Assert(r.Ns, HasLen, 1)
+	c.Check(r.Ns[0].Header().Rrtype, Equals, dns.TypeSOA)
+	r = exchange(c, "sub.test.example.com.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	r = exchange(c, "nxdomain.sub.test.example.com.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	c.Assert(r.Ns, HasLen, 1)
+	c.Check(r.Ns[0].Header().Rrtype, Equals, dns.TypeSOA)
+
 	// CNAMEs
 	r = exchange(c, "www.test.example.com.", dns.TypeA)
 	c.Check(r.Answer[0].(*dns.CNAME).Target, Equals, "geo.bitnames.com.")
 	c.Check(int(r.Answer[0].Header().Ttl), Equals, 1800)
 
+	// alias loop
+	r = exchange(c, "loop1.test.example.com.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeServerFailure)
+
+	// flattened CNAME
+	r = exchange(c, "flat.test.example.com.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.168.1.2")
+	c.Check(r.Answer[0].Header().Name, Equals, "flat.test.example.com.")
+	r = exchange(c, "flat.test.example.com.", dns.TypeTXT)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Answer, HasLen, 0)
+
 	//SPF
 	r = exchange(c, "test.example.com.", dns.TypeSPF)
 	c.Check(r.Answer[0].(*dns.SPF).Txt[0], Equals, "v=spf1 ~all")
@@ -98,11 +148,68 @@ func (s *ServeSuite) TestServing(c *C) {
 	c.Check(r.Answer[0].(*dns.SRV).Priority, Equals, uint16(10))
 	c.Check(r.Answer[0].(*dns.SRV).Weight, Equals, uint16(100))
 
+	// SRV ordered by priority and weight with the in-zone targets
+	// in the additional section
+	r = exchange(c, "_http._tcp.test.example.com.", dns.TypeSRV)
+	c.Assert(r.Answer, HasLen, 3)
+	c.Check(r.Answer[0].(*dns.SRV).Port, Equals, uint16(8081))
+	c.Check(r.Answer[1].(*dns.SRV).Port, Equals, uint16(8080))
+	c.Check(r.Answer[2].(*dns.SRV).Target, Equals, "srv-backup.test.example.com.")
+	extra := map[uint16]dns.RR{}
+	for _, rr := range r.Extra {
+		extra[rr.Header().Rrtype] = rr
+	}
+	c.Assert(extra[dns.TypeA], NotNil)
+	c.Check(extra[dns.TypeA].Header().Name, Equals, "srv-target.test.example.com.")
+	c.Check(extra[dns.TypeA].(*dns.A).A.String(), Equals, "192.168.1.20")
+	c.Assert(extra[dns.TypeAAAA], NotNil)
+	c.Check(extra[dns.TypeAAAA].(*dns.AAAA).AAAA.String(), Equals, "fd06:c1d3:e902::20")
+
+	// CAA
+	r = exchange(c, "caa.test.example.com.", dns.TypeCAA)
+	c.Assert(r.Answer, HasLen, 2)
+	c.Check(r.Answer[0].(*dns.CAA).Tag, Equals, "issue")
+	c.Check(r.Answer[0].(*dns.CAA).Value, Equals, "letsencrypt.org")
+
+	// MX with the in-zone mail host in the additional section
+	r = exchange(c, "mail.test.example.com.", dns.TypeMX)
+	c.Assert(r.Answer, HasLen, 2)
+	c.Check(r.Answer[0].(*dns.MX).Mx, Equals, "mx1.test.example.com.")
+	c.Check(r.Answer[0].(*dns.MX).Preference, Equals, uint16(10))
+	extra = map[uint16]dns.RR{}
+	for _, rr := range r.Extra {
+		extra[rr.Header().Rrtype] = rr
+		c.Check(rr.Header().Name, Equals, "mx1.test.example.com.")
+	}
+	c.Assert(extra[dns.TypeA], NotNil)
+	c.Check(extra[dns.TypeA].(*dns.A).A.String(), Equals, "192.168.1.30")
+	c.Check(extra[dns.TypeAAAA], NotNil)
+
+	// HTTPS with the hints from the label and its addresses in the
+	// additional section
+	r = exchange(c, "svc.test.example.com.", typeHTTPS)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Rrtype, Equals, typeHTTPS)
+	c.Check(r.Answer[0].(*dns.RFC3597).Rdata, Matches, "000100.*00040004c0a80132.*")
+	extra = map[uint16]dns.RR{}
+	for _, rr := range r.Extra {
+		extra[rr.Header().Rrtype] = rr
+		c.Check(rr.Header().Name, Equals, "svc.test.example.com.")
+	}
+	c.Check(extra[dns.TypeA], NotNil)
+	c.Check(extra[dns.TypeAAAA], NotNil)
+
+	r = exchange(c, "_dns.svc.test.example.com.", typeSVCB)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(svcbTarget(r.Answer[0].(*dns.RFC3597)), Equals, "svc.test.example.com.")
+	c.Assert(r.Extra, HasLen, 2)
+
 	// MX
 	r = exchange(c, "test.example.com.", dns.TypeMX)
+	// mx2 has weight 0 so it's draining and left out
+	c.Assert(r.Answer, HasLen, 1)
 	c.Check(r.Answer[0].(*dns.MX).Mx, Equals, "mx.example.net.")
-	c.Check(r.Answer[1].(*dns.MX).Mx, Equals, "mx2.example.net.")
-	c.Check(r.Answer[1].(*dns.MX).Preference, Equals, uint16(20))
+	c.Check(r.Answer[0].(*dns.MX).Preference, Equals, uint16(10))
 
 	// Verify the first A record was created
 	r = exchange(c, "a.b.c.test.example.com.", dns.TypeA)
@@ -225,6 +332,220 @@ func (s *ServeSuite) TestServingEDNS(c *C) {
 
 }
 
+func (s *ServeSuite) TestServingNSID(c *C) {
+	cfgMutex.Lock()
+	Config.EDNS.NSID = "geodns-test"
+	cfgMutex.Unlock()
+	defer func() {
+		cfgMutex.Lock()
+		Config.EDNS.NSID = ""
+		cfgMutex.Unlock()
+	}()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	r := dorequest(c, msg)
+	c.Assert(r.IsEdns0(), NotNil)
+	c.Check(r.IsEdns0().Option, HasLen, 0)
+
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	r = dorequest(c, msg)
+	c.Assert(r.IsEdns0(), NotNil)
+	c.Assert(r.IsEdns0().Option, HasLen, 1)
+	nsid, ok := r.IsEdns0().Option[0].(*dns.EDNS0_NSID)
+	c.Assert(ok, Equals, true)
+	c.Check(nsid.Nsid, Equals, hex.EncodeToString([]byte("geodns-test")))
+
+	// the hostname by default
+	hostname, _ := os.Hostname()
+	cfgMutex.Lock()
+	Config.EDNS.NSID = ""
+	cfgMutex.Unlock()
+	c.Check(Config.NSID(), Equals, hostname)
+}
+
+func (s *ServeSuite) TestServingTruncated(c *C) {
+	// 60 A records don't fit in 512 bytes
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.test.example.com.", dns.TypeA)
+	r, _, err := new(dns.Client).Exchange(msg, "127.0.0.1"+PORT)
+	c.Check(err, Equals, dns.ErrTruncated)
+	c.Assert(r, NotNil)
+	c.Check(r.Truncated, Equals, true)
+	c.Check(len(r.Answer) > 5 && len(r.Answer) < 60, Equals, true)
+	heavy := 0
+	for _, rr := range r.Answer {
+		if a := rr.(*dns.A).A.To4(); a[3] <= 5 {
+			heavy++
+		}
+	}
+	c.Check(heavy, Equals, 5)
+
+	// but they do with a larger EDNS buffer
+	msg = new(dns.Msg)
+	msg.SetQuestion("big.test.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	r = dorequest(c, msg)
+	c.Check(r.Truncated, Equals, false)
+	c.Check(r.Answer, HasLen, 60)
+
+	// and over TCP
+	msg = new(dns.Msg)
+	msg.SetQuestion("big.test.example.com.", dns.TypeA)
+	cli := &dns.Client{Net: "tcp"}
+	r, _, err = cli.Exchange(msg, "127.0.0.1"+PORT)
+	c.Assert(err, IsNil)
+	c.Check(r.Truncated, Equals, false)
+	c.Check(r.Answer, HasLen, 60)
+}
+
+func (s *ServeSuite) TestServingTargetOverrides(c *C) {
+	// GeoIP has these addresses in dk; the /24 override beats both
+	// that and the /16 override
+	r := exchangeSubnet(c, "www.test.example.com.", dns.TypeA, "194.239.135.1")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.CNAME).Target, Equals, "geo.bitnames.com.")
+	ecs := responseSubnet(r)
+	c.Assert(ecs, NotNil)
+	c.Check(ecs.SourceScope, Equals, uint8(24))
+
+	r = exchangeSubnet(c, "www.test.example.com.", dns.TypeA, "194.239.136.1")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.CNAME).Target, Matches, `geo-(europe|dk)\..*`)
+}
+
+func (s *ServeSuite) TestServingECSScope(c *C) {
+	r := exchangeSubnet(c, "bar.test.example.com.", dns.TypeA, "194.239.134.1")
+	c.Check(r.Answer, HasLen, 1)
+	ecs := responseSubnet(r)
+	c.Assert(ecs, NotNil)
+	c.Check(int(ecs.SourceScope) >= 16, Equals, true)
+
+	// the subnet is in the response's only OPT record
+	opts := 0
+	for _, extra := range r.Extra {
+		if _, ok := extra.(*dns.OPT); ok {
+			opts++
+		}
+	}
+	c.Check(opts, Equals, 1)
+
+	// IPv4 client subnet on an AAAA query isn't used for targeting
+	r = exchangeSubnet(c, "foo.test.example.com.", dns.TypeAAAA, "194.239.134.1")
+	ecs = responseSubnet(r)
+	c.Assert(ecs, NotNil)
+	c.Check(ecs.SourceScope, Equals, uint8(0))
+
+	// zone with the client subnet option disabled
+	r = exchangeSubnet(c, "bar.test.example.org.", dns.TypeA, "194.239.134.1")
+	c.Check(r.Answer, HasLen, 1)
+	ecs = responseSubnet(r)
+	c.Assert(ecs, NotNil)
+	c.Check(ecs.SourceScope, Equals, uint8(0))
+}
+
+func (s *ServeSuite) TestTransfer(c *C) {
+	msg := new(dns.Msg)
+	msg.SetAxfr("test.example.com.")
+
+	tr := new(dns.Transfer)
+	env, err := tr.In(msg, "127.0.0.1"+PORT)
+	c.Assert(err, IsNil)
+
+	var rrs []dns.RR
+	for e := range env {
+		c.Assert(e.Error, IsNil)
+		rrs = append(rrs, e.RR...)
+	}
+	c.Assert(len(rrs) > 2, Equals, true)
+	c.Check(rrs[0].Header().Rrtype, Equals, dns.TypeSOA)
+	c.Check(rrs[len(rrs)-1].Header().Rrtype, Equals, dns.TypeSOA)
+
+	names := map[string]bool{}
+	for _, rr := range rrs {
+		names[rr.Header().Name] = true
+	}
+	c.Check(names["bar.test.example.com."], Equals, true)
+	c.Check(names["bar-alias.test.example.com."], Equals, true)
+	c.Check(names["bar.europe.test.example.com."], Equals, false)
+	c.Check(names["bar.de.berlin.test.example.com."], Equals, false)
+
+	// zones without transfer peers are refused
+	msg.SetAxfr("test.example.org.")
+	tr = new(dns.Transfer)
+	env, err = tr.In(msg, "127.0.0.1"+PORT)
+	c.Assert(err, IsNil)
+	e := <-env
+	c.Check(e.Error, NotNil)
+
+	// and transfers are only done over TCP
+	r := exchange(c, "test.example.com.", dns.TypeAXFR)
+	c.Check(r.Rcode, Equals, dns.RcodeRefused)
+
+	// IXFR from an unknown serial gets the full zone, over UDP just
+	// the current SOA
+	soa := rrs[0].(*dns.SOA)
+	msg.SetIxfr("test.example.com.", soa.Serial-1, soa.Ns, soa.Mbox)
+	tr = new(dns.Transfer)
+	env, err = tr.In(msg, "127.0.0.1"+PORT)
+	c.Assert(err, IsNil)
+	var ixfr []dns.RR
+	for e := range env {
+		c.Assert(e.Error, IsNil)
+		ixfr = append(ixfr, e.RR...)
+	}
+	c.Check(ixfr, HasLen, len(rrs))
+
+	r = dorequest(c, msg)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.SOA).Serial, Equals, soa.Serial)
+}
+
+func (s *ServeSuite) TestRateLimit(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	writeZone := func(drop bool) *Zone {
+		data := fmt.Sprintf(`{"rate_limit": {"qps": 0.01, "burst": 2, "drop": %t, "ipv4_prefix": 24},
+			"data": {"": {"ns": ["ns1.example.net"]}, "www": {"a": [["192.0.2.1"]]}}}`, drop)
+		fileName := dir + "/ratelimit.example.net.json"
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		delete(lastRead, "ratelimit.example.net")
+		c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+		return zones["ratelimit.example.net"]
+	}
+	defer func() {
+		os.Remove(dir + "/ratelimit.example.net.json")
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	z := writeZone(false)
+	c.Assert(z.limiter, NotNil)
+	for i := 0; i < 2; i++ {
+		r := exchange(c, "www.ratelimit.example.net.", dns.TypeA)
+		c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	}
+	r := exchange(c, "www.ratelimit.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeRefused)
+	c.Check(z.Metrics.RateLimited.Count(), Equals, int64(1))
+
+	// drop silently
+	z = writeZone(true)
+	for i := 0; i < 2; i++ {
+		exchange(c, "www.ratelimit.example.net.", dns.TypeA)
+	}
+	cli := &dns.Client{ReadTimeout: 200 * time.Millisecond}
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.ratelimit.example.net.", dns.TypeA)
+	_, _, err = cli.Exchange(msg, "127.0.0.1"+PORT)
+	c.Check(err, NotNil)
+	c.Check(z.Metrics.RateLimited.Count(), Equals, int64(2))
+}
+
 func (s *ServeSuite) TestServeRace(c *C) {
 	wg := sync.WaitGroup{}
 	for i := 0; i < 5; i++ {
@@ -281,6 +602,22 @@ func exchangeSubnet(c *C, name string, dnstype uint16, ip string) *dns.Msg {
 	return dorequest(c, msg)
 }
 
+func responseSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	if r == nil {
+		return nil
+	}
+	for _, extra := range r.Extra {
+		if opt, ok := extra.(*dns.OPT); ok {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+					return e
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func exchange(c *C, name string, dnstype uint16) *dns.Msg {
 	msg := new(dns.Msg)
 
@@ -298,3 +635,462 @@ func dorequest(c *C, msg *dns.Msg) *dns.Msg {
 	}
 	return r
 }
+
+// syncBuffer is a buffer for the log output of the server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (s *ServeSuite) TestQueryLogging(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/querylog.example.net.json"
+	data := `{"logging": {"queries": true, "query_sample": 2},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [{"ip": "192.0.2.1", "meta": {"node": "fra-1", "rack": 7}}]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	buf := new(syncBuffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	for i := 0; i < 4; i++ {
+		exchange(c, "www.querylog.example.net.", dns.TypeA)
+	}
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = regexp.MustCompile(`query (\{.*\})`).FindAllString(buf.String(), -1)
+		if len(lines) >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(lines, HasLen, 2)
+
+	var e querylog.Entry
+	c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(lines[0], "query ")), &e), IsNil)
+	c.Check(e.Origin, Equals, "querylog.example.net")
+	c.Check(e.Name, Equals, "www.querylog.example.net.")
+	c.Check(e.RemoteAddr, Equals, "127.0.0.1")
+	c.Check(e.LabelName, Equals, "www")
+	c.Check(e.LabelTarget, Equals, "@")
+	c.Check(e.Records, DeepEquals, []string{"192.0.2.1"})
+	c.Check(e.Meta, DeepEquals, map[string]map[string]string{"192.0.2.1": {"node": "fra-1", "rack": "7"}})
+	c.Check(e.HasECS, Equals, false)
+}
+
+func (s *ServeSuite) TestServingDegradedTtl(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/degraded.example.net.json"
+	data := `{"ttl": 300, "data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 10], ["192.0.2.2", 10]],
+			"health": {"type": "picker-down", "retries": 1, "frequency": "1h", "degraded_ttl": 10}}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	// all the records fail their checks, so they're all served with
+	// the shorter TTL
+	records := zones["degraded.example.net"].Labels["www"].Records[dns.TypeA]
+	defer setDown(c, records[1], false)
+	setDown(c, records[0], true)
+	setDown(c, records[1], true)
+	r := exchange(c, "www.degraded.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 2)
+	for _, rr := range r.Answer {
+		c.Check(rr.Header().Ttl, Equals, uint32(10))
+	}
+
+	// the normal TTL for a healthy record
+	setDown(c, records[0], false)
+	r = exchange(c, "www.degraded.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(300))
+}
+
+func (s *ServeSuite) TestServingPreferFamily(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/family.example.net.json"
+	writeZone := func(options string) {
+		data := `{` + options + `"data": {"": {"ns": ["ns1.example.net"]},
+			"mail": {"a": [["192.0.2.1", 0]], "aaaa": [["2001:db8::1", 0]]},
+			"mx": {"mx": [{"mx": "mail.family.example.net."}]},
+			"mx6": {"mx": [{"mx": "mail.family.example.net."}], "prefer_family": "ipv6", "single_family": true}}}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	}
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+	extraTypes := func(r *dns.Msg) []string {
+		var types []string
+		for _, rr := range r.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				types = append(types, dns.TypeToString[rr.Header().Rrtype])
+			}
+		}
+		return types
+	}
+
+	writeZone(``)
+	r := exchange(c, "mx.family.example.net.", dns.TypeMX)
+	c.Check(extraTypes(r), DeepEquals, []string{"A", "AAAA"})
+	r = exchange(c, "mx6.family.example.net.", dns.TypeMX)
+	c.Check(extraTypes(r), DeepEquals, []string{"AAAA"})
+
+	// the client subnet family overrides the preference
+	msg := new(dns.Msg)
+	msg.SetQuestion("mx6.family.example.net.", dns.TypeMX)
+	msg.SetEdns0(4096, false)
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")})
+	r = dorequest(c, msg)
+	c.Check(extraTypes(r), DeepEquals, []string{"A"})
+
+	time.Sleep(10 * time.Millisecond)
+	writeZone(`"prefer_family": "ipv6", `)
+	r = exchange(c, "mx.family.example.net.", dns.TypeMX)
+	c.Check(extraTypes(r), DeepEquals, []string{"AAAA", "A"})
+
+	for _, options := range []string{`"prefer_family": "ipv5", `, `"single_family": true, `} {
+		data := `{` + options + `"data": {"": {"ns": ["ns1.example.net"]}}}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		_, err := readZoneFile("family.example.net", fileName)
+		c.Check(err, NotNil, Commentf("options %s", options))
+	}
+}
+
+func (s *ServeSuite) TestServingTargetLevels(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/levels.example.net.json"
+	data := `{"logging": {"label_levels": true},
+		"target_overrides": {"192.0.2.0/24": "dk", "198.51.100.0/24": "se"},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 0]]},
+		"www.dk": {"a": [["192.0.2.2", 0]]},
+		"www.europe": {"a": [["192.0.2.3", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	for _, ip := range []string{"192.0.2.10", "192.0.2.20", "198.51.100.10", "203.0.113.10"} {
+		exchangeSubnet(c, "www.levels.example.net.", dns.TypeA, ip)
+	}
+
+	z := zones["levels.example.net"]
+	counts := map[string]int64{}
+	z.Metrics.Registry.Each(func(name string, i interface{}) {
+		if strings.HasPrefix(name, "queries-target-") {
+			counts[strings.TrimPrefix(name, "queries-target-")] = i.(metrics.Meter).Count()
+		}
+	})
+	c.Check(counts, DeepEquals, map[string]int64{"global": 1, "continent": 1, "country": 2})
+
+	c.Check(z.Metrics.LabelLevelStats.Counts(), DeepEquals, map[string]int{
+		"global www": 1, "continent www": 1, "country www": 2,
+	})
+}
+
+func (s *ServeSuite) TestServingWildcard(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/wild.example.net.json"
+	data := `{"target_overrides": {"192.0.2.0/24": "us"},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"*": {"a": [["192.0.2.1", 0]], "aaaa": [["2001:db8::1", 0]]},
+		"*.us": {"a": [["192.0.2.2", 0]]},
+		"www": {"a": [["192.0.2.3", 0]]},
+		"www.us": {"a": [["192.0.2.4", 0]]},
+		"*.sub": {"mx": [{"mx": "mail.wild.example.net"}]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	answer := func(r *dns.Msg) string {
+		c.Assert(r.Answer, HasLen, 1)
+		return r.Answer[0].(*dns.A).A.String()
+	}
+
+	// the targeted wildcard for the US clients, "*" for the others
+	r := exchangeSubnet(c, "foo.wild.example.net.", dns.TypeA, "192.0.2.10")
+	c.Check(answer(r), Equals, "192.0.2.2")
+	c.Check(r.Answer[0].Header().Name, Equals, "foo.wild.example.net.")
+	r = exchangeSubnet(c, "foo.wild.example.net.", dns.TypeA, "198.51.100.10")
+	c.Check(answer(r), Equals, "192.0.2.1")
+	r = exchangeSubnet(c, "a.b.wild.example.net.", dns.TypeA, "198.51.100.10")
+	c.Check(answer(r), Equals, "192.0.2.1")
+
+	// only "*" has AAAA records
+	r = exchangeSubnet(c, "foo.wild.example.net.", dns.TypeAAAA, "192.0.2.10")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.AAAA).AAAA.String(), Equals, "2001:db8::1")
+
+	// the explicit label is used instead of the wildcards
+	r = exchangeSubnet(c, "www.wild.example.net.", dns.TypeA, "192.0.2.10")
+	c.Check(answer(r), Equals, "192.0.2.4")
+	r = exchangeSubnet(c, "www.wild.example.net.", dns.TypeA, "198.51.100.10")
+	c.Check(answer(r), Equals, "192.0.2.3")
+	r = exchange(c, "www.wild.example.net.", dns.TypeAAAA)
+	c.Check(r.Answer, HasLen, 0)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+
+	// below an existing name only its own wildcard matches
+	r = exchange(c, "foo.www.wild.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+	r = exchange(c, "foo.sub.wild.example.net.", dns.TypeMX)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.MX).Mx, Equals, "mail.wild.example.net.")
+	r = exchange(c, "foo.sub.wild.example.net.", dns.TypeA)
+	c.Check(r.Answer, HasLen, 0)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+}
+
+func (s *ServeSuite) TestServingNSGlue(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/glue.example.net.json"
+	data := `{"target_overrides": {"192.0.2.0/24": "europe"},
+		"data": {"": {"ns": ["ns1.glue.example.net", "ns2.glue.example.net", "ns.example.com"]},
+		"ns1": {"a": [["192.0.2.1", 0]], "aaaa": [["2001:db8::1", 0]]},
+		"ns1.europe": {"a": [["192.0.2.11", 0]]},
+		"ns2": {"a": [["192.0.2.2", 0]]},
+		"sub": {"ns": ["ns1.sub.glue.example.net"]},
+		"ns1.sub": {"a": [["192.0.2.3", 0]]},
+		"big": {"ns": ["ns1.big.glue.example.net", "ns2.big.glue.example.net"]},
+		"ns1.big": {"a": [["192.0.2.21", 0], ["192.0.2.22", 0], ["192.0.2.23", 0], ["192.0.2.24", 0],
+			["192.0.2.25", 0], ["192.0.2.26", 0], ["192.0.2.27", 0], ["192.0.2.28", 0]],
+			"aaaa": [["2001:db8::21", 0], ["2001:db8::22", 0], ["2001:db8::23", 0], ["2001:db8::24", 0],
+			["2001:db8::25", 0], ["2001:db8::26", 0], ["2001:db8::27", 0], ["2001:db8::28", 0]]},
+		"ns2.big": {"a": [["192.0.2.31", 0], ["192.0.2.32", 0], ["192.0.2.33", 0], ["192.0.2.34", 0],
+			["192.0.2.35", 0], ["192.0.2.36", 0], ["192.0.2.37", 0], ["192.0.2.38", 0]],
+			"aaaa": [["2001:db8::31", 0], ["2001:db8::32", 0], ["2001:db8::33", 0], ["2001:db8::34", 0],
+			["2001:db8::35", 0], ["2001:db8::36", 0], ["2001:db8::37", 0], ["2001:db8::38", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	glue := func(r *dns.Msg) map[string][]string {
+		result := map[string][]string{}
+		for _, rr := range r.Extra {
+			switch rr := rr.(type) {
+			case *dns.A:
+				result[rr.Hdr.Name] = append(result[rr.Hdr.Name], rr.A.String())
+			case *dns.AAAA:
+				result[rr.Hdr.Name] = append(result[rr.Hdr.Name], rr.AAAA.String())
+			}
+		}
+		return result
+	}
+
+	// the name servers in the zone get glue, the others don't
+	r := exchange(c, "glue.example.net.", dns.TypeNS)
+	c.Assert(r.Answer, HasLen, 3)
+	c.Check(glue(r), DeepEquals, map[string][]string{
+		"ns1.glue.example.net.": {"192.0.2.1", "2001:db8::1"},
+		"ns2.glue.example.net.": {"192.0.2.2"},
+	})
+
+	// targeted for the client, by record type
+	r = exchangeSubnet(c, "glue.example.net.", dns.TypeNS, "192.0.2.10")
+	c.Assert(r.Answer, HasLen, 3)
+	c.Check(glue(r)["ns1.glue.example.net."], DeepEquals, []string{"192.0.2.11", "2001:db8::1"})
+
+	r = exchange(c, "sub.glue.example.net.", dns.TypeNS)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(glue(r), DeepEquals, map[string][]string{"ns1.sub.glue.example.net.": {"192.0.2.3"}})
+
+	// the glue is dropped when the response is too large for UDP, but
+	// the answers fit so it isn't truncated
+	r = exchange(c, "big.glue.example.net.", dns.TypeNS)
+	c.Assert(r.Answer, HasLen, 2)
+	c.Check(r.Extra, HasLen, 0)
+	c.Check(r.Truncated, Equals, false)
+
+	cli := &dns.Client{Net: "tcp"}
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.glue.example.net.", dns.TypeNS)
+	r, _, err = cli.Exchange(msg, "127.0.0.1"+PORT)
+	c.Assert(err, IsNil)
+	c.Check(r.Extra, HasLen, 32)
+}
+
+func (s *ServeSuite) TestServingANY(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	records := `{"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 0]], "aaaa": [["2001:db8::1", 0]], "txt": "www", "ttl": 300},
+		"alias": {"cname": "www.any.example.net"}}`
+	writeZone := func(name, options string) string {
+		fileName := dir + "/" + name + ".json"
+		data := `{` + options + ` "ttl": 600, "data": ` + records + `}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		return fileName
+	}
+	minimal := writeZone("any.example.net", "")
+	full := writeZone("fullany.example.net", `"any": "full",`)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(minimal)
+		os.Remove(full)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	// a single HINFO record (RFC 8482)
+	r := exchange(c, "www.any.example.net.", dns.TypeANY)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	c.Check(r.Authoritative, Equals, true)
+	c.Assert(r.Answer, HasLen, 1)
+	hinfo, ok := r.Answer[0].(*dns.HINFO)
+	c.Assert(ok, Equals, true)
+	c.Check(hinfo.Cpu, Equals, "RFC8482")
+	c.Check(hinfo.Os, Equals, "")
+	c.Check(hinfo.Hdr.Name, Equals, "www.any.example.net.")
+	c.Check(hinfo.Hdr.Ttl, Equals, uint32(300))
+
+	r = exchange(c, "any.example.net.", dns.TypeANY)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Rrtype, Equals, dns.TypeHINFO)
+	c.Check(r.Answer[0].Header().Ttl, Equals, uint32(600))
+
+	r = exchange(c, "alias.any.example.net.", dns.TypeANY)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Rrtype, Equals, dns.TypeCNAME)
+
+	r = exchange(c, "missing.any.example.net.", dns.TypeANY)
+	c.Check(r.Rcode, Equals, dns.RcodeNameError)
+
+	// the legacy answer with all the records
+	r = exchange(c, "www.fullany.example.net.", dns.TypeANY)
+	c.Check(r.Rcode, Equals, dns.RcodeSuccess)
+	qtypes := map[uint16]bool{}
+	for _, rr := range r.Answer {
+		qtypes[rr.Header().Rrtype] = true
+	}
+	c.Check(qtypes, DeepEquals, map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true, dns.TypeTXT: true})
+
+	c.Check(zones["any.example.net"].Options.FullANY, Equals, false)
+	c.Check(zones["fullany.example.net"].Options.FullANY, Equals, true)
+	fileName := writeZone("badany.example.net", `"any": "none",`)
+	_, err = readZoneFile("badany.example.net", fileName)
+	c.Check(err, NotNil)
+	os.Remove(fileName)
+}
+
+func (s *ServeSuite) TestServingQueryNameCase(c *C) {
+	// resolvers using 0x20 encoding expect the case of the query name
+	r := exchange(c, "WwW.tEsT.ExAmPlE.cOm.", dns.TypeA)
+	c.Assert(r.Question, HasLen, 1)
+	c.Check(r.Question[0].Name, Equals, "WwW.tEsT.ExAmPlE.cOm.")
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Name, Equals, "WwW.tEsT.ExAmPlE.cOm.")
+
+	r = exchange(c, "BaR.tEsT.ExAmPlE.cOm.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Name, Equals, "BaR.tEsT.ExAmPlE.cOm.")
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.168.1.2")
+
+	r = exchange(c, "_StAtUs.PgEoDnS.", dns.TypeTXT)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Name, Equals, "_StAtUs.PgEoDnS.")
+
+	r = exchange(c, "_CoUnTrY.pgeodns.", dns.TypeTXT)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].Header().Name, Equals, "_CoUnTrY.pgeodns.")
+}
+
+func (s *ServeSuite) TestServingAnswerRecordsMetrics(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/answers.example.net.json"
+	data := `{"max_hosts": 2,
+		"data": {"": {"ns": ["ns1.example.net"]},
+			"www": {"a": [["192.0.2.1", 1], ["192.0.2.2", 1], ["192.0.2.3", 1]]},
+			"one": {"a": [["192.0.2.4", 1]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	exchange(c, "www.answers.example.net.", dns.TypeA)
+	exchange(c, "one.answers.example.net.", dns.TypeA)
+	exchange(c, "www.answers.example.net.", dns.TypeAAAA)
+
+	z := zones["answers.example.net"]
+	a := z.Metrics.Registry.Get("answer-records-A").(metrics.Histogram)
+	c.Check(a.Count(), Equals, int64(2))
+	c.Check(a.Sum(), Equals, int64(3))
+	c.Check(a.Max(), Equals, int64(2))
+	aaaa := z.Metrics.Registry.Get("answer-records-AAAA").(metrics.Histogram)
+	c.Check(aaaa.Count(), Equals, int64(1))
+	c.Check(aaaa.Max(), Equals, int64(0))
+	c.Check(z.Metrics.Registry.Get("answer-records-MX"), IsNil)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/abh/geodns/querylog"
@@ -10,6 +12,22 @@ import (
 
 type Server struct {
 	queryLogger querylog.QueryLogger
+
+	// serializes reading the zones directory and reloading single zones;
+	// read locked when the zones are listed for the status pages and
+	// the APIs
+	zonesMu sync.RWMutex
+	// the zones fetched from a URL, by origin; they aren't read from
+	// (or removed for missing in) the zones directory
+	remoteZones map[string]*remoteZone
+
+	// the running listeners and the queries in progress, for Shutdown
+	mu          sync.Mutex
+	dnsServers  []dnsListener
+	httpServers []*http.Server
+	stopping    bool
+	queries     int
+	idle        chan struct{}
 }
 
 func NewServer() *Server {
@@ -24,6 +42,10 @@ func (srv *Server) SetQueryLogger(logger querylog.QueryLogger) {
 
 func (srv *Server) setupServerFunc(Zone *Zone) func(dns.ResponseWriter, *dns.Msg) {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if !srv.startQuery() {
+			return
+		}
+		defer srv.finishQuery()
 		srv.serve(w, r, Zone)
 	}
 }
@@ -33,11 +55,28 @@ func (srv *Server) listenAndServe(ip string) {
 	prots := []string{"udp", "tcp"}
 
 	for _, prot := range prots {
-		go func(p string) {
-			server := &dns.Server{Addr: ip, Net: p}
+		server := &dns.Server{Addr: ip, Net: prot}
+		var workers *workerListener
+		if prot == "udp" {
+			// the queries get their worker before the server
+			// starts a goroutine for them
+			workers = queryWorkers.udpListener(dns.DefaultServeMux)
+			workers.setup(server)
+		} else {
+			server.Handler = queryWorkers.handler(dns.DefaultServeMux)
+		}
+		srv.addDNSListener(server, 0)
 
+		go func(p string) {
 			log.Printf("Opening on %s %s", ip, p)
-			if err := server.ListenAndServe(); err != nil {
+			err := server.ListenAndServe()
+			if workers != nil {
+				workers.close()
+			}
+			if srv.isStopping() {
+				return
+			}
+			if err != nil {
 				log.Fatalf("geodns: failed to setup %s %s: %s", ip, p, err)
 			}
 			log.Fatalf("geodns: ListenAndServe unexpectedly returned")
@@ -47,7 +86,11 @@ func (srv *Server) listenAndServe(ip string) {
 
 func (srv *Server) addHandler(zones Zones, name string, config *Zone) {
 	oldZone := zones[name]
+	config.setupSerial(oldZone)
 	config.SetupMetrics(oldZone)
+	config.StartStopHealthChecks(true, oldZone)
+	config.setupXfrHistory(oldZone)
+	config.setupMaintenance(oldZone)
 	zones[name] = config
 	dns.HandleFunc(name, srv.setupServerFunc(config))
 }
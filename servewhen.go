@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// serveExpr is a serve_when condition on the health of other named
+// records in the label, for example "!primary" or "!(a & b)".
+type serveExpr struct {
+	op   byte // 0 for a record name, or '!', '&' or '|'
+	name string
+	args []*serveExpr
+
+	// the record the name refers to, set by resolveServeWhen
+	label *Label
+	qtype uint16
+	index int
+}
+
+// IsServeable returns true if the record is healthy and its
+// serve_when condition (if any) is true.
+func (r Record) IsServeable() bool {
+	return r.IsHealthy() && (r.ServeWhen == nil || r.ServeWhen.eval())
+}
+
+func (e *serveExpr) eval() bool {
+	switch e.op {
+	case '!':
+		return !e.args[0].eval()
+	case '&':
+		for _, a := range e.args {
+			if !a.eval() {
+				return false
+			}
+		}
+		return true
+	case '|':
+		for _, a := range e.args {
+			if a.eval() {
+				return true
+			}
+		}
+		return false
+	}
+	return e.label.Records[e.qtype][e.index].IsServeable()
+}
+
+// copy returns a copy of the expression, for resolving it for a copy
+// of the label.
+func (e *serveExpr) copy() *serveExpr {
+	c := &serveExpr{op: e.op, name: e.name}
+	for _, a := range e.args {
+		c.args = append(c.args, a.copy())
+	}
+	return c
+}
+
+// names returns the record names used in the expression.
+func (e *serveExpr) names() []string {
+	if e.op == 0 {
+		return []string{e.name}
+	}
+	var names []string
+	for _, a := range e.args {
+		names = append(names, a.names()...)
+	}
+	return names
+}
+
+type serveParser struct {
+	s   string
+	pos int
+}
+
+// parseServeWhen parses a serve_when condition; record names combined
+// with ! (not), & (and), | (or) and parentheses. && and || work too.
+func parseServeWhen(s string) (*serveExpr, error) {
+	p := &serveParser{s: s}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected '%s' in serve_when '%s'", p.s[p.pos:], s)
+	}
+	return e, nil
+}
+
+func (p *serveParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// accept skips the operator (or a doubled operator, "&&") if it's next.
+func (p *serveParser) accept(op byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == op {
+		p.pos++
+		if op != '!' && p.pos < len(p.s) && p.s[p.pos] == op {
+			p.pos++
+		}
+		return true
+	}
+	return false
+}
+
+func (p *serveParser) or() (*serveExpr, error) {
+	return p.binary('|', p.and)
+}
+
+func (p *serveParser) and() (*serveExpr, error) {
+	return p.binary('&', p.unary)
+}
+
+func (p *serveParser) binary(op byte, next func() (*serveExpr, error)) (*serveExpr, error) {
+	e, err := next()
+	if err != nil {
+		return nil, err
+	}
+	args := []*serveExpr{e}
+	for p.accept(op) {
+		e, err := next()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return &serveExpr{op: op, args: args}, nil
+}
+
+func (p *serveParser) unary() (*serveExpr, error) {
+	if p.accept('!') {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &serveExpr{op: '!', args: []*serveExpr{e}}, nil
+	}
+	if p.accept('(') {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ')' in serve_when '%s'", p.s)
+		}
+		return e, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) {
+		r := rune(p.s[p.pos])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.", r) {
+			break
+		}
+		p.pos++
+	}
+	if start == p.pos {
+		return nil, fmt.Errorf("record name expected at position %d in serve_when '%s'", start, p.s)
+	}
+	return &serveExpr{name: p.s[start:p.pos]}, nil
+}
+
+type recordRef struct {
+	qtype uint16
+	index int
+}
+
+// resolveServeWhen points the names in the serve_when conditions of the
+// label's records to the named records, and returns an error if a name
+// is unknown or the conditions depend on each other.
+func (label *Label) resolveServeWhen() error {
+	named := map[string]recordRef{}
+	var conditional []recordRef
+	for qtype, records := range label.Records {
+		for i, r := range records {
+			if len(r.Name) > 0 {
+				if _, ok := named[r.Name]; ok {
+					return fmt.Errorf("record name '%s' is used more than once", r.Name)
+				}
+				named[r.Name] = recordRef{qtype, i}
+			}
+			if r.ServeWhen != nil {
+				conditional = append(conditional, recordRef{qtype, i})
+			}
+		}
+	}
+
+	var resolve func(e *serveExpr) error
+	resolve = func(e *serveExpr) error {
+		if e.op != 0 {
+			for _, a := range e.args {
+				if err := resolve(a); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		ref, ok := named[e.name]
+		if !ok {
+			return fmt.Errorf("unknown record '%s' in serve_when", e.name)
+		}
+		e.label, e.qtype, e.index = label, ref.qtype, ref.index
+		return nil
+	}
+	for _, ref := range conditional {
+		if err := resolve(label.Records[ref.qtype][ref.index].ServeWhen); err != nil {
+			return err
+		}
+	}
+
+	// check for loops
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[recordRef]int{}
+	var visit func(ref recordRef) error
+	visit = func(ref recordRef) error {
+		switch state[ref] {
+		case visiting:
+			return fmt.Errorf("serve_when conditions depend on each other")
+		case done:
+			return nil
+		}
+		state[ref] = visiting
+		if e := label.Records[ref.qtype][ref.index].ServeWhen; e != nil {
+			for _, name := range e.names() {
+				if err := visit(named[name]); err != nil {
+					return err
+				}
+			}
+		}
+		state[ref] = done
+		return nil
+	}
+	for _, ref := range conditional {
+		if err := visit(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *PickerSuite) TestParseServeWhen(c *C) {
+	for expr, names := range map[string][]string{
+		"primary":              {"primary"},
+		"!primary":             {"primary"},
+		"!a & !b":              {"a", "b"},
+		"!(a && b) || c":       {"a", "b", "c"},
+		" a-1 | ( b.2 & c_3 )": {"a-1", "b.2", "c_3"},
+	} {
+		e, err := parseServeWhen(expr)
+		c.Assert(err, IsNil, Commentf("expr '%s'", expr))
+		c.Check(e.names(), DeepEquals, names)
+	}
+
+	for _, expr := range []string{"", "!", "a &", "(a", "a b", "a & (b | )"} {
+		_, err := parseServeWhen(expr)
+		c.Check(err, NotNil, Commentf("expr '%s'", expr))
+	}
+}
+
+func (s *PickerSuite) TestServeWhen(c *C) {
+	label := pickerLabel(10, 10, 10)
+	records := label.Records[dns.TypeA]
+	records[0].Name = "primary"
+	records[1].Name = "backup"
+	records[1].ServeWhen, _ = parseServeWhen("!primary")
+	records[2].ServeWhen, _ = parseServeWhen("!primary & !backup")
+	c.Assert(label.resolveServeWhen(), IsNil)
+
+	healthy := records.Healthy()
+	c.Assert(healthy, HasLen, 1)
+	c.Check(healthy[0].Name, Equals, "primary")
+
+	setUnhealthy(c, &records[0])
+	healthy = records.Healthy()
+	c.Assert(healthy, HasLen, 1)
+	c.Check(healthy[0].Name, Equals, "backup")
+
+	// the last one is used when both are down
+	setUnhealthy(c, &records[1])
+	healthy = records.Healthy()
+	c.Assert(healthy, HasLen, 1)
+	c.Check(healthy[0].RR.(*dns.A).A.String(), Equals, "192.168.1.3")
+
+	c.Check(label.Picker(dns.TypeA, 2, ""), HasLen, 1)
+}
+
+func (s *PickerSuite) TestServeWhenErrors(c *C) {
+	label := pickerLabel(10, 10)
+	records := label.Records[dns.TypeA]
+	records[0].Name = "a"
+	records[1].Name = "b"
+	records[0].ServeWhen, _ = parseServeWhen("!b")
+	records[1].ServeWhen, _ = parseServeWhen("!a")
+	c.Check(label.resolveServeWhen(), ErrorMatches, ".*depend on each other")
+
+	records[1].ServeWhen, _ = parseServeWhen("!c")
+	c.Check(label.resolveServeWhen(), ErrorMatches, "unknown record 'c'.*")
+
+	records[1].ServeWhen = nil
+	records[1].Name = "a"
+	c.Check(label.resolveServeWhen(), ErrorMatches, ".*used more than once")
+}
+
+func (s *ConfigSuite) TestServeWhenConfig(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(a string) (*Zone, error) {
+		return readTestZone(c, dir, "backup.example.net",
+			`{ "data": { "": { "ns": [ "ns1.example.net" ] }, "www": { "a": [ `+a+` ] } } }`)
+	}
+
+	z, err := readZone(`{ "ip": "192.0.2.1", "name": "primary" },
+		{ "ip": "192.0.2.2", "serve_when": "!primary" }`)
+	c.Assert(err, IsNil)
+	healthy := z.Labels["www"].Records[dns.TypeA].Healthy()
+	c.Assert(healthy, HasLen, 1)
+	c.Check(healthy[0].RR.(*dns.A).A.String(), Equals, "192.0.2.1")
+
+	for _, a := range []string{
+		`{ "ip": "192.0.2.1", "name": "a", "serve_when": "!b" }, { "ip": "192.0.2.2", "name": "b", "serve_when": "!a" }`,
+		`{ "ip": "192.0.2.1", "serve_when": "!b" }`,
+		`{ "ip": "192.0.2.1", "serve_when": "!(b" }`,
+	} {
+		_, err = readZone(a)
+		c.Check(err, NotNil, Commentf("records %s", a))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Shares returns the percentage of the answers for the qtype that each
+// of the records and the backup records of the label (in the order of
+// label.Records and label.Backup) is picked first for, with the current
+// health of the records. Unhealthy records are left out and their share
+// goes to the other records by weight. When the records aren't picked
+// by weight (with the fixed, random and round_robin orders) the records
+// returned share the answers evenly. The
+// location of the client for the nearest order isn't taken into
+// account.
+func (label *Label) Shares(qtype uint16, now time.Time) (records, backup []float64) {
+	records = make([]float64, len(label.Records[qtype]))
+	backup = make([]float64, len(label.Backup[qtype]))
+
+	active, weight := label.activeRecords(qtype)
+	shares := records
+	if len(backup) > 0 && len(active) > 0 && &active[0] == &label.Backup[qtype][0] {
+		shares = backup
+	}
+
+	var picked []int
+	for i, r := range active {
+		if r.IsServeable() {
+			picked = append(picked, i)
+		}
+	}
+	if len(picked) == 0 {
+		for i := range active {
+			picked = append(picked, i)
+		}
+	}
+
+	order := label.orderPolicy(qtype, weight)
+	if order == OrderNearest && weight > 0 {
+		// without the client location
+		order = OrderWeighted
+	}
+	if order == OrderWeighted && !selfOrdered(qtype) {
+		var withWeight []int
+		sum := 0.0
+		for _, i := range picked {
+			if active[i].Weight > 0 {
+				withWeight = append(withWeight, i)
+				sum += active[i].effectiveWeight(now)
+			}
+		}
+		if len(withWeight) > 0 && sum > 0 {
+			for _, i := range withWeight {
+				shares[i] = 100 * active[i].effectiveWeight(now) / sum
+			}
+			return records, backup
+		}
+	}
+
+	for _, i := range picked {
+		shares[i] = 100 / float64(len(picked))
+	}
+	return records, backup
+}
+
+// WeightShares describes the shares of the answers (with all the records
+// healthy) for the records picked by weight in the labels where the
+// weights don't add up to 100, for checking the traffic split.
+func (z *Zone) WeightShares() []string {
+	z.RLock()
+	defer z.RUnlock()
+
+	keys := make([]string, 0, len(z.Labels))
+	for k := range z.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var notes []string
+	for _, k := range keys {
+		label := z.Labels[k]
+		qtypes := make([]int, 0, len(label.Records))
+		for qtype := range label.Records {
+			qtypes = append(qtypes, int(qtype))
+		}
+		sort.Ints(qtypes)
+		for _, qtype := range qtypes {
+			records := label.Records[uint16(qtype)]
+			total := label.Weight[uint16(qtype)]
+			order := label.orderPolicy(uint16(qtype), total)
+			if order != OrderWeighted && order != OrderNearest || len(records) < 2 ||
+				total == 100 || selfOrdered(uint16(qtype)) {
+				continue
+			}
+			parts := make([]string, 0, len(records))
+			for _, r := range records {
+				share := 0.0
+				if r.Weight > 0 {
+					share = 100 * float64(r.Weight) / float64(total)
+				}
+				parts = append(parts, fmt.Sprintf("%s %.1f%%", strings.TrimSpace(rdataString(r.RR)), share))
+			}
+			notes = append(notes, fmt.Sprintf("%s: %s weights add up to %d: %s",
+				labelDisplayName(k), dns.TypeToString[uint16(qtype)], total, strings.Join(parts, ", ")))
+		}
+	}
+	return notes
+}
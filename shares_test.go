@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *PickerSuite) TestShares(c *C) {
+	now := time.Now()
+
+	label := pickerLabel(10, 30, 0)
+	shares, backup := label.Shares(dns.TypeA, now)
+	c.Check(shares, DeepEquals, []float64{25, 75, 0})
+	c.Check(backup, HasLen, 0)
+
+	// the share of an unhealthy record goes to the others
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	shares, _ = label.Shares(dns.TypeA, now)
+	c.Check(shares, DeepEquals, []float64{100, 0, 0})
+
+	// the draining record is only used when the others are unhealthy
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	shares, _ = label.Shares(dns.TypeA, now)
+	c.Check(shares, DeepEquals, []float64{0, 0, 100})
+
+	// all the records are returned without weights
+	label = pickerLabel(0, 0, 0, 0)
+	setUnhealthy(c, &label.Records[dns.TypeA][3])
+	shares, _ = label.Shares(dns.TypeA, now)
+	c.Check(shares[0], Equals, 100.0/3)
+	c.Check(shares[3], Equals, 0.0)
+
+	label = pickerLabel(10, 40)
+	label.Order = OrderRoundRobin
+	shares, _ = label.Shares(dns.TypeA, now)
+	c.Check(shares, DeepEquals, []float64{50, 50})
+
+	// the backup records get the answers when the records are unhealthy
+	label = pickerLabel(10, 10)
+	label.Backup[dns.TypeA] = pickerLabel(5, 15).Records[dns.TypeA]
+	shares, backup = label.Shares(dns.TypeA, now)
+	c.Check(shares, DeepEquals, []float64{50, 50})
+	c.Check(backup, DeepEquals, []float64{0, 0})
+	setUnhealthy(c, &label.Records[dns.TypeA][0])
+	setUnhealthy(c, &label.Records[dns.TypeA][1])
+	shares, backup = label.Shares(dns.TypeA, now)
+	c.Check(shares, DeepEquals, []float64{0, 0})
+	c.Check(backup, DeepEquals, []float64{25, 75})
+
+	shares, backup = pickerLabel(10).Shares(dns.TypeAAAA, now)
+	c.Check(shares, HasLen, 0)
+	c.Check(backup, HasLen, 0)
+}
+
+func (s *ConfigSuite) TestWeightShares(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	data := `{"data": {
+		"": {"ns": {"ns1.example.net": null}},
+		"www": {"a": [["192.0.2.1", 10], ["192.0.2.2", 30], ["192.0.2.3", 0]]},
+		"hundred": {"a": [["192.0.2.1", 60], ["192.0.2.2", 40]]},
+		"one": {"a": [["192.0.2.1", 10]]},
+		"all": {"a": [["192.0.2.1", 0], ["192.0.2.2", 0]]},
+		"rr": {"round_robin": true, "a": [["192.0.2.1", 10], ["192.0.2.2", 20]]}
+	}}`
+	fileName := dir + "/shares.example.net.json"
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+
+	z, err := readZoneFile("shares.example.net", fileName)
+	c.Assert(err, IsNil)
+	c.Check(z.WeightShares(), DeepEquals, []string{
+		"www: A weights add up to 40: 192.0.2.2 75.0%, 192.0.2.1 25.0%, 192.0.2.3 0.0%",
+	})
+
+	// the notes aren't problems
+	c.Check(z.Validate(), HasLen, 0)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stathat/go"
+)
+
+const defaultShutdownTimeout = 5 * time.Second
+
+// dnsListener is a running DNS server.
+type dnsListener struct {
+	server *dns.Server
+	// how long to wait for its queries when stopping, or 0 to wait
+	// until the shutdown times out
+	timeout time.Duration
+}
+
+// shutdownTimeout returns the time to wait for the queries in progress
+// when stopping, from the [shutdown] section of the configuration.
+func shutdownTimeout(cfg *AppConfig) (time.Duration, error) {
+	if len(cfg.Shutdown.Timeout) == 0 {
+		return defaultShutdownTimeout, nil
+	}
+	d, err := time.ParseDuration(cfg.Shutdown.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad shutdown timeout '%s'", cfg.Shutdown.Timeout)
+	}
+	return d, nil
+}
+
+func (srv *Server) addDNSListener(server *dns.Server, timeout time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.dnsServers = append(srv.dnsServers, dnsListener{server, timeout})
+}
+
+func (srv *Server) addHTTPListener(server *http.Server) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.httpServers = append(srv.httpServers, server)
+}
+
+// isStopping returns true after Shutdown was called, so the listeners
+// returning isn't an error.
+func (srv *Server) isStopping() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.stopping
+}
+
+// startQuery returns true if the query should be answered, and counts
+// it as in progress until finishQuery is called. Queries arriving while
+// stopping aren't answered, so the clients retry with another server.
+func (srv *Server) startQuery() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.stopping {
+		return false
+	}
+	srv.queries++
+	return true
+}
+
+func (srv *Server) finishQuery() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.queries--
+	if srv.stopping && srv.queries == 0 && srv.idle != nil {
+		close(srv.idle)
+		srv.idle = nil
+	}
+}
+
+// Shutdown stops the server gracefully: the TCP, TLS and HTTP listeners
+// stop accepting connections, the queries in progress are finished and
+// the UDP listeners are closed. Then the health checks of the zones are
+// stopped, the zones closed and the query log and StatHat posts flushed.
+// The queries still in progress when ctx is done are abandoned and its
+// error returned.
+func (srv *Server) Shutdown(ctx context.Context, zones Zones) error {
+	srv.mu.Lock()
+	srv.stopping = true
+	idle := make(chan struct{})
+	if srv.queries == 0 {
+		close(idle)
+	} else {
+		srv.idle = idle
+	}
+	dnsServers, httpServers := srv.dnsServers, srv.httpServers
+	srv.dnsServers, srv.httpServers = nil, nil
+	srv.mu.Unlock()
+
+	var udp []dnsListener
+	var wg sync.WaitGroup
+	for _, l := range dnsServers {
+		if l.server.Net == "udp" {
+			// the answers are sent on the listening socket, so it's
+			// closed after the queries are done
+			udp = append(udp, l)
+			continue
+		}
+		wg.Add(1)
+		go func(l dnsListener) {
+			defer wg.Done()
+			srv.shutdownDNS(ctx, l)
+		}(l)
+	}
+	for _, server := range httpServers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Shutting down %s: %s", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		srv.mu.Lock()
+		log.Printf("Shutdown timed out, abandoning %d queries", srv.queries)
+		srv.mu.Unlock()
+	}
+
+	for _, l := range udp {
+		wg.Add(1)
+		go func(l dnsListener) {
+			defer wg.Done()
+			srv.shutdownDNS(ctx, l)
+		}(l)
+	}
+	wg.Wait()
+
+	for _, zone := range zones {
+		zone.StartStopHealthChecks(false, nil)
+		zone.Close()
+	}
+
+	if c, ok := srv.queryLogger.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Closing the query log: %s", err)
+		}
+	}
+	if Config.HasStatHat() {
+		wait := time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			wait = deadline.Sub(time.Now())
+		}
+		if wait > 0 && !stathat.WaitUntilFinished(wait) {
+			log.Printf("Posting to stathat timed out")
+		}
+	}
+
+	return err
+}
+
+// shutdownDNS stops a DNS server, waiting for its queries until ctx is
+// done or the timeout of the listener.
+func (srv *Server) shutdownDNS(ctx context.Context, l dnsListener) {
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.server.Shutdown()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("Shutting down %s %s: %s", l.server.Addr, l.server.Net, err)
+		}
+	case <-ctx.Done():
+		log.Printf("Shutting down %s %s timed out", l.server.Addr, l.server.Net)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestShutdownTimeout(c *C) {
+	cfg := new(AppConfig)
+	d, err := shutdownTimeout(cfg)
+	c.Assert(err, IsNil)
+	c.Check(d, Equals, defaultShutdownTimeout)
+
+	cfg.Shutdown.Timeout = "30s"
+	d, err = shutdownTimeout(cfg)
+	c.Assert(err, IsNil)
+	c.Check(d, Equals, 30*time.Second)
+
+	for _, t := range []string{"30", "-1s", "0s"} {
+		cfg.Shutdown.Timeout = t
+		_, err = shutdownTimeout(cfg)
+		c.Check(err, NotNil, Commentf("timeout %s", t))
+	}
+}
+
+func (s *ServeSuite) TestShutdown(c *C) {
+	const addr = "127.0.0.1:8857"
+
+	srv := &Server{}
+	srv.listenAndServe(addr)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+	cli := &dns.Client{Net: "tcp"}
+	var r *dns.Msg
+	var err error
+	for i := 0; i < 20; i++ {
+		r, _, err = cli.Exchange(msg, addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(r.Answer, HasLen, 1)
+
+	z, err := readZoneFile("test.example.com", "dns/test.example.com.json")
+	c.Assert(err, IsNil)
+	z.SetupMetrics(nil)
+
+	// a query in progress
+	c.Assert(srv.startQuery(), Equals, true)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(ctx, Zones{"test.example.com": z})
+	}()
+	for !srv.isStopping() {
+		time.Sleep(time.Millisecond)
+	}
+	// new queries aren't answered
+	c.Check(srv.startQuery(), Equals, false)
+
+	select {
+	case <-done:
+		c.Fatal("Shutdown returned before the query finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	srv.finishQuery()
+	select {
+	case err = <-done:
+		c.Check(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Shutdown didn't return")
+	}
+
+	_, err = net.Dial("tcp", addr)
+	c.Check(err, NotNil)
+	c.Check(z.Metrics.Registry.Get("queries"), IsNil)
+
+	// the queries still in progress after the timeout are abandoned
+	srv = &Server{}
+	c.Assert(srv.startQuery(), Equals, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Check(srv.Shutdown(ctx, nil), Equals, context.DeadlineExceeded)
+}
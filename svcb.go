@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The SVCB and HTTPS record types (RFC 9460) aren't in the dns
+// package, so the records are served in the generic (RFC 3597) format.
+const (
+	typeSVCB  uint16 = 64
+	typeHTTPS uint16 = 65
+)
+
+// SvcParamKeys
+const (
+	svcbMandatory     uint16 = 0
+	svcbAlpn          uint16 = 1
+	svcbNoDefaultAlpn uint16 = 2
+	svcbPort          uint16 = 3
+	svcbIPv4Hint      uint16 = 4
+	svcbECH           uint16 = 5
+	svcbIPv6Hint      uint16 = 6
+)
+
+var svcbKeys = map[string]uint16{
+	"mandatory":       svcbMandatory,
+	"alpn":            svcbAlpn,
+	"no-default-alpn": svcbNoDefaultAlpn,
+	"port":            svcbPort,
+	"ipv4hint":        svcbIPv4Hint,
+	"ech":             svcbECH,
+	"ipv6hint":        svcbIPv6Hint,
+}
+
+func isSVCBType(qtype uint16) bool {
+	return qtype == typeSVCB || qtype == typeHTTPS
+}
+
+// svcbData is an SVCB or HTTPS record before it's packed.
+type svcbData struct {
+	priority uint16
+	target   string
+	params   map[uint16][]byte
+	// add ipv4hint and ipv6hint from the A and AAAA records in the
+	// label if they aren't set
+	autoHints bool
+}
+
+// parseSVCB parses an SVCB or HTTPS record in the object syntax:
+//
+//	{ "priority": 1, "target": ".", "alpn": [ "h2", "h3" ], "port": 443 }
+func parseSVCB(rec map[string]interface{}, origin string) (*svcbData, error) {
+	s := &svcbData{target: ".", params: map[uint16][]byte{}}
+
+	if rec["priority"] != nil {
+		p := valueToInt(rec["priority"])
+		if p < 0 || p > 65535 {
+			return nil, fmt.Errorf("bad priority %d", p)
+		}
+		s.priority = uint16(p)
+	}
+	if t, ok := rec["target"].(string); ok && t != "." {
+		if !dns.IsFqdn(t) {
+			t = dns.Fqdn(t + "." + origin)
+		}
+		s.target = strings.ToLower(t)
+	}
+	if rec["auto_hints"] != nil {
+		s.autoHints = valueToBool(rec["auto_hints"])
+	}
+
+	for name, v := range rec {
+		key, ok := svcbKeys[strings.Replace(name, "_", "-", -1)]
+		if !ok {
+			continue
+		}
+		if s.priority == 0 {
+			return nil, fmt.Errorf("%s set in an alias mode record (priority 0)", name)
+		}
+		value, err := svcbValue(key, v)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %s", name, err)
+		}
+		s.params[key] = value
+	}
+	if s.priority == 0 && s.autoHints {
+		return nil, fmt.Errorf("auto_hints set in an alias mode record (priority 0)")
+	}
+
+	return s, nil
+}
+
+// svcbValue returns the wire format of the SvcParamValue.
+func svcbValue(key uint16, v interface{}) ([]byte, error) {
+	var buf []byte
+	switch key {
+	case svcbMandatory:
+		for _, name := range valueToStrings(v) {
+			k, ok := svcbKeys[name]
+			if !ok || k == svcbMandatory {
+				return nil, fmt.Errorf("unknown key '%s'", name)
+			}
+			buf = append(buf, byte(k>>8), byte(k))
+		}
+	case svcbAlpn:
+		for _, id := range valueToStrings(v) {
+			if len(id) == 0 || len(id) > 255 {
+				return nil, fmt.Errorf("bad protocol '%s'", id)
+			}
+			buf = append(buf, byte(len(id)))
+			buf = append(buf, id...)
+		}
+	case svcbNoDefaultAlpn:
+		if !valueToBool(v) {
+			return nil, fmt.Errorf("must be true if set")
+		}
+	case svcbPort:
+		port := valueToInt(v)
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%d out of range", port)
+		}
+		buf = []byte{byte(port >> 8), byte(port)}
+	case svcbIPv4Hint, svcbIPv6Hint:
+		for _, s := range valueToStrings(v) {
+			ip := net.ParseIP(s)
+			if ip == nil || (ip.To4() != nil) != (key == svcbIPv4Hint) {
+				return nil, fmt.Errorf("bad address '%s'", s)
+			}
+			if key == svcbIPv4Hint {
+				ip = ip.To4()
+			}
+			buf = append(buf, ip...)
+		}
+	case svcbECH:
+		s, _ := v.(string)
+		ech, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		buf = ech
+	}
+	if buf == nil && key != svcbNoDefaultAlpn {
+		return nil, fmt.Errorf("no value")
+	}
+	return buf, nil
+}
+
+// addHints sets the ipv4hint and ipv6hint parameters from the records,
+// unless they are set already.
+func (s *svcbData) addHints(a, aaaa Records) {
+	if _, ok := s.params[svcbIPv4Hint]; !ok && len(a) > 0 {
+		var buf []byte
+		for _, r := range a {
+			buf = append(buf, r.RR.(*dns.A).A.To4()...)
+		}
+		s.params[svcbIPv4Hint] = buf
+	}
+	if _, ok := s.params[svcbIPv6Hint]; !ok && len(aaaa) > 0 {
+		var buf []byte
+		for _, r := range aaaa {
+			buf = append(buf, r.RR.(*dns.AAAA).AAAA.To16()...)
+		}
+		s.params[svcbIPv6Hint] = buf
+	}
+}
+
+// rr packs the record into the generic format.
+func (s *svcbData) rr(h dns.RR_Header) (dns.RR, error) {
+	buf := make([]byte, 2+256)
+	binary.BigEndian.PutUint16(buf, s.priority)
+	off, err := dns.PackDomainName(s.target, buf, 2, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:off]
+
+	keys := make([]int, 0, len(s.params))
+	for k := range s.params {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		value := s.params[uint16(k)]
+		if len(value) > 65535 {
+			return nil, fmt.Errorf("parameter %d too long", k)
+		}
+		buf = append(buf, byte(k>>8), byte(k), byte(len(value)>>8), byte(len(value)))
+		buf = append(buf, value...)
+	}
+
+	h.Rdlength = uint16(len(buf))
+	return &dns.RFC3597{Hdr: h, Rdata: hex.EncodeToString(buf)}, nil
+}
+
+// svcbTarget returns the target name of an SVCB or HTTPS record, or the
+// owner name if the target is ".".
+func svcbTarget(rr *dns.RFC3597) string {
+	if !isSVCBType(rr.Hdr.Rrtype) {
+		return ""
+	}
+	buf, err := hex.DecodeString(rr.Rdata)
+	if err != nil || len(buf) < 3 {
+		return ""
+	}
+	target, _, err := dns.UnpackDomainName(buf, 2)
+	if err != nil {
+		return ""
+	}
+	if target == "." {
+		return rr.Hdr.Name
+	}
+	return target
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+
+	"github.com/abh/geodns/countries"
 )
 
 type TargetOptions int
@@ -16,6 +19,9 @@ const (
 	TargetRegion
 	TargetASN
 	TargetIP
+	TargetCity
+	TargetTimezone
+	TargetCategory
 )
 
 var cidr48Mask net.IPMask
@@ -24,19 +30,36 @@ func init() {
 	cidr48Mask = net.CIDRMask(48, 128)
 }
 
+// defaultTargetOrder is the order the targets are tried in if the zone
+// doesn't specify one; the most specific first.
+var defaultTargetOrder = []TargetOptions{
+	TargetIP, TargetCategory, TargetASN, TargetCity, TargetRegion, TargetRegionGroup,
+	TargetTimezone, TargetCountry, TargetContinent, TargetGlobal,
+}
+
+// GetTargets returns the targets for a client querying without a
+// resolver in between (or without an EDNS client subnet).
 func (t TargetOptions) GetTargets(ip net.IP) ([]string, int) {
+	return t.GetTargetsOrder(ip, ip, nil)
+}
 
-	targets := make([]string, 0)
+// GetTargetsOrder returns the targets for the IP with the targeting
+// levels in the order specified (or the default order if it's empty).
+// The category is for the resolver the query came from; the other
+// levels are for the client IP (the EDNS client subnet if there's one).
+func (t TargetOptions) GetTargetsOrder(ip, resolver net.IP, order []TargetOptions) ([]string, int) {
+
+	levels := make(map[TargetOptions][]string)
 
-	var country, continent, region, regionGroup, asn string
+	var country, continent, region, regionGroup, city, asn string
 	var netmask int
 
 	if t&TargetASN > 0 {
 		asn, netmask = geoIP.GetASN(ip)
 	}
 
-	if t&TargetRegion > 0 || t&TargetRegionGroup > 0 {
-		country, continent, regionGroup, region, netmask = geoIP.GetCountryRegion(ip)
+	if t&TargetRegion > 0 || t&TargetRegionGroup > 0 || t&TargetCity > 0 {
+		country, continent, regionGroup, region, city, netmask = geoIP.GetCountryRegion(ip)
 
 	} else if t&TargetCountry > 0 || t&TargetContinent > 0 {
 		country, continent, netmask = geoIP.GetCountry(ip)
@@ -44,43 +67,74 @@ func (t TargetOptions) GetTargets(ip net.IP) ([]string, int) {
 
 	if t&TargetIP > 0 {
 		ipStr := ip.String()
-		targets = append(targets, "["+ipStr+"]")
+		levels[TargetIP] = append(levels[TargetIP], "["+ipStr+"]")
 		ip4 := ip.To4()
 		if ip4 != nil {
 			if ip4[3] != 0 {
 				ip4[3] = 0
-				targets = append(targets, "["+ip4.String()+"]")
+				levels[TargetIP] = append(levels[TargetIP], "["+ip4.String()+"]")
 			}
 		} else {
 			// v6 address, also target the /48 address
 			ip48 := ip.Mask(cidr48Mask)
-			targets = append(targets, "["+ip48.String()+"]")
+			levels[TargetIP] = append(levels[TargetIP], "["+ip48.String()+"]")
 		}
 	}
 
 	if t&TargetASN > 0 && len(asn) > 0 {
-		targets = append(targets, asn)
+		levels[TargetASN] = []string{asn}
+	}
+
+	if t&TargetCategory > 0 {
+		// unclassified resolvers only get the other targets; the
+		// category doesn't depend on the client subnet, so it doesn't
+		// change the netmask
+		if category, _ := resolverCategories.classify(resolver); len(category) > 0 {
+			levels[TargetCategory] = []string{category}
+		}
+	}
+
+	if t&TargetCity > 0 && len(city) > 0 {
+		levels[TargetCity] = []string{city}
 	}
 
 	if t&TargetRegion > 0 && len(region) > 0 {
-		targets = append(targets, region)
+		levels[TargetRegion] = []string{region}
 	}
 	if t&TargetRegionGroup > 0 && len(regionGroup) > 0 {
-		targets = append(targets, regionGroup)
+		levels[TargetRegionGroup] = []string{regionGroup}
+	}
+
+	if t&TargetTimezone > 0 {
+		if band, ok := timezoneBand(geoIP.GetLocation(ip)); ok {
+			levels[TargetTimezone] = []string{band}
+		}
 	}
 
 	if t&TargetCountry > 0 && len(country) > 0 {
-		targets = append(targets, country)
+		levels[TargetCountry] = []string{country}
 	}
 
 	if t&TargetContinent > 0 && len(continent) > 0 {
-		targets = append(targets, continent)
+		levels[TargetContinent] = []string{continent}
 	}
 
 	if t&TargetGlobal > 0 {
-		targets = append(targets, "@")
+		levels[TargetGlobal] = []string{"@"}
 	}
-	return targets, netmask
+	return orderTargets(levels, order), netmask
+}
+
+// orderTargets returns the targets for each level in the order.
+func orderTargets(levels map[TargetOptions][]string, order []TargetOptions) []string {
+	if len(order) == 0 {
+		order = defaultTargetOrder
+	}
+	targets := make([]string, 0)
+	for _, level := range order {
+		targets = append(targets, levels[level]...)
+	}
+	return targets
 }
 
 func (t TargetOptions) String() string {
@@ -106,9 +160,40 @@ func (t TargetOptions) String() string {
 	if t&TargetIP > 0 {
 		targets = append(targets, "ip")
 	}
+	if t&TargetCity > 0 {
+		targets = append(targets, "city")
+	}
+	if t&TargetTimezone > 0 {
+		targets = append(targets, "timezone")
+	}
+	if t&TargetCategory > 0 {
+		targets = append(targets, "category")
+	}
 	return strings.Join(targets, " ")
 }
 
+// parseTargetOrder parses the targeting levels in the order they
+// should be tried, for example "region country @".
+func parseTargetOrder(v string) ([]TargetOptions, error) {
+	var order []TargetOptions
+	var seen TargetOptions
+	for _, t := range strings.Fields(v) {
+		x, err := parseTargets(t)
+		if err != nil {
+			return nil, err
+		}
+		if seen&x > 0 {
+			return nil, fmt.Errorf("Targeting option '%s' is repeated", t)
+		}
+		seen |= x
+		order = append(order, x)
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("Empty targeting order")
+	}
+	return order, nil
+}
+
 func parseTargets(v string) (tgt TargetOptions, err error) {
 	targets := strings.Split(v, " ")
 	for _, t := range targets {
@@ -128,6 +213,12 @@ func parseTargets(v string) (tgt TargetOptions, err error) {
 			x = TargetASN
 		case "ip":
 			x = TargetIP
+		case "city":
+			x = TargetCity
+		case "timezone":
+			x = TargetTimezone
+		case "category":
+			x = TargetCategory
 		default:
 			err = fmt.Errorf("Unknown targeting option '%s'", t)
 		}
@@ -135,3 +226,205 @@ func parseTargets(v string) (tgt TargetOptions, err error) {
 	}
 	return
 }
+
+// targetLabelBase returns the name that a label is a targeted variant
+// of; "www" for "www.europe", "www.de.berlin" or "www.[192.168.1.0]"
+// and "" for "dk".
+func targetLabelBase(name string) (string, bool) {
+	if strings.HasSuffix(name, "]") {
+		if i := strings.LastIndex(name, "["); i >= 0 {
+			return strings.TrimSuffix(name[:i], "."), true
+		}
+	}
+
+	parts := strings.Split(name, ".")
+	n := len(parts)
+	if isTargetName(parts[n-1]) {
+		return strings.Join(parts[:n-1], "."), true
+	}
+	// cities are prefixed with the country code
+	if n > 1 && len(countries.CountryContinent[parts[n-2]]) > 0 {
+		return strings.Join(parts[:n-2], "."), true
+	}
+	return name, false
+}
+
+func isTargetName(t string) bool {
+	if isTimezoneBand(t) || resolverCategories.isCategory(t) {
+		return true
+	}
+	if _, ok := countries.CountryContinent[t]; ok {
+		return true
+	}
+	if _, ok := countries.ContinentCountries[t]; ok {
+		return true
+	}
+	if _, ok := countries.RegionGroupRegions[t]; ok {
+		return true
+	}
+	// regions, "us-ca"
+	if len(t) > 3 && t[2] == '-' && len(countries.CountryContinent[t[:2]]) > 0 {
+		return true
+	}
+	// asn, "as15169"
+	if len(t) > 2 && strings.HasPrefix(t, "as") {
+		if strings.Trim(t[2:], "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// targetLevel returns the targeting level of a target ("europe" is a
+// continent, "us-ca" a region and "de.berlin" a city), or 0 if it isn't
+// a target.
+func targetLevel(t string) TargetOptions {
+	switch {
+	case strings.HasPrefix(t, "["):
+		return TargetIP
+	case isTimezoneBand(t):
+		return TargetTimezone
+	case len(countries.ContinentCountries[t]) > 0:
+		return TargetContinent
+	case len(countries.CountryContinent[t]) > 0:
+		return TargetCountry
+	case len(countries.RegionGroupRegions[t]) > 0:
+		return TargetRegionGroup
+	case strings.Contains(t, "."):
+		if len(countries.CountryContinent[t[:strings.Index(t, ".")]]) > 0 {
+			return TargetCity
+		}
+	case len(t) > 3 && t[2] == '-' && len(countries.CountryContinent[t[:2]]) > 0:
+		return TargetRegion
+	case resolverCategories.isCategory(t):
+		return TargetCategory
+	case isTargetName(t):
+		return TargetASN
+	}
+	return 0
+}
+
+// targetLevelName returns the name of a targeting level as in the
+// targeting option, or "global" for TargetGlobal.
+func targetLevelName(t TargetOptions) string {
+	if t == TargetGlobal {
+		return "global"
+	}
+	return t.String()
+}
+
+// labelTargetLevel returns the name of the targeting level of the
+// label's target; "country" for "www.dk" and "global" for "www".
+func labelTargetLevel(name string) string {
+	level := TargetOptions(TargetGlobal)
+	if base, ok := targetLabelBase(name); ok {
+		if t := targetLevel(strings.TrimPrefix(name[len(base):], ".")); t != 0 {
+			level = t
+		}
+	}
+	return targetLevelName(level)
+}
+
+// targetOverride sets the target for the clients in a network instead
+// of the GeoIP data.
+type targetOverride struct {
+	network *net.IPNet
+	target  string
+}
+
+// targetOverrides are sorted with the longest prefixes first, so the
+// first matching network is the longest prefix match.
+type targetOverrides []targetOverride
+
+func (o targetOverrides) Len() int      { return len(o) }
+func (o targetOverrides) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o targetOverrides) Less(i, j int) bool {
+	a, _ := o[i].network.Mask.Size()
+	b, _ := o[j].network.Mask.Size()
+	if a != b {
+		return a > b
+	}
+	return o[i].network.String() < o[j].network.String()
+}
+
+// parseTargetOverrides parses the "target_overrides" zone option, a map
+// of networks to targets:
+//
+//	{ "192.0.2.0/24": "dk", "2001:db8::/32": "as64500" }
+func parseTargetOverrides(m map[string]interface{}) (targetOverrides, error) {
+	var o targetOverrides
+	for cidr, v := range m {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad target override network '%s': %s", cidr, err)
+		}
+		target := strings.ToLower(valueToString(v))
+		if target != "@" && !isTargetName(target) {
+			return nil, fmt.Errorf("Bad target override '%s' for %s", target, cidr)
+		}
+		o = append(o, targetOverride{network: n, target: target})
+	}
+	sort.Sort(o)
+	return o, nil
+}
+
+// lookup returns the override with the longest prefix matching the IP.
+func (o targetOverrides) lookup(ip net.IP) (targetOverride, bool) {
+	for _, to := range o {
+		if to.network.Contains(ip) {
+			return to, true
+		}
+	}
+	return targetOverride{}, false
+}
+
+// overrideTargets returns the target and the broader targets it's part
+// of; "us-ca" is also in "us-west", "us" and "north-america".
+func overrideTargets(target string, t TargetOptions) []string {
+	var targets []string
+	if target != "@" {
+		targets = append(targets, target)
+		country := ""
+		switch {
+		case isTimezoneBand(target):
+			// the bands cross countries and continents
+		case len(countries.RegionGroupRegions[target]) > 0:
+			country = target[:2]
+		case len(target) > 3 && target[2] == '-':
+			if group, ok := countries.RegionGroups[target]; ok {
+				targets = append(targets, group)
+			}
+			country = target[:2]
+		case len(countries.CountryContinent[target]) > 0:
+			country = target
+		}
+		if len(country) > 0 {
+			if country != target {
+				targets = append(targets, country)
+			}
+			targets = append(targets, countries.CountryContinent[country])
+		}
+	}
+	if t&TargetGlobal > 0 {
+		targets = append(targets, "@")
+	}
+	return targets
+}
+
+// getTargets returns the targets for the client IP and the address
+// the query came from, from the zone's target overrides or the GeoIP
+// data.
+func (z *Zone) getTargets(ip, resolver net.IP) ([]string, int) {
+	if to, ok := z.Options.TargetOverrides.lookup(ip); ok {
+		ones, _ := to.network.Mask.Size()
+		return overrideTargets(to.target, z.Options.Targeting), ones
+	}
+	return z.Options.Targeting.GetTargetsOrder(ip, resolver, z.Options.TargetOrder)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
-	. "gopkg.in/check.v1"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"sort"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
 )
 
 type TargetingSuite struct {
@@ -31,6 +37,21 @@ func (s *TargetingSuite) TestTargetParse(c *C) {
 	c.Assert(err, IsNil)
 	str = tgt.String()
 	c.Check(str, Equals, "@ continent country asn")
+
+	// zones without asn targeting don't do the ASN lookup
+	c.Check(tgt&TargetASN > 0, Equals, true)
+	tgt, _ = parseTargets("@ continent country")
+	c.Check(tgt&TargetASN > 0, Equals, false)
+
+	tgt, err = parseTargets("@ country region city")
+	c.Assert(err, IsNil)
+	c.Check(tgt.String(), Equals, "@ country region city")
+}
+
+func (s *TargetingSuite) TestCityTarget(c *C) {
+	c.Check(cityTarget("Berlin"), Equals, "berlin")
+	c.Check(cityTarget("San Francisco"), Equals, "san-francisco")
+	c.Check(cityTarget(" Rio  de Janeiro "), Equals, "rio-de-janeiro")
 }
 
 func (s *TargetingSuite) TestGetTargets(c *C) {
@@ -61,9 +82,327 @@ func (s *TargetingSuite) TestGetTargets(c *C) {
 	targets, _ = tgt.GetTargets(ip)
 	c.Check(targets, DeepEquals, []string{"[207.171.1.1]", "[207.171.1.0]", "as7012", "us-ca", "us-west", "us", "north-america", "@"})
 
+	tgt, _ = parseTargets("@ continent country region city")
+	targets, _ = tgt.GetTargets(ip)
+	c.Assert(len(targets) > 0, Equals, true)
+	if len(targets) == 5 {
+		c.Check(targets[0], Matches, "us\\.[a-z-]+")
+		c.Check(targets[1:], DeepEquals, []string{"us-ca", "us", "north-america", "@"})
+	} else {
+		// no city data for the IP, the level is skipped
+		c.Check(targets, DeepEquals, []string{"us-ca", "us", "north-america", "@"})
+	}
+
 	ip = net.ParseIP("2607:f238:2:0::ff:4")
 	tgt, _ = parseTargets("ip")
 	targets, _ = tgt.GetTargets(ip)
 	c.Check(targets, DeepEquals, []string{"[2607:f238:2::ff:4]", "[2607:f238:2::]"})
 
 }
+
+func (s *TargetingSuite) TestTargetLabelBase(c *C) {
+	for name, expected := range map[string]string{
+		"www.europe":        "www",
+		"www.dk":            "www",
+		"dk":                "",
+		"www.us-ca":         "www",
+		"www.us-west":       "www",
+		"www.as15169":       "www",
+		"www.de.berlin":     "www",
+		"a.www.[1.0.0.255]": "a.www",
+		"[1.0.0.255]":       "",
+	} {
+		base, ok := targetLabelBase(name)
+		c.Check(ok, Equals, true, Commentf("name %s", name))
+		c.Check(base, Equals, expected, Commentf("name %s", name))
+	}
+
+	for _, name := range []string{"www", "a.b.c", "three.two.one", "www.asx"} {
+		base, ok := targetLabelBase(name)
+		c.Check(ok, Equals, false, Commentf("name %s", name))
+		c.Check(base, Equals, name)
+	}
+}
+
+func (s *TargetingSuite) TestLabelTargetLevel(c *C) {
+	for name, expected := range map[string]string{
+		"www":               "global",
+		"":                  "global",
+		"www.europe":        "continent",
+		"europe":            "continent",
+		"www.dk":            "country",
+		"www.us-ca":         "region",
+		"www.us-west":       "regiongroup",
+		"www.as15169":       "asn",
+		"www.de.berlin":     "city",
+		"a.www.[1.0.0.255]": "ip",
+	} {
+		c.Check(labelTargetLevel(name), Equals, expected, Commentf("name %s", name))
+	}
+}
+
+func (s *TargetingSuite) TestTargetOrder(c *C) {
+	order, err := parseTargetOrder("region country @")
+	c.Assert(err, IsNil)
+	c.Check(order, DeepEquals, []TargetOptions{TargetRegion, TargetCountry, TargetGlobal})
+
+	for _, bad := range []string{"", "country foo @", "country @ country"} {
+		_, err = parseTargetOrder(bad)
+		c.Check(err, NotNil, Commentf("order '%s'", bad))
+	}
+
+	levels := map[TargetOptions][]string{
+		TargetIP:        {"[192.0.2.1]", "[192.0.2.0]"},
+		TargetCountry:   {"dk"},
+		TargetContinent: {"europe"},
+		TargetGlobal:    {"@"},
+	}
+	c.Check(orderTargets(levels, nil), DeepEquals, []string{"[192.0.2.1]", "[192.0.2.0]", "dk", "europe", "@"})
+	order, _ = parseTargetOrder("country @")
+	c.Check(orderTargets(levels, order), DeepEquals, []string{"dk", "@"})
+	order, _ = parseTargetOrder("continent ip @")
+	c.Check(orderTargets(levels, order), DeepEquals, []string{"europe", "[192.0.2.1]", "[192.0.2.0]", "@"})
+}
+
+func (s *TargetingSuite) TestTargetOverrides(c *C) {
+	o, err := parseTargetOverrides(map[string]interface{}{
+		"192.0.2.0/24":  "dk",
+		"192.0.0.0/16":  "europe",
+		"192.0.2.128":   "us-ca",
+		"2001:db8::/32": "as64500",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(o, HasLen, 4)
+	c.Check(o[0].network.String(), Equals, "192.0.2.128/32")
+	c.Check(o[3].network.String(), Equals, "192.0.0.0/16")
+
+	for ip, target := range map[string]string{
+		"192.0.2.128":   "us-ca",
+		"192.0.2.1":     "dk",
+		"192.0.3.1":     "europe",
+		"2001:db8::1":   "as64500",
+		"198.51.100.1":  "",
+		"2001:db9::100": "",
+	} {
+		to, ok := o.lookup(net.ParseIP(ip))
+		c.Check(ok, Equals, len(target) > 0, Commentf("ip %s", ip))
+		c.Check(to.target, Equals, target, Commentf("ip %s", ip))
+	}
+
+	all := TargetOptions(TargetGlobal | TargetCountry | TargetContinent)
+	c.Check(overrideTargets("dk", all), DeepEquals, []string{"dk", "europe", "@"})
+	c.Check(overrideTargets("europe", all), DeepEquals, []string{"europe", "@"})
+	c.Check(overrideTargets("us-ca", all), DeepEquals, []string{"us-ca", "us-west", "us", "north-america", "@"})
+	c.Check(overrideTargets("us-west", all), DeepEquals, []string{"us-west", "us", "north-america", "@"})
+	c.Check(overrideTargets("as64500", TargetCountry), DeepEquals, []string{"as64500"})
+	c.Check(overrideTargets("@", all), DeepEquals, []string{"@"})
+
+	for _, bad := range []map[string]interface{}{
+		{"192.0.2.0/33": "dk"},
+		{"192.0.2.0/24": "atlantis"},
+	} {
+		_, err = parseTargetOverrides(bad)
+		c.Check(err, NotNil, Commentf("overrides %v", bad))
+	}
+}
+
+func (s *TargetingSuite) TestSpillover(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/spill.example.net.json"
+	zone := `{ "data": {
+		"www": { "a": [ [ "192.0.2.1" ] ] },
+		"www.us": { "a": [ [ "192.0.2.2" ] ], "spillover": 20 } } }`
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	z, err := readZoneFile("spill.example.net", fileName)
+	c.Assert(err, IsNil)
+	c.Check(z.Labels["www.us"].Spillover, Equals, 20)
+
+	targets := []string{"us", "north-america", "@"}
+	qts := qTypes{dns.TypeCNAME, dns.TypeA}
+	lookup := func(sticky string) string {
+		label, qtype := z.findLabels("www", targets, qts)
+		label, qtype = z.spillover("www", label, qtype, targets, qts, sticky)
+		c.Assert(qtype, Equals, dns.TypeA)
+		return label.Label
+	}
+
+	const n = 5000
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[lookup("")]++
+	}
+	c.Check(counts["www"] > n*15/100 && counts["www"] < n*25/100, Equals, true, Commentf("%v", counts))
+
+	// sticky keys always get the same label
+	counts = map[string]int{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+		name := lookup(key)
+		c.Assert(lookup(key), Equals, name)
+		counts[name]++
+	}
+	c.Check(counts["www"] > n*15/100 && counts["www"] < n*25/100, Equals, true, Commentf("%v", counts))
+
+	// nothing to spill over to
+	label, _ := z.spillover("www", z.Labels["www.us"], dns.TypeA, []string{"us"}, qts, "")
+	c.Check(label.Label, Equals, "www.us")
+
+	zone = `{ "data": { "www": { "a": [ [ "192.0.2.1" ] ], "spillover": 101 } } }`
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	_, err = readZoneFile("spill.example.net", fileName)
+	c.Check(err, NotNil)
+}
+
+func (s *TargetingSuite) TestMinHealthy(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/minhealthy.example.net.json"
+	zone := `{ "data": {
+		"www": { "a": [ [ "192.0.2.1", 10 ], [ "192.0.2.2", 10 ] ] },
+		"www.europe": { "a": [ [ "192.0.2.11", 10 ], [ "192.0.2.12", 10 ], [ "192.0.2.13", 10 ] ],
+			"min_healthy": 2 } } }`
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	z, err := readZoneFile("minhealthy.example.net", fileName)
+	c.Assert(err, IsNil)
+	c.Check(z.Labels["www.europe"].MinHealthy, Equals, 2)
+
+	targets := []string{"dk", "europe", "@"}
+	lookup := func() (*Label, []string) {
+		label, qtype := z.findLabels("www", targets, qTypes{dns.TypeA})
+		label = z.minHealthy("www", label, qtype, targets)
+		var ips []string
+		for _, r := range label.Select(dns.TypeA, 10, "", "", nil) {
+			ips = append(ips, r.RR.(*dns.A).A.String())
+		}
+		sort.Strings(ips)
+		return label, ips
+	}
+	europe := z.Labels["www.europe"]
+	global := z.Labels["www"]
+
+	label, ips := lookup()
+	c.Check(label, Equals, europe)
+	c.Check(ips, DeepEquals, []string{"192.0.2.11", "192.0.2.12", "192.0.2.13"})
+
+	// at the threshold only the local records are used
+	setUnhealthy(c, &europe.Records[dns.TypeA][0])
+	label, ips = lookup()
+	c.Check(label, Equals, europe)
+	c.Check(ips, DeepEquals, []string{"192.0.2.12", "192.0.2.13"})
+
+	// below it the healthy global records are added
+	setUnhealthy(c, &europe.Records[dns.TypeA][1])
+	label, ips = lookup()
+	c.Check(label.Label, Equals, "www.europe")
+	c.Check(ips, DeepEquals, []string{"192.0.2.1", "192.0.2.13", "192.0.2.2"})
+	c.Check(label.Weight[dns.TypeA], Equals, 30)
+	// the zone's label isn't changed
+	c.Check(europe.Records[dns.TypeA], HasLen, 3)
+
+	// unhealthy global records aren't added
+	setUnhealthy(c, &global.Records[dns.TypeA][0])
+	_, ips = lookup()
+	c.Check(ips, DeepEquals, []string{"192.0.2.13", "192.0.2.2"})
+
+	// with no healthy global records the local records are used as usual
+	setUnhealthy(c, &global.Records[dns.TypeA][1])
+	label, ips = lookup()
+	c.Check(label, Equals, europe)
+	c.Check(ips, DeepEquals, []string{"192.0.2.13"})
+
+	// and when the local records are healthy again the global ones
+	// aren't used
+	global.Records[dns.TypeA][1].Test = nil
+	europe.Records[dns.TypeA][0].Test = nil
+	label, ips = lookup()
+	c.Check(label, Equals, europe)
+	c.Check(ips, DeepEquals, []string{"192.0.2.11", "192.0.2.13"})
+
+	zone = `{ "data": { "www": { "a": [ [ "192.0.2.1" ] ], "min_healthy": -1 } } }`
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	_, err = readZoneFile("minhealthy.example.net", fileName)
+	c.Check(err, NotNil)
+}
+
+func (s *TargetingSuite) TestPools(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(data string) (*Zone, error) {
+		return readTestZone(c, dir, "pools.example.net",
+			`{ "data": { "": { "ns": [ "ns1.example.net" ] }, `+data+` } }`)
+	}
+
+	z, err := readZone(`
+		"www": { "a": [ [ "192.0.2.1", 0 ] ] },
+		"www.de": { "a": [ [ "192.0.2.11", 0 ] ] },
+		"www.fr": { "a": [ [ "192.0.2.21", 0 ] ], "aaaa": [ [ "2001:db8::21", 0 ] ] },
+		"www.nl": { "a": [ [ "192.0.2.31", 0 ] ] },
+		"www.europe": { "pools": [ [ "www.de", 60 ], [ "www.fr", 30 ], [ "www.nl", 10 ] ],
+			"txt": "europe" }`)
+	c.Assert(err, IsNil)
+	c.Check(z.Labels["www.europe"].Pools, DeepEquals,
+		[]labelPool{{"www.de", 60}, {"www.fr", 30}, {"www.nl", 10}})
+
+	lookup := func(targets []string, qtype uint16) string {
+		label, labelQtype := z.findLabels("www", targets, qTypes{dns.TypeCNAME, qtype})
+		c.Assert(label, NotNil)
+		c.Check(labelQtype, Equals, qtype)
+		return label.Label
+	}
+
+	// clients only placed on the continent are split by the weights
+	n := 10000
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[lookup([]string{"europe", "@"}, dns.TypeA)]++
+	}
+	c.Check(counts, HasLen, 3)
+	for label, share := range map[string]float64{"www.de": 0.6, "www.fr": 0.3, "www.nl": 0.1} {
+		got := float64(counts[label]) / float64(n)
+		c.Check(got > share-0.03 && got < share+0.03, Equals, true, Commentf("%s: %.3f", label, got))
+	}
+
+	// clients in a country get its label; the other continents the
+	// global label
+	c.Check(lookup([]string{"fr", "europe", "@"}, dns.TypeA), Equals, "www.fr")
+	c.Check(lookup([]string{"us", "north-america", "@"}, dns.TypeA), Equals, "www")
+
+	// only the pools with the type (and healthy records) are used,
+	// then the label's own records
+	c.Check(lookup([]string{"europe", "@"}, dns.TypeAAAA), Equals, "www.fr")
+	setUnhealthy(c, &z.Labels["www.de"].Records[dns.TypeA][0])
+	for i := 0; i < 100; i++ {
+		c.Check(lookup([]string{"europe", "@"}, dns.TypeA), Not(Equals), "www.de")
+	}
+	c.Check(lookup([]string{"europe", "@"}, dns.TypeTXT), Equals, "www.europe")
+	label, qtype := z.findLabels("www", []string{"europe", "@"}, qTypes{dns.TypeMX})
+	c.Check(label.Label, Equals, "www")
+	c.Check(qtype, Equals, uint16(0))
+
+	// pools of pools are followed
+	z, err = readZone(`
+		"www.de": { "a": [ [ "192.0.2.11", 0 ] ] },
+		"www.west": { "pools": [ [ "www.de", 1 ] ] },
+		"www.europe": { "pools": [ [ "www.west", 1 ] ] }`)
+	c.Assert(err, IsNil)
+	c.Check(lookup([]string{"europe", "@"}, dns.TypeA), Equals, "www.de")
+
+	for _, bad := range []string{
+		`"www.europe": { "pools": [ [ "www.de", 1 ] ] }`,
+		`"www.europe": { "pools": [ [ "www.europe", 1 ] ] }`,
+		`"a": { "pools": [ [ "b", 1 ] ] }, "b": { "pools": [ [ "c", 1 ] ] }, "c": { "pools": [ [ "a", 1 ] ] }`,
+		`"www.de": { "a": [ [ "192.0.2.11", 0 ] ] }, "www.europe": { "pools": [ [ "www.de", -1 ] ] }`,
+		`"www.de": { "a": [ [ "192.0.2.11", 0 ] ] }, "www.europe": { "pools": [ "www.de" ] }`,
+		`"www.de": { "a": [ [ "192.0.2.11", 0 ] ] }, "www.europe": { "pools": [ [ "www.de", 1 ], [ "www.de", 2 ] ] }`,
+	} {
+		_, err = readZone(bad)
+		c.Check(err, NotNil, Commentf("%s", bad))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// timezoneBands is the number of longitude bands for the "timezone"
+// targeting, each 45 degrees or about three hours wide. The bands are
+// single digits so "tz-3" can't be mistaken for a region of Tanzania
+// ("tz-03").
+const timezoneBands = 8
+
+// timezoneBand returns the target for the longitude band of the
+// location: "tz-0" is centered on longitude 0 (UTC) and "tz-N" on
+// longitude 45*N east (UTC+3N hours, so "tz-7" is UTC-3). It returns
+// false for locations without coordinates.
+func timezoneBand(loc *Location) (string, bool) {
+	if loc == nil || loc.Latitude == 0 && loc.Longitude == 0 {
+		return "", false
+	}
+	width := 360.0 / timezoneBands
+	band := int(math.Floor(math.Mod(loc.Longitude+width/2+360, 360) / width))
+	return "tz-" + strconv.Itoa(band%timezoneBands), true
+}
+
+// isTimezoneBand returns true for the timezone targets, "tz-0" to
+// "tz-7".
+func isTimezoneBand(t string) bool {
+	if len(t) != 4 || !strings.HasPrefix(t, "tz-") {
+		return false
+	}
+	n, err := strconv.Atoi(t[3:])
+	return err == nil && n >= 0 && n < timezoneBands
+}
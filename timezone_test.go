@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TargetingSuite) TestTimezoneBand(c *C) {
+	for _, t := range []struct {
+		lat, lon float64
+		band     string
+	}{
+		{51.5, -0.13, "tz-0"},    // London
+		{52.5, 13.4, "tz-0"},     // Berlin
+		{55.75, 37.62, "tz-1"},   // Moscow
+		{28.6, 77.2, "tz-2"},     // Delhi
+		{35.7, 139.7, "tz-3"},    // Tokyo
+		{-36.85, 174.76, "tz-4"}, // Auckland
+		{61.2, -149.9, "tz-5"},   // Anchorage
+		{37.77, -122.42, "tz-5"}, // San Francisco
+		{40.7, -74.0, "tz-6"},    // New York
+		{-23.55, -46.63, "tz-7"}, // São Paulo
+		{-16.5, 180, "tz-4"},
+		{-16.5, -180, "tz-4"},
+	} {
+		band, ok := timezoneBand(&Location{t.lat, t.lon})
+		c.Check(ok, Equals, true)
+		c.Check(band, Equals, t.band, Commentf("%v", t))
+	}
+	_, ok := timezoneBand(nil)
+	c.Check(ok, Equals, false)
+	_, ok = timezoneBand(&Location{})
+	c.Check(ok, Equals, false)
+
+	c.Check(isTimezoneBand("tz-7"), Equals, true)
+	c.Check(isTimezoneBand("tz-8"), Equals, false)
+	c.Check(isTimezoneBand("tz-03"), Equals, false)
+	c.Check(targetLevel("tz-3"), Equals, TargetOptions(TargetTimezone))
+	c.Check(targetLevel("tz-03"), Equals, TargetOptions(TargetRegion))
+	base, ok := targetLabelBase("www.tz-3")
+	c.Check(ok, Equals, true)
+	c.Check(base, Equals, "www")
+	c.Check(overrideTargets("tz-3", TargetGlobal|TargetTimezone), DeepEquals, []string{"tz-3", "@"})
+}
+
+func (s *TargetingSuite) TestTimezoneTargets(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/overrides.json"
+	c.Assert(ioutil.WriteFile(fileName, []byte(`{
+		"192.0.2.0/24": { "country": "jp", "latitude": 35.7, "longitude": 139.7 },
+		"198.51.100.0/24": { "country": "jp" }
+	}`), 0644), IsNil)
+	p, err := newGeoProvider("override:" + fileName)
+	c.Assert(err, IsNil)
+
+	saved := geoIP.providers
+	geoIP.providers = []geoProvider{p}
+	defer func() { geoIP.providers = saved }()
+
+	tgt, err := parseTargets("@ continent country timezone")
+	c.Assert(err, IsNil)
+	c.Check(tgt.String(), Equals, "@ continent country timezone")
+
+	targets, _ := tgt.GetTargets(net.ParseIP("192.0.2.1"))
+	c.Check(targets, DeepEquals, []string{"tz-3", "jp", "asia", "@"})
+
+	// without coordinates the country is next
+	targets, _ = tgt.GetTargets(net.ParseIP("198.51.100.1"))
+	c.Check(targets, DeepEquals, []string{"jp", "asia", "@"})
+}
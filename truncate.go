@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// maxUDPSize is the largest UDP response sent, the buffer size
+// advertised in our OPT records.
+const maxUDPSize = 4096
+
+// udpSize returns the largest UDP response the client accepts; 512
+// bytes or the buffer size in the EDNS OPT record.
+func udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	return size
+}
+
+// truncateMsg makes the response fit in size bytes. The additional and
+// authority records are dropped first and then the answers, keeping
+// the ones first in the preferred order (the indexes of the answers,
+// best first). The TC bit is set if answers were dropped so the client
+// retries over TCP. Signed answers are dropped altogether, since the
+// signatures are for the complete RRsets.
+func truncateMsg(m *dns.Msg, size int, preferred []int) bool {
+	if m.Len() <= size {
+		return false
+	}
+
+	// keep the OPT record
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	if m.Len() <= size {
+		return false
+	}
+	m.Ns = nil
+	if m.Len() <= size {
+		return false
+	}
+
+	m.Truncated = true
+
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			m.Answer = nil
+			return true
+		}
+	}
+
+	if len(preferred) != len(m.Answer) {
+		preferred = make([]int, len(m.Answer))
+		for i := range preferred {
+			preferred[i] = i
+		}
+	}
+	answers := m.Answer
+	for n := len(preferred) - 1; n >= 0 && m.Len() > size; n-- {
+		keep := append([]int{}, preferred[:n]...)
+		sort.Ints(keep)
+		m.Answer = make([]dns.RR, len(keep))
+		for i, idx := range keep {
+			m.Answer[i] = answers[idx]
+		}
+	}
+	return true
+}
+
+// truncateAll removes the records from the response (except for the
+// OPT record) and sets the TC bit, so the client retries over TCP.
+func truncateAll(m *dns.Msg) {
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Answer, m.Ns, m.Extra = nil, nil, extra
+	m.Truncated = true
+}
+
+// preferredRecords returns the indexes of the records with the healthy
+// ones first and then by weight, for truncating the answers.
+func preferredRecords(records Records) []int {
+	idx := make([]int, len(records))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		a, b := records[idx[i]], records[idx[j]]
+		if ah, bh := a.IsServeable(), b.IsServeable(); ah != bh {
+			return ah
+		}
+		return a.Weight > b.Weight
+	})
+	return idx
+}
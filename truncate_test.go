@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *PickerSuite) TestTruncateMsg(c *C) {
+	label := pickerLabel(1, 50, 1, 1)
+	records := label.Records[dns.TypeA]
+	setUnhealthy(c, &records[1])
+	c.Check(preferredRecords(records), DeepEquals, []int{0, 2, 3, 1})
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	for _, r := range records {
+		m.Answer = append(m.Answer, r.RR)
+	}
+	m.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns1.example.com."}}
+	m.SetEdns0(4096, false)
+
+	c.Check(truncateMsg(m, 512, nil), Equals, false)
+	c.Check(m.Ns, HasLen, 1)
+
+	// the authority section goes first
+	full := m.Len()
+	c.Check(truncateMsg(m, full-1, nil), Equals, false)
+	c.Check(m.Ns, HasLen, 0)
+	c.Check(m.IsEdns0(), NotNil)
+
+	// then the least preferred answers
+	c.Check(truncateMsg(m, m.Len()-1, preferredRecords(records)), Equals, true)
+	c.Check(m.Truncated, Equals, true)
+	c.Assert(m.Answer, HasLen, 3)
+	for i, ip := range []string{"192.168.1.1", "192.168.1.3", "192.168.1.4"} {
+		c.Check(m.Answer[i].(*dns.A).A.Equal(net.ParseIP(ip)), Equals, true)
+	}
+
+	req := new(dns.Msg)
+	c.Check(udpSize(req), Equals, 512)
+	req.SetEdns0(1232, false)
+	c.Check(udpSize(req), Equals, 1232)
+	req = new(dns.Msg)
+	req.SetEdns0(65000, false)
+	c.Check(udpSize(req), Equals, maxUDPSize)
+}
+
+func (s *ServeSuite) TestServingTCPOnly(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/tcponly.example.net.json"
+	data := `{"target_overrides": {"127.0.0.1": "europe"},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"secret": {"a": [["192.0.2.1", 0]], "tcp_only": true},
+		"secret.europe": {"a": [["192.0.2.2", 0]]},
+		"public": {"a": [["192.0.2.3", 0]]},
+		"other": {"alias": "secret"}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	for _, name := range []string{"secret", "secret.europe", "other"} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name+".tcponly.example.net.", dns.TypeA)
+		msg.SetEdns0(4096, false)
+		r, _, err := new(dns.Client).Exchange(msg, "127.0.0.1"+PORT)
+		c.Check(err, Equals, dns.ErrTruncated)
+		c.Assert(r, NotNil)
+		c.Check(r.Truncated, Equals, true, Commentf("name %s", name))
+		c.Check(r.Answer, HasLen, 0)
+		c.Check(r.IsEdns0(), NotNil)
+
+		cli := &dns.Client{Net: "tcp"}
+		r, _, err = cli.Exchange(msg, "127.0.0.1"+PORT)
+		c.Assert(err, IsNil)
+		c.Check(r.Truncated, Equals, false)
+		c.Assert(r.Answer, HasLen, 1)
+		c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.2")
+	}
+
+	r := exchange(c, "public.tcponly.example.net.", dns.TypeA)
+	c.Check(r.Truncated, Equals, false)
+	c.Check(r.Answer, HasLen, 1)
+}
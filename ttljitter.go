@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ttlJitter is the "ttl_jitter" zone option; the TTLs in the responses
+// are changed randomly by up to percent, so the clients that got an
+// answer at the same time don't all query again at the same time.
+type ttlJitter struct {
+	percent int
+	floor   uint32 // TTLs aren't lowered below this
+}
+
+// parseTTLJitter parses the "ttl_jitter" zone option:
+//
+//	{ "percent": 10, "floor": 30 }
+func parseTTLJitter(m map[string]interface{}) (*ttlJitter, error) {
+	j := &ttlJitter{floor: 1}
+	for k, v := range m {
+		switch k {
+		case "percent":
+			j.percent = valueToInt(v)
+			if j.percent < 0 || j.percent > 50 {
+				return nil, fmt.Errorf("Bad ttl_jitter percent %v (0 to 50)", v)
+			}
+		case "floor":
+			floor := valueToInt(v)
+			if floor < 0 {
+				return nil, fmt.Errorf("Bad ttl_jitter floor %v", v)
+			}
+			j.floor = uint32(floor)
+		default:
+			return nil, fmt.Errorf("Unknown ttl_jitter option '%s'", k)
+		}
+	}
+	return j, nil
+}
+
+// apply changes the TTLs in the response by the same random factor, so
+// the RRsets keep a single TTL. The signatures in signed responses are
+// for the original TTLs, so those are only lowered, and not beyond the
+// expiration of the signatures.
+func (j *ttlJitter) apply(m *dns.Msg, now time.Time) {
+	if j == nil || j.percent == 0 {
+		return
+	}
+	f := (rand.Float64()*2 - 1) * float64(j.percent) / 100
+
+	signed := false
+	validity := int64(math.MaxUint32)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				signed = true
+				if left := int64(sig.Expiration) - now.Unix(); left < validity {
+					validity = left
+				}
+			}
+		}
+	}
+	if signed && f > 0 {
+		f = -f
+	}
+	if validity < 0 {
+		validity = 0
+	}
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl := rr.Header().Ttl
+			n := ttl
+			if ttl > j.floor {
+				n = uint32(math.Floor(float64(ttl)*(1+f) + 0.5))
+				if n < j.floor {
+					n = j.floor
+				}
+			}
+			if signed && int64(n) > validity {
+				n = uint32(validity)
+			}
+			if n != ttl {
+				// the records can be the zone's own (the SOA record)
+				section[i] = dns.Copy(rr)
+				section[i].Header().Ttl = n
+			}
+		}
+	}
+}
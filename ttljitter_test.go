@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestTTLJitter(c *C) {
+	_, err := parseTTLJitter(map[string]interface{}{"percent": 60.0})
+	c.Check(err, NotNil)
+	_, err = parseTTLJitter(map[string]interface{}{"percent": 10.0, "floor": -1.0})
+	c.Check(err, NotNil)
+	_, err = parseTTLJitter(map[string]interface{}{"percentage": 10.0})
+	c.Check(err, NotNil)
+
+	j, err := parseTTLJitter(map[string]interface{}{"percent": 10.0, "floor": 30.0})
+	c.Assert(err, IsNil)
+
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		c.Assert(err, IsNil)
+		return rr
+	}
+	soa := rr("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 2 3 4 5")
+
+	now := time.Now()
+	seen := map[uint32]bool{}
+	for i := 0; i < 200; i++ {
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{rr("www.example.com. 300 IN A 192.0.2.1"), rr("www.example.com. 300 IN A 192.0.2.2")}
+		m.Ns = []dns.RR{soa}
+		m.Extra = []dns.RR{rr("short.example.com. 20 IN A 192.0.2.3")}
+		j.apply(m, now)
+
+		ttl := m.Answer[0].Header().Ttl
+		c.Assert(ttl >= 270 && ttl <= 330, Equals, true, Commentf("ttl %d", ttl))
+		c.Check(m.Answer[1].Header().Ttl, Equals, ttl)
+		c.Check(m.Ns[0].Header().Ttl, Equals, ttl)
+		// below the floor
+		c.Check(m.Extra[0].Header().Ttl, Equals, uint32(20))
+		seen[ttl] = true
+	}
+	c.Check(len(seen) > 10, Equals, true)
+	// the records are copied, not changed
+	c.Check(soa.Header().Ttl, Equals, uint32(300))
+
+	// the floor
+	j = &ttlJitter{percent: 50, floor: 280}
+	for i := 0; i < 50; i++ {
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{rr("www.example.com. 300 IN A 192.0.2.1")}
+		j.apply(m, now)
+		c.Check(m.Answer[0].Header().Ttl >= 280, Equals, true)
+	}
+
+	// signed answers are only lowered, within the signature validity
+	j = &ttlJitter{percent: 20, floor: 1}
+	for _, expires := range []time.Duration{time.Hour, 100 * time.Second} {
+		for i := 0; i < 50; i++ {
+			m := new(dns.Msg)
+			sig := &dns.RRSIG{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+				TypeCovered: dns.TypeA, OrigTtl: 300, Expiration: uint32(now.Add(expires).Unix())}
+			m.Answer = []dns.RR{rr("www.example.com. 300 IN A 192.0.2.1"), sig}
+			j.apply(m, now)
+			ttl := m.Answer[0].Header().Ttl
+			c.Check(ttl <= 300 && ttl >= 240 || expires < 240*time.Second && ttl == 100, Equals, true, Commentf("ttl %d", ttl))
+			c.Check(m.Answer[1].Header().Ttl, Equals, ttl)
+		}
+	}
+}
+
+func (s *ServeSuite) TestServingTTLJitter(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	fileName := dir + "/jitter.example.net.json"
+	data := `{"ttl": 600, "ttl_jitter": {"percent": 20},
+		"data": {"": {"ns": ["ns1.example.net"]},
+		"www": {"a": [["192.0.2.1", 0]]}}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		os.Remove(fileName)
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	seen := map[uint32]bool{}
+	for i := 0; i < 20; i++ {
+		r := exchange(c, "www.jitter.example.net.", dns.TypeA)
+		c.Assert(r.Answer, HasLen, 1)
+		ttl := r.Answer[0].Header().Ttl
+		c.Check(ttl >= 480 && ttl <= 720, Equals, true, Commentf("ttl %d", ttl))
+		seen[ttl] = true
+	}
+	c.Check(len(seen) > 1, Equals, true)
+
+	// the negative answers too, without changing the zone's SOA record
+	r := exchange(c, "nope.jitter.example.net.", dns.TypeA)
+	c.Assert(r.Ns, HasLen, 1)
+	c.Check(zones["jitter.example.net"].SoaRR().Header().Ttl, Equals, uint32(3600))
+}
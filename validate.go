@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Validate checks that the zone is consistent and returns the problems
+// found. It doesn't use the network, CNAME targets outside of the zone
+// aren't resolved and the health checks aren't run (their options are
+// checked when the zone is read).
+func (z *Zone) Validate() []error {
+	z.RLock()
+	defer z.RUnlock()
+
+	var errs []error
+	problem := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	// the labels for each name, for all the targets
+	names := map[string][]*Label{}
+	for k, label := range z.Labels {
+		base, _ := targetLabelBase(k)
+		names[base] = append(names[base], label)
+	}
+	exists := func(name string) bool {
+		_, ok := names[name]
+		return ok || z.targetedNames[name]
+	}
+	hasRecords := func(name string, qtypes ...uint16) bool {
+		if wildcard := wildcardFor(name, exists); len(wildcard) > 0 {
+			name = wildcard
+		}
+		for _, label := range names[name] {
+			if len(qtypes) == 0 && len(label.Alias) > 0 {
+				return true
+			}
+			for qtype, records := range label.Records {
+				if len(records) == 0 {
+					continue
+				}
+				if len(qtypes) == 0 {
+					return true
+				}
+				for _, t := range qtypes {
+					if t == qtype {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+
+	origin := strings.ToLower(dns.Fqdn(z.Origin))
+	checkTarget := func(k string, rr dns.RR, target string, qtypes ...uint16) {
+		target = strings.ToLower(target)
+		if target == "." || !dns.IsSubDomain(origin, target) {
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(target, origin), ".")
+		if !hasRecords(name, qtypes...) {
+			problem("%s: %s target %s doesn't have any %s", labelDisplayName(k),
+				dns.TypeToString[rr.Header().Rrtype], target, recordsDescription(qtypes))
+		}
+	}
+
+	keys := make([]string, 0, len(z.Labels))
+	for k := range z.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		label := z.Labels[k]
+
+		if len(label.Alias) > 0 {
+			if !hasRecords(label.Alias) {
+				problem("%s: alias target %s doesn't have any records", labelDisplayName(k), labelDisplayName(label.Alias))
+			}
+			seen := map[string]bool{k: true}
+			for alias := label.Alias; len(alias) > 0; {
+				if seen[alias] {
+					problem("%s: alias loop", labelDisplayName(k))
+					break
+				}
+				seen[alias] = true
+				next, ok := z.Labels[alias]
+				if !ok {
+					break
+				}
+				alias = next.Alias
+			}
+		}
+
+		qtypes := make([]int, 0, len(label.Records))
+		for qtype := range label.Records {
+			qtypes = append(qtypes, int(qtype))
+		}
+		sort.Ints(qtypes)
+		for _, qtype := range qtypes {
+			for _, records := range []Records{label.Records[uint16(qtype)], label.Backup[uint16(qtype)]} {
+				for _, r := range records {
+					if r.Weight < 0 {
+						problem("%s: %s has a negative weight (%d)", labelDisplayName(k), rdataString(r.RR), r.Weight)
+					}
+					switch rr := r.RR.(type) {
+					case *dns.CNAME:
+						checkTarget(k, rr, rr.Target)
+					case *dns.MX:
+						checkTarget(k, rr, rr.Mx, dns.TypeA, dns.TypeAAAA)
+					case *dns.NS:
+						checkTarget(k, rr, rr.Ns, dns.TypeA, dns.TypeAAAA)
+					case *dns.SRV:
+						checkTarget(k, rr, rr.Target, dns.TypeA, dns.TypeAAAA)
+					}
+				}
+			}
+		}
+
+		if label.Order == OrderNearest {
+			if len(label.Records[dns.TypeA])+len(label.Records[dns.TypeAAAA]) == 0 {
+				problem("%s: closest is set but there are no A or AAAA records", labelDisplayName(k))
+			}
+			for _, qtype := range locationQtypes {
+				for _, r := range label.Records[qtype] {
+					if r.Loc == nil {
+						problem("%s: no location for %s (closest)", labelDisplayName(k), rdataString(r.RR))
+					}
+				}
+			}
+		}
+
+		if z.Options.Targeting == TargetGlobal || len(label.Records) == 0 && len(label.Alias) == 0 {
+			// without targeting "www.dk" is just a name; the labels
+			// without records are parents of other labels ("us-ca"
+			// for "www.us-ca")
+			continue
+		}
+		if base, ok := targetLabelBase(k); ok {
+			target := strings.TrimPrefix(k[len(base):], ".")
+			if level := targetLevel(target); level > 0 && z.Options.Targeting&level == 0 {
+				problem("%s: the zone doesn't have %s targeting", labelDisplayName(k), level)
+			}
+		} else if i := strings.LastIndex(k, "."); i > 0 && z.Options.Targeting&TargetCountry > 0 {
+			// a typo'd country ("www.uk") for a name in the zone
+			if code := k[i+1:]; len(code) == 2 && len(names[k[:i]]) > 0 && strings.Trim(code, "abcdefghijklmnopqrstuvwxyz") == "" {
+				problem("%s: unknown country code '%s'", labelDisplayName(k), code)
+			}
+		}
+	}
+
+	targets := make([]string, 0, len(z.Options.TargetMaxHosts))
+	for t := range z.Options.TargetMaxHosts {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	for _, t := range targets {
+		if !isTargetName(t) {
+			problem("target_max_hosts: unknown target '%s'", t)
+		}
+	}
+
+	return errs
+}
+
+// labelDisplayName is the label name for the problems, "@" for the apex.
+func labelDisplayName(k string) string {
+	if len(k) == 0 {
+		return "@"
+	}
+	return k
+}
+
+// recordsDescription describes the record types for the problems.
+func recordsDescription(qtypes []uint16) string {
+	if len(qtypes) == 0 {
+		return "records"
+	}
+	types := make([]string, len(qtypes))
+	for i, t := range qtypes {
+		types[i] = dns.TypeToString[t]
+	}
+	return strings.Join(types, " or ") + " records"
+}
+
+// validateZonesDir reads the zone files in the directory (without
+// serving them or starting the health checks) and writes the problems
+// found to out, and notes on the weights. It returns false if there
+// were any problems.
+func validateZonesDir(dirName string, out io.Writer) bool {
+	dir, err := ioutil.ReadDir(dirName)
+	if err != nil {
+		fmt.Fprintf(out, "Could not read %s: %s\n", dirName, err)
+		return false
+	}
+
+	ok := true
+	for _, file := range dir {
+		if !isZoneFile(file) {
+			continue
+		}
+		zoneName := zoneNameFromFile(file.Name())
+		zone, err := readZone(zoneName, path.Join(dirName, file.Name()))
+		if err != nil {
+			errs, isList := err.(zoneErrors)
+			if !isList {
+				errs = zoneErrors{err}
+			}
+			for _, err := range errs {
+				fmt.Fprintf(out, "%s: %s\n", zoneName, err)
+			}
+			ok = false
+			continue
+		}
+		for _, err := range zone.Validate() {
+			fmt.Fprintf(out, "%s: %s\n", zoneName, err)
+			ok = false
+		}
+		for _, note := range zone.WeightShares() {
+			fmt.Fprintf(out, "%s: note: %s\n", zoneName, note)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestValidate(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	data := `{"target_max_hosts": {"europa": 1},
+		"data": {
+		"": {"ns": {"ns1.example.net": null}, "mx": [{"mx": "mail.validate.example.net"}]},
+		"mail": {"a": [["192.0.2.1", 0]]},
+		"mail.europe": {"a": [["192.0.2.2", 0]]},
+		"ok": {"cname": "mail"},
+		"out": {"cname": "www.example.com."},
+		"www": {"cname": "missing"},
+		"www.uk": {"a": [["192.0.2.3", 0]]},
+		"www.us-ca": {"a": [["192.0.2.4", 0]]},
+		"web": {"alias": "nowhere"},
+		"loop1": {"alias": "loop2"},
+		"loop2": {"alias": "loop1"},
+		"neg": {"a": [["192.0.2.5", -1]]},
+		"close": {"closest": true, "a": [["192.0.2.6", 0]]},
+		"_sip._tcp": {"srv": [{"target": "sip", "port": 5060}]}
+	}}`
+	fileName := dir + "/validate.example.net.json"
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+
+	z, err := readZoneFile("validate.example.net", fileName)
+	c.Assert(err, IsNil)
+
+	var problems []string
+	for _, err := range z.Validate() {
+		problems = append(problems, err.Error())
+	}
+	c.Check(problems, DeepEquals, []string{
+		"_sip._tcp: SRV target sip.validate.example.net. doesn't have any A or AAAA records",
+		"close: no location for 192.0.2.6 (closest)",
+		"loop1: alias loop",
+		"loop2: alias loop",
+		"neg: 192.0.2.5 has a negative weight (-1)",
+		"web: alias target nowhere doesn't have any records",
+		"www: CNAME target missing.validate.example.net. doesn't have any records",
+		"www.uk: unknown country code 'uk'",
+		"www.us-ca: the zone doesn't have region targeting",
+		"target_max_hosts: unknown target 'europa'",
+	})
+
+	var out bytes.Buffer
+	c.Check(validateZonesDir(dir, &out), Equals, false)
+	c.Check(strings.Count(out.String(), "validate.example.net: "), Equals, len(problems))
+
+	// a consistent zone
+	data = `{"data": {
+		"": {"ns": {"ns1.validate.example.net": null}, "mx": [{"mx": "mail.validate.example.net"}]},
+		"ns1": {"a": [["192.0.2.1", 0]]},
+		"mail.europe": {"aaaa": [["2001:db8::1", 0]]},
+		"www": {"alias": "mail"},
+		"www.dk": {"cname": "www.example.com."}
+	}}`
+	c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+	z, err = readZoneFile("validate.example.net", fileName)
+	c.Assert(err, IsNil)
+	c.Check(z.Validate(), HasLen, 0)
+
+	out.Reset()
+	c.Check(validateZonesDir(dir, &out), Equals, true)
+	c.Check(out.String(), Equals, "")
+}
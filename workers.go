@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const defaultWorkerQueue = 1000
+
+// workerPool limits the queries answered at once to the number of
+// workers, with up to queue more queries waiting for a worker. UDP
+// queries get their place in the pool when they're read from the
+// socket, before the DNS server starts a goroutine for them, and are
+// dropped without an answer while the pool is full, so a flood of
+// queries can't pile up goroutines and memory (the clients of dropped
+// queries retry). TCP and TLS queries get their place before they're
+// answered.
+type workerPool struct {
+	mu   sync.Mutex
+	free *sync.Cond // signaled when a worker is done
+
+	workers int // no limit if 0
+	queue   int
+
+	pending int // the queries answered or waiting
+	active  int // the queries answered
+
+	dropped metrics.Meter
+	queued  metrics.Counter // the queries waiting for a worker
+}
+
+var queryWorkers = newWorkerPool(metrics.DefaultRegistry)
+
+func newWorkerPool(registry metrics.Registry) *workerPool {
+	p := &workerPool{
+		dropped: metrics.GetOrRegisterMeter("queries-dropped", registry),
+		queued:  metrics.GetOrRegisterCounter("queries-queued", registry),
+	}
+	p.free = sync.NewCond(&p.mu)
+	return p
+}
+
+// setup changes the number of workers and the queue from the [workers]
+// section of the configuration; without workers the queries aren't
+// limited. The queries in the pool when the limits are lowered are
+// still answered.
+func (p *workerPool) setup(workers, queue int) error {
+	if workers < 0 || queue < 0 {
+		return fmt.Errorf("bad workers count %d or queue %d", workers, queue)
+	}
+	if queue == 0 {
+		queue = defaultWorkerQueue
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workers = workers
+	p.queue = queue
+	p.free.Broadcast()
+	return nil
+}
+
+// reserve gets a place in the pool for a query, or returns false (and
+// counts the query as dropped) if the pool is full.
+func (p *workerPool) reserve() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.workers > 0 && p.pending >= p.workers+p.queue {
+		p.dropped.Mark(1)
+		return false
+	}
+	p.pending++
+	return true
+}
+
+// cancel gives up the place of a query that won't be answered.
+func (p *workerPool) cancel() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending--
+}
+
+// wait waits for a worker for a query with a place in the pool.
+func (p *workerPool) wait() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.workers > 0 && p.active >= p.workers {
+		p.queued.Inc(1)
+		for p.workers > 0 && p.active >= p.workers {
+			p.free.Wait()
+		}
+		p.queued.Dec(1)
+	}
+	p.active++
+}
+
+// done releases the worker and the place of an answered query.
+func (p *workerPool) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	p.pending--
+	p.free.Signal()
+}
+
+// handler returns the handler answering the TCP, TLS and HTTPS
+// queries with the workers.
+func (p *workerPool) handler(handler dns.Handler) dns.Handler {
+	return &workerHandler{pool: p, handler: handler}
+}
+
+type workerHandler struct {
+	pool    *workerPool
+	handler dns.Handler
+}
+
+func (h *workerHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if !h.pool.reserve() {
+		return
+	}
+	h.pool.wait()
+	defer h.pool.done()
+	h.handler.ServeDNS(w, req)
+}
+
+// udpListener returns the reader, writer and handler for a UDP
+// listener, getting the queries their place in the pool as they're
+// read. The place is given up if the server doesn't pass a query to
+// the handler: it answers the queries that don't parse with FORMERR
+// itself, and the last query read is dropped if the server is shut
+// down before it gets a goroutine (close is called when the server
+// has stopped).
+func (p *workerPool) udpListener(handler dns.Handler) *workerListener {
+	return &workerListener{
+		pool:    p,
+		handler: handler,
+		writers: map[dns.Writer]*workerWriter{},
+	}
+}
+
+type workerListener struct {
+	pool    *workerPool
+	handler dns.Handler
+
+	mu sync.Mutex
+	// a query was read and the server hasn't asked for the next one
+	read bool
+	// the writers of the queries the handler didn't get yet
+	writers map[dns.Writer]*workerWriter
+}
+
+// setup sets the server to read and answer the queries with the pool.
+func (l *workerListener) setup(server *dns.Server) {
+	server.DecorateReader = l.decorateReader
+	server.DecorateWriter = l.decorateWriter
+	server.Handler = l
+}
+
+func (l *workerListener) decorateReader(r dns.Reader) dns.Reader {
+	return &workerReader{Reader: r, listener: l}
+}
+
+// decorateWriter is called by the server for each query before it's
+// parsed.
+func (l *workerListener) decorateWriter(w dns.Writer) dns.Writer {
+	ww := &workerWriter{Writer: w, listener: l}
+	l.mu.Lock()
+	l.writers[w] = ww
+	l.mu.Unlock()
+	return ww
+}
+
+func (l *workerListener) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	l.mu.Lock()
+	if ww, ok := l.writers[w]; ok {
+		ww.handled = true
+		delete(l.writers, w)
+	}
+	l.mu.Unlock()
+
+	l.pool.wait()
+	defer l.pool.done()
+	l.handler.ServeDNS(w, req)
+}
+
+// close gives up the place of the last query read if the server
+// stopped without passing it on.
+func (l *workerListener) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.read {
+		l.read = false
+		l.pool.cancel()
+	}
+}
+
+// workerReader reads the UDP queries, skipping the ones that don't get
+// a place in the pool. Only the header is checked; the messages too
+// short for one and the responses (which the server ignores) are
+// skipped before they get a place.
+type workerReader struct {
+	dns.Reader
+	listener *workerListener
+}
+
+func (r *workerReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	l := r.listener
+	// the server passed on the last query before reading the next
+	l.mu.Lock()
+	l.read = false
+	l.mu.Unlock()
+
+	for {
+		m, s, err := r.Reader.ReadUDP(conn, timeout)
+		if err != nil {
+			return m, s, err
+		}
+		if len(m) < dnsHeaderSize || m[2]&0x80 != 0 {
+			continue
+		}
+		if !l.pool.reserve() {
+			continue
+		}
+		l.mu.Lock()
+		l.read = true
+		l.mu.Unlock()
+		return m, s, nil
+	}
+}
+
+// dnsHeaderSize is the size of the header of a DNS message; the QR
+// (response) bit is the top bit of its third byte.
+const dnsHeaderSize = 12
+
+// workerWriter gives up the place of a query if it's answered before
+// the handler gets it (with FORMERR by the server).
+type workerWriter struct {
+	dns.Writer
+	listener *workerListener
+	handled  bool // set when the handler got the query
+}
+
+func (w *workerWriter) Write(b []byte) (int, error) {
+	if !w.handled {
+		l := w.listener
+		l.mu.Lock()
+		delete(l.writers, w.Writer)
+		l.mu.Unlock()
+		w.handled = true
+		l.pool.cancel()
+	}
+	return w.Writer.Write(b)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	metrics "github.com/rcrowley/go-metrics"
+	. "gopkg.in/check.v1"
+)
+
+// poolCounts returns the queries answered or waiting and the queries
+// answered.
+func poolCounts(p *workerPool) (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending, p.active
+}
+
+func (s *ConfigSuite) TestWorkerPool(c *C) {
+	p := newWorkerPool(metrics.NewRegistry())
+	c.Check(p.setup(-1, 0), NotNil)
+	c.Assert(p.setup(2, 0), IsNil)
+	c.Check(p.queue, Equals, defaultWorkerQueue)
+
+	// without workers the queries aren't limited
+	c.Assert(p.setup(0, 0), IsNil)
+	for i := 0; i < 10; i++ {
+		c.Check(p.reserve(), Equals, true)
+	}
+	for i := 0; i < 10; i++ {
+		p.cancel()
+	}
+
+	// one query answered, one waiting and the next dropped
+	c.Assert(p.setup(1, 1), IsNil)
+	c.Assert(p.reserve(), Equals, true)
+	p.wait()
+	c.Assert(p.reserve(), Equals, true)
+	done := make(chan bool)
+	go func() {
+		p.wait()
+		done <- true
+	}()
+	for i := 0; i < 100 && p.queued.Count() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(p.queued.Count(), Equals, int64(1))
+	c.Check(p.reserve(), Equals, false)
+	c.Check(p.dropped.Count(), Equals, int64(1))
+
+	// the handler of a TCP query drops it too
+	var answered int
+	h := p.handler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) { answered++ }))
+	h.ServeDNS(nil, new(dns.Msg))
+	c.Check(answered, Equals, 0)
+	c.Check(p.dropped.Count(), Equals, int64(2))
+
+	p.done()
+	<-done
+	c.Check(p.queued.Count(), Equals, int64(0))
+	p.done()
+	h.ServeDNS(nil, new(dns.Msg))
+	c.Check(answered, Equals, 1)
+
+	pending, active := poolCounts(p)
+	c.Check(pending, Equals, 0)
+	c.Check(active, Equals, 0)
+
+	// a UDP query read when the server is shut down gives up its place
+	l := p.udpListener(h)
+	c.Assert(p.reserve(), Equals, true)
+	l.read = true
+	l.close()
+	l.close()
+	pending, _ = poolCounts(p)
+	c.Check(pending, Equals, 0)
+}
+
+// TestWorkersFlood floods a UDP listener with queries answered slowly;
+// the queries beyond the workers and the queue are dropped as they're
+// read, so the goroutines answering them stay within the pool.
+func (s *ServeSuite) TestWorkersFlood(c *C) {
+	const workers, queue = 4, 16
+	p := newWorkerPool(metrics.NewRegistry())
+	c.Assert(p.setup(workers, queue), IsNil)
+
+	release := make(chan struct{})
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		<-release
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	l := p.udpListener(handler)
+	l.setup(server)
+	go server.ActivateAndServe()
+	<-started
+	defer func() {
+		server.Shutdown()
+		l.close()
+	}()
+
+	goroutines := runtime.NumGoroutine()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.net.", dns.TypeA)
+	query, err := m.Pack()
+	c.Assert(err, IsNil)
+
+	// a message that doesn't parse gets FORMERR from the server without
+	// keeping its place, and a response doesn't get one
+	conn.Write([]byte("not a dns message"))
+	buf := make([]byte, dns.MaxMsgSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+	formerr := new(dns.Msg)
+	c.Assert(formerr.Unpack(buf[:n]), IsNil)
+	c.Check(formerr.Rcode, Equals, dns.RcodeFormatError)
+	response := m.Copy()
+	response.Response = true
+	packed, err := response.Pack()
+	c.Assert(err, IsNil)
+	conn.Write(packed)
+	for i := 0; i < 100; i++ {
+		if pending, _ := poolCounts(p); pending == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pending, _ := poolCounts(p)
+	c.Check(pending, Equals, 0)
+	l.mu.Lock()
+	c.Check(l.writers, HasLen, 0)
+	l.mu.Unlock()
+
+	const flood = 2000
+	for i := 0; i < flood; i++ {
+		conn.Write(query)
+	}
+
+	for i := 0; i < 200; i++ {
+		if pending, _ := poolCounts(p); pending == workers+queue && p.dropped.Count() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	pending, active := poolCounts(p)
+	c.Check(pending, Equals, workers+queue)
+	c.Check(active, Equals, workers)
+	c.Check(p.queued.Count(), Equals, int64(queue))
+	c.Check(p.dropped.Count() > 0, Equals, true)
+	// a few goroutines for other tests running in the background
+	extra := runtime.NumGoroutine() - goroutines
+	c.Check(extra <= workers+queue+10, Equals, true, Commentf("%d more goroutines", extra))
+
+	close(release)
+	for i := 0; i < 200; i++ {
+		if pending, _ := poolCounts(p); pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pending, active = poolCounts(p)
+	c.Check(pending, Equals, 0)
+	c.Check(active, Equals, 0)
+}
+
+// BenchmarkWorkersFlood floods a UDP listener with a small pool; the
+// goroutines (the most seen while the queries are read) and the memory
+// allocated per query stay bounded however many queries are sent.
+func BenchmarkWorkersFlood(b *testing.B) {
+	const workers, queue = 4, 16
+	p := newWorkerPool(metrics.NewRegistry())
+	if err := p.setup(workers, queue); err != nil {
+		b.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(100 * time.Microsecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	l := p.udpListener(handler)
+	l.setup(server)
+	go server.ActivateAndServe()
+	<-started
+	defer func() {
+		server.Shutdown()
+		l.close()
+	}()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.net.", dns.TypeA)
+	query, err := m.Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	goroutines := runtime.NumGoroutine()
+	maxGoroutines := goroutines
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(query)
+		if i%100 == 0 {
+			if n := runtime.NumGoroutine(); n > maxGoroutines {
+				maxGoroutines = n
+			}
+		}
+	}
+	b.StopTimer()
+
+	for i := 0; i < 1000; i++ {
+		if pending, _ := poolCounts(p); pending == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.ReportMetric(float64(maxGoroutines-goroutines), "goroutines")
+	b.ReportMetric(float64(p.dropped.Count())/float64(b.N), "dropped/op")
+}
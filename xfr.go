@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// xfrChunkSize is the number of records sent per message in a zone
+	// transfer.
+	xfrChunkSize = 100
+
+	// xfrHistorySize is how many versions of a zone are kept for IXFR.
+	xfrHistorySize = 10
+)
+
+// xfrDelta is the difference between two versions (serials) of a zone.
+type xfrDelta struct {
+	From    *dns.SOA
+	To      *dns.SOA
+	Removed []dns.RR
+	Added   []dns.RR
+}
+
+// serialLess compares zone serials with RFC 1982 arithmetic.
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// soa returns the SOA record. It's read with the zone locked, as the
+// runtime updates replace it with one with a new serial.
+func (z *Zone) soa() *dns.SOA {
+	return z.SoaRR().(*dns.SOA)
+}
+
+// parsePeer parses an IP address or a CIDR network, for transfer peers
+// and the other options with lists of networks.
+func parsePeer(peer string) (*net.IPNet, error) {
+	if !strings.Contains(peer, "/") {
+		ip := net.ParseIP(peer)
+		if ip == nil {
+			return nil, fmt.Errorf("Bad network '%s'", peer)
+		}
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = net.IPv4len * 8
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(peer)
+	if err != nil {
+		return nil, fmt.Errorf("Bad network '%s': %s", peer, err)
+	}
+	return n, nil
+}
+
+// transferAllowed returns true if ip is in the transfer peers of the
+// zone. Zones without peers can't be transferred.
+func (z *Zone) transferAllowed(ip net.IP) bool {
+	for _, n := range z.Options.TransferPeers {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// transferTargets returns the targets used to flatten the zone for
+// transfers; the transfer_target option and then the global labels.
+func (z *Zone) transferTargets() []string {
+	targets := make([]string, 0, len(z.Options.TransferTargets)+1)
+	for _, t := range z.Options.TransferTargets {
+		if t != "@" {
+			targets = append(targets, t)
+		}
+	}
+	return append(targets, "@")
+}
+
+// xfrRecords returns the records in the zone (except the SOA) as a
+// client in the transfer targets would get them. Targeted labels are
+// left out and all records are returned rather than picked by weight.
+func (z *Zone) xfrRecords() []dns.RR {
+	targets := z.transferTargets()
+
+	names := map[string]bool{}
+	rtypes := map[uint16]bool{}
+	z.RLock()
+	for name, label := range z.Labels {
+		if base, ok := targetLabelBase(name); ok {
+			name = base
+		}
+		names[name] = true
+		for rtype := range label.Records {
+			rtypes[rtype] = true
+		}
+	}
+	z.RUnlock()
+	delete(rtypes, dns.TypeSOA)
+	delete(rtypes, dns.TypeCNAME)
+
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	sortedTypes := make([]int, 0, len(rtypes))
+	for rtype := range rtypes {
+		sortedTypes = append(sortedTypes, int(rtype))
+	}
+	sort.Ints(sortedTypes)
+
+	var rrs []dns.RR
+	for _, name := range sortedNames {
+		fqdn := z.Origin + "."
+		if len(name) > 0 {
+			fqdn = name + "." + fqdn
+		}
+
+		add := func(records Records) {
+			for _, record := range records {
+				rr := dns.Copy(record.RR)
+				rr.Header().Name = fqdn
+				rrs = append(rrs, rr)
+			}
+		}
+
+		// a CNAME can't have other data
+		label, qtype := z.findLabels(name, targets, qTypes{dns.TypeCNAME})
+		if qtype == dns.TypeCNAME {
+			add(label.Records[dns.TypeCNAME])
+			continue
+		}
+
+		for _, rtype := range sortedTypes {
+			label, qtype := z.findLabels(name, targets, qTypes{uint16(rtype)})
+			if qtype != uint16(rtype) {
+				continue
+			}
+			add(label.Records[qtype])
+		}
+	}
+	return rrs
+}
+
+// setupXfrHistory keeps the changes from the previous versions of the
+// zone for IXFR. The history is reset if the zone changed without the
+// serial increasing.
+func (z *Zone) setupXfrHistory(old *Zone) {
+	if old == nil || len(z.Options.TransferPeers) == 0 {
+		return
+	}
+
+	from, to := old.soa(), z.soa()
+	if !serialLess(from.Serial, to.Serial) {
+		return
+	}
+
+	oldRRs := map[string]dns.RR{}
+	for _, rr := range old.xfrRecords() {
+		oldRRs[rr.String()] = rr
+	}
+
+	delta := &xfrDelta{From: from, To: to}
+	for _, rr := range z.xfrRecords() {
+		key := rr.String()
+		if _, ok := oldRRs[key]; ok {
+			delete(oldRRs, key)
+			continue
+		}
+		delta.Added = append(delta.Added, rr)
+	}
+	for _, rr := range oldRRs {
+		delta.Removed = append(delta.Removed, rr)
+	}
+	sort.Sort(rrsByString(delta.Removed))
+
+	history := append(old.xfrHistory, delta)
+	if len(history) > xfrHistorySize {
+		history = history[len(history)-xfrHistorySize:]
+	}
+	z.xfrHistory = history
+}
+
+// ixfrRecords returns the IXFR answer (without the SOA records at the
+// start and end) for a client with the serial or false if the history
+// doesn't go back to the serial.
+func (z *Zone) ixfrRecords(serial uint32) ([]dns.RR, bool) {
+	z.RLock()
+	defer z.RUnlock()
+	for i, delta := range z.xfrHistory {
+		if delta.From.Serial != serial {
+			continue
+		}
+		var rrs []dns.RR
+		for _, d := range z.xfrHistory[i:] {
+			rrs = append(rrs, d.From)
+			rrs = append(rrs, d.Removed...)
+			rrs = append(rrs, d.To)
+			rrs = append(rrs, d.Added...)
+		}
+		return rrs, true
+	}
+	return nil, false
+}
+
+type rrsByString []dns.RR
+
+func (s rrsByString) Len() int           { return len(s) }
+func (s rrsByString) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s rrsByString) Less(i, j int) bool { return s[i].String() < s[j].String() }
+
+// serveXfr answers AXFR and IXFR requests from the transfer peers. AXFR
+// is only done over TCP; over UDP IXFR requests get the current SOA so
+// the client can retry with TCP. If the history for IXFR doesn't go
+// back to the client serial the full zone is sent.
+func (srv *Server) serveXfr(w dns.ResponseWriter, req *dns.Msg, z *Zone, ip net.IP) {
+	qtype := req.Question[0].Qtype
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	if _, ok := w.(*dohWriter); ok {
+		// a DNS over HTTPS response is a single message
+		tcp = false
+	}
+
+	if !z.transferAllowed(ip) || (!tcp && qtype == dns.TypeAXFR) {
+		logPrintf("[zone %s] refused transfer to %s\n", z.Origin, w.RemoteAddr())
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	soa := z.SoaRR()
+
+	var rrs []dns.RR
+	if qtype == dns.TypeIXFR {
+		var clientSOA *dns.SOA
+		if len(req.Ns) > 0 {
+			clientSOA, _ = req.Ns[0].(*dns.SOA)
+		}
+		if clientSOA == nil {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeFormatError)
+			w.WriteMsg(m)
+			return
+		}
+
+		current := soa.(*dns.SOA).Serial
+		if !tcp || !serialLess(clientSOA.Serial, current) {
+			// up to date (or retry with TCP)
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Authoritative = true
+			m.Answer = []dns.RR{soa}
+			w.WriteMsg(m)
+			return
+		}
+
+		ixfr, ok := z.ixfrRecords(clientSOA.Serial)
+		if ok {
+			rrs = append([]dns.RR{soa}, ixfr...)
+		}
+	}
+
+	if rrs == nil {
+		rrs = append([]dns.RR{soa}, z.xfrRecords()...)
+	}
+	rrs = append(rrs, soa)
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	go func() {
+		for len(rrs) > 0 {
+			n := xfrChunkSize
+			if n > len(rrs) {
+				n = len(rrs)
+			}
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+		close(ch)
+	}()
+	if err := tr.Out(w, req, ch); err != nil {
+		log.Printf("[zone %s] transfer to %s failed: %s", z.Origin, w.RemoteAddr(), err)
+		// drain the channel so the sender can finish
+		for range ch {
+		}
+	}
+}
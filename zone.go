@@ -1,29 +1,147 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/abh/geodns/health"
 	"github.com/miekg/dns"
 	"github.com/rcrowley/go-metrics"
 )
 
 type ZoneOptions struct {
-	Serial    int
-	Ttl       int
-	MaxHosts  int
-	Contact   string
-	Targeting TargetOptions
+	Serial       int
+	SerialAuto   bool
+	Ttl          int
+	MinTTL       int // floor for the TTLs in the responses
+	MaxHosts     int
+	Contact      string
+	Targeting    TargetOptions
+	TargetOrder  []TargetOptions
+	DisableECS   bool
+	StickyWeight bool
+
+	// answer ANY queries with all the records instead of a single
+	// HINFO record (RFC 8482)
+	FullANY bool
+
+	// CNAMEs to follow in the zone for the records of the target in
+	// the answer, 0 to answer with just the CNAME
+	CNAMEChase int
+
+	// the address records (dns.TypeA or dns.TypeAAAA) first in the
+	// additional section, and only those with SingleFamily
+	PreferFamily uint16
+	SingleFamily bool
+
+	// networks with targets set instead of using GeoIP
+	TargetOverrides targetOverrides
+
+	// max_hosts for the labels of a target ("europe") that don't set it
+	TargetMaxHosts map[string]int
+
+	// pick the records of labels with the closest option randomly,
+	// weighted by the distance to the power of -ClosestDecay, instead
+	// of the nearest records
+	ClosestBlend bool
+	ClosestDecay float64
+
+	// latency matrices for the labels with the closest option, by name
+	Latency map[string]latencyMatrix
+
+	// SOA primary name server, the first NS record if it's not set
+	PrimaryNs string
+
+	// SOA timers
+	Refresh int
+	Retry   int
+	Expire  int
+	Minimum int
+
+	// networks allowed to query the zone
+	ACL *zoneACL
+
+	// query types the zone answers
+	Qtypes *zoneQtypes
+
+	// random changes to the TTLs in the responses
+	TTLJitter *ttlJitter
+
+	// fixed answers while the zone is in maintenance
+	Maintenance *maintenance
+
+	// AAAA records synthesized from the A records for IPv6-only clients
+	DNS64 *dns64
+
+	// records served when all the records for a name are unhealthy
+	Emergency *emergency
+
+	// zone transfers
+	TransferPeers   []*net.IPNet
+	TransferTargets []string
+
+	// query rate limits per client IP or network
+	QPSLimit      float64
+	BurstLimit    int
+	RateLimitDrop bool
+	RateLimitV4   int // prefix length
+	RateLimitV6   int
+
+	// resolving CNAME targets outside the zone for flattened labels
+	FlattenResolver string
+	FlattenStale    bool
+	FlattenMaxStale time.Duration
 }
 
 type ZoneLogging struct {
 	StatHat    bool
 	StatHatAPI string
+
+	// log every QuerySample'th query (or every query if it's 0 or 1)
+	Queries     bool
+	QuerySample int
+
+	// count the queries for each label by the targeting level of
+	// the answer
+	LabelLevels bool
+
+	queryCount uint64
+}
+
+// sampleQuery returns true if the query should be logged.
+func (l *ZoneLogging) sampleQuery() bool {
+	if l == nil || !l.Queries {
+		return false
+	}
+	n := atomic.AddUint64(&l.queryCount, 1)
+	return l.QuerySample <= 1 || n%uint64(l.QuerySample) == 1
 }
 
 type Record struct {
 	RR     dns.RR
 	Weight int
+	Ttl    int
+	Loc    *Location
+	Test   *health.HealthTest
+
+	// Region is the row of the label's latency matrix for the record
+	Region string
+
+	// Name is used to refer to the record in the ServeWhen condition
+	// of other records in the label
+	Name      string
+	ServeWhen *serveExpr
+
+	// Meta is information about the record (the node name or data
+	// center) for the health status and the logs; it isn't served
+	Meta map[string]string
 }
 
 type Records []Record
@@ -31,9 +149,76 @@ type Records []Record
 func (s Records) Len() int      { return len(s) }
 func (s Records) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
+// IsHealthy returns false if the record has a health check that's
+// failing.
+func (r Record) IsHealthy() bool {
+	return r.Test == nil || r.Test.IsHealthy()
+}
+
+// degradedTtl returns the shorter TTL from the health check if the
+// record is unhealthy or recovered recently, or 0.
+func (r Record) degradedTtl() uint32 {
+	if r.Test == nil || r.Test.DegradedTtl <= 0 || !r.Test.Degraded() {
+		return 0
+	}
+	return uint32(r.Test.DegradedTtl)
+}
+
+// effectiveWeight returns the weight of the record, scaled down while
+// it's slow starting after recovering from a failed health check.
+func (r Record) effectiveWeight(now time.Time) float64 {
+	w := float64(r.Weight)
+	if r.Test != nil {
+		w *= r.Test.WeightFactor(now)
+	}
+	return w
+}
+
+// Healthy returns the healthy records (that can be served according to
+// their serve_when condition), or all the records if there are none.
+func (s Records) Healthy() Records {
+	var healthy Records
+	for _, r := range s {
+		if r.IsServeable() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 || len(healthy) == len(s) {
+		return s
+	}
+	return healthy
+}
+
+// selfOrdered returns true for the record types that are ordered by
+// their own fields (SRV priority and weight, NAPTR order and preference);
+// all the records are returned for the client to pick from.
+func selfOrdered(qtype uint16) bool {
+	return qtype == dns.TypeSRV || qtype == dns.TypeNAPTR
+}
+
 type RecordsByWeight struct{ Records }
 
-func (s RecordsByWeight) Less(i, j int) bool { return s.Records[i].Weight > s.Records[j].Weight }
+func (s RecordsByWeight) Less(i, j int) bool {
+	// SRV records are ordered by their own priority and weight
+	if a, ok := s.Records[i].RR.(*dns.SRV); ok {
+		if b, ok := s.Records[j].RR.(*dns.SRV); ok {
+			if a.Priority != b.Priority {
+				return a.Priority < b.Priority
+			}
+			return a.Weight > b.Weight
+		}
+	}
+	// and NAPTR records by their order and preference
+	if a, ok := s.Records[i].RR.(*dns.NAPTR); ok {
+		if b, ok := s.Records[j].RR.(*dns.NAPTR); ok {
+			if a.Order != b.Order {
+				return a.Order < b.Order
+			}
+			return a.Preference < b.Preference
+		}
+	}
+	return s.Records[i].Weight > s.Records[j].Weight
+}
 
 type Label struct {
 	Label    string
@@ -41,6 +226,77 @@ type Label struct {
 	Ttl      int
 	Records  map[uint16]Records
 	Weight   map[uint16]int
+	Order    OrderPolicy
+	Flatten  bool
+	Alias    string // name of the label this label is an alias for
+	Test     *health.HealthTest
+
+	// labels the answers are drawn from by weight, before the label's
+	// own records; for example the country labels of a continent
+	Pools []labelPool
+
+	// percentage of the queries answered from the next target instead
+	Spillover int
+
+	// with fewer healthy records than this the healthy records of the
+	// labels for the next targets are added
+	MinHealthy int
+
+	// countries and continents the name resolves for
+	GeoFence *geoFence
+
+	// UDP queries get an empty truncated response, so the name is only
+	// answered over TCP
+	TCPOnly bool
+
+	// the NS records delegate the name (and the names below it) to
+	// other name servers, so the queries get a referral
+	Delegate bool
+
+	// costs between the client targets and the record regions used
+	// instead of the distance for the closest records
+	Latency latencyMatrix
+
+	// artificial delay before answering, with the [debug] delay option
+	DebugDelay time.Duration
+
+	// the zone options, unless the label sets them
+	PreferFamily uint16
+	SingleFamily bool
+
+	// the next record for the round_robin order
+	rotation uint32
+
+	// records only served when none of the records of the type are
+	// healthy
+	Backup map[uint16]Records
+}
+
+// activeRecords returns the records of the qtype, or the backup records
+// if there are some and none of the records are healthy, and their
+// total weight.
+func (label *Label) activeRecords(qtype uint16) (Records, int) {
+	records := label.Records[qtype]
+	backup := label.Backup[qtype]
+	if len(backup) == 0 {
+		return records, label.Weight[qtype]
+	}
+	for _, r := range records {
+		if r.IsServeable() {
+			return records, label.Weight[qtype]
+		}
+	}
+	weight := 0
+	for _, r := range backup {
+		weight += r.Weight
+	}
+	return backup, weight
+}
+
+// healthRecords returns the record sets of the qtype that can have
+// health checks.
+func (label *Label) healthRecords(qtype uint16) []Records {
+	return []Records{label.Records[qtype], label.Backup[qtype]}
 }
 
 type labels map[string]*Label
@@ -48,9 +304,41 @@ type labels map[string]*Label
 type ZoneMetrics struct {
 	Queries     metrics.Meter
 	EdnsQueries metrics.Meter
+	// the EDNS options in the queries, by name or "other"
+	EdnsOptions map[string]metrics.Meter
+	DohQueries  metrics.Meter
+	Truncated   metrics.Meter
+	Serial      metrics.Gauge
+	RateLimited metrics.Meter
+	Denied      metrics.Meter
+	QtypeDenied metrics.Meter
+	Maintenance metrics.Meter
+	Delayed     metrics.Meter
+	DNS64       metrics.Meter
+	Emergency   metrics.Meter
 	Registry    metrics.Registry
+	Qtypes      metrics.Registry
+	// Health has the health check metrics for each record, named
+	// by metric and "label/qtype/ip"
+	Health      metrics.Registry
 	LabelStats  *zoneLabelStats
 	ClientStats *zoneLabelStats
+
+	// queries by the targeting level ("country", "global") of the
+	// label answering them, and with the LabelLevels logging option
+	// by "level label" for each queried label
+	TargetLevels    map[string]metrics.Meter
+	LabelLevelStats *zoneLabelStats
+
+	// lookups of flattened CNAME targets outside the zone
+	FlattenCacheHits   metrics.Meter
+	FlattenCacheMisses metrics.Meter
+	FlattenStale       metrics.Meter // stale records served after failed lookups
+
+	// time answering queries (except zone transfers), and the part
+	// of it spent looking up the client in the GeoIP databases
+	QueryTime metrics.Timer
+	GeoIPTime metrics.Timer
 }
 
 type Zone struct {
@@ -60,6 +348,21 @@ type Zone struct {
 	Options    ZoneOptions
 	Logging    *ZoneLogging
 	Metrics    ZoneMetrics
+	Signer     *ZoneSigner
+
+	limiter *rateLimiter
+
+	// sha256 of the zone file, for the "auto" serial
+	contentHash string
+
+	// names that only have targeted labels ("www" for "www.europe")
+	targetedNames map[string]bool
+
+	// names delegated to other name servers
+	delegations map[string]bool
+
+	// changes from the previous versions of the zone, for IXFR
+	xfrHistory []*xfrDelta
 
 	sync.RWMutex
 }
@@ -77,6 +380,14 @@ func NewZone(name string) *Zone {
 	zone.Options.MaxHosts = 2
 	zone.Options.Contact = "hostmaster." + name
 	zone.Options.Targeting = TargetGlobal + TargetCountry + TargetContinent
+	zone.Options.Refresh = 5400
+	zone.Options.Retry = 5400
+	zone.Options.Expire = 1209600
+	zone.Options.Minimum = 3600
+	zone.Options.RateLimitV4 = 32
+	zone.Options.RateLimitV6 = 128
+	zone.Options.ClosestDecay = 2
+	zone.Options.FlattenMaxStale = flattenMaxStale
 
 	return zone
 }
@@ -87,10 +398,36 @@ func (z *Zone) SetupMetrics(old *Zone) {
 
 	if old != nil {
 		z.Metrics = old.Metrics
+
+		// keep the label counts for the labels that are still in
+		// the zone (and the names that weren't labels before)
+		z.Metrics.LabelStats = NewZoneLabelStats(10000)
+		z.Metrics.LabelStats.Merge(old.Metrics.LabelStats, func(l string) bool {
+			_, ok := z.Labels[l]
+			_, wasLabel := old.Labels[l]
+			return ok || !wasLabel
+		})
+		if old.Metrics.LabelLevelStats != nil && z.Logging != nil && z.Logging.LabelLevels {
+			z.Metrics.LabelLevelStats = NewZoneLabelStats(10000)
+			z.Metrics.LabelLevelStats.Merge(old.Metrics.LabelLevelStats, func(l string) bool {
+				name := l[strings.Index(l, " ")+1:]
+				_, ok := z.Labels[name]
+				_, wasLabel := old.Labels[name]
+				return ok || !wasLabel
+			})
+		} else {
+			z.Metrics.LabelLevelStats = nil
+		}
 	}
 	if z.Metrics.Registry == nil {
 		z.Metrics.Registry = metrics.NewRegistry()
 	}
+	if z.Metrics.Qtypes == nil {
+		z.Metrics.Qtypes = metrics.NewRegistry()
+	}
+	if z.Metrics.Health == nil {
+		z.Metrics.Health = metrics.NewRegistry()
+	}
 	if z.Metrics.Queries == nil {
 		z.Metrics.Queries = metrics.NewMeter()
 		z.Metrics.Registry.Register("queries", z.Metrics.Queries)
@@ -99,22 +436,340 @@ func (z *Zone) SetupMetrics(old *Zone) {
 		z.Metrics.EdnsQueries = metrics.NewMeter()
 		z.Metrics.Registry.Register("queries-edns", z.Metrics.EdnsQueries)
 	}
+	z.Metrics.EdnsOptions = map[string]metrics.Meter{
+		"other": metrics.GetOrRegisterMeter("edns-option-other", z.Metrics.Registry),
+	}
+	for _, name := range ednsOptionNames {
+		z.Metrics.EdnsOptions[name] = metrics.GetOrRegisterMeter("edns-option-"+name, z.Metrics.Registry)
+	}
+	if z.Metrics.DohQueries == nil {
+		z.Metrics.DohQueries = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-doh", z.Metrics.DohQueries)
+	}
+	if z.Metrics.Serial == nil {
+		z.Metrics.Serial = metrics.NewGauge()
+		z.Metrics.Registry.Register("serial", z.Metrics.Serial)
+	}
+	if apex, ok := z.Labels[""]; ok && len(apex.Records[dns.TypeSOA]) > 0 {
+		z.Metrics.Serial.Update(int64(apex.firstRR(dns.TypeSOA).(*dns.SOA).Serial))
+	}
+	if z.Metrics.Truncated == nil {
+		z.Metrics.Truncated = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-truncated", z.Metrics.Truncated)
+	}
+	if z.Metrics.FlattenCacheHits == nil {
+		z.Metrics.FlattenCacheHits = metrics.NewMeter()
+		z.Metrics.Registry.Register("flatten-cache-hits", z.Metrics.FlattenCacheHits)
+	}
+	if z.Metrics.FlattenCacheMisses == nil {
+		z.Metrics.FlattenCacheMisses = metrics.NewMeter()
+		z.Metrics.Registry.Register("flatten-cache-misses", z.Metrics.FlattenCacheMisses)
+	}
+	if z.Metrics.FlattenStale == nil {
+		z.Metrics.FlattenStale = metrics.NewMeter()
+		z.Metrics.Registry.Register("flatten-stale", z.Metrics.FlattenStale)
+	}
+	if z.Metrics.QueryTime == nil {
+		z.Metrics.QueryTime = metrics.NewTimer()
+		z.Metrics.Registry.Register("query-time", z.Metrics.QueryTime)
+	}
+	if z.Metrics.GeoIPTime == nil {
+		z.Metrics.GeoIPTime = metrics.NewTimer()
+		z.Metrics.Registry.Register("geoip-time", z.Metrics.GeoIPTime)
+	}
+	if z.Metrics.Denied == nil {
+		z.Metrics.Denied = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-denied", z.Metrics.Denied)
+	}
+	if z.Metrics.QtypeDenied == nil {
+		z.Metrics.QtypeDenied = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-qtype-denied", z.Metrics.QtypeDenied)
+	}
+	if z.Metrics.RateLimited == nil {
+		z.Metrics.RateLimited = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-ratelimited", z.Metrics.RateLimited)
+	}
+	if z.Metrics.Maintenance == nil {
+		z.Metrics.Maintenance = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-maintenance", z.Metrics.Maintenance)
+	}
+	if z.Metrics.Delayed == nil {
+		z.Metrics.Delayed = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-delayed", z.Metrics.Delayed)
+	}
+	if z.Metrics.DNS64 == nil {
+		z.Metrics.DNS64 = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-dns64", z.Metrics.DNS64)
+	}
+	if z.Metrics.Emergency == nil {
+		z.Metrics.Emergency = metrics.NewMeter()
+		z.Metrics.Registry.Register("queries-emergency", z.Metrics.Emergency)
+	}
+	z.Metrics.TargetLevels = map[string]metrics.Meter{}
+	for t := TargetOptions(TargetGlobal); t <= TargetCategory; t <<= 1 {
+		if t == TargetGlobal || z.Options.Targeting&t > 0 {
+			name := targetLevelName(t)
+			z.Metrics.TargetLevels[name] = metrics.GetOrRegisterMeter("queries-target-"+name, z.Metrics.Registry)
+		}
+	}
 	if z.Metrics.LabelStats == nil {
 		z.Metrics.LabelStats = NewZoneLabelStats(10000)
 	}
+	if z.Metrics.LabelLevelStats == nil && z.Logging != nil && z.Logging.LabelLevels {
+		z.Metrics.LabelLevelStats = NewZoneLabelStats(10000)
+	}
 	if z.Metrics.ClientStats == nil {
 		z.Metrics.ClientStats = NewZoneLabelStats(10000)
 	}
 }
 
+// answerRecords returns the histogram of the number of records in the
+// answers to queries of the type (after the health checks, weights and
+// max_hosts), registered as "answer-records-<qtype>" on the first query.
+func (z *Zone) answerRecords(qtype uint16) metrics.Histogram {
+	return z.Metrics.Registry.GetOrRegister("answer-records-"+dns.Type(qtype).String(), func() metrics.Histogram {
+		return metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	}).(metrics.Histogram)
+}
+
 func (z *Zone) Close() {
 	z.Metrics.Registry.UnregisterAll()
+	if z.Metrics.Qtypes != nil {
+		z.Metrics.Qtypes.UnregisterAll()
+	}
 	if z.Metrics.LabelStats != nil {
 		z.Metrics.LabelStats.Close()
 	}
 	if z.Metrics.ClientStats != nil {
 		z.Metrics.ClientStats.Close()
 	}
+	if z.Metrics.LabelLevelStats != nil {
+		z.Metrics.LabelLevelStats.Close()
+	}
+}
+
+// StartStopHealthChecks starts (or stops) the health checks for the
+// A and AAAA records in labels with a health test. When starting, the
+// checks that are unchanged from oldZone keep running with their
+// current health state and the checks from oldZone for records that
+// aren't in the zone anymore are stopped.
+func (z *Zone) StartStopHealthChecks(start bool, oldZone *Zone) {
+	refs := map[string]bool{}
+
+	z.Lock()
+	for _, label := range z.Labels {
+		if start {
+			z.startHealthChecks(label, refs)
+			continue
+		}
+		z.stopHealthChecks(label, refs)
+		for _, qtype := range health.Qtypes {
+			for _, records := range label.healthRecords(qtype) {
+				for i := range records {
+					records[i].Test = nil
+				}
+			}
+		}
+	}
+	z.Unlock()
+
+	if !start || oldZone == nil {
+		return
+	}
+
+	oldZone.RLock()
+	defer oldZone.RUnlock()
+	for _, label := range oldZone.Labels {
+		oldZone.stopHealthChecks(label, refs)
+	}
+}
+
+// startHealthChecks starts the health checks for the records in the
+// label (keeping the running checks that didn't change) and adds their
+// references to refs.
+func (z *Zone) startHealthChecks(label *Label, refs map[string]bool) {
+	if label.Test == nil {
+		return
+	}
+	for _, qtype := range health.Qtypes {
+		for _, records := range label.healthRecords(qtype) {
+			for i := range records {
+				ip := recordIP(records[i].RR)
+				ref := z.healthRef(label, qtype, ip)
+
+				test := label.Test.Copy(ip)
+				if running := health.TestRunner.Get(ref); running != nil {
+					if running.Equal(test) {
+						test = running
+					} else {
+						test.CopyState(running)
+					}
+				}
+				health.TestRunner.Add(ref, test)
+				z.setupHealthMetrics(test, label, qtype, ip, records[i].Meta)
+				records[i].Test = test
+				refs[ref] = true
+			}
+		}
+	}
+}
+
+// stopHealthChecks stops the health checks for the records in the
+// label that aren't in refs.
+func (z *Zone) stopHealthChecks(label *Label, refs map[string]bool) {
+	for _, qtype := range health.Qtypes {
+		for _, records := range label.healthRecords(qtype) {
+			for _, record := range records {
+				if record.Test == nil {
+					continue
+				}
+				ip := recordIP(record.RR)
+				if ref := z.healthRef(label, qtype, ip); !refs[ref] {
+					health.TestRunner.Remove(ref)
+					z.removeHealthMetrics(label, qtype, ip)
+				}
+			}
+		}
+	}
+}
+
+// HealthStatus returns the state of the health checks for the label
+// (or all labels if it's empty) by label, record type and IP.
+func (z *Zone) HealthStatus(name string) map[string]map[string]map[string]health.Status {
+	z.RLock()
+	defer z.RUnlock()
+
+	status := map[string]map[string]map[string]health.Status{}
+	for _, label := range z.Labels {
+		if len(name) > 0 && label.Label != name {
+			continue
+		}
+		for _, qtype := range health.Qtypes {
+			for _, records := range label.healthRecords(qtype) {
+				for _, record := range records {
+					if record.Test == nil {
+						continue
+					}
+					if status[label.Label] == nil {
+						status[label.Label] = map[string]map[string]health.Status{}
+					}
+					qt := dns.TypeToString[qtype]
+					if status[label.Label][qt] == nil {
+						status[label.Label][qt] = map[string]health.Status{}
+					}
+					s := record.Test.Status()
+					s.Meta = record.Meta
+					status[label.Label][qt][record.Test.IP().String()] = s
+				}
+			}
+		}
+	}
+	return status
+}
+
+var healthMetricNames = []string{"transitions", "healthy", "healthy-time", "unhealthy-time"}
+
+func healthMetricName(metric string, label *Label, qtype uint16, ip net.IP) string {
+	return fmt.Sprintf("%s %s/%s/%s", metric, label.Label, dns.TypeToString[qtype], ip)
+}
+
+// setupHealthMetrics registers the metrics for the record's health
+// test; the number of changes between healthy and unhealthy, the
+// current state (1 for healthy) and the time spent in each state. The
+// changes are logged with the record's metadata.
+func (z *Zone) setupHealthMetrics(test *health.HealthTest, label *Label, qtype uint16, ip net.IP, meta map[string]string) {
+	reg := z.Metrics.Health
+	if reg == nil {
+		return
+	}
+	transitions := metrics.GetOrRegisterCounter(healthMetricName("transitions", label, qtype, ip), reg)
+	healthy := metrics.GetOrRegisterGauge(healthMetricName("healthy", label, qtype, ip), reg)
+	healthyTime := metrics.GetOrRegisterTimer(healthMetricName("healthy-time", label, qtype, ip), reg)
+	unhealthyTime := metrics.GetOrRegisterTimer(healthMetricName("unhealthy-time", label, qtype, ip), reg)
+
+	setHealthy := func(h bool) {
+		if h {
+			healthy.Update(1)
+		} else {
+			healthy.Update(0)
+		}
+	}
+	setHealthy(test.IsHealthy())
+
+	test.SetOnChange(func(h bool, inState time.Duration) {
+		state := "unhealthy"
+		if h {
+			state = "healthy"
+		}
+		log.Printf("[zone %s] %s is %s%s", z.Origin, z.healthRef(label, qtype, ip), state, formatMeta(meta))
+		transitions.Inc(1)
+		setHealthy(h)
+		if h {
+			unhealthyTime.Update(inState)
+		} else {
+			healthyTime.Update(inState)
+		}
+	})
+}
+
+// formatMeta formats the record metadata for the logs, sorted by key.
+func formatMeta(meta map[string]string) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + meta[k]
+	}
+	return " (" + strings.Join(keys, " ") + ")"
+}
+
+func (z *Zone) removeHealthMetrics(label *Label, qtype uint16, ip net.IP) {
+	if z.Metrics.Health == nil {
+		return
+	}
+	for _, metric := range healthMetricNames {
+		z.Metrics.Health.Unregister(healthMetricName(metric, label, qtype, ip))
+	}
+}
+
+// ExportHealth returns the state of the health checks of the zone by
+// reference, for health.TestRunner.Import.
+func (z *Zone) ExportHealth() map[string]health.Status {
+	z.RLock()
+	defer z.RUnlock()
+
+	states := map[string]health.Status{}
+	for _, label := range z.Labels {
+		for _, qtype := range health.Qtypes {
+			for _, records := range label.healthRecords(qtype) {
+				for _, record := range records {
+					if record.Test != nil {
+						states[z.healthRef(label, qtype, record.Test.IP())] = record.Test.Status()
+					}
+				}
+			}
+		}
+	}
+	return states
+}
+
+func (z *Zone) healthRef(label *Label, qtype uint16, ip net.IP) string {
+	return fmt.Sprintf("%s/%s/%s/%s", z.Origin, label.Label, dns.TypeToString[qtype], ip)
+}
+
+func recordIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
 }
 
 func (l *Label) firstRR(dnsType uint16) dns.RR {
@@ -128,60 +783,378 @@ func (z *Zone) AddLabel(k string) *Label {
 	label.Label = k
 	label.Ttl = z.Options.Ttl
 	label.MaxHosts = z.Options.MaxHosts
+	label.PreferFamily = z.Options.PreferFamily
+	label.SingleFamily = z.Options.SingleFamily
 
 	label.Records = make(map[uint16]Records)
+	label.Backup = make(map[uint16]Records)
 	label.Weight = make(map[uint16]int)
 
 	return label
 }
 
+// additionalTarget returns the name in NS, SRV, MX, SVCB and HTTPS
+// records that the additional section has the addresses for.
+func additionalTarget(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.NS:
+		return rr.Ns
+	case *dns.SRV:
+		return rr.Target
+	case *dns.MX:
+		return rr.Mx
+	case *dns.RFC3597:
+		return svcbTarget(rr)
+	}
+	return ""
+}
+
+// addressFamilies returns the address record types for the additional
+// section, the preferred family first (or only). The family of the
+// client subnet, if it was used, is preferred over the label's.
+func (label *Label) addressFamilies(ecsFamily uint16) []uint16 {
+	prefer := label.PreferFamily
+	if ecsFamily != 0 {
+		prefer = ecsFamily
+	}
+	switch {
+	case prefer != 0 && label.SingleFamily:
+		return []uint16{prefer}
+	case prefer == dns.TypeAAAA:
+		return []uint16{dns.TypeAAAA, dns.TypeA}
+	}
+	return []uint16{dns.TypeA, dns.TypeAAAA}
+}
+
+// additionalAddresses returns the A and AAAA records (the families, in
+// that order) for target if it's a name in the zone, for the additional
+// section of NS, SRV, MX, SVCB and HTTPS answers.
+func (z *Zone) additionalAddresses(target string, families []uint16, targets []string, sticky string) []dns.RR {
+	origin := z.Origin + "."
+	target = strings.ToLower(target)
+	if !dns.IsSubDomain(origin, target) {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(target, origin), ".")
+
+	var rrs []dns.RR
+	for _, qtype := range families {
+		label, labelQtype := z.findLabels(name, targets, qTypes{qtype})
+		if label == nil || labelQtype != qtype {
+			continue
+		}
+		for _, record := range label.Select(qtype, label.MaxHosts, sticky, target, nil) {
+			rr := dns.Copy(record.RR)
+			rr.Header().Name = target
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
 func (z *Zone) SoaRR() dns.RR {
+	z.RLock()
+	defer z.RUnlock()
 	return z.Labels[""].firstRR(dns.TypeSOA)
 }
 
+// NegativeSoaRR returns the SOA record for the authority section of
+// NXDOMAIN and NODATA responses, with the TTL limited to the SOA
+// minimum (RFC 2308).
+func (z *Zone) NegativeSoaRR() dns.RR {
+	soa := z.SoaRR()
+	if minimum := soa.(*dns.SOA).Minttl; soa.Header().Ttl > minimum {
+		soa = dns.Copy(soa)
+		soa.Header().Ttl = minimum
+	}
+	return soa
+}
+
+// floorTTLs raises the TTLs in the response to the min_ttl zone option.
+// The SOA record in the authority section of negative answers keeps its
+// TTL, the SOA minimum for negative caching (RFC 2308).
+func (z *Zone) floorTTLs(m *dns.Msg) {
+	min := uint32(z.Options.MinTTL)
+	if min == 0 {
+		return
+	}
+	for s, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range section {
+			h := rr.Header()
+			negativeSoa := s == 1 && h.Rrtype == dns.TypeSOA
+			if h.Ttl >= min || h.Rrtype == dns.TypeOPT || negativeSoa {
+				continue
+			}
+			// the records can be the zone's own
+			section[i] = dns.Copy(rr)
+			section[i].Header().Ttl = min
+		}
+	}
+}
+
+// nameExists returns true if the name is in the zone for any target,
+// so a query that findLabels didn't find a label for should get an
+// empty NOERROR (NODATA) answer rather than NXDOMAIN.
+func (z *Zone) nameExists(s string) bool {
+	z.RLock()
+	defer z.RUnlock()
+	if _, ok := z.Labels[s]; ok {
+		return true
+	}
+	return z.targetedNames[s]
+}
+
+// wildcardName returns the wildcard label ("*.b" for "a.b") that
+// answers for a name that isn't in the zone, or "" if there's none. As
+// in RFC 4592 only the wildcard of the closest existing parent of the
+// name is used, and a name that's in the zone for any target is never
+// answered by a wildcard. The wildcard can have targeted labels ("*.us")
+// like other labels.
+func (z *Zone) wildcardName(s string) string {
+	return wildcardFor(s, z.nameExists)
+}
+
+// wildcardFor is wildcardName with exists checking if a name is in the
+// zone.
+func wildcardFor(s string, exists func(string) bool) string {
+	if exists(s) {
+		return ""
+	}
+	for name := s; len(name) > 0; {
+		if i := strings.Index(name, "."); i >= 0 {
+			name = name[i+1:]
+		} else {
+			name = ""
+		}
+		if !exists(name) {
+			continue
+		}
+		wildcard := "*"
+		if len(name) > 0 {
+			wildcard += "." + name
+		}
+		if exists(wildcard) {
+			return wildcard
+		}
+		return ""
+	}
+	return ""
+}
+
+// labelTCPOnly returns true if the name is only answered over TCP.
+// Targeted labels queried directly ("www.dk") have the option of their
+// base name.
+func (z *Zone) labelTCPOnly(s string) bool {
+	z.RLock()
+	defer z.RUnlock()
+	if label, ok := z.Labels[s]; ok && label.TCPOnly {
+		return true
+	}
+	if base, ok := targetLabelBase(s); ok {
+		if label, ok := z.Labels[base]; ok {
+			return label.TCPOnly
+		}
+	}
+	return false
+}
+
+// aliasMaxDepth is how many aliases are followed for a query.
+const aliasMaxDepth = 10
+
+// errAliasLoop is returned by lookupLabels if following the aliases
+// loops (or goes too deep).
+var errAliasLoop = errors.New("alias loop")
+
 // Find label "s" in country "cc" falling back to the appropriate
 // continent and the global label name as needed. Looks for the
 // first available qType at each targeting level. Return a Label
 // and the qtype that was "found"
 func (z *Zone) findLabels(s string, targets []string, qts qTypes) (*Label, uint16) {
-	for _, target := range targets {
-		var name string
-
-		switch target {
-		case "@":
-			name = s
-		default:
-			if len(s) > 0 {
-				name = s + "." + target
-			} else {
-				name = target
+	label, qtype, err := z.lookupLabels(s, targets, qts)
+	if err != nil {
+		log.Printf("[zone %s] %s: %s", z.Origin, s, err)
+	}
+	return label, qtype
+}
+
+// lookupLabels is findLabels, returning errAliasLoop if the aliases
+// from the label loop. Names that aren't in the zone are looked up as
+// their wildcard label, if there's one. While the zone is in
+// maintenance the names are answered from the maintenance label
+// instead.
+func (z *Zone) lookupLabels(s string, targets []string, qts qTypes) (*Label, uint16, error) {
+	if wildcard := z.wildcardName(s); len(wildcard) > 0 {
+		s = wildcard
+	}
+	if label, qtype, ok := z.Options.Maintenance.lookup(z, s, qts); ok {
+		return label, qtype, nil
+	}
+	var visited []string
+	for {
+		label, qtype, alias := z.findLabelsTargets(s, targets, qts)
+		if len(alias) == 0 {
+			return label, qtype, nil
+		}
+		visited = append(visited, s)
+		if len(visited) > aliasMaxDepth {
+			return nil, 0, errAliasLoop
+		}
+		for _, v := range visited {
+			if v == alias {
+				return nil, 0, errAliasLoop
 			}
 		}
+		// the alias is looked up with the same targets
+		s = alias
+		if wildcard := z.wildcardName(s); len(wildcard) > 0 {
+			s = wildcard
+		}
+	}
+}
 
-		if label, ok := z.Labels[name]; ok {
-			var name string
+// spillover returns the label (and qtype) for the next targets instead
+// of the label found for s for the share of the queries in the label's
+// spillover option. With a sticky key the same key consistently gets
+// the same label.
+func (z *Zone) spillover(s string, label *Label, qtype uint16, targets []string, qts qTypes, sticky string) (*Label, uint16) {
+	for label != nil && label.Spillover > 0 && qtype != 0 {
+		i := 0
+		for i < len(targets) && targetName(s, targets[i]) != label.Label {
+			i++
+		}
+		if i >= len(targets)-1 || !label.spills(sticky) {
+			break
+		}
+		targets = targets[i+1:]
+		next, nextQtype := z.findLabels(s, targets, qts)
+		if next == nil || nextQtype == 0 {
+			break
+		}
+		label, qtype = next, nextQtype
+	}
+	return label, qtype
+}
+
+// minHealthy returns the label with the healthy records of the labels
+// for the next targets (for example the global records for a region)
+// added while it has fewer healthy records of the qtype than its
+// min_healthy option. The unhealthy records of the next labels aren't
+// added, so if none of them are healthy the label is returned as is.
+func (z *Zone) minHealthy(s string, label *Label, qtype uint16, targets []string) *Label {
+	if label == nil || label.MinHealthy == 0 || qtype == 0 ||
+		qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return label
+	}
+	active, _ := label.activeRecords(qtype)
+	var records Records
+	for _, r := range active {
+		if r.IsServeable() {
+			records = append(records, r)
+		}
+	}
+	local := len(records)
+	if local >= label.MinHealthy {
+		return label
+	}
+
+	i := 0
+	for i < len(targets) && targetName(s, targets[i]) != label.Label {
+		i++
+	}
+	if i >= len(targets)-1 {
+		return label
+	}
+	seen := map[string]bool{}
+	for _, r := range records {
+		seen[rdataString(r.RR)] = true
+	}
+	for _, target := range targets[i+1:] {
+		if len(records) >= label.MinHealthy {
+			break
+		}
+		next, nextQtype := z.findLabels(s, []string{target}, qTypes{qtype})
+		if next == nil || nextQtype != qtype || next == label {
+			continue
+		}
+		nextActive, _ := next.activeRecords(qtype)
+		for _, r := range nextActive {
+			if r.IsServeable() && !seen[rdataString(r.RR)] {
+				seen[rdataString(r.RR)] = true
+				records = append(records, r)
+			}
+		}
+	}
+	if len(records) == local {
+		return label
+	}
+
+	merged := *label
+	merged.Records = make(map[uint16]Records, len(label.Records))
+	merged.Weight = make(map[uint16]int, len(label.Weight))
+	for t, rs := range label.Records {
+		merged.Records[t] = rs
+		merged.Weight[t] = label.Weight[t]
+	}
+	merged.Records[qtype] = records
+	merged.Weight[qtype] = 0
+	for _, r := range records {
+		merged.Weight[qtype] += r.Weight
+	}
+	merged.Backup = make(map[uint16]Records, len(label.Backup))
+	for t, rs := range label.Backup {
+		if t != qtype {
+			merged.Backup[t] = rs
+		}
+	}
+	return &merged
+}
+
+// targetName returns the name of the label for s and the target.
+func targetName(s, target string) string {
+	switch {
+	case target == "@":
+		return s
+	case len(s) > 0:
+		return s + "." + target
+	default:
+		return target
+	}
+}
+
+// findLabelsTargets finds the label for s like findLabels, or returns
+// the name the label (for the first matching target) is an alias for.
+func (z *Zone) findLabelsTargets(s string, targets []string, qts qTypes) (*Label, uint16, string) {
+	// the labels are replaced rather than changed by updateLabel, so
+	// the label can be used after the lock is released
+	z.RLock()
+	defer z.RUnlock()
+
+	for _, target := range targets {
+		if label, ok := z.Labels[targetName(s, target)]; ok {
+			if len(label.Alias) > 0 {
+				return nil, 0, label.Alias
+			}
+			// the pool is looked up like an alias; without a pool
+			// for the qtypes the label's own records are used
+			if pool := z.pickPool(label, qts); len(pool) > 0 {
+				return nil, 0, pool
+			}
 			for _, qtype := range qts {
 				switch qtype {
 				case dns.TypeANY:
 					// short-circuit mostly to avoid subtle bugs later
 					// to be correct we should run through all the selectors and
 					// pick types not already picked
-					return z.Labels[s], qtype
-				case dns.TypeMF:
-					if label.Records[dns.TypeMF] != nil {
-						name = label.firstRR(dns.TypeMF).(*dns.MF).Mf
-						// TODO: need to avoid loops here somehow
-						return z.findLabels(name, targets, qts)
-					}
+					return z.Labels[s], qtype, ""
 				default:
 					// return the label if it has the right record
 					if label.Records[qtype] != nil && len(label.Records[qtype]) > 0 {
-						return label, qtype
+						return label, qtype, ""
 					}
 				}
 			}
 		}
 	}
 
-	return z.Labels[s], 0
+	return z.Labels[s], 0, ""
 }
@@ -61,6 +61,31 @@ func (zs *zoneLabelStats) add(l string) {
 	}
 }
 
+// Merge adds the entries from other (oldest first) for the labels
+// where keep returns true.
+func (zs *zoneLabelStats) Merge(other *zoneLabelStats, keep func(string) bool) {
+	for _, l := range other.entries() {
+		if keep(l) {
+			zs.add(l)
+		}
+	}
+}
+
+// entries returns the logged labels in the order they were added.
+func (zs *zoneLabelStats) entries() []string {
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+
+	if len(zs.log) == 0 {
+		// closed
+		return nil
+	}
+	if !zs.rotated {
+		return append([]string{}, zs.log[:zs.pos]...)
+	}
+	return append(append([]string{}, zs.log[zs.pos:]...), zs.log[:zs.pos]...)
+}
+
 func (zs *zoneLabelStats) TopCounts(n int) labelStats {
 	cm := zs.Counts()
 	top := make(labelStats, len(cm))
@@ -50,3 +50,22 @@ func (s *ZoneStatsSuite) TestZoneStats(c *C) {
 	zs.Close()
 
 }
+
+func (s *ZoneStatsSuite) TestZoneStatsMerge(c *C) {
+	old := NewZoneLabelStats(4)
+	for _, l := range []string{"a", "b", "c", "b", "d", "b"} {
+		old.Add(l)
+	}
+	c.Check(old.entries(), DeepEquals, []string{"c", "b", "d", "b"})
+
+	zs := NewZoneLabelStats(3)
+	zs.Merge(old, func(l string) bool { return l != "d" })
+	co := zs.Counts()
+	c.Check(co["b"], Equals, 2)
+	c.Check(co["c"], Equals, 1)
+	c.Check(co["d"], Equals, 0)
+
+	old.Close()
+	zs.Merge(old, func(string) bool { return true })
+	c.Check(zs.Counts(), DeepEquals, co)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"net"
+
 	"github.com/miekg/dns"
 	. "gopkg.in/check.v1"
 )
@@ -25,6 +27,22 @@ func (s *ConfigSuite) TestExampleComZone(c *C) {
 	c.Check(label.Records[dns.TypeA][0].RR.(*dns.A).A.String(), Equals, "192.168.1.2")
 	c.Check(qtype, Equals, dns.TypeA)
 
+	// ASN targets take precedence over the country and global labels
+	label, qtype = ex.findLabels("bar", []string{"as15169", "us", "north-america", "@"}, qTypes{dns.TypeA})
+	c.Check(label.Label, Equals, "bar.as15169")
+	c.Check(label.Records[dns.TypeA][0].RR.(*dns.A).A.String(), Equals, "192.168.1.4")
+
+	label, qtype = ex.findLabels("bar", []string{"as7012", "us", "north-america", "@"}, qTypes{dns.TypeA})
+	c.Check(label.Label, Equals, "bar")
+
+	// city targets fall back to the region, country etc
+	label, qtype = ex.findLabels("bar", []string{"de.berlin", "de-16", "de", "europe", "@"}, qTypes{dns.TypeA})
+	c.Check(label.Label, Equals, "bar.de.berlin")
+	c.Check(label.Records[dns.TypeA][0].RR.(*dns.A).A.String(), Equals, "192.168.1.8")
+
+	label, qtype = ex.findLabels("bar", []string{"de.hamburg", "de-04", "de", "europe", "@"}, qTypes{dns.TypeA})
+	c.Check(label.Label, Equals, "bar")
+
 	label, qtype = ex.findLabels("", []string{"@"}, qTypes{dns.TypeMX})
 	Mxs := label.Records[dns.TypeMX]
 	c.Check(Mxs, HasLen, 2)
@@ -37,6 +55,35 @@ func (s *ConfigSuite) TestExampleComZone(c *C) {
 	c.Check(Mxs[0].RR.(*dns.MX).Mx, Equals, "mx-eu.example.net.")
 	c.Check(qtype, Equals, dns.TypeMX)
 
+	// geo targeted SRV sets and their in-zone targets
+	label, qtype = ex.findLabels("_http._tcp", []string{"dk", "europe", "@"}, qTypes{dns.TypeSRV})
+	c.Check(label.Label, Equals, "_http._tcp.europe")
+	c.Check(label.firstRR(dns.TypeSRV).(*dns.SRV).Target, Equals, "srv-target-eu.test.example.com.")
+	extra := ex.additionalAddresses("srv-target-eu.test.example.com.", []uint16{dns.TypeA, dns.TypeAAAA}, []string{"dk", "europe", "@"}, "")
+	c.Assert(extra, HasLen, 1)
+	c.Check(extra[0].(*dns.A).A.String(), Equals, "192.168.1.21")
+	c.Check(ex.additionalAddresses("sipserver.example.com.", []uint16{dns.TypeA, dns.TypeAAAA}, []string{"@"}, ""), HasLen, 0)
+
+	// geo targeted MX
+	label, qtype = ex.findLabels("mail", []string{"dk", "europe", "@"}, qTypes{dns.TypeMX})
+	c.Check(label.Label, Equals, "mail.europe")
+	c.Check(qtype, Equals, dns.TypeMX)
+	extra = ex.additionalAddresses(label.firstRR(dns.TypeMX).(*dns.MX).Mx, []uint16{dns.TypeA, dns.TypeAAAA}, []string{"dk", "europe", "@"}, "")
+	c.Assert(extra, HasLen, 1)
+	c.Check(extra[0].(*dns.A).A.String(), Equals, "192.168.1.31")
+
+	// CAA records
+	label, qtype = ex.findLabels("caa", []string{"us", "north-america", "@"}, qTypes{dns.TypeCAA})
+	c.Assert(label.Records[dns.TypeCAA], HasLen, 2)
+	caa := label.Records[dns.TypeCAA][1].RR.(*dns.CAA)
+	c.Check(caa.Tag, Equals, "iodef")
+	c.Check(caa.Flag, Equals, uint8(128))
+	c.Check(caa.Value, Equals, "mailto:security@example.com")
+
+	label, qtype = ex.findLabels("caa", []string{"dk", "europe", "@"}, qTypes{dns.TypeCAA})
+	c.Check(label.Label, Equals, "caa.europe")
+	c.Check(label.firstRR(dns.TypeCAA).(*dns.CAA).Tag, Equals, "issuewild")
+
 	// look for multiple record types
 	label, qtype = ex.findLabels("www", []string{"@"}, qTypes{dns.TypeCNAME, dns.TypeA})
 	c.Check(label.Records[dns.TypeCNAME], HasLen, 1)
@@ -68,6 +115,30 @@ func (s *ConfigSuite) TestExampleComZone(c *C) {
 	c.Check(Txt[0].RR.(*dns.TXT).Txt[0], Equals, "w1000")
 	c.Check(Txt[1].RR.(*dns.TXT).Txt[0], Equals, "w1")
 
+	// targeted only names exist, but don't have a label for other targets
+	label, qtype = ex.findLabels("geo-only.sub", []string{"@"}, qTypes{dns.TypeA})
+	c.Check(label, IsNil)
+	c.Check(ex.nameExists("geo-only.sub"), Equals, true)
+	c.Check(ex.nameExists("sub"), Equals, true)
+	c.Check(ex.nameExists("bar"), Equals, true)
+	c.Check(ex.nameExists("nxdomain"), Equals, false)
+	label, qtype = ex.findLabels("geo-only.sub", []string{"dk", "europe", "@"}, qTypes{dns.TypeA})
+	c.Check(label.Label, Equals, "geo-only.sub.europe")
+
+	// aliases are looked up with the same targets
+	label, qtype = ex.findLabels("bar-alias", []string{"de.berlin", "de", "europe", "@"}, qTypes{dns.TypeA})
+	c.Check(label.Label, Equals, "bar.de.berlin")
+	c.Check(qtype, Equals, dns.TypeA)
+
+	// alias loops
+	_, _, err := ex.lookupLabels("loop1", []string{"@"}, qTypes{dns.TypeA})
+	c.Check(err, Equals, errAliasLoop)
+	label, _, err = ex.lookupLabels("loop-geo", []string{"@"}, qTypes{dns.TypeA})
+	c.Assert(err, IsNil)
+	c.Check(label.Label, Equals, "loop-geo-target")
+	_, _, err = ex.lookupLabels("loop-geo", []string{"dk", "europe", "@"}, qTypes{dns.TypeA})
+	c.Check(err, Equals, errAliasLoop)
+
 	//verify empty labels are created
 	label, qtype = ex.findLabels("a.b.c", []string{"@"}, qTypes{dns.TypeA})
 	c.Check(label.Records[dns.TypeA], HasLen, 1)
@@ -96,6 +167,81 @@ func (s *ConfigSuite) TestExampleComZone(c *C) {
 	c.Check(label.Records[dns.TypeA][0].RR.(*dns.A).A.String(), Equals, "192.168.1.6")
 }
 
+func (s *ConfigSuite) TestSVCB(c *C) {
+	ex := s.zones["test.example.com"]
+
+	label, qtype := ex.findLabels("svc", []string{"@"}, qTypes{dns.TypeCNAME, typeHTTPS})
+	c.Assert(qtype, Equals, typeHTTPS)
+	rr := label.firstRR(typeHTTPS).(*dns.RFC3597)
+	c.Check(rr.Rdata, Equals, "0001"+"00"+
+		"00010006"+"026832"+"026833"+
+		"00040004"+"c0a80132"+
+		"00060010"+"fd06c1d3e90200000000000000000050")
+
+	label, qtype = ex.findLabels("_dns.svc", []string{"@"}, qTypes{dns.TypeCNAME, typeSVCB})
+	c.Assert(qtype, Equals, typeSVCB)
+	rr = label.firstRR(typeSVCB).(*dns.RFC3597)
+	c.Check(svcbTarget(rr), Equals, "svc.test.example.com.")
+
+	// packs and unpacks as a generic record
+	m := new(dns.Msg)
+	m.SetQuestion("_dns.svc.test.example.com.", typeSVCB)
+	m.Answer = []dns.RR{rr}
+	buf, err := m.Pack()
+	c.Assert(err, IsNil)
+	m2 := new(dns.Msg)
+	c.Assert(m2.Unpack(buf), IsNil)
+	c.Check(m2.Answer[0].(*dns.RFC3597).Rdata, Equals, rr.Rdata)
+
+	for _, rec := range []map[string]interface{}{
+		{"target": "foo", "alpn": "h2"},
+		{"priority": 1.0, "port": 70000.0},
+		{"priority": 1.0, "ipv4hint": "2001:db8::1"},
+		{"priority": 1.0, "mandatory": "color"},
+		{"priority": 1.0, "ech": "not base64!"},
+		{"auto_hints": true},
+	} {
+		_, err := parseSVCB(rec, "example.com")
+		c.Check(err, NotNil, Commentf("record %v", rec))
+	}
+}
+
+func (s *ConfigSuite) TestXfrRecords(c *C) {
+	ex := s.zones["test.example.com"]
+
+	c.Check(ex.transferAllowed(net.ParseIP("127.0.0.1")), Equals, true)
+	c.Check(ex.transferAllowed(net.ParseIP("::1")), Equals, true)
+	c.Check(ex.transferAllowed(net.ParseIP("192.0.2.1")), Equals, false)
+
+	xfrRRs := func(targets ...string) map[string][]dns.RR {
+		defer func(t []string) { ex.Options.TransferTargets = t }(ex.Options.TransferTargets)
+		ex.Options.TransferTargets = targets
+		rrs := map[string][]dns.RR{}
+		for _, rr := range ex.xfrRecords() {
+			key := rr.Header().Name + " " + dns.TypeToString[rr.Header().Rrtype]
+			rrs[key] = append(rrs[key], rr)
+		}
+		return rrs
+	}
+
+	rrs := xfrRRs()
+	c.Check(rrs["test.example.com. SOA"], HasLen, 0)
+	c.Check(rrs["test.example.com. MX"], HasLen, 2)
+	c.Check(rrs["foo.test.example.com. A"], HasLen, 3)
+	c.Check(rrs["_http._tcp.test.example.com. SRV"], HasLen, 3)
+	c.Check(rrs["bar-alias.test.example.com. A"][0].(*dns.A).A.String(), Equals, "192.168.1.2")
+	c.Check(rrs["www.test.example.com. CNAME"], HasLen, 1)
+	c.Check(rrs["www.test.example.com. A"], HasLen, 0)
+	c.Check(rrs["bar.as15169.test.example.com. A"], HasLen, 0)
+	c.Check(rrs["europe.test.example.com. MX"], HasLen, 0)
+
+	// flattened to the europe labels
+	rrs = xfrRRs("europe")
+	c.Check(rrs["test.example.com. MX"], HasLen, 1)
+	c.Check(rrs["_http._tcp.test.example.com. SRV"], HasLen, 1)
+	c.Check(rrs["foo.test.example.com. A"], HasLen, 3)
+}
+
 func (s *ConfigSuite) TestExampleOrgZone(c *C) {
 	ex := s.zones["test.example.org"]
 
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// AddRecord adds the record to a label in the zone with the weight,
+// for changing the records (adding a host when scaling up, for
+// example) without reloading the zone file. The changes are lost when
+// the zone file is reloaded.
+func (z *Zone) AddRecord(name string, rr dns.RR, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("bad weight %d", weight)
+	}
+	return z.updateLabel(name, rr, func(label *Label, rrsets map[uint16]Records, qtype uint16, i int) error {
+		if i >= 0 {
+			return fmt.Errorf("%s is already in '%s'", rdataString(rr), label.Label)
+		}
+		rr = dns.Copy(rr)
+		h := rr.Header()
+		h.Name = z.Origin + "."
+		if len(label.Label) > 0 {
+			h.Name = label.Label + "." + h.Name
+		}
+		h.Class = dns.ClassINET
+		record := Record{RR: rr, Weight: weight, Ttl: int(h.Ttl)}
+		if record.Ttl == 0 && label.Ttl > 0 {
+			h.Ttl = uint32(label.Ttl)
+		}
+		if label.Order == OrderNearest {
+			record.Loc = geoIP.GetLocation(recordIP(rr))
+		}
+		label.Records[qtype] = append(label.Records[qtype], record)
+		return nil
+	})
+}
+
+// RemoveRecord removes the record with the same data as rr from a label
+// in the zone (from its records or its backup records).
+func (z *Zone) RemoveRecord(name string, rr dns.RR) error {
+	return z.updateLabel(name, rr, func(label *Label, rrsets map[uint16]Records, qtype uint16, i int) error {
+		if i < 0 {
+			return fmt.Errorf("%s isn't in '%s'", rdataString(rr), label.Label)
+		}
+		records := rrsets[qtype]
+		records = append(records[:i], records[i+1:]...)
+		if len(records) == 0 {
+			delete(rrsets, qtype)
+			return nil
+		}
+		rrsets[qtype] = records
+		return nil
+	})
+}
+
+// UpdateWeight sets the weight of the record with the same data as rr
+// in a label in the zone (in its records or its backup records).
+func (z *Zone) UpdateWeight(name string, rr dns.RR, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("bad weight %d", weight)
+	}
+	return z.updateLabel(name, rr, func(label *Label, rrsets map[uint16]Records, qtype uint16, i int) error {
+		if i < 0 {
+			return fmt.Errorf("%s isn't in '%s'", rdataString(rr), label.Label)
+		}
+		rrsets[qtype][i].Weight = weight
+		return nil
+	})
+}
+
+// updateLabel changes the records of a copy of the label with fn and
+// replaces the label with the copy, so queries being answered keep
+// using the label they found. fn gets the records or backup records
+// with the data of rr and its index, or the records and -1. The
+// health checks of the added and removed records are started and
+// stopped and the serial is increased.
+func (z *Zone) updateLabel(name string, rr dns.RR, fn func(label *Label, rrsets map[uint16]Records, qtype uint16, i int) error) error {
+	name = strings.ToLower(name)
+	qtype := rr.Header().Rrtype
+	if qtype == dns.TypeSOA {
+		return fmt.Errorf("the SOA record can't be changed")
+	}
+
+	z.Lock()
+	defer z.Unlock()
+
+	old, ok := z.Labels[name]
+	if !ok {
+		return fmt.Errorf("no label '%s' in %s", name, z.Origin)
+	}
+	label := old.clone()
+
+	rrsets, i := label.Records, -1
+	data := rdataString(rr)
+	for _, set := range []map[uint16]Records{label.Records, label.Backup} {
+		for j, r := range set[qtype] {
+			if rdataString(r.RR) == data {
+				rrsets, i = set, j
+				break
+			}
+		}
+		if i >= 0 {
+			break
+		}
+	}
+	if err := fn(label, rrsets, qtype, i); err != nil {
+		return err
+	}
+
+	if records, ok := label.Records[qtype]; ok {
+		weight := 0
+		for _, r := range records {
+			weight += r.Weight
+		}
+		label.Weight[qtype] = weight
+		if weight > 0 || selfOrdered(qtype) {
+			sort.Sort(RecordsByWeight{records})
+			sort.Sort(RecordsByWeight{label.Backup[qtype]})
+		}
+	} else {
+		delete(label.Weight, qtype)
+	}
+	if err := label.resolveServeWhen(); err != nil {
+		return err
+	}
+
+	refs := map[string]bool{}
+	z.startHealthChecks(label, refs)
+	z.stopHealthChecks(old, refs)
+	z.Labels[name] = label
+
+	return z.increaseSerial()
+}
+
+// increaseSerial increases the serial after the records were changed.
+// The IXFR history doesn't have the changes, so it's cleared and the
+// secondaries get the whole zone.
+func (z *Zone) increaseSerial() error {
+	apex := z.Labels[""].clone()
+	z.Labels[""] = apex
+	z.Options.Serial = int(apex.firstRR(dns.TypeSOA).(*dns.SOA).Serial + 1)
+	if err := setupSOA(z); err != nil {
+		return err
+	}
+	if z.Metrics.Serial != nil {
+		z.Metrics.Serial.Update(int64(z.Options.Serial))
+	}
+	z.xfrHistory = nil
+	// so the "auto" serial is increased when the file is reloaded
+	z.contentHash = ""
+	return nil
+}
+
+// clone returns a copy of the label with its own records, which can be
+// changed without affecting the queries using the label.
+func (label *Label) clone() *Label {
+	c := *label
+	c.rotation = atomic.LoadUint32(&label.rotation)
+	c.Weight = make(map[uint16]int, len(label.Weight))
+	for qtype, weight := range label.Weight {
+		c.Weight[qtype] = weight
+	}
+	c.Records = cloneRecords(label.Records)
+	c.Backup = cloneRecords(label.Backup)
+	for _, records := range c.Records {
+		for i := range records {
+			if records[i].ServeWhen != nil {
+				records[i].ServeWhen = records[i].ServeWhen.copy()
+			}
+		}
+	}
+	return &c
+}
+
+func cloneRecords(m map[uint16]Records) map[uint16]Records {
+	c := make(map[uint16]Records, len(m))
+	for qtype, records := range m {
+		c[qtype] = append(Records(nil), records...)
+	}
+	return c
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConfigSuite) TestUpdateRecords(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/update.example.net.json"
+	zone := `{ "serial": 10, "data": { "": { "ns": [ "ns1.example.net" ] },
+		"www": { "a": [ [ "192.0.2.1", 10 ] ],
+			"health": { "type": "tcp", "port": 1, "frequency": "1h" } } } }`
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	z, err := readZoneFile("update.example.net", fileName)
+	c.Assert(err, IsNil)
+	z.SetupMetrics(nil)
+	defer z.Close()
+	z.StartStopHealthChecks(true, nil)
+	defer z.StartStopHealthChecks(false, nil)
+
+	old := z.Labels["www"]
+
+	rr, _ := dns.NewRR("www 300 IN A 192.0.2.2")
+	c.Assert(z.AddRecord("www", rr, 20), IsNil)
+	label := z.Labels["www"]
+	c.Check(label, Not(Equals), old)
+	c.Check(old.Records[dns.TypeA], HasLen, 1)
+	c.Assert(label.Records[dns.TypeA], HasLen, 2)
+	c.Check(label.Weight[dns.TypeA], Equals, 30)
+	added := label.Records[dns.TypeA][0]
+	c.Check(added.RR.Header().Name, Equals, "www.update.example.net.")
+	c.Check(added.Weight, Equals, 20)
+	c.Check(added.Test, NotNil)
+	c.Check(z.HealthStatus("www")["www"]["A"], HasLen, 2)
+	c.Check(z.soa().Serial, Equals, uint32(11))
+	c.Check(z.Metrics.Serial.Value(), Equals, int64(11))
+
+	c.Check(z.AddRecord("www", rr, 20), ErrorMatches, ".*already in 'www'")
+	c.Check(z.AddRecord("nope", rr, 20), ErrorMatches, "no label 'nope'.*")
+
+	c.Assert(z.UpdateWeight("www", rr, 5), IsNil)
+	label = z.Labels["www"]
+	c.Check(label.Records[dns.TypeA][0].RR.(*dns.A).A.String(), Equals, "192.0.2.1")
+	c.Check(label.Weight[dns.TypeA], Equals, 15)
+
+	c.Assert(z.RemoveRecord("www", rr), IsNil)
+	c.Check(z.Labels["www"].Records[dns.TypeA], HasLen, 1)
+	c.Check(z.HealthStatus("www")["www"]["A"], HasLen, 1)
+	c.Check(z.RemoveRecord("www", rr), ErrorMatches, ".*isn't in 'www'")
+	c.Check(z.soa().Serial, Equals, uint32(13))
+
+	// lookups while the records are changed
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				label, qtype := z.findLabels("www", []string{"@"}, qTypes{dns.TypeA})
+				c.Check(qtype, Equals, dns.TypeA)
+				label.Picker(qtype, 2, "")
+				z.SoaRR()
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		c.Assert(z.AddRecord("www", rr, 10), IsNil)
+		c.Assert(z.RemoveRecord("www", rr), IsNil)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func (s *ConfigSuite) TestUpdateBackupRecords(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/update.example.net.json"
+	zone := `{ "serial": 10, "data": { "": { "ns": [ "ns1.example.net" ] },
+		"www": { "a": [ [ "192.0.2.1", 10 ], { "ip": "198.51.100.1", "weight": 10, "backup": true } ],
+			"health": { "type": "tcp", "port": 1, "frequency": "1h" } } } }`
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	z, err := readZoneFile("update.example.net", fileName)
+	c.Assert(err, IsNil)
+	z.SetupMetrics(nil)
+	defer z.Close()
+	z.StartStopHealthChecks(true, nil)
+	defer z.StartStopHealthChecks(false, nil)
+
+	// the backup records are kept (with their health checks) when the
+	// records are changed
+	rr, _ := dns.NewRR("www 300 IN A 192.0.2.2")
+	c.Assert(z.AddRecord("www", rr, 20), IsNil)
+	label := z.Labels["www"]
+	c.Check(label.Records[dns.TypeA], HasLen, 2)
+	c.Assert(label.Backup[dns.TypeA], HasLen, 1)
+	c.Check(label.Backup[dns.TypeA][0].Test, NotNil)
+	c.Check(z.HealthStatus("www")["www"]["A"], HasLen, 3)
+
+	c.Assert(z.RemoveRecord("www", rr), IsNil)
+	c.Check(z.Labels["www"].Backup[dns.TypeA], HasLen, 1)
+
+	// and can be changed too
+	backup, _ := dns.NewRR("www IN A 198.51.100.1")
+	c.Check(z.AddRecord("www", backup, 20), ErrorMatches, ".*already in 'www'")
+	c.Assert(z.UpdateWeight("www", backup, 5), IsNil)
+	label = z.Labels["www"]
+	c.Check(label.Backup[dns.TypeA][0].Weight, Equals, 5)
+	c.Check(label.Weight[dns.TypeA], Equals, 10)
+
+	c.Assert(z.RemoveRecord("www", backup), IsNil)
+	label = z.Labels["www"]
+	c.Check(label.Backup[dns.TypeA], HasLen, 0)
+	c.Check(label.Records[dns.TypeA], HasLen, 1)
+	c.Check(z.HealthStatus("www")["www"]["A"], HasLen, 1)
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path"
+	"regexp"
 	"runtime/debug"
 	"sort"
 	"strconv"
@@ -17,6 +19,7 @@ import (
 	"time"
 
 	"github.com/abh/errorutil"
+	"github.com/abh/geodns/health"
 	"github.com/miekg/dns"
 )
 
@@ -31,6 +34,9 @@ type ZoneReadRecord struct {
 var lastRead = map[string]*ZoneReadRecord{}
 
 func (srv *Server) zonesReadDir(dirName string, zones Zones) error {
+	srv.zonesMu.Lock()
+	defer srv.zonesMu.Unlock()
+
 	dir, err := ioutil.ReadDir(dirName)
 	if err != nil {
 		log.Println("Could not read", dirName, ":", err)
@@ -43,14 +49,21 @@ func (srv *Server) zonesReadDir(dirName string, zones Zones) error {
 
 	for _, file := range dir {
 		fileName := file.Name()
-		if !strings.HasSuffix(strings.ToLower(fileName), ".json") ||
-			strings.HasPrefix(path.Base(fileName), ".") ||
-			file.IsDir() {
+		if !isZoneFile(file) {
 			continue
 		}
 
 		zoneName := zoneNameFromFile(fileName)
 
+		if _, ok := srv.remoteZones[zoneName]; ok {
+			logPrintf("Zone %s is fetched from a zone source, ignoring %s\n", zoneName, fileName)
+			continue
+		}
+
+		if seenZones[zoneName] {
+			log.Printf("Zone %s is in more than one file, ignoring %s", zoneName, fileName)
+			continue
+		}
 		seenZones[zoneName] = true
 
 		if _, ok := lastRead[zoneName]; !ok || file.ModTime().After(lastRead[zoneName].time) {
@@ -92,7 +105,7 @@ func (srv *Server) zonesReadDir(dirName string, zones Zones) error {
 				continue
 			}
 
-			config, err := readZoneFile(zoneName, filename)
+			config, err := readZone(zoneName, filename)
 			if config == nil || err != nil {
 				parseErr = fmt.Errorf("Error reading zone '%s': %s", zoneName, err)
 				log.Println(parseErr.Error())
@@ -105,23 +118,87 @@ func (srv *Server) zonesReadDir(dirName string, zones Zones) error {
 		}
 	}
 
-	for zoneName, zone := range zones {
+	for zoneName := range zones {
 		if zoneName == "pgeodns" {
 			continue
 		}
 		if ok, _ := seenZones[zoneName]; ok {
 			continue
 		}
-		log.Println("Removing zone", zone.Origin)
-		delete(lastRead, zoneName)
-		zone.Close()
-		dns.HandleRemove(zoneName)
-		delete(zones, zoneName)
+		if _, ok := srv.remoteZones[zoneName]; ok {
+			continue
+		}
+		srv.removeZone(zones, zoneName)
 	}
 
 	return parseErr
 }
 
+// removeZone stops serving the zone.
+func (srv *Server) removeZone(zones Zones, zoneName string) {
+	zone := zones[zoneName]
+	log.Println("Removing zone", zone.Origin)
+	delete(lastRead, zoneName)
+	zone.StartStopHealthChecks(false, nil)
+	zone.Close()
+	dns.HandleRemove(zoneName)
+	delete(zones, zoneName)
+}
+
+// reloadZone reads the file of the zone with the origin again, without
+// checking the other zones in the directory. The metrics, health checks
+// and other state of the zone are carried over from the loaded zone like
+// when zonesReadDir reloads it. If the file can't be read the loaded
+// zone is kept. Zones from a zone source are fetched again.
+func (srv *Server) reloadZone(dirName string, zones Zones, origin string) error {
+	srv.zonesMu.Lock()
+	rz := srv.remoteZones[origin]
+	srv.zonesMu.Unlock()
+	if rz != nil {
+		return srv.fetchZone(dirName, zones, rz, true)
+	}
+
+	srv.zonesMu.Lock()
+	defer srv.zonesMu.Unlock()
+
+	dir, err := ioutil.ReadDir(dirName)
+	if err != nil {
+		return err
+	}
+	for _, file := range dir {
+		if !isZoneFile(file) || zoneNameFromFile(file.Name()) != origin {
+			continue
+		}
+		fileName := path.Join(dirName, file.Name())
+		logPrintf("Reloading %s\n", fileName)
+		sha256 := sha256File(fileName)
+		config, err := readZone(origin, fileName)
+		if config == nil || err != nil {
+			return fmt.Errorf("Error reading zone '%s': %s", origin, err)
+		}
+		lastRead[origin] = &ZoneReadRecord{time: file.ModTime(), hash: sha256}
+		srv.addHandler(zones, origin, config)
+		return nil
+	}
+	return fmt.Errorf("No zone file for '%s'", origin)
+}
+
+// isZoneFile returns true if the file is a JSON or BIND zone file.
+func isZoneFile(file os.FileInfo) bool {
+	fileName := file.Name()
+	return (strings.HasSuffix(strings.ToLower(fileName), ".json") || isBindZoneFile(fileName)) &&
+		!strings.HasPrefix(path.Base(fileName), ".") &&
+		!file.IsDir()
+}
+
+// readZone reads the zone from a JSON or BIND zone file.
+func readZone(zoneName, fileName string) (*Zone, error) {
+	if isBindZoneFile(fileName) {
+		return readBindZoneFile(zoneName, fileName)
+	}
+	return readZoneFile(zoneName, fileName)
+}
+
 func (srv *Server) setupPgeodnsZone(zones Zones) {
 	zoneName := "pgeodns"
 	Zone := NewZone(zoneName)
@@ -129,7 +206,9 @@ func (srv *Server) setupPgeodnsZone(zones Zones) {
 	label.Records = make(map[uint16]Records)
 	label.Weight = make(map[uint16]int)
 	Zone.Labels[""] = label
-	setupSOA(Zone)
+	if err := setupSOA(Zone); err != nil {
+		log.Printf("pgeodns: %s", err)
+	}
 	srv.addHandler(zones, zoneName, Zone)
 }
 
@@ -141,29 +220,42 @@ func (srv *Server) setupRootZone() {
 	})
 }
 
-func readZoneFile(zoneName, fileName string) (zone *Zone, zerr error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("reading %s failed: %s", zoneName, r)
-			debug.PrintStack()
-			zerr = fmt.Errorf("reading %s failed: %s", zoneName, r)
-		}
-	}()
-
+func readZoneFile(zoneName, fileName string) (*Zone, error) {
 	fh, err := os.Open(fileName)
 	if err != nil {
 		log.Printf("Could not read '%s': %s", fileName, err)
-		panic(err)
+		return nil, fmt.Errorf("reading %s failed: %s", zoneName, err)
 	}
+	defer fh.Close()
 
-	zone = NewZone(zoneName)
-
+	var modTime time.Time
 	fileInfo, err := fh.Stat()
 	if err != nil {
 		log.Printf("Could not stat '%s': %s", fileName, err)
 	} else {
-		zone.Options.Serial = int(fileInfo.ModTime().Unix())
+		modTime = fileInfo.ModTime()
 	}
+	return readZoneJSON(zoneName, fileName, path.Dir(fileName), fh, modTime, sha256File(fileName))
+}
+
+// readZoneJSON reads a JSON zone from fh, a file or the data of a zone
+// fetched from a URL (the fileName). The serial defaults to the
+// modification time and the DNSSEC keys are read from keyDir.
+func readZoneJSON(zoneName, fileName, keyDir string, fh io.ReadSeeker, modTime time.Time, hash string) (zone *Zone, zerr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("reading %s failed: %s", zoneName, r)
+			debug.PrintStack()
+			zerr = fmt.Errorf("reading %s failed: %s", zoneName, r)
+		}
+	}()
+
+	var err error
+	zone = NewZone(zoneName)
+	if !modTime.IsZero() {
+		zone.Options.Serial = int(modTime.Unix())
+	}
+	zone.contentHash = hash
 
 	var objmap map[string]interface{}
 	decoder := json.NewDecoder(fh)
@@ -178,7 +270,7 @@ func readZoneFile(zoneName, fileName string) (zone *Zone, zerr error) {
 				line, col, serr.Offset, highlight)
 		}
 		return nil, fmt.Errorf("error parsing JSON object in config file %s%s\n%v",
-			fh.Name(), extra, err)
+			fileName, extra, err)
 	}
 
 	if err != nil {
@@ -195,17 +287,239 @@ func readZoneFile(zoneName, fileName string) (zone *Zone, zerr error) {
 		case "ttl":
 			zone.Options.Ttl = valueToInt(v)
 		case "serial":
+			if s, ok := v.(string); ok && s == "auto" {
+				zone.Options.SerialAuto = true
+				break
+			}
 			zone.Options.Serial = valueToInt(v)
 		case "contact":
-			zone.Options.Contact = v.(string)
+			zone.Options.Contact, err = parseContact(valueToString(v))
+			if err != nil {
+				return nil, fmt.Errorf("Bad contact '%s' for %s: %s", v, zoneName, err)
+			}
+		case "primary_ns":
+			ns := strings.ToLower(dns.Fqdn(valueToString(v)))
+			if _, ok := dns.IsDomainName(ns); !ok || ns == "." {
+				return nil, fmt.Errorf("Bad primary_ns '%s' for %s", v, zoneName)
+			}
+			zone.Options.PrimaryNs = ns
 		case "max_hosts":
 			zone.Options.MaxHosts = valueToInt(v)
+		case "min_ttl":
+			zone.Options.MinTTL = valueToInt(v)
+			if zone.Options.MinTTL < 0 {
+				return nil, fmt.Errorf("Bad min_ttl %v for %s", v, zoneName)
+			}
+		case "refresh":
+			zone.Options.Refresh = valueToInt(v)
+		case "retry":
+			zone.Options.Retry = valueToInt(v)
+		case "expire":
+			zone.Options.Expire = valueToInt(v)
+		case "minimum":
+			zone.Options.Minimum = valueToInt(v)
+		case "disable_ecs":
+			zone.Options.DisableECS = valueToBool(v)
+		case "any":
+			switch valueToString(v) {
+			case "minimal":
+				zone.Options.FullANY = false
+			case "full":
+				zone.Options.FullANY = true
+			default:
+				return nil, fmt.Errorf("Bad any '%s' for %s (minimal or full)", v, zoneName)
+			}
+		case "sticky_weight":
+			zone.Options.StickyWeight = valueToBool(v)
+		case "prefer_family":
+			zone.Options.PreferFamily, err = parseFamily(valueToString(v))
+			if err != nil {
+				return nil, fmt.Errorf("Bad prefer_family for %s: %s", zoneName, err)
+			}
+		case "single_family":
+			zone.Options.SingleFamily = valueToBool(v)
+		case "transfer_peers":
+			for _, peer := range v.([]interface{}) {
+				n, err := parsePeer(valueToString(peer))
+				if err != nil {
+					return nil, err
+				}
+				zone.Options.TransferPeers = append(zone.Options.TransferPeers, n)
+			}
+		case "acl":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("acl must be a map of options")
+			}
+			zone.Options.ACL, err = parseACL(m)
+			if err != nil {
+				log.Printf("Could not parse acl for %s: %s", zoneName, err)
+				return nil, err
+			}
+		case "qtypes":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("qtypes must be a map of options")
+			}
+			zone.Options.Qtypes, err = parseQtypes(m)
+			if err != nil {
+				log.Printf("Could not parse qtypes for %s: %s", zoneName, err)
+				return nil, err
+			}
+		case "ttl_jitter":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("ttl_jitter must be a map of options")
+			}
+			zone.Options.TTLJitter, err = parseTTLJitter(m)
+			if err != nil {
+				return nil, err
+			}
+		case "maintenance":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("maintenance must be a map of options")
+			}
+			zone.Options.Maintenance, err = parseMaintenance(m)
+			if err != nil {
+				return nil, err
+			}
+		case "cname_chase":
+			zone.Options.CNAMEChase, err = parseCNAMEChase(v)
+			if err != nil {
+				return nil, fmt.Errorf("Bad cname_chase for %s: %s", zoneName, err)
+			}
+		case "dns64":
+			zone.Options.DNS64, err = parseDNS64(v)
+			if err != nil {
+				return nil, err
+			}
+		case "emergency":
+			zone.Options.Emergency, err = parseEmergency(v)
+			if err != nil {
+				return nil, err
+			}
+		case "dnssec":
+			zone.Signer, err = NewZoneSigner(zoneName, keyDir, v.(map[string]interface{}))
+			if err != nil {
+				log.Printf("Could not setup dnssec for %s: %s", zoneName, err)
+				return nil, err
+			}
+		case "rate_limit":
+			for k, rv := range v.(map[string]interface{}) {
+				switch k {
+				case "qps":
+					zone.Options.QPSLimit = valueToFloat(rv)
+				case "burst":
+					zone.Options.BurstLimit = valueToInt(rv)
+				case "drop":
+					zone.Options.RateLimitDrop = valueToBool(rv)
+				case "ipv4_prefix":
+					zone.Options.RateLimitV4 = valueToInt(rv)
+				case "ipv6_prefix":
+					zone.Options.RateLimitV6 = valueToInt(rv)
+				default:
+					log.Println("Unknown rate_limit option", k)
+				}
+			}
+			if zone.Options.RateLimitV4 < 0 || zone.Options.RateLimitV4 > 32 ||
+				zone.Options.RateLimitV6 < 0 || zone.Options.RateLimitV6 > 128 {
+				return nil, fmt.Errorf("Bad rate_limit prefix length for %s", zoneName)
+			}
+			if zone.Options.QPSLimit > 0 {
+				zone.limiter = newRateLimiter(zone.Options.QPSLimit, zone.Options.BurstLimit)
+			}
+		case "flatten":
+			for k, fv := range v.(map[string]interface{}) {
+				switch k {
+				case "resolver":
+					zone.Options.FlattenResolver = resolverAddress(valueToString(fv))
+				case "failure":
+					switch valueToString(fv) {
+					case "servfail":
+						zone.Options.FlattenStale = false
+					case "stale":
+						zone.Options.FlattenStale = true
+					default:
+						return nil, fmt.Errorf("Bad flatten failure policy '%s' for %s", fv, zoneName)
+					}
+				case "max_stale":
+					d, err := time.ParseDuration(valueToString(fv))
+					if err != nil || d <= 0 {
+						return nil, fmt.Errorf("Bad flatten max_stale '%v' for %s", fv, zoneName)
+					}
+					zone.Options.FlattenMaxStale = d
+				default:
+					log.Println("Unknown flatten option", k)
+				}
+			}
+		case "closest":
+			for k, cv := range v.(map[string]interface{}) {
+				switch k {
+				case "mode":
+					switch valueToString(cv) {
+					case "nearest":
+						zone.Options.ClosestBlend = false
+					case "blend":
+						zone.Options.ClosestBlend = true
+					default:
+						return nil, fmt.Errorf("Bad closest mode '%s' for %s", cv, zoneName)
+					}
+				case "decay":
+					zone.Options.ClosestDecay = valueToFloat(cv)
+					if zone.Options.ClosestDecay <= 0 {
+						return nil, fmt.Errorf("Bad closest decay %v for %s", cv, zoneName)
+					}
+				case "latency":
+					zone.Options.Latency, err = parseLatencyMatrices(cv)
+					if err != nil {
+						return nil, fmt.Errorf("Bad closest latency for %s: %s", zoneName, err)
+					}
+				default:
+					log.Println("Unknown closest option", k)
+				}
+			}
+			// the blend picks records by the distance only
+			if zone.Options.ClosestBlend && len(zone.Options.Latency) > 0 {
+				return nil, fmt.Errorf("Bad closest latency for %s: can't be used with the blend mode", zoneName)
+			}
+		case "transfer_target":
+			zone.Options.TransferTargets = strings.Fields(strings.ToLower(v.(string)))
 		case "targeting":
 			zone.Options.Targeting, err = parseTargets(v.(string))
 			if err != nil {
 				log.Printf("Could not parse targeting '%s': %s", v, err)
 				return nil, err
 			}
+		case "targeting_order":
+			zone.Options.TargetOrder, err = parseTargetOrder(valueToString(v))
+			if err != nil {
+				log.Printf("Could not parse targeting_order '%s': %s", v, err)
+				return nil, err
+			}
+		case "target_max_hosts":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("target_max_hosts must be a map of targets to numbers")
+			}
+			zone.Options.TargetMaxHosts = map[string]int{}
+			for target, nv := range m {
+				n := valueToInt(nv)
+				if n < 1 {
+					return nil, fmt.Errorf("Bad target_max_hosts for %s: %v", target, nv)
+				}
+				zone.Options.TargetMaxHosts[strings.ToLower(target)] = n
+			}
+		case "target_overrides":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("target_overrides must be a map of networks to targets")
+			}
+			zone.Options.TargetOverrides, err = parseTargetOverrides(m)
+			if err != nil {
+				log.Printf("Could not parse target_overrides: %s", err)
+				return nil, err
+			}
 
 		case "logging":
 			{
@@ -217,6 +531,12 @@ func readZoneFile(zoneName, fileName string) (zone *Zone, zerr error) {
 					case "stathat_api":
 						logging.StatHatAPI = valueToString(v)
 						logging.StatHat = true
+					case "queries":
+						logging.Queries = valueToBool(v)
+					case "query_sample":
+						logging.QuerySample = valueToInt(v)
+					case "label_levels":
+						logging.LabelLevels = valueToBool(v)
 					default:
 						log.Println("Unknown logger option", logger)
 					}
@@ -231,7 +551,44 @@ func readZoneFile(zoneName, fileName string) (zone *Zone, zerr error) {
 		}
 	}
 
-	setupZoneData(data, zone)
+	if len(zone.Options.TargetOrder) > 0 {
+		// the order specifies the targeting levels too
+		var targeting TargetOptions
+		for _, t := range zone.Options.TargetOrder {
+			targeting |= t
+		}
+		if _, ok := objmap["targeting"]; ok && targeting != zone.Options.Targeting {
+			return nil, fmt.Errorf("targeting '%s' doesn't match the targeting_order for %s", zone.Options.Targeting, zoneName)
+		}
+		zone.Options.Targeting = targeting
+	}
+
+	if zone.Options.SingleFamily && zone.Options.PreferFamily == 0 {
+		return nil, fmt.Errorf("single_family for %s needs prefer_family", zoneName)
+	}
+
+	if err := checkSOATimers(zone.Options); err != nil {
+		log.Printf("Bad SOA options for %s: %s", zoneName, err)
+		return nil, err
+	}
+
+	if errs := setupZoneData(data, zone); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s: %s", zoneName, err)
+		}
+		return nil, zoneErrors(errs)
+	}
+
+	if mt := zone.Options.Maintenance; mt != nil {
+		if err := mt.setup(zone); err != nil {
+			return nil, err
+		}
+	}
+
+	if j := zone.Options.TTLJitter; j != nil && uint32(zone.Options.MinTTL) > j.floor {
+		// the jitter doesn't lower the TTLs below min_ttl
+		j.floor = uint32(zone.Options.MinTTL)
+	}
 
 	//log.Printf("ZO T: %T %s\n", Zones["0.us"], Zones["0.us"])
 
@@ -247,291 +604,635 @@ func readZoneFile(zoneName, fileName string) (zone *Zone, zerr error) {
 		geoIP.setupGeoIPASN()
 	}
 
+	for _, label := range zone.Labels {
+		if label.Order == OrderNearest {
+			geoIP.setupGeoIPCity()
+			zone.SetLocations()
+			break
+		}
+	}
+
 	return zone, nil
 }
 
-func setupZoneData(data map[string]interface{}, Zone *Zone) {
+// zoneErrors are the problems found in a zone file.
+type zoneErrors []error
+
+func (e zoneErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// setupZoneData adds the labels and records from the data section of a
+// zone file to the zone, returning the problems found.
+func setupZoneData(data map[string]interface{}, Zone *Zone) []error {
+	var errs []error
+
 	recordTypes := map[string]uint16{
 		"a":     dns.TypeA,
 		"aaaa":  dns.TypeAAAA,
-		"alias": dns.TypeMF,
 		"cname": dns.TypeCNAME,
 		"mx":    dns.TypeMX,
 		"ns":    dns.TypeNS,
 		"txt":   dns.TypeTXT,
 		"spf":   dns.TypeSPF,
 		"srv":   dns.TypeSRV,
+		"naptr": dns.TypeNAPTR,
 		"ptr":   dns.TypePTR,
+		"caa":   dns.TypeCAA,
+		"svcb":  typeSVCB,
+		"https": typeHTTPS,
 	}
 
-	for dk, dv_inter := range data {
-		dv := dv_inter.(map[string]interface{})
-
-		//log.Printf("K %s V %s TYPE-V %T\n", dk, dv, dv)
-
-		label := Zone.AddLabel(dk)
+	// SVCB and HTTPS records getting hints from the A and AAAA records
+	type svcbHints struct {
+		label *Label
+		rr    dns.RR
+		data  *svcbData
+	}
+	var autoHints []svcbHints
 
-		for rType, rdata := range dv {
-			switch rType {
-			case "max_hosts":
-				label.MaxHosts = valueToInt(rdata)
-				continue
-			case "ttl":
-				label.Ttl = valueToInt(rdata)
-				continue
-			}
+	for dk, dv_inter := range data {
+		// an error in a label is recorded and the other labels are still
+		// read, to report all the problems in the zone at once
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("label '%s': %v", dk, r)
+				}
+			}()
+
+			dv := dv_inter.(map[string]interface{})
+
+			//log.Printf("K %s V %s TYPE-V %T\n", dk, dv, dv)
+
+			label := Zone.AddLabel(dk)
+			maxHostsSet := false
+
+			for rType, rdata := range dv {
+				switch rType {
+				case "max_hosts":
+					label.MaxHosts = valueToInt(rdata)
+					maxHostsSet = true
+					continue
+				case "ttl":
+					label.Ttl = valueToInt(rdata)
+					continue
+				case "order":
+					order, err := parseOrderPolicy(valueToString(rdata))
+					if err == nil {
+						err = label.setOrder(order, rType)
+					}
+					if err != nil {
+						panic(fmt.Errorf("Bad order for %s: %s", dk, err))
+					}
+					continue
+				case "closest", "random_n", "round_robin":
+					if !valueToBool(rdata) {
+						continue
+					}
+					order := map[string]OrderPolicy{
+						"closest":     OrderNearest,
+						"random_n":    OrderRandom,
+						"round_robin": OrderRoundRobin,
+					}[rType]
+					if err := label.setOrder(order, rType); err != nil {
+						panic(fmt.Errorf("Bad options for %s: %s", dk, err))
+					}
+					continue
+				case "flatten":
+					label.Flatten = valueToBool(rdata)
+					continue
+				case "tcp_only":
+					label.TCPOnly = valueToBool(rdata)
+					continue
+				case "delegate":
+					label.Delegate = valueToBool(rdata)
+					continue
+				case "latency":
+					matrix, ok := Zone.Options.Latency[valueToString(rdata)]
+					if !ok {
+						panic(fmt.Errorf("Bad latency for %s: no latency matrix '%v'", dk, rdata))
+					}
+					label.Latency = matrix
+					continue
+				case "debug_delay":
+					delay, err := parseDebugDelay(rdata)
+					if err != nil {
+						panic(fmt.Errorf("Bad debug_delay for %s: %s", dk, err))
+					}
+					label.DebugDelay = delay
+					continue
+				case "prefer_family":
+					family, err := parseFamily(valueToString(rdata))
+					if err != nil {
+						panic(fmt.Errorf("Bad prefer_family for %s: %s", dk, err))
+					}
+					label.PreferFamily = family
+					continue
+				case "single_family":
+					label.SingleFamily = valueToBool(rdata)
+					continue
+				case "alias":
+					label.Alias = valueToString(rdata)
+					continue
+				case "pools":
+					pools, err := parsePools(rdata)
+					if err != nil {
+						panic(fmt.Errorf("Bad pools for %s: %s", dk, err))
+					}
+					label.Pools = pools
+					continue
+				case "spillover":
+					label.Spillover = valueToInt(rdata)
+					if label.Spillover < 0 || label.Spillover > 100 {
+						panic(fmt.Errorf("Bad spillover for %s: %d isn't a percentage", dk, label.Spillover))
+					}
+					continue
+				case "min_healthy":
+					label.MinHealthy = valueToInt(rdata)
+					if label.MinHealthy < 0 {
+						panic(fmt.Errorf("Bad min_healthy for %s: %d", dk, label.MinHealthy))
+					}
+					continue
+				case "geo_fence":
+					m, ok := rdata.(map[string]interface{})
+					if !ok {
+						panic(fmt.Errorf("Bad geo_fence for %s: %v", dk, rdata))
+					}
+					fence, err := parseGeoFence(m)
+					if err != nil {
+						panic(fmt.Errorf("Bad geo_fence for %s: %s", dk, err))
+					}
+					label.GeoFence = fence
+					continue
+				case "health":
+					test, err := health.NewFromMap(rdata.(map[string]interface{}))
+					if err != nil {
+						panic(fmt.Errorf("Bad health check for %s: %s", dk, err))
+					}
+					label.Test = test
+					continue
+				}
 
-			dnsType, ok := recordTypes[strings.ToLower(rType)]
-			if !ok {
-				log.Printf("Unsupported record type '%s'\n", rType)
-				continue
-			}
+				dnsType, ok := recordTypes[strings.ToLower(rType)]
+				if !ok {
+					log.Printf("Unsupported record type '%s'\n", rType)
+					continue
+				}
 
-			if rdata == nil {
-				//log.Printf("No %s records for label %s\n", rType, dk)
-				continue
-			}
+				if rdata == nil {
+					//log.Printf("No %s records for label %s\n", rType, dk)
+					continue
+				}
 
-			//log.Printf("rdata %s TYPE-R %T\n", rdata, rdata)
+				//log.Printf("rdata %s TYPE-R %T\n", rdata, rdata)
 
-			records := make(map[string][]interface{})
+				records := make(map[string][]interface{})
 
-			switch rdata.(type) {
-			case map[string]interface{}:
-				// Handle NS map syntax, map[ns2.example.net:<nil> ns1.example.net:<nil>]
-				tmp := make([]interface{}, 0)
-				for rdataK, rdataV := range rdata.(map[string]interface{}) {
-					if rdataV == nil {
-						rdataV = ""
+				switch rdata.(type) {
+				case map[string]interface{}:
+					// Handle NS map syntax, map[ns2.example.net:<nil> ns1.example.net:<nil>]
+					tmp := make([]interface{}, 0)
+					for rdataK, rdataV := range rdata.(map[string]interface{}) {
+						if rdataV == nil {
+							rdataV = ""
+						}
+						tmp = append(tmp, []string{rdataK, rdataV.(string)})
 					}
-					tmp = append(tmp, []string{rdataK, rdataV.(string)})
+					records[rType] = tmp
+				case string:
+					// CNAME
+					tmp := make([]interface{}, 1)
+					tmp[0] = rdata.(string)
+					records[rType] = tmp
+				default:
+					records[rType] = rdata.([]interface{})
 				}
-				records[rType] = tmp
-			case string:
-				// CNAME and alias
-				tmp := make([]interface{}, 1)
-				tmp[0] = rdata.(string)
-				records[rType] = tmp
-			default:
-				records[rType] = rdata.([]interface{})
-			}
 
-			//log.Printf("RECORDS %s TYPE-REC %T\n", Records, Records)
+				//log.Printf("RECORDS %s TYPE-REC %T\n", Records, Records)
 
-			label.Records[dnsType] = make(Records, len(records[rType]))
+				label.Records[dnsType] = make(Records, 0, len(records[rType]))
 
-			for i := 0; i < len(records[rType]); i++ {
-				//log.Printf("RT %T %#v\n", records[rType][i], records[rType][i])
+				for i := 0; i < len(records[rType]); i++ {
+					//log.Printf("RT %T %#v\n", records[rType][i], records[rType][i])
 
-				record := new(Record)
+					record := new(Record)
 
-				var h dns.RR_Header
-				h.Class = dns.ClassINET
-				h.Rrtype = dnsType
+					var h dns.RR_Header
+					h.Class = dns.ClassINET
+					h.Rrtype = dnsType
 
-				// We add the TTL as a last pass because we might not have
-				// processed it yet when we process the record data.
-
-				switch len(label.Label) {
-				case 0:
-					h.Name = Zone.Origin + "."
-				default:
-					h.Name = label.Label + "." + Zone.Origin + "."
-				}
+					// We add the TTL as a last pass because we might not have
+					// processed it yet when we process the record data.
 
-				switch dnsType {
-				case dns.TypeA, dns.TypeAAAA, dns.TypePTR:
+					switch len(label.Label) {
+					case 0:
+						h.Name = Zone.Origin + "."
+					default:
+						h.Name = label.Label + "." + Zone.Origin + "."
+					}
 
-					str, weight := getStringWeight(records[rType][i].([]interface{}))
-					ip := str
-					record.Weight = weight
+					// records in the object syntax can override the label TTL
+					backup := false
+					if recmap, ok := records[rType][i].(map[string]interface{}); ok {
+						if b, ok := recmap["backup"]; ok {
+							backup = valueToBool(b)
+						}
+						if ttl, ok := recmap["ttl"]; ok {
+							record.Ttl = valueToInt(ttl)
+						}
+						if name, ok := recmap["name"]; ok {
+							record.Name = valueToString(name)
+						}
+						if meta, ok := recmap["meta"]; ok {
+							m, ok := meta.(map[string]interface{})
+							if !ok {
+								panic(fmt.Errorf("Bad meta for %s: %v", dk, meta))
+							}
+							record.Meta = make(map[string]string, len(m))
+							for k, v := range m {
+								record.Meta[k] = valueToString(v)
+							}
+						}
+						if loc, ok := recmap["location"]; ok {
+							if !isLocationQtype(dnsType) {
+								panic(fmt.Errorf("Bad record for %s: only A and AAAA records have a location", dk))
+							}
+							l, err := parseLocation(loc)
+							if err != nil {
+								panic(fmt.Errorf("Bad record for %s: %s", dk, err))
+							}
+							record.Loc = l
+						}
+						if region, ok := recmap["region"]; ok {
+							if !isLocationQtype(dnsType) {
+								panic(fmt.Errorf("Bad record for %s: only A and AAAA records have a region", dk))
+							}
+							record.Region = valueToString(region)
+						}
+						if cond, ok := recmap["serve_when"]; ok {
+							e, err := parseServeWhen(valueToString(cond))
+							if err != nil {
+								panic(fmt.Errorf("Bad record for %s: %s", dk, err))
+							}
+							record.ServeWhen = e
+						}
+						if backup && (len(record.Name) > 0 || record.ServeWhen != nil) {
+							panic(fmt.Errorf("Bad record for %s: backup records can't have a name or serve_when", dk))
+						}
+					}
 
 					switch dnsType {
-					case dns.TypePTR:
-						record.RR = &dns.PTR{Hdr: h, Ptr: ip}
-						break
-					case dns.TypeA:
-						if x := net.ParseIP(ip); x != nil {
-							record.RR = &dns.A{Hdr: h, A: x}
-							break
+					case dns.TypeA, dns.TypeAAAA, dns.TypePTR:
+
+						var str string
+						var weight int
+
+						switch rec := records[rType][i].(type) {
+						case map[string]interface{}:
+							// { "ip": "192.168.0.1", "weight": 10, "ttl": 30 }
+							key := "ip"
+							if dnsType == dns.TypePTR {
+								key = "ptr"
+							}
+							str = valueToString(rec[key])
+							if rec["weight"] != nil {
+								weight = valueToInt(rec["weight"])
+							}
+						default:
+							str, weight = getStringWeight(rec.([]interface{}))
 						}
-						panic(fmt.Errorf("Bad A record %s for %s", ip, dk))
-					case dns.TypeAAAA:
-						if x := net.ParseIP(ip); x != nil {
-							record.RR = &dns.AAAA{Hdr: h, AAAA: x}
+						ip := str
+						record.Weight = weight
+
+						switch dnsType {
+						case dns.TypePTR:
+							record.RR = &dns.PTR{Hdr: h, Ptr: ip}
 							break
+						case dns.TypeA:
+							if x := net.ParseIP(ip); x != nil {
+								record.RR = &dns.A{Hdr: h, A: x}
+								break
+							}
+							panic(fmt.Errorf("Bad A record %s for %s", ip, dk))
+						case dns.TypeAAAA:
+							if x := net.ParseIP(ip); x != nil {
+								record.RR = &dns.AAAA{Hdr: h, AAAA: x}
+								break
+							}
+							panic(fmt.Errorf("Bad AAAA record %s for %s", ip, dk))
 						}
-						panic(fmt.Errorf("Bad AAAA record %s for %s", ip, dk))
-					}
 
-				case dns.TypeMX:
-					rec := records[rType][i].(map[string]interface{})
-					pref := uint16(0)
-					mx := rec["mx"].(string)
-					if !strings.HasSuffix(mx, ".") {
-						mx = mx + "."
-					}
-					if rec["weight"] != nil {
-						record.Weight = valueToInt(rec["weight"])
-					}
-					if rec["preference"] != nil {
-						pref = uint16(valueToInt(rec["preference"]))
-					}
-					record.RR = &dns.MX{
-						Hdr:        h,
-						Mx:         mx,
-						Preference: pref}
-
-				case dns.TypeSRV:
-					rec := records[rType][i].(map[string]interface{})
-					priority := uint16(0)
-					srv_weight := uint16(0)
-					port := uint16(0)
-					target := rec["target"].(string)
-
-					if !dns.IsFqdn(target) {
-						target = target + "." + Zone.Origin
-					}
+					case dns.TypeMX:
+						rec := records[rType][i].(map[string]interface{})
+						pref := uint16(0)
+						mx := rec["mx"].(string)
+						if !strings.HasSuffix(mx, ".") {
+							mx = mx + "."
+						}
+						if rec["weight"] != nil {
+							record.Weight = valueToInt(rec["weight"])
+						}
+						if rec["preference"] != nil {
+							pref = uint16(valueToInt(rec["preference"]))
+						}
+						record.RR = &dns.MX{
+							Hdr:        h,
+							Mx:         mx,
+							Preference: pref}
+
+					case dns.TypeSRV:
+						rec := records[rType][i].(map[string]interface{})
+						priority := uint16(0)
+						srv_weight := uint16(0)
+						port := uint16(0)
+						target := rec["target"].(string)
+
+						if !dns.IsFqdn(target) {
+							target = dns.Fqdn(target + "." + Zone.Origin)
+						}
 
-					if rec["srv_weight"] != nil {
-						srv_weight = uint16(valueToInt(rec["srv_weight"]))
-					}
-					if rec["port"] != nil {
-						port = uint16(valueToInt(rec["port"]))
-					}
-					if rec["priority"] != nil {
-						priority = uint16(valueToInt(rec["priority"]))
-					}
-					record.RR = &dns.SRV{
-						Hdr:      h,
-						Priority: priority,
-						Weight:   srv_weight,
-						Port:     port,
-						Target:   target}
-
-				case dns.TypeCNAME:
-					rec := records[rType][i]
-					var target string
-					var weight int
-					switch rec.(type) {
-					case string:
-						target = rec.(string)
-					case []interface{}:
-						target, weight = getStringWeight(rec.([]interface{}))
-					}
-					if !dns.IsFqdn(target) {
-						target = target + "." + Zone.Origin
-					}
-					record.Weight = weight
-					record.RR = &dns.CNAME{Hdr: h, Target: dns.Fqdn(target)}
-
-				case dns.TypeMF:
-					rec := records[rType][i]
-					// MF records (how we store aliases) are not FQDNs
-					record.RR = &dns.MF{Hdr: h, Mf: rec.(string)}
-
-				case dns.TypeNS:
-					rec := records[rType][i]
-					if h.Ttl < 86400 {
-						h.Ttl = 86400
-					}
+						if rec["srv_weight"] != nil {
+							srv_weight = uint16(valueToInt(rec["srv_weight"]))
+						}
+						if rec["port"] != nil {
+							port = uint16(valueToInt(rec["port"]))
+						}
+						if rec["priority"] != nil {
+							priority = uint16(valueToInt(rec["priority"]))
+						}
+						record.RR = &dns.SRV{
+							Hdr:      h,
+							Priority: priority,
+							Weight:   srv_weight,
+							Port:     port,
+							Target:   target}
+
+					case dns.TypeCNAME:
+						rec := records[rType][i]
+						var target string
+						var weight int
+						switch rec.(type) {
+						case string:
+							target = rec.(string)
+						case []interface{}:
+							target, weight = getStringWeight(rec.([]interface{}))
+						case map[string]interface{}:
+							recmap := rec.(map[string]interface{})
+							target = valueToString(recmap["cname"])
+							if recmap["weight"] != nil {
+								weight = valueToInt(recmap["weight"])
+							}
+						}
+						if !dns.IsFqdn(target) {
+							target = target + "." + Zone.Origin
+						}
+						record.Weight = weight
+						record.RR = &dns.CNAME{Hdr: h, Target: dns.Fqdn(target)}
 
-					var ns string
+					case dns.TypeNS:
+						rec := records[rType][i]
+						if h.Ttl < 86400 {
+							h.Ttl = 86400
+						}
 
-					switch rec.(type) {
-					case string:
-						ns = rec.(string)
-					case []string:
-						recl := rec.([]string)
-						ns = recl[0]
-						if len(recl[1]) > 0 {
-							log.Println("NS records with names syntax not supported")
+						var ns string
+
+						switch rec.(type) {
+						case string:
+							ns = rec.(string)
+						case []string:
+							recl := rec.([]string)
+							ns = recl[0]
+							if len(recl[1]) > 0 {
+								log.Println("NS records with names syntax not supported")
+							}
+						default:
+							log.Printf("Data: %T %#v\n", rec, rec)
+							panic("Unrecognized NS format/syntax")
 						}
-					default:
-						log.Printf("Data: %T %#v\n", rec, rec)
-						panic("Unrecognized NS format/syntax")
-					}
 
-					rr := &dns.NS{Hdr: h, Ns: dns.Fqdn(ns)}
+						rr := &dns.NS{Hdr: h, Ns: dns.Fqdn(ns)}
 
-					record.RR = rr
+						record.RR = rr
 
-				case dns.TypeTXT:
-					rec := records[rType][i]
+					case dns.TypeTXT:
+						rec := records[rType][i]
 
-					var txt string
+						var txt string
 
-					switch rec.(type) {
-					case string:
-						txt = rec.(string)
-					case map[string]interface{}:
+						switch rec.(type) {
+						case string:
+							txt = rec.(string)
+						case map[string]interface{}:
 
-						recmap := rec.(map[string]interface{})
+							recmap := rec.(map[string]interface{})
 
-						if weight, ok := recmap["weight"]; ok {
-							record.Weight = valueToInt(weight)
+							if weight, ok := recmap["weight"]; ok {
+								record.Weight = valueToInt(weight)
+							}
+							if t, ok := recmap["txt"]; ok {
+								txt = t.(string)
+							}
 						}
-						if t, ok := recmap["txt"]; ok {
-							txt = t.(string)
+						txt, err := expandTXT(txt, Zone.Origin, dk)
+						if err != nil {
+							panic(fmt.Errorf("Bad TXT record for %s: %s", dk, err))
 						}
-					}
-					if len(txt) > 0 {
-						rr := &dns.TXT{Hdr: h, Txt: []string{txt}}
-						record.RR = rr
-					} else {
-						log.Printf("Zero length txt record for '%s' in '%s'\n", label.Label, Zone.Origin)
-						continue
-					}
-					// Initial SPF support added here, cribbed from the TypeTXT case definition - SPF records should be handled identically
+						if len(txt) > 0 {
+							rr := &dns.TXT{Hdr: h, Txt: splitTXT(txt)}
+							record.RR = rr
+						} else {
+							log.Printf("Zero length txt record for '%s' in '%s'\n", label.Label, Zone.Origin)
+							continue
+						}
+						// Initial SPF support added here, cribbed from the TypeTXT case definition - SPF records should be handled identically
 
-				case dns.TypeSPF:
-					rec := records[rType][i]
+					case dns.TypeSPF:
+						rec := records[rType][i]
 
-					var spf string
+						var spf string
 
-					switch rec.(type) {
-					case string:
-						spf = rec.(string)
-					case map[string]interface{}:
+						switch rec.(type) {
+						case string:
+							spf = rec.(string)
+						case map[string]interface{}:
 
-						recmap := rec.(map[string]interface{})
+							recmap := rec.(map[string]interface{})
 
-						if weight, ok := recmap["weight"]; ok {
-							record.Weight = valueToInt(weight)
+							if weight, ok := recmap["weight"]; ok {
+								record.Weight = valueToInt(weight)
+							}
+							if t, ok := recmap["spf"]; ok {
+								spf = t.(string)
+							}
 						}
-						if t, ok := recmap["spf"]; ok {
-							spf = t.(string)
+						spf, err := expandTXT(spf, Zone.Origin, dk)
+						if err != nil {
+							panic(fmt.Errorf("Bad SPF record for %s: %s", dk, err))
+						}
+						if len(spf) > 0 {
+							rr := &dns.SPF{Hdr: h, Txt: splitTXT(spf)}
+							record.RR = rr
+						} else {
+							log.Printf("Zero length SPF record for '%s' in '%s'\n", label.Label, Zone.Origin)
+							continue
+						}
+
+					case dns.TypeCAA:
+						rec, ok := records[rType][i].(map[string]interface{})
+						if !ok {
+							panic(fmt.Errorf("Bad CAA record for %s: %v", dk, records[rType][i]))
+						}
+						tag, _ := rec["tag"].(string)
+						tag = strings.ToLower(tag)
+						switch tag {
+						case "issue", "issuewild", "iodef":
+						default:
+							panic(fmt.Errorf("Bad CAA tag '%s' for %s", tag, dk))
+						}
+						value, ok := rec["value"].(string)
+						if !ok {
+							panic(fmt.Errorf("Bad CAA value for %s: %v", dk, rec["value"]))
+						}
+						flag := 0
+						if rec["flag"] != nil {
+							flag = valueToInt(rec["flag"])
+							if flag < 0 || flag > 255 {
+								panic(fmt.Errorf("Bad CAA flag %d for %s", flag, dk))
+							}
+						}
+						if rec["weight"] != nil {
+							record.Weight = valueToInt(rec["weight"])
+						}
+						record.RR = &dns.CAA{
+							Hdr:   h,
+							Flag:  uint8(flag),
+							Tag:   tag,
+							Value: value}
+
+					case dns.TypeNAPTR:
+						rec, ok := records[rType][i].(map[string]interface{})
+						if !ok {
+							panic(fmt.Errorf("Bad NAPTR record for %s: %v", dk, records[rType][i]))
+						}
+						rr, err := parseNAPTR(rec, h, Zone.Origin)
+						if err != nil {
+							panic(fmt.Errorf("Bad NAPTR record for %s: %s", dk, err))
+						}
+						if rec["weight"] != nil {
+							record.Weight = valueToInt(rec["weight"])
 						}
-					}
-					if len(spf) > 0 {
-						rr := &dns.SPF{Hdr: h, Txt: []string{spf}}
 						record.RR = rr
-					} else {
-						log.Printf("Zero length SPF record for '%s' in '%s'\n", label.Label, Zone.Origin)
-						continue
+
+					case typeSVCB, typeHTTPS:
+						rec, ok := records[rType][i].(map[string]interface{})
+						if !ok {
+							panic(fmt.Errorf("Bad %s record for %s: %v", rType, dk, records[rType][i]))
+						}
+						svcb, err := parseSVCB(rec, Zone.Origin)
+						if err != nil {
+							panic(fmt.Errorf("Bad %s record for %s: %s", rType, dk, err))
+						}
+						if rec["weight"] != nil {
+							record.Weight = valueToInt(rec["weight"])
+						}
+						record.RR, err = svcb.rr(h)
+						if err != nil {
+							panic(fmt.Errorf("Bad %s record for %s: %s", rType, dk, err))
+						}
+						if svcb.autoHints {
+							autoHints = append(autoHints, svcbHints{label, record.RR, svcb})
+						}
+
+					default:
+						log.Println("type:", rType)
+						panic("Don't know how to handle this type")
 					}
 
-				default:
-					log.Println("type:", rType)
-					panic("Don't know how to handle this type")
-				}
+					if record.RR == nil {
+						panic("record.RR is nil")
+					}
 
-				if record.RR == nil {
-					panic("record.RR is nil")
+					if backup {
+						label.Backup[dnsType] = append(label.Backup[dnsType], *record)
+						continue
+					}
+					label.Weight[dnsType] += record.Weight
+					label.Records[dnsType] = append(label.Records[dnsType], *record)
+				}
+				if label.Weight[dnsType] > 0 || selfOrdered(dnsType) {
+					sort.Stable(RecordsByWeight{label.Records[dnsType]})
+					sort.Stable(RecordsByWeight{label.Backup[dnsType]})
 				}
+			}
+
+			if label.SingleFamily && label.PreferFamily == 0 {
+				panic(fmt.Errorf("Bad options for %s: single_family needs prefer_family", dk))
+			}
 
-				label.Weight[dnsType] += record.Weight
-				label.Records[dnsType][i] = *record
+			if !maxHostsSet {
+				if err := Zone.setupTargetMaxHosts(label); err != nil {
+					panic(fmt.Errorf("Bad max_hosts for %s: %s", dk, err))
+				}
 			}
-			if label.Weight[dnsType] > 0 {
-				sort.Sort(RecordsByWeight{label.Records[dnsType]})
+
+			return nil
+		}()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, ah := range autoHints {
+		ah.data.addHints(ah.label.Records[dns.TypeA], ah.label.Records[dns.TypeAAAA])
+		rr, err := ah.data.rr(*ah.rr.Header())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Bad record for %s: %s", ah.label.Label, err))
+			continue
+		}
+		for _, records := range []Records{ah.label.Records[rr.Header().Rrtype], ah.label.Backup[rr.Header().Rrtype]} {
+			for i := range records {
+				if records[i].RR == ah.rr {
+					records[i].RR = rr
+				}
 			}
 		}
 	}
 
+	return append(errs, setupLabels(Zone)...)
+}
+
+// setupLabels checks the label options, adds the labels for the parent
+// names of the labels, sets the record TTLs and adds the SOA record.
+func setupLabels(Zone *Zone) []error {
+	var errs []error
+
+	for k, label := range Zone.Labels {
+		if err := label.resolveServeWhen(); err != nil {
+			errs = append(errs, fmt.Errorf("Bad serve_when for %s: %s", k, err))
+		}
+	}
+
 	// loop over exisiting labels, create zone records for missing sub-domains
 	// and set TTLs
+	Zone.targetedNames = map[string]bool{}
 	for k := range Zone.Labels {
+		if base, ok := targetLabelBase(k); ok {
+			// the name (and its parents) exists for some targets
+			for name := base; len(name) > 0; {
+				Zone.targetedNames[name] = true
+				i := strings.Index(name, ".")
+				if i < 0 {
+					break
+				}
+				name = name[i+1:]
+			}
+		}
 		if strings.Contains(k, ".") {
 			subLabels := strings.Split(k, ".")
 			for i := 1; i < len(subLabels); i++ {
@@ -541,18 +1242,81 @@ func setupZoneData(data map[string]interface{}, Zone *Zone) {
 				}
 			}
 		}
-		if Zone.Labels[k].Ttl > 0 {
-			for _, records := range Zone.Labels[k].Records {
+		for _, rrsets := range []map[uint16]Records{Zone.Labels[k].Records, Zone.Labels[k].Backup} {
+			for _, records := range rrsets {
 				for _, r := range records {
-					r.RR.Header().Ttl = uint32(Zone.Labels[k].Ttl)
+					switch {
+					case r.Ttl > 0:
+						r.RR.Header().Ttl = uint32(r.Ttl)
+					case Zone.Labels[k].Ttl > 0:
+						r.RR.Header().Ttl = uint32(Zone.Labels[k].Ttl)
+					}
 				}
 			}
 		}
 	}
 
-	setupSOA(Zone)
+	if err := Zone.checkPools(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := Zone.setupDelegations(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := setupSOA(Zone); err != nil {
+		errs = append(errs, err)
+	}
 
-	//log.Println(Zones[k])
+	return errs
+}
+
+// checkSOATimers checks that the SOA refresh, retry and expire values
+// make sense for secondary servers.
+func checkSOATimers(o ZoneOptions) error {
+	switch {
+	case o.Refresh <= 0 || o.Retry <= 0 || o.Expire <= 0 || o.Minimum < 0:
+		return fmt.Errorf("refresh, retry and expire must be positive (and minimum not negative)")
+	case o.Expire <= o.Refresh:
+		return fmt.Errorf("expire (%d) must be larger than refresh (%d)", o.Expire, o.Refresh)
+	case o.Expire <= o.Retry:
+		return fmt.Errorf("expire (%d) must be larger than retry (%d)", o.Expire, o.Retry)
+	}
+	return nil
+}
+
+// parseFamily returns the address record type for an address family,
+// "ipv4" or "ipv6", or 0 for "none".
+func parseFamily(s string) (uint16, error) {
+	switch strings.ToLower(s) {
+	case "ipv4":
+		return dns.TypeA, nil
+	case "ipv6":
+		return dns.TypeAAAA, nil
+	case "none", "":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unknown address family '%s'", s)
+}
+
+// parseContact returns the SOA contact as a mailbox domain name; an
+// email address ("dns.admin@example.com") is converted, with the dots
+// in the local part escaped ("dns\.admin.example.com").
+func parseContact(s string) (string, error) {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		local, domain := s[:i], s[i+1:]
+		if len(local) == 0 || len(domain) == 0 {
+			return "", fmt.Errorf("expected an email address or a domain name")
+		}
+		s = strings.Replace(local, ".", `\.`, -1) + "." + domain
+	}
+	s = strings.TrimSuffix(s, ".")
+	if strings.ContainsAny(s, " \t;()\"@") {
+		return "", fmt.Errorf("invalid characters")
+	}
+	if _, ok := dns.IsDomainName(s); !ok || dns.CountLabel(s) < 2 {
+		return "", fmt.Errorf("expected a mailbox and a domain (hostmaster.example.com)")
+	}
+	return s, nil
 }
 
 func getStringWeight(rec []interface{}) (string, int) {
@@ -575,20 +1339,46 @@ func getStringWeight(rec []interface{}) (string, int) {
 	return str, weight
 }
 
-func setupSOA(Zone *Zone) {
+// setupTargetMaxHosts sets max_hosts for a targeted label from the
+// target_max_hosts zone option. The label must have at least that many
+// records of a type.
+func (z *Zone) setupTargetMaxHosts(label *Label) error {
+	base, ok := targetLabelBase(label.Label)
+	if !ok {
+		return nil
+	}
+	target := strings.TrimPrefix(label.Label[len(base):], ".")
+	n, ok := z.Options.TargetMaxHosts[target]
+	if !ok {
+		return nil
+	}
+	records := 0
+	for _, rs := range label.Records {
+		if len(rs) > records {
+			records = len(rs)
+		}
+	}
+	if records > 0 && n > records {
+		return fmt.Errorf("%d for %s is more than the %d records", n, target, records)
+	}
+	label.MaxHosts = n
+	return nil
+}
+
+func setupSOA(Zone *Zone) error {
 	label := Zone.Labels[""]
 
 	primaryNs := "ns"
 
-	// log.Println("LABEL", label)
-
 	if label == nil {
 		log.Println(Zone.Origin, "doesn't have any 'root' records,",
 			"you should probably add some NS records")
 		label = Zone.AddLabel("")
 	}
 
-	if record, ok := label.Records[dns.TypeNS]; ok {
+	if len(Zone.Options.PrimaryNs) > 0 {
+		primaryNs = Zone.Options.PrimaryNs
+	} else if record, ok := label.Records[dns.TypeNS]; ok {
 		primaryNs = record[0].RR.(*dns.NS).Ns
 	}
 
@@ -602,18 +1392,18 @@ func setupSOA(Zone *Zone) {
 
 	s := Zone.Origin + ". " + strconv.Itoa(ttl) + " IN SOA " +
 		primaryNs + " " + Zone.Options.Contact + " " +
-		strconv.Itoa(Zone.Options.Serial) +
-		// refresh, retry, expire, minimum are all
-		// meaningless with this implementation
-		" 5400 5400 1209600 3600"
+		strconv.Itoa(Zone.Options.Serial) + " " +
+		strconv.Itoa(Zone.Options.Refresh) + " " +
+		strconv.Itoa(Zone.Options.Retry) + " " +
+		strconv.Itoa(Zone.Options.Expire) + " " +
+		strconv.Itoa(Zone.Options.Minimum)
 
 	// log.Println("SOA: ", s)
 
 	rr, err := dns.NewRR(s)
 
 	if err != nil {
-		log.Println("SOA Error", err)
-		panic("Could not setup SOA")
+		return fmt.Errorf("Could not setup SOA: %s", err)
 	}
 
 	record := Record{RR: rr}
@@ -621,6 +1411,31 @@ func setupSOA(Zone *Zone) {
 	label.Records[dns.TypeSOA] = make([]Record, 1)
 	label.Records[dns.TypeSOA][0] = record
 
+	return nil
+}
+
+// setupSerial sets the serial for zones with the "auto" serial option.
+// The serial is the file modification time, but it's kept the same
+// if the zone content didn't change and always increases from the
+// serial of the old zone when it did.
+func (z *Zone) setupSerial(old *Zone) {
+	if !z.Options.SerialAuto || old == nil {
+		return
+	}
+	oldSerial := old.soa().Serial
+	serial := uint32(z.Options.Serial)
+	switch {
+	case z.contentHash == old.contentHash:
+		serial = oldSerial
+	case !serialLess(oldSerial, serial):
+		serial = oldSerial + 1
+	default:
+		return
+	}
+	z.Options.Serial = int(serial)
+	if err := setupSOA(z); err != nil {
+		log.Printf("%s: %s", z.Origin, err)
+	}
 }
 
 func valueToBool(v interface{}) (rv bool) {
@@ -647,6 +1462,73 @@ func valueToBool(v interface{}) (rv bool) {
 
 }
 
+var txtPlaceholder = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// expandTXT replaces the placeholders in a TXT (or SPF) value of the
+// label: {origin} with the zone name, {label} with the name of the label
+// without its target ("www" for "www.europe", empty at the zone apex)
+// and {name} with the full name ("www.example.com"). Other names in
+// braces are errors, to catch typos.
+func expandTXT(txt, origin, label string) (string, error) {
+	if !strings.Contains(txt, "{") {
+		return txt, nil
+	}
+	base, _ := targetLabelBase(label)
+	name := origin
+	if len(base) > 0 {
+		name = base + "." + origin
+	}
+	var err error
+	txt = txtPlaceholder.ReplaceAllStringFunc(txt, func(p string) string {
+		switch p {
+		case "{origin}":
+			return origin
+		case "{label}":
+			return base
+		case "{name}":
+			return name
+		}
+		if err == nil {
+			err = fmt.Errorf("unknown placeholder %s", p)
+		}
+		return p
+	})
+	if err == nil && len(txt) == 0 {
+		err = fmt.Errorf("the value is empty after expanding the placeholders")
+	}
+	return txt, err
+}
+
+// splitTXT splits a TXT (or SPF) value into the 255 byte strings that
+// fit in the record; clients join them back together.
+func splitTXT(txt string) []string {
+	var chunks []string
+	for len(txt) > 255 {
+		chunks = append(chunks, txt[:255])
+		txt = txt[255:]
+	}
+	return append(chunks, txt)
+}
+
+// valueToStrings returns a list of strings from a JSON list or a comma
+// separated string.
+func valueToStrings(v interface{}) []string {
+	var l []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, s := range v {
+			l = append(l, valueToString(s))
+		}
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				l = append(l, s)
+			}
+		}
+	}
+	return l
+}
+
 func valueToString(v interface{}) (rv string) {
 	switch v.(type) {
 	case string:
@@ -660,6 +1542,23 @@ func valueToString(v interface{}) (rv string) {
 	return rv
 }
 
+func valueToFloat(v interface{}) (rv float64) {
+	switch v.(type) {
+	case string:
+		f, err := strconv.ParseFloat(v.(string), 64)
+		if err != nil {
+			panic("Error converting value to float")
+		}
+		rv = f
+	case float64:
+		rv = v.(float64)
+	default:
+		log.Println("Can't convert", v, "to float")
+		panic("Can't convert value")
+	}
+	return rv
+}
+
 func valueToInt(v interface{}) (rv int) {
 	switch v.(type) {
 	case string:
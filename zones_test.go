@@ -1,12 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/abh/geodns/health"
 	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
 	. "gopkg.in/check.v1"
 )
 
@@ -27,6 +35,20 @@ func (s *ConfigSuite) SetUpSuite(c *C) {
 	s.srv.zonesReadDir("dns", s.zones)
 }
 
+// writeTestZone writes the zone to the file for the origin in dir and
+// returns its name.
+func writeTestZone(c *C, dir, origin, zone string) string {
+	fileName := dir + "/" + origin + ".json"
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	return fileName
+}
+
+// readTestZone writes the zone to the file for the origin in dir and
+// reads it.
+func readTestZone(c *C, dir, origin, zone string) (*Zone, error) {
+	return readZoneFile(origin, writeTestZone(c, dir, origin, zone))
+}
+
 func (s *ConfigSuite) TestReadConfigs(c *C) {
 	// Just check that example.com and test.example.org loaded, too.
 	c.Check(s.zones["example.com"].Origin, Equals, "example.com")
@@ -46,6 +68,8 @@ func (s *ConfigSuite) TestReadConfigs(c *C) {
 	c.Check(tz.Options.MaxHosts, Equals, 2)
 	c.Check(tz.Options.Contact, Equals, "support.bitnames.com")
 	c.Check(tz.Options.Targeting.String(), Equals, "@ continent country regiongroup region asn ip")
+	c.Check(tz.Options.DisableECS, Equals, false)
+	c.Check(s.zones["test.example.org"].Options.DisableECS, Equals, true)
 
 	// Got logging option
 	c.Check(tz.Logging.StatHat, Equals, true)
@@ -61,15 +85,306 @@ func (s *ConfigSuite) TestReadConfigs(c *C) {
 		firstRR(dns.TypeCNAME).(*dns.CNAME).
 		Target, Equals, "bar.test.example.com.")
 
-	c.Check(tz.Labels["www-alias"].
-		firstRR(dns.TypeMF).(*dns.MF).
-		Mf, Equals, "www")
+	c.Check(tz.Labels["www-alias"].Alias, Equals, "www")
+
+	// per record TTLs override the label TTL
+	ttls := map[string]uint32{}
+	for _, r := range tz.Labels["ttl-override"].Records[dns.TypeA] {
+		ttls[r.RR.(*dns.A).A.String()] = r.RR.Header().Ttl
+	}
+	c.Check(ttls["192.168.1.9"], Equals, uint32(30))
+	c.Check(ttls["192.168.1.10"], Equals, uint32(300))
+	c.Check(tz.Labels["ttl-override"].firstRR(dns.TypeMX).Header().Ttl, Equals, uint32(3600))
+	c.Check(tz.Labels["ttl-override"].Records[dns.TypeA][0].Weight, Equals, 10)
 
 	// The header name should just have a dot-prefix
 	c.Check(tz.Labels[""].Records[dns.TypeNS][0].RR.(*dns.NS).Hdr.Name, Equals, "test.example.com.")
 
 }
 
+func (s *ConfigSuite) TestBadCAA(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	for _, caa := range []string{
+		`{ "tag": "issuer", "value": "ca.example.net" }`,
+		`{ "tag": "issue", "value": 1 }`,
+		`{ "tag": "issue", "value": "ca.example.net", "flag": 256 }`,
+		`"issue ca.example.net"`,
+	} {
+		fileName := dir + "/caa.example.net.json"
+		zone := `{ "data": { "": { "ns": [ "ns1.example.net" ] }, "www": { "caa": [ ` + caa + ` ] } } }`
+		err = ioutil.WriteFile(fileName, []byte(zone), 0644)
+		c.Assert(err, IsNil)
+		_, err = readZoneFile("caa.example.net", fileName)
+		c.Check(err, NotNil, Commentf("CAA %s", caa))
+	}
+}
+
+func (s *ConfigSuite) TestLongTXT(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", 19)[:582]
+	c.Assert(dkim, HasLen, 600)
+
+	fileName := dir + "/txt.example.net.json"
+	zone := fmt.Sprintf(`{ "data": { "mail._domainkey": { "txt": "%s" },
+		"": { "ns": [ "ns1.example.net" ], "spf": [ { "spf": "%s" } ] } } }`, dkim, dkim)
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	z, err := readZoneFile("txt.example.net", fileName)
+	c.Assert(err, IsNil)
+
+	txt := z.Labels["mail._domainkey"].firstRR(dns.TypeTXT).(*dns.TXT)
+	c.Assert(txt.Txt, HasLen, 3)
+	c.Check(txt.Txt[0], HasLen, 255)
+	c.Check(txt.Txt[1], HasLen, 255)
+	c.Check(txt.Txt[2], HasLen, 90)
+	c.Check(strings.Join(txt.Txt, ""), Equals, dkim)
+
+	spf := z.Labels[""].firstRR(dns.TypeSPF).(*dns.SPF)
+	c.Check(strings.Join(spf.Txt, ""), Equals, dkim)
+
+	// the record can be packed and unpacked
+	m := new(dns.Msg)
+	m.SetQuestion("mail._domainkey.txt.example.net.", dns.TypeTXT)
+	m.Answer = []dns.RR{txt}
+	buf, err := m.Pack()
+	c.Assert(err, IsNil)
+	m2 := new(dns.Msg)
+	c.Assert(m2.Unpack(buf), IsNil)
+	c.Check(strings.Join(m2.Answer[0].(*dns.TXT).Txt, ""), Equals, dkim)
+
+	c.Check(splitTXT("short"), DeepEquals, []string{"short"})
+	c.Check(splitTXT(strings.Repeat("x", 255)), HasLen, 1)
+	c.Check(splitTXT(strings.Repeat("x", 256)), HasLen, 2)
+}
+
+func (s *ConfigSuite) TestTXTTemplates(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(data string) (*Zone, error) {
+		return readTestZone(c, dir, "tmpl.example.net",
+			`{ "data": { "": { "ns": [ "ns1.example.net" ] }, `+data+` } }`)
+	}
+
+	long := strings.Repeat("x", 250)
+	z, err := readZone(`
+		"www": { "txt": "v=spf1 include:_spf.{name} -all" },
+		"www.europe": { "txt": "v=spf1 include:_spf.{name} -all" },
+		"mail": { "txt": [ { "txt": "{label} of {origin}", "weight": 1 } ],
+			"spf": "v=spf1 a:{name} -all" },
+		"verify": { "txt": "` + long + ` {name}" },
+		"apex": { "txt": "plain text without placeholders {}" }`)
+	c.Assert(err, IsNil)
+
+	txt := func(label string) []string {
+		return z.Labels[label].firstRR(dns.TypeTXT).(*dns.TXT).Txt
+	}
+	c.Check(txt("www"), DeepEquals, []string{"v=spf1 include:_spf.www.tmpl.example.net -all"})
+	// the target isn't part of the name
+	c.Check(txt("www.europe"), DeepEquals, []string{"v=spf1 include:_spf.www.tmpl.example.net -all"})
+	c.Check(txt("mail"), DeepEquals, []string{"mail of tmpl.example.net"})
+	c.Check(z.Labels["mail"].firstRR(dns.TypeSPF).(*dns.SPF).Txt, DeepEquals,
+		[]string{"v=spf1 a:mail.tmpl.example.net -all"})
+	c.Check(txt("apex"), DeepEquals, []string{"plain text without placeholders {}"})
+
+	// the expanded value is split in 255 byte strings
+	verify := txt("verify")
+	c.Assert(verify, HasLen, 2)
+	c.Check(verify[0], HasLen, 255)
+	c.Check(strings.Join(verify, ""), Equals, long+" verify.tmpl.example.net")
+
+	_, err = readZone(`"www": { "txt": "include:{domain}" }`)
+	c.Check(err, ErrorMatches, ".*Bad TXT record for www: unknown placeholder \\{domain\\}.*")
+	_, err = readZone(`"": { "ns": [ "ns1.example.net" ], "txt": "{label}" }`)
+	c.Check(err, NotNil)
+
+	name, err := expandTXT("{name}", "example.com", "")
+	c.Check(err, IsNil)
+	c.Check(name, Equals, "example.com")
+}
+
+func (s *ConfigSuite) TestSOATimers(c *C) {
+	soa := s.zones["test.example.com"].SoaRR().(*dns.SOA)
+	c.Check(soa.Refresh, Equals, uint32(5400))
+	c.Check(soa.Retry, Equals, uint32(5400))
+	c.Check(soa.Expire, Equals, uint32(1209600))
+	c.Check(soa.Minttl, Equals, uint32(3600))
+
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	for _, options := range []string{
+		`"refresh": 3600, "expire": 3600`,
+		`"retry": 86400, "expire": 7200`,
+		`"refresh": 0`,
+		`"minimum": -1`,
+	} {
+		fileName := dir + "/soa.example.net.json"
+		zone := `{ ` + options + `, "data": { "": { "ns": [ "ns1.example.net" ] } } }`
+		c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+		_, err = readZoneFile("soa.example.net", fileName)
+		c.Check(err, NotNil, Commentf("options %s", options))
+	}
+}
+
+func (s *ConfigSuite) TestSOAContact(c *C) {
+	for in, out := range map[string]string{
+		"hostmaster.example.com":  "hostmaster.example.com",
+		"hostmaster.example.com.": "hostmaster.example.com",
+		"dns@example.com":         "dns.example.com",
+		"dns.admin@example.com":   `dns\.admin.example.com`,
+	} {
+		contact, err := parseContact(in)
+		c.Check(err, IsNil, Commentf("contact %s", in))
+		c.Check(contact, Equals, out)
+	}
+	for _, in := range []string{"", "hostmaster", "@example.com", "dns@", "dns admin.example.com", "a@b@example.com"} {
+		_, err := parseContact(in)
+		c.Check(err, NotNil, Commentf("contact %s", in))
+	}
+
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + "/soa.example.net.json"
+	zone := `{ "contact": "dns.admin@example.org", "primary_ns": "NS2.example.net",
+		"data": { "": { "ns": { "ns1.example.net": null, "ns2.example.net": null, "ns3.example.net": null } } } }`
+	c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+	z, err := readZoneFile("soa.example.net", fileName)
+	c.Assert(err, IsNil)
+	soa := z.SoaRR().(*dns.SOA)
+	c.Check(soa.Ns, Equals, "ns2.example.net.")
+	c.Check(soa.Mbox, Equals, `dns\.admin.example.org.`)
+
+	// the mailbox survives the wire format
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{soa}
+	buf, err := m.Pack()
+	c.Assert(err, IsNil)
+	c.Assert(m.Unpack(buf), IsNil)
+	c.Check(m.Answer[0].(*dns.SOA).Mbox, Equals, soa.Mbox)
+
+	for _, options := range []string{`"contact": "hostmaster"`, `"primary_ns": "ns..example.net"`} {
+		zone := `{ ` + options + `, "data": { "": { "ns": [ "ns1.example.net" ] } } }`
+		c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+		_, err = readZoneFile("soa.example.net", fileName)
+		c.Check(err, NotNil, Commentf("options %s", options))
+	}
+}
+
+func (s *ConfigSuite) TestTargetMaxHosts(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(options string) (*Zone, error) {
+		return readTestZone(c, dir, "maxhosts.example.net", `{ `+options+`, "max_hosts": 2, "data": {
+			"www": { "a": [ [ "192.0.2.1" ], [ "192.0.2.2" ], [ "192.0.2.3" ] ] },
+			"www.europe": { "a": [ [ "192.0.2.1" ], [ "192.0.2.2" ], [ "192.0.2.3" ] ] },
+			"www.dk": { "a": [ [ "192.0.2.1" ], [ "192.0.2.2" ] ], "max_hosts": 1 },
+			"www.us": { "a": [ [ "192.0.2.1" ] ] } } }`)
+	}
+
+	z, err := readZone(`"target_max_hosts": { "Europe": 3, "dk": 3 }`)
+	c.Assert(err, IsNil)
+	c.Check(z.Labels["www"].MaxHosts, Equals, 2)
+	c.Check(z.Labels["www.europe"].MaxHosts, Equals, 3)
+	// the label's own max_hosts is used
+	c.Check(z.Labels["www.dk"].MaxHosts, Equals, 1)
+	c.Check(z.Labels["www.us"].MaxHosts, Equals, 2)
+
+	for _, options := range []string{
+		`"target_max_hosts": { "us": 2 }`,
+		`"target_max_hosts": { "europe": 0 }`,
+	} {
+		_, err = readZone(options)
+		c.Check(err, NotNil, Commentf("options %s", options))
+	}
+}
+
+func (s *ConfigSuite) TestTargetingOrder(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(options string) (*Zone, error) {
+		return readTestZone(c, dir, "order.example.net",
+			`{ `+options+`, "data": { "": { "ns": [ "ns1.example.net" ] } } }`)
+	}
+
+	zone, err := readZone(`"targeting_order": "country @"`)
+	c.Assert(err, IsNil)
+	c.Check(zone.Options.TargetOrder, DeepEquals, []TargetOptions{TargetCountry, TargetGlobal})
+	c.Check(zone.Options.Targeting.String(), Equals, "@ country")
+
+	zone, err = readZone(`"targeting": "@ country", "targeting_order": "country @"`)
+	c.Assert(err, IsNil)
+
+	for _, options := range []string{
+		`"targeting_order": "country planet @"`,
+		`"targeting_order": "country @ country"`,
+		`"targeting": "@ continent country", "targeting_order": "country @"`,
+	} {
+		_, err = readZone(options)
+		c.Check(err, NotNil, Commentf("options %s", options))
+	}
+}
+
+func (s *ConfigSuite) TestSerialAuto(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(ip string, mtime time.Time) *Zone {
+		fileName := writeTestZone(c, dir, "serial.example.net",
+			`{ "serial": "auto", "data": { "": { "ns": [ "ns1.example.net" ], "a": [ [ "`+ip+`" ] ] } } }`)
+		c.Assert(os.Chtimes(fileName, mtime, mtime), IsNil)
+		z, err := readZoneFile("serial.example.net", fileName)
+		c.Assert(err, IsNil)
+		return z
+	}
+
+	start := time.Unix(1500000000, 0)
+	z1 := readZone("192.0.2.1", start)
+	c.Check(z1.Options.SerialAuto, Equals, true)
+	z1.setupSerial(nil)
+	c.Check(z1.soa().Serial, Equals, uint32(1500000000))
+
+	// unchanged content keeps the serial
+	z2 := readZone("192.0.2.1", start.Add(time.Hour))
+	z2.setupSerial(z1)
+	c.Check(z2.soa().Serial, Equals, uint32(1500000000))
+
+	// changed content uses the new modification time
+	z3 := readZone("192.0.2.2", start.Add(time.Hour))
+	z3.setupSerial(z2)
+	c.Check(z3.soa().Serial, Equals, uint32(1500003600))
+
+	// or increases if the modification time went back
+	z4 := readZone("192.0.2.3", start)
+	z4.setupSerial(z3)
+	c.Check(z4.soa().Serial, Equals, uint32(1500003601))
+
+	// after wrapping around
+	z4.Options.Serial = 4294967295
+	c.Assert(setupSOA(z4), IsNil)
+	z5 := readZone("192.0.2.4", start)
+	z5.setupSerial(z4)
+	c.Check(z5.soa().Serial, Equals, uint32(1500000000))
+
+	z5.SetupMetrics(nil)
+	defer z5.Close()
+	c.Check(z5.Metrics.Serial.Value(), Equals, int64(1500000000))
+}
+
 func (s *ConfigSuite) TestRemoveConfig(c *C) {
 	// restore the dns.Mux
 	defer s.srv.zonesReadDir("dns", s.zones)
@@ -110,6 +425,355 @@ func (s *ConfigSuite) TestRemoveConfig(c *C) {
 	c.Check(ok, Equals, false)
 }
 
+func (s *ConfigSuite) TestHealthReload(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// a port nothing is listening on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	zones := make(Zones)
+	fileName := dir + "/health.example.net.json"
+	mtime := time.Now()
+
+	writeZone := func(ttl int, ips ...string) {
+		a := []string{}
+		for _, ip := range ips {
+			a = append(a, fmt.Sprintf(`["%s", 10]`, ip))
+		}
+		data := fmt.Sprintf(`{"ttl": %d, "data": {"www": {"a": [ %s ],
+			"health": {"type": "tcp", "port": %d, "retries": 1, "frequency": "1h"}}}}`,
+			ttl, strings.Join(a, ","), port)
+		c.Assert(ioutil.WriteFile(fileName, []byte(data), 0644), IsNil)
+		mtime = mtime.Add(time.Second)
+		os.Chtimes(fileName, mtime, mtime)
+		s.srv.zonesReadDir(dir, zones)
+	}
+
+	ref1 := "health.example.net/www/A/127.0.0.1"
+	ref2 := "health.example.net/www/A/127.0.0.2"
+
+	writeZone(300, "127.0.0.1")
+	test := health.TestRunner.Get(ref1)
+	c.Assert(test, NotNil)
+	for i := 0; i < 100 && test.IsHealthy(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(test.IsHealthy(), Equals, false)
+
+	healthReg := zones["health.example.net"].Metrics.Health
+	transitions := healthReg.Get("transitions www/A/127.0.0.1").(metrics.Counter)
+	for i := 0; i < 100 && transitions.Count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(transitions.Count(), Equals, int64(1))
+	c.Check(healthReg.Get("healthy www/A/127.0.0.1").(metrics.Gauge).Value(), Equals, int64(0))
+	c.Check(healthReg.Get("healthy-time www/A/127.0.0.1").(metrics.Timer).Count(), Equals, int64(1))
+
+	// reload with an unrelated change and a new IP
+	writeZone(600, "127.0.0.1", "127.0.0.2")
+	c.Check(zones["health.example.net"].Options.Ttl, Equals, 600)
+	c.Check(health.TestRunner.Get(ref1), Equals, test)
+	c.Check(health.TestRunner.IsHealthy(ref1), Equals, false)
+	c.Check(health.TestRunner.Get(ref2), NotNil)
+
+	records := zones["health.example.net"].Labels["www"].Records[dns.TypeA]
+	for _, r := range records {
+		if r.RR.(*dns.A).A.String() == "127.0.0.1" {
+			c.Check(r.Test, Equals, test)
+		}
+	}
+
+	// IP removed from the zone; its check is stopped
+	writeZone(600, "127.0.0.2")
+	c.Check(health.TestRunner.Get(ref1), IsNil)
+	c.Check(health.TestRunner.Get(ref2), NotNil)
+	c.Check(healthReg.Get("healthy www/A/127.0.0.1"), IsNil)
+	c.Check(healthReg.Get("healthy www/A/127.0.0.2"), NotNil)
+
+	// zone removed
+	os.Remove(fileName)
+	s.srv.zonesReadDir(dir, zones)
+	c.Check(health.TestRunner.Get(ref2), IsNil)
+}
+
+func (s *ConfigSuite) TestBackupRecords(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	readZone := func(a string) (*Zone, error) {
+		return readTestZone(c, dir, "backup.example.net", `{ "data": { "www": { "a": [ `+a+` ], "ttl": 300,
+			"health": { "type": "tcp", "port": 1, "frequency": "1h" } } } }`)
+	}
+
+	z, err := readZone(`[ "192.0.2.1", 10 ], { "ip": "192.0.2.2", "weight": 5 },
+		{ "ip": "198.51.100.1", "weight": 20, "backup": true }`)
+	c.Assert(err, IsNil)
+	label := z.Labels["www"]
+	c.Check(label.Records[dns.TypeA], HasLen, 2)
+	c.Check(label.Weight[dns.TypeA], Equals, 15)
+	c.Assert(label.Backup[dns.TypeA], HasLen, 1)
+	c.Check(label.Backup[dns.TypeA][0].RR.(*dns.A).A.String(), Equals, "198.51.100.1")
+	c.Check(label.Records[dns.TypeA][0].RR.Header().Ttl, Equals, uint32(300))
+	c.Check(label.Backup[dns.TypeA][0].RR.Header().Ttl, Equals, uint32(300))
+
+	// the backup records have health checks too
+	z.StartStopHealthChecks(true, nil)
+	c.Check(label.Backup[dns.TypeA][0].Test, NotNil)
+	c.Check(z.HealthStatus("www")["www"]["A"], HasLen, 3)
+	z.StartStopHealthChecks(false, nil)
+	c.Check(label.Backup[dns.TypeA][0].Test, IsNil)
+
+	_, err = readZone(`{ "ip": "192.0.2.1", "name": "a" }, { "ip": "192.0.2.2", "backup": true, "serve_when": "!a" }`)
+	c.Check(err, NotNil)
+}
+
+func (s *ConfigSuite) TestIxfrHistory(c *C) {
+	c.Check(serialLess(1, 2), Equals, true)
+	c.Check(serialLess(2, 1), Equals, false)
+	c.Check(serialLess(2, 2), Equals, false)
+	c.Check(serialLess(0xffffffff, 1), Equals, true)
+	c.Check(serialLess(1, 0xffffffff), Equals, false)
+
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	fileName := dir + "/ixfr.example.net.json"
+	mtime := time.Now()
+
+	writeZone := func(serial int, data string) *Zone {
+		zone := fmt.Sprintf(`{"serial": %d, "transfer_peers": ["127.0.0.1"],
+			"data": {"": {"ns": ["ns1.example.net"]}, %s}}`, serial, data)
+		c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+		mtime = mtime.Add(time.Second)
+		os.Chtimes(fileName, mtime, mtime)
+		s.srv.zonesReadDir(dir, zones)
+		return zones["ixfr.example.net"]
+	}
+
+	z := writeZone(4294967295, `"www": {"a": [["192.0.2.1", 10], ["192.0.2.2", 10]]}`)
+	c.Check(z.xfrHistory, HasLen, 0)
+
+	// label added, weight changed; the serial wraps around
+	z = writeZone(1, `"www": {"a": [["192.0.2.1", 10], ["192.0.2.2", 20]]},
+		"mail": {"a": [["192.0.2.3"]]}`)
+	c.Assert(z.xfrHistory, HasLen, 1)
+	c.Check(z.xfrHistory[0].Removed, HasLen, 0)
+	c.Assert(z.xfrHistory[0].Added, HasLen, 1)
+	c.Check(z.xfrHistory[0].Added[0].Header().Name, Equals, "mail.ixfr.example.net.")
+
+	// label and record removed
+	z = writeZone(2, `"www": {"a": [["192.0.2.1", 10]]}`)
+	c.Assert(z.xfrHistory, HasLen, 2)
+	c.Check(z.xfrHistory[1].Removed, HasLen, 2)
+	c.Check(z.xfrHistory[1].Added, HasLen, 0)
+
+	rrs, ok := z.ixfrRecords(4294967295)
+	c.Assert(ok, Equals, true)
+	serials := []uint32{}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			serials = append(serials, soa.Serial)
+		}
+	}
+	c.Check(serials, DeepEquals, []uint32{4294967295, 1, 1, 2})
+	c.Check(rrs, HasLen, 7)
+
+	rrs, ok = z.ixfrRecords(1)
+	c.Check(ok, Equals, true)
+	c.Check(rrs, HasLen, 4)
+
+	_, ok = z.ixfrRecords(3)
+	c.Check(ok, Equals, false)
+
+	// changed without updating the serial
+	z = writeZone(2, `"www": {"a": [["192.0.2.4", 10]]}`)
+	c.Check(z.xfrHistory, HasLen, 0)
+
+	os.Remove(fileName)
+	s.srv.zonesReadDir(dir, zones)
+}
+
+func (s *ConfigSuite) TestReloadLabelStats(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	fileName := dir + "/stats.example.net.json"
+	mtime := time.Now()
+
+	writeZone := func(data string) *Zone {
+		zone := `{"data": {"": {"ns": ["ns1.example.net"]}, ` + data + `}}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+		mtime = mtime.Add(time.Second)
+		os.Chtimes(fileName, mtime, mtime)
+		s.srv.zonesReadDir(dir, zones)
+		return zones["stats.example.net"]
+	}
+
+	z := writeZone(`"www": {"a": [["192.0.2.1"]]}, "old": {"a": [["192.0.2.2"]]}`)
+	for _, l := range []string{"www", "www", "old", "nxdomain"} {
+		z.Metrics.LabelStats.Add(l)
+	}
+	queries := z.Metrics.Queries
+
+	z = writeZone(`"www": {"a": [["192.0.2.1"]]}, "new": {"a": [["192.0.2.3"]]}`)
+	c.Check(z.Metrics.Queries, Equals, queries)
+	counts := z.Metrics.LabelStats.Counts()
+	c.Check(counts, DeepEquals, map[string]int{"www": 2, "nxdomain": 1})
+
+	os.Remove(fileName)
+	s.srv.zonesReadDir(dir, zones)
+}
+
+func (s *ConfigSuite) TestBadRecordsKeepZone(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	fileName := dir + "/bad.example.net.json"
+	mtime := time.Now()
+
+	writeZone := func(data string) error {
+		zone := `{"data": {"": {"ns": ["ns1.example.net"]}, ` + data + `}}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+		mtime = mtime.Add(time.Second)
+		os.Chtimes(fileName, mtime, mtime)
+		return s.srv.zonesReadDir(dir, zones)
+	}
+
+	c.Assert(writeZone(`"www": {"a": [["192.0.2.1"]]}`), IsNil)
+	z := zones["bad.example.net"]
+	c.Assert(z, NotNil)
+
+	// all the bad labels are reported and the old zone is kept
+	err = writeZone(`"www": {"a": [["192.0.2.1"]]}, "one": {"a": [["192.0.2.300"]]},
+		"two": {"aaaa": [["2001:db8::1::1"]]}`)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, ".*Bad A record 192.0.2.300 for one.*")
+	c.Check(err, ErrorMatches, ".*Bad AAAA record 2001:db8::1::1 for two.*")
+	c.Check(zones["bad.example.net"], Equals, z)
+	c.Check(z.Labels["www"].Records[dns.TypeA], HasLen, 1)
+	c.Check(z.Labels["one"], IsNil)
+
+	os.Remove(fileName)
+	s.srv.zonesReadDir(dir, zones)
+}
+
+func (s *ServeSuite) TestReloadZone(c *C) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	mtime := time.Now()
+	writeZone := func(name, ip string) {
+		fileName := dir + "/" + name + ".json"
+		zone := `{"data": {"": {"ns": ["ns1.example.net"]}, "www": {"a": [["` + ip + `", 0]]}}}`
+		c.Assert(ioutil.WriteFile(fileName, []byte(zone), 0644), IsNil)
+		mtime = mtime.Add(time.Second)
+		os.Chtimes(fileName, mtime, mtime)
+	}
+	address := func(name string) string {
+		r := exchange(c, "www."+name+".", dns.TypeA)
+		if len(r.Answer) != 1 {
+			return ""
+		}
+		return r.Answer[0].(*dns.A).A.String()
+	}
+
+	names := []string{"one.reload.example.net", "two.reload.example.net", "three.reload.example.net"}
+	for _, name := range names {
+		writeZone(name, "192.0.2.1")
+	}
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	defer func() {
+		for _, name := range names {
+			os.Remove(dir + "/" + name + ".json")
+		}
+		srv.zonesReadDir(dir, zones)
+	}()
+
+	for _, name := range names {
+		c.Assert(address(name), Equals, "192.0.2.1")
+	}
+	one, two, three := zones[names[0]], zones[names[1]], zones[names[2]]
+	queries := one.Metrics.Queries.Count()
+
+	writeZone(names[0], "192.0.2.2")
+	writeZone(names[1], "192.0.2.2")
+
+	// the queries for the other zones are answered during the reload
+	answers := make(chan string, 10)
+	go func() {
+		defer close(answers)
+		for i := 0; i < 10; i++ {
+			answers <- address(names[2])
+		}
+	}()
+	c.Assert(srv.reloadZone(dir, zones, names[0]), IsNil)
+	for answer := range answers {
+		c.Check(answer, Equals, "192.0.2.1")
+	}
+
+	c.Check(address(names[0]), Equals, "192.0.2.2")
+	c.Check(zones[names[0]], Not(Equals), one)
+	c.Check(zones[names[0]].Metrics.Queries, Equals, one.Metrics.Queries)
+	c.Check(zones[names[0]].Metrics.Queries.Count(), Equals, queries+1)
+
+	// the other zones aren't read again
+	c.Check(zones[names[1]], Equals, two)
+	c.Check(zones[names[2]], Equals, three)
+	c.Check(address(names[1]), Equals, "192.0.2.1")
+
+	// until the directory is read, which doesn't read the reloaded
+	// zone again
+	reloaded := zones[names[0]]
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	c.Check(zones[names[0]], Equals, reloaded)
+	c.Check(zones[names[2]], Equals, three)
+	c.Check(address(names[1]), Equals, "192.0.2.2")
+
+	c.Check(srv.reloadZone(dir, zones, "missing.reload.example.net"), NotNil)
+	writeZone(names[2], "192.0.2.300")
+	c.Check(srv.reloadZone(dir, zones, names[2]), NotNil)
+	c.Check(zones[names[2]], Equals, three)
+
+	h := newAdminHandler(zones, &srv.zonesMu, func(origin string) error {
+		return srv.reloadZone(dir, zones, origin)
+	})
+	reload := func(method, origin string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/v1/ReloadZone?origin="+origin, nil))
+		return w.Code
+	}
+	writeZone(names[2], "192.0.2.3")
+	c.Check(reload("GET", names[2]), Equals, http.StatusMethodNotAllowed)
+	c.Check(reload("POST", ""), Equals, http.StatusBadRequest)
+	c.Check(reload("POST", "missing.reload.example.net"), Equals, http.StatusBadRequest)
+	c.Check(reload("POST", names[2]+"."), Equals, http.StatusOK)
+	c.Check(address(names[2]), Equals, "192.0.2.3")
+
+	// the zone is removed before the response
+	h = newAdminHandler(zones, &srv.zonesMu, func(origin string) error {
+		srv.zonesMu.Lock()
+		defer srv.zonesMu.Unlock()
+		delete(zones, origin)
+		return nil
+	})
+	c.Check(reload("POST", names[2]), Equals, http.StatusNotFound)
+}
+
 func CopyFile(c *C, src, dst string) (int64, error) {
 	sf, err := os.Open(src)
 	if err != nil {
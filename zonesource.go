@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zoneSourceInterval    = 60 * time.Second
+	zoneSourceMinInterval = time.Second
+)
+
+// zoneSourceClient fetches the zones; a zone that can't be fetched in
+// time is retried at the next poll.
+var zoneSourceClient = &http.Client{Timeout: 30 * time.Second}
+
+// zoneSource is a zone fetched from a URL (an HTTP(S) server or an
+// S3-compatible object store), configured in a [zonesource "origin"]
+// section. The zone is polled every interval, with the ETag and
+// Last-Modified of the last response so unchanged zones aren't fetched
+// again, and the headers (for authentication) are added to each request.
+type zoneSource struct {
+	origin   string
+	url      string
+	interval time.Duration
+	header   http.Header
+}
+
+func (s zoneSource) equal(o zoneSource) bool {
+	return s.url == o.url && s.interval == o.interval &&
+		fmt.Sprint(s.header) == fmt.Sprint(o.header)
+}
+
+type zoneSourcesConfig struct {
+	mu      sync.RWMutex
+	sources map[string]zoneSource
+}
+
+var zoneSources = &zoneSourcesConfig{}
+
+func (zs *zoneSourcesConfig) setup(cfg map[string]*ZoneSourceConfig) error {
+	sources := map[string]zoneSource{}
+	for name, c := range cfg {
+		origin := strings.TrimSuffix(strings.ToLower(name), ".")
+		s, err := parseZoneSource(origin, c)
+		if err != nil {
+			return fmt.Errorf("zone source %s: %s", name, err)
+		}
+		sources[origin] = s
+	}
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+	zs.sources = sources
+	return nil
+}
+
+func (zs *zoneSourcesConfig) get() map[string]zoneSource {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+	return zs.sources
+}
+
+func parseZoneSource(origin string, c *ZoneSourceConfig) (zoneSource, error) {
+	s := zoneSource{origin: origin, url: c.URL, interval: zoneSourceInterval, header: http.Header{}}
+	if len(origin) == 0 {
+		return s, fmt.Errorf("missing zone name")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return s, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return s, fmt.Errorf("bad url '%s' (http or https)", c.URL)
+	}
+	if len(c.Interval) > 0 {
+		s.interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return s, fmt.Errorf("bad interval: %s", err)
+		}
+		if s.interval < zoneSourceMinInterval {
+			return s, fmt.Errorf("interval %s is less than %s", s.interval, zoneSourceMinInterval)
+		}
+	}
+	for _, h := range c.Header {
+		i := strings.Index(h, ":")
+		if i < 1 {
+			return s, fmt.Errorf("bad header '%s' (name: value)", h)
+		}
+		s.header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return s, nil
+}
+
+// remoteZone is the state of a zone source: the validators and hash of
+// the loaded version of the zone and when it's polled next.
+type remoteZone struct {
+	zoneSource
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	hash         string
+	next         time.Time
+}
+
+// zoneSourcesReader polls the zone sources in the configuration.
+func (srv *Server) zoneSourcesReader(dirName string, zones Zones) {
+	for {
+		srv.checkZoneSources(dirName, zones, time.Now())
+		time.Sleep(time.Second)
+	}
+}
+
+// checkZoneSources updates the zone sources from the configuration,
+// removing the zones that aren't configured anymore, and fetches the
+// zones that are due. A zone that can't be fetched or read is logged
+// and the loaded version is kept.
+func (srv *Server) checkZoneSources(dirName string, zones Zones, now time.Time) {
+	sources := zoneSources.get()
+
+	srv.zonesMu.Lock()
+	if srv.remoteZones == nil {
+		srv.remoteZones = map[string]*remoteZone{}
+	}
+	for origin := range srv.remoteZones {
+		if _, ok := sources[origin]; !ok {
+			delete(srv.remoteZones, origin)
+			if _, ok := zones[origin]; ok {
+				srv.removeZone(zones, origin)
+			}
+		}
+	}
+	var due []*remoteZone
+	for origin, s := range sources {
+		rz, ok := srv.remoteZones[origin]
+		if !ok || !rz.equal(s) {
+			rz = &remoteZone{zoneSource: s}
+			srv.remoteZones[origin] = rz
+		}
+		if !now.Before(rz.next) {
+			rz.next = now.Add(rz.interval)
+			due = append(due, rz)
+		}
+	}
+	srv.zonesMu.Unlock()
+
+	for _, rz := range due {
+		if err := srv.fetchZone(dirName, zones, rz, false); err != nil {
+			log.Printf("Could not fetch zone %s from %s (keeping the loaded zone): %s", rz.origin, rz.url, err)
+		}
+	}
+}
+
+// fetchZone fetches the zone and loads it if it changed, carrying over
+// the state of the loaded zone like a reload of a zone file. With force
+// the zone is fetched and loaded even if it didn't change.
+func (srv *Server) fetchZone(dirName string, zones Zones, rz *remoteZone, force bool) error {
+	rz.mu.Lock()
+	defer rz.mu.Unlock()
+
+	req, err := http.NewRequest("GET", rz.url, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range rz.header {
+		req.Header[name] = values
+	}
+	if !force {
+		if len(rz.etag) > 0 {
+			req.Header.Set("If-None-Match", rz.etag)
+		}
+		if len(rz.lastModified) > 0 {
+			req.Header.Set("If-Modified-Since", rz.lastModified)
+		}
+	}
+	resp, err := zoneSourceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && !force {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	hasher.Write(data)
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if hash == rz.hash && !force {
+		rz.etag, rz.lastModified = etag, lastModified
+		return nil
+	}
+
+	logPrintf("Reading zone %s from %s\n", rz.origin, rz.url)
+	modTime, err := http.ParseTime(lastModified)
+	if err != nil {
+		modTime = time.Now()
+	}
+	var zone *Zone
+	if u, _ := url.Parse(rz.url); isBindZoneFile(u.Path) {
+		zone, err = readBindZone(rz.origin, rz.url, "", bytes.NewReader(data), hash)
+	} else {
+		zone, err = readZoneJSON(rz.origin, rz.url, dirName, bytes.NewReader(data), modTime, hash)
+	}
+	if zone == nil || err != nil {
+		return fmt.Errorf("Error reading zone '%s': %s", rz.origin, err)
+	}
+
+	srv.zonesMu.Lock()
+	defer srv.zonesMu.Unlock()
+	if srv.remoteZones[rz.origin] != rz {
+		// the source was changed or removed while fetching
+		return nil
+	}
+	srv.addHandler(zones, rz.origin, zone)
+	rz.etag, rz.lastModified, rz.hash = etag, lastModified, hash
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	. "gopkg.in/check.v1"
+	"gopkg.in/gcfg.v1"
+)
+
+func (s *ConfigSuite) TestZoneSourceConfig(c *C) {
+	cfg := new(AppConfig)
+	err := gcfg.ReadStringInto(cfg, `
+[zonesource "Remote.example.net."]
+url = https://zones.example.net/remote.example.net.json
+interval = 30s
+header = "Authorization: Bearer secret"
+
+[zonesource "bind.example.net"]
+url = http://zones.example.net/bind.example.net.zone
+`)
+	c.Assert(err, IsNil)
+
+	zs := &zoneSourcesConfig{}
+	c.Assert(zs.setup(cfg.ZoneSource), IsNil)
+	sources := zs.get()
+	c.Assert(sources, HasLen, 2)
+	remote := sources["remote.example.net"]
+	c.Check(remote.url, Equals, "https://zones.example.net/remote.example.net.json")
+	c.Check(remote.interval, Equals, 30*time.Second)
+	c.Check(remote.header.Get("Authorization"), Equals, "Bearer secret")
+	c.Check(sources["bind.example.net"].interval, Equals, zoneSourceInterval)
+
+	for _, bad := range []ZoneSourceConfig{
+		{URL: "ftp://zones.example.net/example.net.json"},
+		{URL: "zones.example.net/example.net.json"},
+		{URL: "https://zones.example.net/example.net.json", Interval: "10ms"},
+		{URL: "https://zones.example.net/example.net.json", Interval: "soon"},
+		{URL: "https://zones.example.net/example.net.json", Header: []string{"Authorization"}},
+	} {
+		bad := bad
+		c.Check(zs.setup(map[string]*ZoneSourceConfig{"example.net": &bad}), NotNil, Commentf("%+v", bad))
+	}
+}
+
+func (s *ServeSuite) TestZoneSource(c *C) {
+	var mu sync.Mutex
+	zone := `{"data": {"": {"ns": ["ns1.example.net"]}, "www": {"a": [["192.0.2.1", 0]]}}}`
+	etag := `"1"`
+	var requests, fetches int
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches++
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Tue, 01 Sep 2026 10:00:00 GMT")
+		w.Write([]byte(zone))
+	}))
+	defer web.Close()
+
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	zones := make(Zones)
+	srv := Server{}
+	origin := "remote.example.net"
+	defer zoneSources.setup(nil)
+	c.Assert(zoneSources.setup(map[string]*ZoneSourceConfig{origin: {
+		URL:    web.URL + "/remote.example.net.json",
+		Header: []string{"Authorization: Bearer secret"},
+	}}), IsNil)
+
+	now := time.Now()
+	srv.checkZoneSources(dir, zones, now)
+	c.Assert(zones[origin], NotNil)
+	c.Check(zones[origin].Options.Serial, Equals, 1788256800)
+	r := exchange(c, "www.remote.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.1")
+
+	// reading the zones directory doesn't remove it
+	c.Assert(srv.zonesReadDir(dir, zones), IsNil)
+	c.Check(zones[origin], NotNil)
+
+	// not polled again before the interval, and unchanged after it
+	loaded := zones[origin]
+	srv.checkZoneSources(dir, zones, now.Add(time.Second))
+	srv.checkZoneSources(dir, zones, now.Add(zoneSourceInterval))
+	mu.Lock()
+	c.Check(requests, Equals, 2)
+	c.Check(fetches, Equals, 1)
+	zone = `{"data": {"": {"ns": ["ns1.example.net"]}, "www": {"a": [["192.0.2.2", 0]]}}}`
+	etag = `"2"`
+	mu.Unlock()
+	c.Check(zones[origin], Equals, loaded)
+
+	// a changed zone is loaded with the state of the loaded zone
+	srv.checkZoneSources(dir, zones, now.Add(2*zoneSourceInterval))
+	c.Assert(zones[origin], Not(Equals), loaded)
+	c.Check(zones[origin].Metrics.Queries, Equals, loaded.Metrics.Queries)
+	r = exchange(c, "www.remote.example.net.", dns.TypeA)
+	c.Assert(r.Answer, HasLen, 1)
+	c.Check(r.Answer[0].(*dns.A).A.String(), Equals, "192.0.2.2")
+
+	// a zone that can't be read is logged and the loaded zone kept
+	mu.Lock()
+	zone = `{"data": `
+	etag = `"3"`
+	mu.Unlock()
+	loaded = zones[origin]
+	srv.checkZoneSources(dir, zones, now.Add(3*zoneSourceInterval))
+	c.Check(zones[origin], Equals, loaded)
+	c.Check(srv.reloadZone(dir, zones, origin), NotNil)
+
+	mu.Lock()
+	zone = `{"data": {"": {"ns": ["ns1.example.net"]}, "www": {"a": [["192.0.2.3", 0]]}}}`
+	mu.Unlock()
+	c.Check(srv.reloadZone(dir, zones, origin), IsNil)
+	c.Check(zones[origin], Not(Equals), loaded)
+
+	// without the source the zone is removed
+	zoneSources.setup(nil)
+	srv.checkZoneSources(dir, zones, now.Add(4*zoneSourceInterval))
+	c.Check(zones[origin], IsNil)
+	r = exchange(c, "www.remote.example.net.", dns.TypeA)
+	c.Check(r.Rcode, Equals, dns.RcodeRefused)
+}